@@ -0,0 +1,231 @@
+// Package cache keeps decrypted objects read from the bucket, thumbnails by
+// default, in memory and optionally on disk. Concurrent reads of an object
+// which is not cached download it once.
+package cache
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/crypto"
+	"github.com/marpio/mirror/manifest"
+	"github.com/spf13/afero"
+)
+
+// DefaultMemory is the size of the in-memory cache.
+const DefaultMemory = 64 << 20
+
+// fetchTimeout bounds a download, which is not cancelled with the request
+// which started it since other requests may be waiting for it.
+const fetchTimeout = time.Minute
+
+// Stats are the counters of a Cache.
+type Stats struct {
+	// Hits were served from memory, DiskHits from disk and Misses were
+	// downloaded. Coalesced requests waited for the download of another one.
+	Hits      int64 `json:"hits"`
+	DiskHits  int64 `json:"disk_hits"`
+	Misses    int64 `json:"misses"`
+	Coalesced int64 `json:"coalesced"`
+	Errors    int64 `json:"errors"`
+
+	MemoryBytes     int64 `json:"memory_bytes"`
+	MemoryEntries   int   `json:"memory_entries"`
+	MemoryEvictions int64 `json:"memory_evictions"`
+	DiskBytes       int64 `json:"disk_bytes"`
+	DiskEntries     int   `json:"disk_entries"`
+	DiskEvictions   int64 `json:"disk_evictions"`
+}
+
+// Cache is a mirror.StorageReader caching the objects of another one.
+type Cache struct {
+	rd        mirror.StorageReader
+	cacheable func(id string) bool
+	memory    int64
+	diskFs    afero.Fs
+	diskDir   string
+	diskMax   int64
+	crpt      crypto.Service
+
+	mu    sync.Mutex
+	mem   *lru
+	disk  *disk
+	calls map[string]*call
+	stats Stats
+}
+
+type call struct {
+	done chan struct{}
+	b    []byte
+	err  error
+}
+
+type option func(*Cache)
+
+// WithMemory sets the size of the in-memory cache in bytes, 0 disables it.
+func WithMemory(n int64) option {
+	return func(c *Cache) {
+		c.memory = n
+	}
+}
+
+// WithDisk keeps up to max bytes of objects in dir as well, an empty dir
+// disables the disk cache.
+func WithDisk(fs afero.Fs, dir string, max int64) option {
+	return func(c *Cache) {
+		c.diskFs, c.diskDir, c.diskMax = fs, dir, max
+	}
+}
+
+// WithEncryption keeps the objects on disk encrypted with crpt, nil keeps
+// them in plain text.
+func WithEncryption(crpt crypto.Service) option {
+	return func(c *Cache) {
+		c.crpt = crpt
+	}
+}
+
+// WithFilter sets which objects are cached, the thumbnails by default. The
+// others are read from the underlying storage directly.
+func WithFilter(cacheable func(id string) bool) option {
+	return func(c *Cache) {
+		c.cacheable = cacheable
+	}
+}
+
+// New returns a cache of the objects of rd.
+func New(rd mirror.StorageReader, options ...option) (*Cache, error) {
+	c := &Cache{
+		rd:     rd,
+		memory: DefaultMemory,
+		cacheable: func(id string) bool {
+			return strings.HasPrefix(id, manifest.ThumbnailPrefix)
+		},
+		calls: make(map[string]*call),
+	}
+	for _, opt := range options {
+		opt(c)
+	}
+	c.mem = newLRU(c.memory, func(string, int64) { c.stats.MemoryEvictions++ })
+	if c.diskFs != nil && c.diskDir != "" && c.diskMax > 0 {
+		d, err := newDisk(c.diskFs, c.diskDir, c.diskMax, c.crpt)
+		if err != nil {
+			return nil, err
+		}
+		c.disk = d
+	}
+	return c, nil
+}
+
+func (c *Cache) NewReader(ctx context.Context, id string) (io.ReadCloser, error) {
+	if !c.cacheable(id) {
+		return c.rd.NewReader(ctx, id)
+	}
+	b, err := c.get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// Exists asks the underlying storage, if it can tell. Objects it cannot tell
+// about are assumed to exist.
+func (c *Cache) Exists(ctx context.Context, id string) bool {
+	if s, ok := c.rd.(interface {
+		Exists(ctx context.Context, path string) bool
+	}); ok {
+		return s.Exists(ctx, id)
+	}
+	return true
+}
+
+func (c *Cache) get(ctx context.Context, id string) ([]byte, error) {
+	c.mu.Lock()
+	if e, ok := c.mem.get(id); ok {
+		c.stats.Hits++
+		c.mu.Unlock()
+		return e.value, nil
+	}
+	cl, ok := c.calls[id]
+	if ok {
+		c.stats.Coalesced++
+	} else {
+		cl = &call{done: make(chan struct{})}
+		c.calls[id] = cl
+		go c.fetch(id, cl)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-cl.done:
+		return cl.b, cl.err
+	}
+}
+
+func (c *Cache) fetch(id string, cl *call) {
+	var b []byte
+	var err error
+	fromDisk := false
+	if c.disk != nil && validName(id) {
+		if b, fromDisk, err = c.disk.get(id); err != nil {
+			log.WithError(err).WithField("id", id).Warn("error reading the cached file")
+		}
+	}
+	if !fromDisk {
+		b, err = c.download(id)
+		if err == nil && c.disk != nil && validName(id) {
+			if err := c.disk.put(id, b); err != nil {
+				log.WithError(err).WithField("id", id).Warn("error writing the cached file")
+			}
+		}
+	}
+
+	c.mu.Lock()
+	switch {
+	case err != nil:
+		c.stats.Errors++
+	case fromDisk:
+		c.stats.DiskHits++
+	default:
+		c.stats.Misses++
+	}
+	if err == nil {
+		c.mem.add(id, b, int64(len(b)))
+	}
+	delete(c.calls, id)
+	c.mu.Unlock()
+	cl.b, cl.err = b, err
+	close(cl.done)
+}
+
+func (c *Cache) download(id string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+	rd, err := c.rd.NewReader(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return ioutil.ReadAll(rd)
+}
+
+// Stats returns the current counters.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	s := c.stats
+	s.MemoryBytes, s.MemoryEntries = c.mem.size, c.mem.len()
+	c.mu.Unlock()
+	if c.disk != nil {
+		s.DiskBytes, s.DiskEntries, s.DiskEvictions = c.disk.stats()
+	}
+	return s
+}
@@ -0,0 +1,186 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/marpio/mirror/crypto"
+	"github.com/spf13/afero"
+)
+
+const key = "b40b3de5e3ef0fc5c7c0b2a9d3d6c82f0c4a0fa7b9d7e2e3a8c1f1d0e9b8a7c6"
+
+var ctx = context.Background()
+
+type fakeStorage struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	reads   map[string]int
+	// gate, if set, blocks the reads until it is closed
+	gate chan struct{}
+}
+
+func newFakeStorage(ids ...string) *fakeStorage {
+	s := &fakeStorage{objects: make(map[string][]byte), reads: make(map[string]int)}
+	for _, id := range ids {
+		s.objects[id] = bytes.Repeat([]byte(id), 100)
+	}
+	return s
+}
+
+func (s *fakeStorage) NewReader(ctx context.Context, id string) (io.ReadCloser, error) {
+	if s.gate != nil {
+		<-s.gate
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reads[id]++
+	b, ok := s.objects[id]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", id)
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *fakeStorage) readCount(id string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reads[id]
+}
+
+func read(t *testing.T, c *Cache, id string) []byte {
+	rd, err := c.NewReader(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rd.Close()
+	b, err := ioutil.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestMemory(t *testing.T) {
+	s := newFakeStorage("thumb_a", "thumb_b", "thumb_c", "photo")
+	// room for two of the 700 byte thumbnails
+	c, err := New(s, WithMemory(1500))
+	if err != nil {
+		t.Fatal(err)
+	}
+	read(t, c, "thumb_a")
+	if b := read(t, c, "thumb_a"); !bytes.Equal(b, s.objects["thumb_a"]) {
+		t.Error("expected the cached content")
+	}
+	read(t, c, "thumb_b")
+	read(t, c, "thumb_a")
+	read(t, c, "thumb_c") // evicts b, the least recently used
+	read(t, c, "thumb_a")
+	read(t, c, "thumb_b")
+	if n := s.readCount("thumb_a"); n != 1 {
+		t.Errorf("expected a to be downloaded once, got %d", n)
+	}
+	if n := s.readCount("thumb_b"); n != 2 {
+		t.Errorf("expected b to be evicted, got %d downloads", n)
+	}
+	read(t, c, "photo")
+	read(t, c, "photo")
+	if n := s.readCount("photo"); n != 2 {
+		t.Errorf("expected the photo not to be cached, got %d downloads", n)
+	}
+
+	st := c.Stats()
+	if st.Hits != 3 || st.Misses != 4 || st.MemoryEntries != 2 || st.MemoryBytes != 1400 || st.MemoryEvictions != 2 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestCoalescing(t *testing.T) {
+	s := newFakeStorage("thumb_a")
+	s.gate = make(chan struct{})
+	c, _ := New(s)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			read(t, c, "thumb_a")
+		}()
+	}
+	// wait until all but the first request are waiting for the download
+	for {
+		if c.Stats().Coalesced == 9 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(s.gate)
+	wg.Wait()
+	if n := s.readCount("thumb_a"); n != 1 {
+		t.Errorf("expected a single download, got %d", n)
+	}
+
+	// a cancelled request does not cancel the download
+	s.gate = make(chan struct{})
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := c.NewReader(cctx, "thumb_b"); err == nil {
+		t.Error("expected the cancelled request to fail")
+	}
+	close(s.gate)
+	if _, err := c.NewReader(ctx, "thumb_b"); err == nil {
+		t.Error("expected an error for a missing object")
+	}
+	if st := c.Stats(); st.Errors == 0 {
+		t.Errorf("expected the error to be counted: %+v", st)
+	}
+}
+
+func TestDisk(t *testing.T) {
+	for _, encrypted := range []bool{false, true} {
+		fs := afero.NewMemMapFs()
+		s := newFakeStorage("thumb_a", "thumb_b", "thumb_c")
+		var options []option
+		if encrypted {
+			options = append(options, WithEncryption(crypto.NewService(key, crypto.WithBlockSize(256))))
+		}
+		newCache := func() *Cache {
+			c, err := New(s, append(options, WithMemory(0), WithDisk(fs, "/cache", 2000))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return c
+		}
+		c := newCache()
+		read(t, c, "thumb_a")
+		if b := read(t, c, "thumb_a"); !bytes.Equal(b, s.objects["thumb_a"]) {
+			t.Errorf("encrypted %v: expected the cached content", encrypted)
+		}
+		stored, _ := afero.ReadFile(fs, "/cache/thumb_a")
+		if bytes.Equal(stored, s.objects["thumb_a"]) == encrypted {
+			t.Errorf("encrypted %v: unexpected file content", encrypted)
+		}
+		read(t, c, "thumb_b")
+		read(t, c, "thumb_c")
+		st := c.Stats()
+		if st.DiskEntries != 2 || st.DiskBytes > 2000 || st.DiskEvictions != 1 {
+			t.Errorf("encrypted %v: unexpected stats %+v", encrypted, st)
+		}
+
+		// the disk cache survives a restart
+		c = newCache()
+		read(t, c, "thumb_c")
+		if n := s.readCount("thumb_c"); n != 1 {
+			t.Errorf("encrypted %v: expected c to be read from disk, got %d downloads", encrypted, n)
+		}
+		if st := c.Stats(); st.DiskHits != 1 {
+			t.Errorf("encrypted %v: unexpected stats %+v", encrypted, st)
+		}
+	}
+}
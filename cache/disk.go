@@ -0,0 +1,162 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marpio/mirror/crypto"
+	"github.com/spf13/afero"
+)
+
+const tmpSuffix = ".tmp"
+
+// disk keeps objects as files in a directory, up to max bytes in total. With
+// a crypto service the files are encrypted like the objects in the bucket.
+type disk struct {
+	fs   afero.Fs
+	crpt crypto.Service
+	now  func() time.Time
+
+	mu        sync.Mutex
+	index     *lru
+	evictions int64
+}
+
+func newDisk(fs afero.Fs, dir string, max int64, crpt crypto.Service) (*disk, error) {
+	if err := fs.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating the cache directory: %v", err)
+	}
+	d := &disk{fs: afero.NewBasePathFs(fs, dir), crpt: crpt, now: time.Now}
+	d.index = newLRU(max, func(key string, size int64) {
+		d.evictions++
+		d.fs.Remove(key)
+	})
+	fis, err := afero.ReadDir(d.fs, "/")
+	if err != nil {
+		return nil, fmt.Errorf("error reading the cache directory: %v", err)
+	}
+	files := make([]os.FileInfo, 0, len(fis))
+	for _, fi := range fis {
+		if fi.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(fi.Name(), tmpSuffix) {
+			d.fs.Remove(fi.Name())
+			continue
+		}
+		files = append(files, fi)
+	}
+	// the files are touched when read, so the most recently used come first
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().After(files[j].ModTime()) })
+	for _, fi := range files {
+		d.index.pushBack(fi.Name(), fi.Size())
+	}
+	for d.index.size > d.index.max {
+		d.index.removeElement(d.index.ll.Back(), true)
+	}
+	return d, nil
+}
+
+// validName reports whether key can be used as a file name in the cache
+// directory.
+func validName(key string) bool {
+	return key != "" && !strings.HasPrefix(key, ".") && !strings.HasSuffix(key, tmpSuffix) && !strings.ContainsAny(key, `/\`)
+}
+
+// get returns the cached object key, false if it is not cached.
+func (d *disk) get(key string) ([]byte, bool, error) {
+	d.mu.Lock()
+	_, ok := d.index.get(key)
+	d.mu.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+	b, err := afero.ReadFile(d.fs, key)
+	if err == nil && d.crpt != nil {
+		b, err = open(d.crpt, b)
+	}
+	if err != nil {
+		d.mu.Lock()
+		d.index.remove(key)
+		d.mu.Unlock()
+		d.fs.Remove(key)
+		return nil, false, err
+	}
+	now := d.now()
+	d.fs.Chtimes(key, now, now)
+	return b, true, nil
+}
+
+func (d *disk) put(key string, b []byte) error {
+	if d.crpt != nil {
+		var err error
+		if b, err = seal(d.crpt, b); err != nil {
+			return err
+		}
+	}
+	tmp := key + tmpSuffix
+	if err := afero.WriteFile(d.fs, tmp, b, 0600); err != nil {
+		d.fs.Remove(tmp)
+		return err
+	}
+	if err := d.fs.Rename(tmp, key); err != nil {
+		d.fs.Remove(tmp)
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.index.add(key, nil, int64(len(b))) {
+		d.fs.Remove(key)
+	}
+	return nil
+}
+
+// seal encrypts b block by block, the same way storage.RemoteStorage writes
+// objects.
+func seal(crpt crypto.Service, b []byte) ([]byte, error) {
+	res := make([]byte, 0, len(b)+(len(b)/crpt.BlockSize()+1)*(crpt.NonceSize()+crpt.Overhead()))
+	for len(b) > 0 {
+		n := crpt.BlockSize()
+		if n > len(b) {
+			n = len(b)
+		}
+		s, err := crpt.Seal(b[:n])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, s...)
+		b = b[n:]
+	}
+	return res, nil
+}
+
+func open(crpt crypto.Service, b []byte) ([]byte, error) {
+	res := make([]byte, 0, len(b))
+	block := crpt.NonceSize() + crpt.BlockSize() + crpt.Overhead()
+	for len(b) > 0 {
+		n := block
+		if n > len(b) {
+			n = len(b)
+		}
+		if n <= crpt.NonceSize()+crpt.Overhead() {
+			return nil, fmt.Errorf("the cached file is truncated")
+		}
+		d, err := crpt.Open(b[:n])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, d...)
+		b = b[n:]
+	}
+	return res, nil
+}
+
+func (d *disk) stats() (int64, int, int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.index.size, d.index.len(), d.evictions
+}
@@ -0,0 +1,81 @@
+package cache
+
+import "container/list"
+
+// lru keeps entries up to max bytes in total, evicting the least recently
+// used. It is not safe for concurrent use.
+type lru struct {
+	max     int64
+	size    int64
+	ll      *list.List
+	entries map[string]*list.Element
+	// onEvict is called with the key and size of every evicted entry.
+	onEvict func(key string, size int64)
+}
+
+type lruEntry struct {
+	key   string
+	size  int64
+	value []byte
+}
+
+func newLRU(max int64, onEvict func(string, int64)) *lru {
+	return &lru{max: max, ll: list.New(), entries: make(map[string]*list.Element), onEvict: onEvict}
+}
+
+func (c *lru) get(key string) (*lruEntry, bool) {
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(el)
+	return el.Value.(*lruEntry), true
+}
+
+// add stores value with the given size, unless it is larger than the whole
+// cache. It reports whether the value was stored.
+func (c *lru) add(key string, value []byte, size int64) bool {
+	if size > c.max {
+		return false
+	}
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*lruEntry)
+		c.size += size - e.size
+		e.size, e.value = size, value
+		c.ll.MoveToFront(el)
+	} else {
+		c.entries[key] = c.ll.PushFront(&lruEntry{key: key, size: size, value: value})
+		c.size += size
+	}
+	for c.size > c.max {
+		c.removeElement(c.ll.Back(), true)
+	}
+	return true
+}
+
+// pushBack adds an entry as the least recently used one, used to fill the
+// cache in order of last use.
+func (c *lru) pushBack(key string, size int64) {
+	c.entries[key] = c.ll.PushBack(&lruEntry{key: key, size: size})
+	c.size += size
+}
+
+func (c *lru) remove(key string) {
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el, false)
+	}
+}
+
+func (c *lru) removeElement(el *list.Element, evicted bool) {
+	e := el.Value.(*lruEntry)
+	c.ll.Remove(el)
+	delete(c.entries, e.key)
+	c.size -= e.size
+	if evicted && c.onEvict != nil {
+		c.onEvict(e.key, e.size)
+	}
+}
+
+func (c *lru) len() int {
+	return c.ll.Len()
+}
@@ -0,0 +1,356 @@
+// Copyright © 2017 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/text"
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/lock"
+	"github.com/marpio/mirror/metadata/repo"
+	"github.com/marpio/mirror/storage"
+	"github.com/spf13/cobra"
+)
+
+var (
+	albumTitle       string
+	albumDescription string
+	albumCover       string
+)
+
+var albumCmd = &cobra.Command{
+	Use:   "album",
+	Short: "Manage the albums.",
+	Long: `Manage the albums, ordered selections of photos with a title, a description
+and a cover. They are kept in the catalog next to the photos, changes are
+written to the segment of this device like the ones of sync.
+
+Albums are given by their id, a unique prefix of it or their title, photos by
+their id or a unique prefix of it.`,
+}
+
+var albumListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the albums.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		r := loadCatalog()
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tTITLE\tPHOTOS")
+		for _, a := range r.Albums() {
+			fmt.Fprintf(w, "%s\t%s\t%d\n", a.ID, a.Title, len(a.Photos))
+		}
+		w.Flush()
+	},
+}
+
+var albumShowCmd = &cobra.Command{
+	Use:   "show ALBUM",
+	Short: "Show an album and its photos.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		r := loadCatalog()
+		a, err := findAlbum(r, args[0])
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		fmt.Printf("%s (%s)\n", a.Title, a.ID)
+		if a.Description != "" {
+			fmt.Println(a.Description)
+		}
+		cover := a.CoverID()
+		for _, id := range a.Photos {
+			if id == cover {
+				fmt.Println(id, "(cover)")
+				continue
+			}
+			fmt.Println(id)
+		}
+	},
+}
+
+var albumCreateCmd = &cobra.Command{
+	Use:   "create TITLE [PHOTO...]",
+	Short: "Create an album, with the photos given.",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var id string
+		runCatalog(func(r *repo.SegmentStore) error {
+			photos, err := findPhotos(r, args[1:])
+			if err != nil {
+				return err
+			}
+			a, err := r.CreateAlbum(args[0], albumDescription)
+			if err != nil {
+				return err
+			}
+			id = a.ID
+			if len(photos) == 0 {
+				return nil
+			}
+			a.Photos = photos
+			return r.UpdateAlbum(a)
+		})
+		log.Infof("created album %s.", id)
+	},
+}
+
+var albumEditCmd = &cobra.Command{
+	Use:   "edit ALBUM",
+	Short: "Change the title, description or cover of an album.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		runCatalog(func(r *repo.SegmentStore) error {
+			a, err := findAlbum(r, args[0])
+			if err != nil {
+				return err
+			}
+			if flags.Changed("title") {
+				a.Title = albumTitle
+			}
+			if flags.Changed("description") {
+				a.Description = albumDescription
+			}
+			if flags.Changed("cover") {
+				a.Cover = ""
+				if albumCover != "" {
+					if a.Cover, err = findPhoto(r, albumCover); err != nil {
+						return err
+					}
+				}
+			}
+			return r.UpdateAlbum(a)
+		})
+		log.Infof("changed album %s.", args[0])
+	},
+}
+
+var albumAddCmd = &cobra.Command{
+	Use:   "add ALBUM PHOTO...",
+	Short: "Add photos to the end of an album.",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		runCatalog(func(r *repo.SegmentStore) error {
+			a, err := findAlbum(r, args[0])
+			if err != nil {
+				return err
+			}
+			photos, err := findPhotos(r, args[1:])
+			if err != nil {
+				return err
+			}
+			a.Photos = append(a.Photos, photos...)
+			return r.UpdateAlbum(a)
+		})
+		log.Infof("added %d photos to %s.", len(args)-1, args[0])
+	},
+}
+
+var albumRemoveCmd = &cobra.Command{
+	Use:   "remove ALBUM PHOTO...",
+	Short: "Remove photos from an album, they stay in the catalog.",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		runCatalog(func(r *repo.SegmentStore) error {
+			a, err := findAlbum(r, args[0])
+			if err != nil {
+				return err
+			}
+			photos, err := findPhotos(r, args[1:])
+			if err != nil {
+				return err
+			}
+			a.Photos = withoutPhotos(a.Photos, photos)
+			if !a.Contains(a.Cover) {
+				a.Cover = ""
+			}
+			return r.UpdateAlbum(a)
+		})
+		log.Infof("removed %d photos from %s.", len(args)-1, args[0])
+	},
+}
+
+var albumMoveCmd = &cobra.Command{
+	Use:   "move ALBUM PHOTO POSITION",
+	Short: "Move a photo of an album to a position, starting at 1.",
+	Args:  cobra.ExactArgs(3),
+	Run: func(cmd *cobra.Command, args []string) {
+		runCatalog(func(r *repo.SegmentStore) error {
+			a, err := findAlbum(r, args[0])
+			if err != nil {
+				return err
+			}
+			id, err := findPhoto(r, args[1])
+			if err != nil {
+				return err
+			}
+			if !a.Contains(id) {
+				return fmt.Errorf("%s is not in the album", id)
+			}
+			pos, err := strconv.Atoi(args[2])
+			if err != nil || pos < 1 || pos > len(a.Photos) {
+				return fmt.Errorf("the position must be between 1 and %d", len(a.Photos))
+			}
+			rest := withoutPhotos(a.Photos, []string{id})
+			a.Photos = append(append(append([]string{}, rest[:pos-1]...), id), rest[pos-1:]...)
+			return r.UpdateAlbum(a)
+		})
+		log.Infof("moved %s to position %s.", args[1], args[2])
+	},
+}
+
+var albumDeleteCmd = &cobra.Command{
+	Use:   "delete ALBUM",
+	Short: "Delete an album, its photos stay in the catalog.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runCatalog(func(r *repo.SegmentStore) error {
+			a, err := findAlbum(r, args[0])
+			if err != nil {
+				return err
+			}
+			return r.DeleteAlbum(a.ID)
+		})
+		log.Infof("deleted album %s.", args[0])
+	},
+}
+
+func init() {
+	albumCreateCmd.Flags().StringVar(&albumDescription, "description", "", "the description of the album")
+	albumEditCmd.Flags().StringVar(&albumTitle, "title", "", "the new title")
+	albumEditCmd.Flags().StringVar(&albumDescription, "description", "", "the new description")
+	albumEditCmd.Flags().StringVar(&albumCover, "cover", "", "the photo shown for the album, empty for the first one")
+	for _, c := range []*cobra.Command{albumCreateCmd, albumEditCmd, albumAddCmd, albumRemoveCmd, albumMoveCmd, albumDeleteCmd} {
+		addLockFlags(c)
+		albumCmd.AddCommand(c)
+	}
+	albumCmd.AddCommand(albumListCmd)
+	albumCmd.AddCommand(albumShowCmd)
+}
+
+// loadCatalog reads the catalog merged with the segments of all devices.
+func loadCatalog() *repo.SegmentStore {
+	log.SetHandler(text.New(os.Stderr))
+	ctx := context.Background()
+	cfg := loadConfig()
+	backend := newBackend(ctx, cfg)
+	rs := storage.NewRemote(backend, newCrypto(ctx, cfg, backend))
+	r, err := repo.NewSegmentStore(ctx, rs, rs, cfg.Repo, "")
+	if err != nil {
+		log.Fatalf("error reading the catalog: %v", err)
+	}
+	return r
+}
+
+// runCatalog changes the albums or tags with f and writes the segment of
+// this device, holding its lock like sync does.
+func runCatalog(f func(r *repo.SegmentStore) error) {
+	log.SetHandler(text.New(os.Stderr))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logctx := log.WithFields(log.Fields{
+		"cmd": "mirror-cli",
+	})
+
+	cfg := loadConfig()
+	backend := newBackend(ctx, cfg)
+	rs := storage.NewRemote(backend, newCrypto(ctx, cfg, backend))
+	device := deviceID(cfg)
+	l := acquireLock(ctx, logctx, backend, lock.DeviceObject(device), cancel, lock.ObjectName)
+	r, err := repo.NewSegmentStore(ctx, l.Guard(rs), rs, cfg.Repo, device)
+	if err == nil {
+		err = f(r)
+	}
+	if err == nil {
+		err = r.Persist(ctx)
+	}
+	releaseLock(logctx, l)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+// findAlbum returns the album with the id, unique id prefix or title arg.
+func findAlbum(r mirror.CollectionRepoReader, arg string) (mirror.Album, error) {
+	var found []mirror.Album
+	for _, a := range r.Albums() {
+		if a.ID == arg {
+			return a, nil
+		}
+		if strings.HasPrefix(a.ID, arg) || strings.EqualFold(a.Title, arg) {
+			found = append(found, a)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return mirror.Album{}, fmt.Errorf("no album %s", arg)
+	case 1:
+		return found[0], nil
+	}
+	return mirror.Album{}, fmt.Errorf("%s matches %d albums, give the id", arg, len(found))
+}
+
+// findPhoto returns the id of the photo with the id or unique id prefix arg.
+func findPhoto(r mirror.MetadataRepoReader, arg string) (string, error) {
+	found := make(map[string]bool)
+	for _, p := range r.GetAll() {
+		if strings.HasPrefix(p.ID(), arg) {
+			found[p.ID()] = true
+		}
+	}
+	if len(found) == 1 {
+		for id := range found {
+			return id, nil
+		}
+	}
+	if len(found) == 0 {
+		return "", fmt.Errorf("no photo %s", arg)
+	}
+	return "", fmt.Errorf("%s matches %d photos, give more of the id", arg, len(found))
+}
+
+func findPhotos(r mirror.MetadataRepoReader, args []string) ([]string, error) {
+	res := make([]string, 0, len(args))
+	for _, arg := range args {
+		id, err := findPhoto(r, arg)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, id)
+	}
+	return res, nil
+}
+
+func withoutPhotos(photos, remove []string) []string {
+	removed := make(map[string]bool)
+	for _, id := range remove {
+		removed[id] = true
+	}
+	res := make([]string, 0, len(photos))
+	for _, id := range photos {
+		if !removed[id] {
+			res = append(res, id)
+		}
+	}
+	return res
+}
@@ -0,0 +1,130 @@
+// Copyright © 2017 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/config"
+	"github.com/marpio/mirror/crypto"
+	"github.com/marpio/mirror/manifest"
+	"github.com/marpio/mirror/storage/remotebackend"
+	"github.com/spf13/afero"
+)
+
+// configPath returns the --config flag, $MIRROR_CONFIG or config.yml in the
+// state directory.
+func configPath() string {
+	if cfgFile != "" {
+		return cfgFile
+	}
+	if p := os.Getenv("MIRROR_CONFIG"); p != "" {
+		return p
+	}
+	return filepath.Join(stateDir(), "config.yml")
+}
+
+// loadConfig reads the config file, applies the environment and validates the
+// result.
+func loadConfig() *config.Config {
+	c := readConfig()
+	if err := c.Validate(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := c.ResolveSecrets(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	return c
+}
+
+// readConfig reads the config file and applies the environment and the
+// defaults. The default config file is optional, an explicitly given one not.
+func readConfig() *config.Config {
+	load := config.LoadOptional
+	if cfgFile != "" || os.Getenv("MIRROR_CONFIG") != "" {
+		load = config.Load
+	}
+	c, err := load(configPath())
+	if err != nil {
+		log.Fatalf("error loading the config: %v", err)
+	}
+	c.ApplyEnv(os.Getenv)
+	c.SetDefaults()
+	return c
+}
+
+func newBackend(ctx context.Context, c *config.Config) mirror.Storage {
+	if c.Backend.Type == config.BackendFilesystem {
+		return remotebackend.NewFileSystem(afero.NewBasePathFs(afero.NewOsFs(), c.Backend.Filesystem.Path))
+	}
+	return remotebackend.NewB2(ctx, c.Backend.B2.AccountID, c.Backend.B2.AccountKey, c.Backend.B2.Bucket)
+}
+
+// newCrypto returns the crypto service for the repository in backend. The
+// repository must have the current version and the key must match it.
+func newCrypto(ctx context.Context, c *config.Config, backend mirror.Storage) crypto.Service {
+	m, err := manifest.Open(ctx, backend, c.Repo)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	key, err := m.ResolveKey(c.Key.Value, c.Key.Passphrase)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return crypto.NewService(key, crypto.WithBlockSize(m.BlockSize))
+}
+
+var unsafeDeviceChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// deviceID returns the configured device, or the one generated on the first
+// run and kept in the state directory: the host name and a random suffix, so
+// machines with the same name get their own segment of the catalog.
+func deviceID(c *config.Config) string {
+	if c.Device != "" {
+		return c.Device
+	}
+	p := filepath.Join(stateDir(), "device")
+	if b, err := ioutil.ReadFile(p); err == nil {
+		if d := strings.TrimSpace(string(b)); d != "" {
+			return d
+		}
+	}
+	host, _ := os.Hostname()
+	host = unsafeDeviceChars.ReplaceAllString(host, "")
+	if host == "" {
+		host = "device"
+	}
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		log.Fatalf("error generating the device id: %v", err)
+	}
+	d := host + "-" + hex.EncodeToString(suffix)
+	if err := os.MkdirAll(stateDir(), 0700); err != nil {
+		log.Fatalf("error saving the device id: %v", err)
+	}
+	if err := ioutil.WriteFile(p, []byte(d+"\n"), 0600); err != nil {
+		log.Fatalf("error saving the device id: %v", err)
+	}
+	return d
+}
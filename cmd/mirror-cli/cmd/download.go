@@ -22,9 +22,7 @@ import (
 
 	"github.com/apex/log"
 	"github.com/apex/log/handlers/text"
-	"github.com/marpio/mirror/crypto"
 	"github.com/marpio/mirror/storage"
-	"github.com/marpio/mirror/storage/remotebackend"
 	"github.com/spf13/cobra"
 )
 
@@ -46,13 +44,9 @@ func runDownload(localFilePath, remoteFilePath string) {
 	}).Trace("starting download.")
 	ctx := context.Background()
 
-	encryptionKey := os.Getenv("ENCR_KEY")
-	b2id := os.Getenv("B2_ACCOUNT_ID")
-	b2key := os.Getenv("B2_ACCOUNT_KEY")
-	bucketName := os.Getenv("B2_BUCKET_NAME")
-
-	rsBackend := remotebackend.NewB2(ctx, b2id, b2key, bucketName)
-	rs := storage.NewRemote(rsBackend, crypto.NewService(encryptionKey))
+	cfg := loadConfig()
+	rsBackend := newBackend(ctx, cfg)
+	rs := storage.NewRemote(rsBackend, newCrypto(ctx, cfg, rsBackend))
 
 	f, err := os.Create(localFilePath)
 
@@ -0,0 +1,128 @@
+// Copyright © 2017 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/text"
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/gc"
+	"github.com/marpio/mirror/lock"
+	"github.com/marpio/mirror/metadata"
+	"github.com/marpio/mirror/metadata/repo"
+	"github.com/marpio/mirror/storage"
+	"github.com/spf13/cobra"
+)
+
+var (
+	gcDelete      bool
+	gcRepair      bool
+	gcGracePeriod time.Duration
+)
+
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "Find objects in the remote which are not referenced by the catalog.",
+	Long: `Cross-references the remote objects with the catalog and reports orphaned
+objects, catalog entries whose photo is missing and catalog entries whose
+thumbnail is missing. Nothing is changed unless --delete or --repair is given.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runGC()
+	},
+}
+
+func init() {
+	gcCmd.Flags().BoolVar(&gcDelete, "delete", false, "delete orphaned objects and remove catalog entries whose photo is missing")
+	gcCmd.Flags().BoolVar(&gcRepair, "repair", false, "regenerate missing thumbnails")
+	gcCmd.Flags().DurationVar(&gcGracePeriod, "grace", 24*time.Hour, "keep orphaned objects younger than this")
+	addLockFlags(gcCmd)
+}
+
+func runGC() {
+	log.SetHandler(text.New(os.Stderr))
+	ctx := context.Background()
+	logctx := log.WithFields(log.Fields{
+		"cmd": "mirror-cli",
+	})
+
+	cfg := loadConfig()
+	rsBackend := newBackend(ctx, cfg)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// the objects uploaded by a sync are not in the catalog until it is saved,
+	// so none of the devices may be syncing
+	own := lock.DeviceObject(deviceID(cfg))
+	var devices []string
+	if lister, ok := rsBackend.(mirror.StorageLister); ok {
+		all, err := lock.DeviceObjects(ctx, lister)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		for _, d := range all {
+			if d != own {
+				devices = append(devices, d)
+			}
+		}
+	}
+	l := acquireLock(ctx, logctx, rsBackend, lock.ObjectName, cancel, devices...)
+	// the catalog entries are pruned from the segment of this device
+	dl := acquireLock(ctx, logctx, rsBackend, own, cancel, lock.ObjectName)
+	rs := storage.NewRemote(rsBackend, newCrypto(ctx, cfg, rsBackend))
+	guarded := dl.Guard(l.Guard(rs))
+
+	repo, err := repo.NewSegmentStore(ctx, guarded, rs, cfg.Repo, deviceID(cfg))
+	if err != nil {
+		log.Fatalf("error creating metadata repository: %v", err)
+	}
+	collector := gc.New(guarded, rs, repo, metadata.NewThumbnail,
+		gc.WithDelete(gcDelete),
+		gc.WithRepair(gcRepair),
+		gc.WithGracePeriod(gcGracePeriod))
+	rep, err := collector.Run(ctx, logctx)
+	releaseLock(logctx, dl)
+	releaseLock(logctx, l)
+	if err != nil {
+		log.Fatalf("error collecting garbage: %v", err)
+	}
+	for _, o := range rep.Orphans {
+		logctx.WithFields(log.Fields{
+			"object":   o.Name,
+			"size":     o.Size,
+			"uploaded": o.ModTime,
+		}).Info("orphaned object")
+	}
+	for _, id := range rep.MissingPhotos {
+		logctx.WithField("photo", id).Warn("catalog entry without photo")
+	}
+	for _, id := range rep.MissingThumbs {
+		logctx.WithField("photo", id).Warn("catalog entry without thumbnail")
+	}
+	logctx.WithFields(log.Fields{
+		"orphans":         len(rep.Orphans),
+		"deleted":         len(rep.Deleted),
+		"missing_photos":  len(rep.MissingPhotos),
+		"pruned":          len(rep.Pruned),
+		"missing_thumbs":  len(rep.MissingThumbs),
+		"repaired_thumbs": len(rep.RepairedThumbs),
+		"errors":          len(rep.Errors),
+	}).Info("done collecting garbage.")
+	if len(rep.Errors) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright © 2017 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/text"
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/config"
+	"github.com/marpio/mirror/crypto"
+	"github.com/marpio/mirror/manifest"
+	"github.com/marpio/mirror/metadata/repo"
+	"github.com/marpio/mirror/secret"
+	"github.com/marpio/mirror/storage"
+	"github.com/spf13/cobra"
+)
+
+const defaultRepo = "catalog"
+
+var (
+	initPassphrase string
+	initKeyFile    string
+)
+
+var initCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Initialise a new repository in the configured bucket.",
+	Long: `Initialise a new repository in the configured bucket: generate a key, write
+the repository manifest and create an empty catalog. The catalog is named by
+repo in the config file, or "catalog".
+
+The key is printed once, together with a paper key to write down. Without it
+the photos cannot be decrypted. With --passphrase the key is derived from a
+passphrase instead, given as a secret reference, e.g. "prompt", and key.passphrase
+can be set in the config file instead of the key.
+
+A bucket which already has a manifest or a catalog is left alone.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runInit()
+	},
+}
+
+func init() {
+	initCmd.Flags().StringVar(&initPassphrase, "passphrase", "", "derive the key from this passphrase (a secret reference)")
+	initCmd.Flags().StringVar(&initKeyFile, "key-file", "", "also write the key to this file")
+}
+
+func runInit() {
+	log.SetHandler(text.New(os.Stderr))
+	ctx := context.Background()
+
+	cfg := readConfig()
+	if err := cfg.ValidateBackend(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	// the key is generated, a configured one is not needed
+	cfg.Key = config.Key{}
+	if err := cfg.ResolveSecrets(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if cfg.Repo == "" {
+		cfg.Repo = defaultRepo
+	}
+	backend := newBackend(ctx, cfg)
+	if manifest.Exists(ctx, backend) {
+		log.Fatalf("the bucket is already initialised, it has a %s", manifest.ObjectName)
+	}
+	if backend.Exists(ctx, cfg.Repo) {
+		log.Fatalf("the bucket already has a catalog %q", cfg.Repo)
+	}
+	if initKeyFile != "" {
+		if _, err := os.Stat(initKeyFile); err == nil {
+			log.Fatalf("the key file %s already exists", initKeyFile)
+		}
+	}
+
+	m := manifest.New(cfg.Repo)
+	key, err := initKey(m)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := m.SetKey(key); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := initRepository(ctx, backend, m, key); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if initKeyFile != "" {
+		if err := ioutil.WriteFile(initKeyFile, []byte(key+"\n"), 0600); err != nil {
+			log.WithError(err).Errorf("error writing the key file %s", initKeyFile)
+		}
+	}
+
+	fmt.Printf("Initialised the repository with the catalog %q.\n\n", cfg.Repo)
+	fmt.Printf("Key:\n\n  %s\n\n", key)
+	fmt.Printf("Paper key - write it down and keep it in a safe place. Without the key\nthe photos cannot be decrypted, it cannot be recovered:\n\n")
+	for _, l := range strings.Split(manifest.PaperKey(key), "\n") {
+		fmt.Printf("  %s\n", l)
+	}
+	fmt.Printf("\nSet repo: %s and the key (key.value, key.file or key.passphrase) in the config file.\n", cfg.Repo)
+}
+
+// initKey generates the key, or derives it from the passphrase.
+func initKey(m *manifest.Manifest) (string, error) {
+	if initPassphrase == "" {
+		return manifest.GenerateKey()
+	}
+	pass, err := secret.Resolve(initPassphrase, "passphrase")
+	if err != nil {
+		return "", err
+	}
+	if initPassphrase == "prompt" {
+		again, err := secret.Resolve(initPassphrase, "repeat passphrase")
+		if err != nil {
+			return "", err
+		}
+		if again != pass {
+			return "", fmt.Errorf("the passphrases do not match")
+		}
+	}
+	if pass == "" {
+		return "", fmt.Errorf("the passphrase must not be empty")
+	}
+	if err := m.UseScrypt(); err != nil {
+		return "", err
+	}
+	return m.DeriveKey(pass)
+}
+
+// initRepository creates the empty catalog and then the manifest, which marks
+// the repository as initialised.
+func initRepository(ctx context.Context, backend mirror.Storage, m *manifest.Manifest, key string) error {
+	rs := storage.NewRemote(backend, crypto.NewService(key, crypto.WithBlockSize(m.BlockSize)))
+	catalog, err := repo.NewHashmap(ctx, rs, m.Naming.Catalog)
+	if err != nil {
+		return fmt.Errorf("error creating the catalog: %v", err)
+	}
+	if err := catalog.Persist(ctx); err != nil {
+		return fmt.Errorf("error creating the catalog: %v", err)
+	}
+	if err := manifest.Write(ctx, backend, m); err != nil {
+		backend.Delete(ctx, m.Naming.Catalog)
+		return err
+	}
+	return nil
+}
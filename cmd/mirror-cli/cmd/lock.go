@@ -0,0 +1,105 @@
+// Copyright © 2017 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/text"
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/lock"
+	"github.com/spf13/cobra"
+)
+
+var (
+	lockWait     time.Duration
+	unlockDevice string
+)
+
+var unlockCmd = &cobra.Command{
+	Use:   "unlock",
+	Short: "Remove the repository lock.",
+	Long: `Remove the repository lock left behind by a mirror-cli which did not exit
+cleanly, or with --device the lock of a device's catalog segment. A lock
+without heartbeat is taken over after its TTL anyway, make sure its holder is
+not running any more.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runUnlock()
+	},
+}
+
+func init() {
+	unlockCmd.Flags().StringVar(&unlockDevice, "device", "", "remove the lock of this device instead")
+}
+
+// addLockFlags adds the flags of the commands writing the catalog, which
+// hold the repository lock while running.
+func addLockFlags(cmd *cobra.Command) {
+	cmd.Flags().DurationVar(&lockWait, "lock-wait", 0, "how long to wait for the repository lock held by another mirror-cli")
+}
+
+// acquireLock takes the lock object name unless another process holds one of
+// exclude, cancel is called if it is lost.
+func acquireLock(ctx context.Context, logctx log.Interface, backend mirror.Storage, name string, cancel context.CancelFunc, exclude ...string) *lock.Lock {
+	l, err := lock.Acquire(ctx, logctx, backend, lock.Holder(), lock.WithObject(name), lock.WithWait(lockWait), lock.WithExclude(exclude...))
+	if err != nil {
+		if _, ok := err.(*lock.LockedError); ok {
+			log.Fatalf("%v - wait with --lock-wait, or remove the lock with mirror-cli unlock if it is left over", err)
+		}
+		log.Fatalf("error locking the repository: %v", err)
+	}
+	go func() {
+		select {
+		case <-l.Lost():
+			logctx.Error("lost the repository lock to another process, stopping without saving the catalog")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return l
+}
+
+func releaseLock(logctx log.Interface, l *lock.Lock) {
+	if err := l.Release(context.Background()); err != nil {
+		logctx.WithError(err).Error("error releasing the repository lock")
+	}
+}
+
+func runUnlock() {
+	log.SetHandler(text.New(os.Stderr))
+	ctx := context.Background()
+	cfg := loadConfig()
+	backend := newBackend(ctx, cfg)
+	name := lock.ObjectName
+	if unlockDevice != "" {
+		name = lock.DeviceObject(unlockDevice)
+	}
+	cur, err := lock.Read(ctx, backend, name)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if cur == nil {
+		log.Info("not locked.")
+		return
+	}
+	if err := lock.Break(ctx, backend, name); err != nil {
+		log.Fatalf("error removing the lock: %v", err)
+	}
+	log.Infof("removed the lock of %s.", cur)
+}
@@ -0,0 +1,116 @@
+// Copyright © 2017 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/text"
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/crypto"
+	"github.com/marpio/mirror/lock"
+	"github.com/marpio/mirror/manifest"
+	"github.com/marpio/mirror/migration"
+	"github.com/marpio/mirror/storage"
+	"github.com/spf13/cobra"
+)
+
+var migrateDryRun bool
+
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Upgrade the repository to the format of this mirror.",
+	Long: fmt.Sprintf(`Upgrade the repository to format version %d, step by step. An interrupted
+migration continues where it stopped when migrate is run again. Until the
+migration is finished the other commands and mirror-web refuse to use the
+repository.`, manifest.Version),
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		runMigrate()
+	},
+}
+
+func init() {
+	migrateCmd.Flags().BoolVar(&migrateDryRun, "dry-run", false, "only list the migrations which would be run")
+	addLockFlags(migrateCmd)
+}
+
+func runMigrate() {
+	log.SetHandler(text.New(os.Stderr))
+	ctx := context.Background()
+	logctx := log.WithFields(log.Fields{
+		"cmd": "mirror-cli",
+	})
+
+	cfg := loadConfig()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	backend := newBackend(ctx, cfg)
+	m, err := manifest.Load(ctx, backend, cfg.Repo)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if err := m.CheckVersion(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	ms, err := migration.Pending(m.Version)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	if len(ms) == 0 && !backend.Exists(ctx, manifest.MigrationObject) {
+		logctx.Infof("the repository already has version %d.", m.Version)
+		return
+	}
+	for _, mg := range ms {
+		logctx.Infof("version %d to %d: %s", mg.From, mg.To, mg.Description)
+	}
+	if migrateDryRun {
+		return
+	}
+	key, err := m.ResolveKey(cfg.Key.Value, cfg.Key.Passphrase)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	lister, _ := backend.(mirror.StorageLister)
+	// the catalog is rewritten, none of the devices may be writing to it
+	var devices []string
+	if lister != nil {
+		if devices, err = lock.DeviceObjects(ctx, lister); err != nil {
+			log.Fatalf("%v", err)
+		}
+	}
+	l := acquireLock(ctx, logctx, backend, lock.ObjectName, cancel, devices...)
+	backend = l.Guard(backend)
+	env := &migration.Env{
+		Backend:  backend,
+		Remote:   storage.NewRemote(backend, crypto.NewService(key, crypto.WithBlockSize(m.BlockSize))),
+		Lister:   lister,
+		Manifest: m,
+		Key:      key,
+	}
+	err = migration.Run(ctx, logctx, env, ms)
+	if err == nil && len(ms) == 0 {
+		// only the progress of a finished migration was left
+		backend.Delete(ctx, manifest.MigrationObject)
+	}
+	releaseLock(logctx, l)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	logctx.Infof("the repository has version %d.", m.Version)
+}
@@ -0,0 +1,108 @@
+// Copyright © 2017 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/marpio/mirror/config"
+	"github.com/spf13/cobra"
+)
+
+var syncProfile string
+
+// loadProfile returns the profile selected by --profile, or an empty one if
+// none is selected, with the sync defaults of the config filled in. The flags
+// given on the command line take precedence over both.
+func loadProfile(cmd *cobra.Command, c *config.Config) (*config.Profile, error) {
+	p := &config.Profile{}
+	if syncProfile != "" {
+		var err error
+		if p, err = c.Profile(syncProfile); err != nil {
+			return nil, err
+		}
+	}
+	if len(p.Exts) == 0 {
+		p.Exts = c.Sync.Exts
+	}
+	if p.MaxConcurrentUploads == 0 {
+		p.MaxConcurrentUploads = c.Sync.MaxConcurrentUploads
+	}
+	if p.Timeout == 0 {
+		p.Timeout = c.Sync.Timeout
+	}
+	flags := cmd.Flags()
+	if !flags.Changed("limit-up") && c.Sync.LimitUp != "" {
+		limitUp = c.Sync.LimitUp
+	}
+	if !flags.Changed("limit-down") && c.Sync.LimitDown != "" {
+		limitDown = c.Sync.LimitDown
+	}
+	if !flags.Changed("window") && len(c.Sync.Windows) > 0 {
+		limitWindows = c.Sync.Windows
+	}
+	if !flags.Changed("include") && len(p.Include) > 0 {
+		scanInclude = p.Include
+	}
+	if !flags.Changed("exclude") && len(p.Exclude) > 0 {
+		scanExclude = p.Exclude
+	}
+	if !flags.Changed("ignore-file") && p.IgnoreFile != "" {
+		scanIgnoreFile = p.IgnoreFile
+	}
+	if !flags.Changed("max-depth") && p.MaxDepth > 0 {
+		scanMaxDepth = p.MaxDepth
+	}
+	if !flags.Changed("symlinks") && p.Symlinks != "" {
+		scanSymlinks = p.Symlinks
+	}
+	if !flags.Changed("skip-hidden") && p.SkipHidden {
+		scanSkipHidden = true
+	}
+	if !flags.Changed("min-size") && p.MinSize != "" {
+		scanMinSize = p.MinSize
+	}
+	if !flags.Changed("max-size") && p.MaxSize != "" {
+		scanMaxSize = p.MaxSize
+	}
+	return p, nil
+}
+
+// syncRoots returns the directories given as arguments, or the roots of the
+// profile if there are none.
+func syncRoots(args []string, p *config.Profile) ([]string, error) {
+	if len(args) > 0 {
+		return args, nil
+	}
+	if len(p.Roots) > 0 {
+		return p.Roots, nil
+	}
+	return nil, fmt.Errorf("no directory to sync, pass one or select a profile with --profile")
+}
+
+// normalizeExts makes the extensions lower case with a leading dot, as
+// expected by FindFiles.
+func normalizeExts(exts []string) []string {
+	res := make([]string, 0, len(exts))
+	for _, e := range exts {
+		e = strings.ToLower(e)
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		res = append(res, e)
+	}
+	return res
+}
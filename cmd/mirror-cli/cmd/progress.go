@@ -0,0 +1,139 @@
+// Copyright © 2017 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/marpio/mirror/syncronizer"
+	"github.com/spf13/cobra"
+)
+
+var (
+	jsonProgress bool
+	noProgress   bool
+)
+
+func addProgressFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&jsonProgress, "json-progress", false, "write progress events as newline delimited JSON to stdout")
+	cmd.Flags().BoolVar(&noProgress, "no-progress", false, "don't show the progress line, even on a terminal")
+}
+
+// progressOutput returns the observer showing the sync progress, if any, and
+// the writer log lines for the terminal have to go through.
+func progressOutput() (syncronizer.Observer, io.Writer) {
+	if jsonProgress {
+		return newJSONProgress(os.Stdout), os.Stderr
+	}
+	if noProgress || !isTerminal(os.Stderr) {
+		return nil, os.Stderr
+	}
+	p := newTerminalProgress(os.Stderr)
+	return p, p
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+type jsonProgressWriter struct {
+	enc *json.Encoder
+}
+
+func newJSONProgress(w io.Writer) *jsonProgressWriter {
+	return &jsonProgressWriter{enc: json.NewEncoder(w)}
+}
+
+func (p *jsonProgressWriter) OnEvent(e syncronizer.Event) {
+	p.enc.Encode(e)
+}
+
+// terminalProgress keeps a status line at the bottom of the terminal. Log
+// lines written through it are printed above the status line.
+type terminalProgress struct {
+	mu       sync.Mutex
+	w        io.Writer
+	status   string
+	lastDraw time.Time
+}
+
+const redrawInterval = 200 * time.Millisecond
+
+func newTerminalProgress(w io.Writer) *terminalProgress {
+	return &terminalProgress{w: w}
+}
+
+func (p *terminalProgress) OnEvent(e syncronizer.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status = formatProgress(e.Progress)
+	switch e.Type {
+	case syncronizer.ScanStarted:
+		p.status = fmt.Sprintf("scanning %s...", e.FilePath)
+	case syncronizer.FileFailed:
+		p.clear()
+		fmt.Fprintf(p.w, "failed: %s: %s\n", e.FilePath, e.Err)
+	case syncronizer.SyncDone:
+		p.clear()
+		fmt.Fprintln(p.w, p.status)
+		p.status = ""
+		return
+	default:
+		if time.Since(p.lastDraw) < redrawInterval {
+			return
+		}
+	}
+	p.draw()
+}
+
+func (p *terminalProgress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	n, err := p.w.Write(b)
+	p.draw()
+	return n, err
+}
+
+func (p *terminalProgress) clear() {
+	fmt.Fprint(p.w, "\r\033[K")
+}
+
+func (p *terminalProgress) draw() {
+	if p.status == "" {
+		return
+	}
+	fmt.Fprint(p.w, "\r\033[K"+p.status)
+	p.lastDraw = time.Now()
+}
+
+func formatProgress(pr syncronizer.Progress) string {
+	s := fmt.Sprintf("found %d | checked %d (%d new) | uploaded %d/%d",
+		pr.FilesFound, pr.FilesHashed, pr.FilesNew, pr.FilesUploaded, pr.FilesNew)
+	if pr.FilesFailed > 0 {
+		s += fmt.Sprintf(", %d failed", pr.FilesFailed)
+	}
+	s += fmt.Sprintf(" | %.1f MiB", float64(pr.BytesUploaded)/(1<<20))
+	if pr.ETA > 0 {
+		s += fmt.Sprintf(" | ETA %v", pr.ETA.Round(time.Second))
+	}
+	return s
+}
@@ -48,6 +48,15 @@ func Execute() {
 }
 
 func init() {
+	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default $MIRROR_CONFIG or $HOME/.mirror/config.yml)")
+	RootCmd.AddCommand(initCmd)
 	RootCmd.AddCommand(syncCmd)
 	RootCmd.AddCommand(downloadCmd)
+	RootCmd.AddCommand(gcCmd)
+	RootCmd.AddCommand(migrateCmd)
+	RootCmd.AddCommand(watchCmd)
+	RootCmd.AddCommand(unlockCmd)
+	RootCmd.AddCommand(userCmd)
+	RootCmd.AddCommand(albumCmd)
+	RootCmd.AddCommand(tagCmd)
 }
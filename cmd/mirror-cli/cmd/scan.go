@@ -0,0 +1,73 @@
+// Copyright © 2017 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/marpio/mirror/config"
+	"github.com/marpio/mirror/storage"
+	"github.com/spf13/cobra"
+)
+
+var (
+	scanInclude    []string
+	scanExclude    []string
+	scanIgnoreFile string
+	scanMaxDepth   int
+	scanSymlinks   string
+	scanSkipHidden bool
+	scanMinSize    string
+	scanMaxSize    string
+)
+
+func addScanFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVar(&scanInclude, "include", nil, "only sync files matching this gitignore style pattern (repeatable)")
+	cmd.Flags().StringArrayVar(&scanExclude, "exclude", nil, "skip files and directories matching this gitignore style pattern (repeatable)")
+	cmd.Flags().StringVar(&scanIgnoreFile, "ignore-file", ".mirrorignore", "name of the per-directory files with exclude patterns, empty to disable")
+	cmd.Flags().IntVar(&scanMaxDepth, "max-depth", 0, "how many directory levels to descend, 0 for no limit")
+	cmd.Flags().StringVar(&scanSymlinks, "symlinks", "files", "symlink policy: skip, files (follow links to files only) or follow")
+	cmd.Flags().BoolVar(&scanSkipHidden, "skip-hidden", false, "skip files and directories starting with a dot")
+	cmd.Flags().StringVar(&scanMinSize, "min-size", "", "skip files smaller than this, e.g. 100K")
+	cmd.Flags().StringVar(&scanMaxSize, "max-size", "", "skip files larger than this, e.g. 2G")
+}
+
+func scanRules() (storage.ScanRules, error) {
+	r := storage.ScanRules{
+		Include:    scanInclude,
+		Exclude:    scanExclude,
+		IgnoreFile: scanIgnoreFile,
+		MaxDepth:   scanMaxDepth,
+		SkipHidden: scanSkipHidden,
+	}
+	switch scanSymlinks {
+	case "skip":
+		r.Symlinks = storage.SkipSymlinks
+	case "files":
+		r.Symlinks = storage.FollowFileSymlinks
+	case "follow":
+		r.Symlinks = storage.FollowSymlinks
+	default:
+		return r, fmt.Errorf("invalid symlink policy %q", scanSymlinks)
+	}
+	var err error
+	if r.MinSize, err = config.ParseSize(scanMinSize); err != nil {
+		return r, fmt.Errorf("invalid min size: %v", err)
+	}
+	if r.MaxSize, err = config.ParseSize(scanMaxSize); err != nil {
+		return r, fmt.Errorf("invalid max size: %v", err)
+	}
+	return r, nil
+}
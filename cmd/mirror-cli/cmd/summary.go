@@ -0,0 +1,53 @@
+// Copyright © 2017 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/marpio/mirror/syncronizer"
+)
+
+func summaryFields(res *syncronizer.Result) log.Fields {
+	return log.Fields{
+		"scanned":  res.Scanned,
+		"skipped":  res.Skipped,
+		"uploaded": res.Uploaded,
+		"failed":   res.Failed,
+		"bytes":    res.Bytes,
+		"duration": res.Duration.Round(time.Second),
+	}
+}
+
+func printSummary(w io.Writer, res *syncronizer.Result) {
+	fmt.Fprintf(w, "\nscanned:  %d\nskipped:  %d (already synced)\nuploaded: %d (%.1f MiB)\nfailed:   %d\nduration: %v\n",
+		res.Scanned, res.Skipped, res.Uploaded, float64(res.Bytes)/(1<<20), res.Failed, res.Duration.Round(time.Second))
+	for _, f := range res.Failures {
+		fmt.Fprintf(w, "  %s: %v\n", f.FilePath, f.Err)
+	}
+}
+
+func writeSummary(path string, res *syncronizer.Result) error {
+	b, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
 	"github.com/apex/log"
@@ -25,40 +26,104 @@ import (
 	"github.com/apex/log/handlers/multi"
 	"github.com/apex/log/handlers/text"
 	"github.com/marpio/mirror/crypto"
+	"github.com/marpio/mirror/lock"
 	"github.com/marpio/mirror/metadata"
 	"github.com/marpio/mirror/metadata/repo"
 	"github.com/marpio/mirror/storage"
-	"github.com/marpio/mirror/storage/remotebackend"
 	"github.com/marpio/mirror/syncronizer"
 	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 )
 
 var syncCmd = &cobra.Command{
-	Use:   "sync",
-	Short: "Sync local directory with a remote.",
-	Long:  "",
+	Use:   "sync [dir...]",
+	Short: "Sync local directories with a remote.",
+	Long: `Sync local directories with a remote.
+
+Instead of passing the directories, a profile from the config file can be
+selected with --profile. Its roots are synced with its settings, flags given
+on the command line take precedence over them.
+
+Exit codes:
+  0  all files have been synced
+  1  the sync failed as a whole, e.g. the catalog could not be saved
+  2  some files could not be synced
+  3  none of the new files could be synced`,
 	Run: func(cmd *cobra.Command, args []string) {
-		runSync(args[0])
+		if code := runSync(cmd, args); code != 0 {
+			os.Exit(code)
+		}
 	},
 }
 
-func getenv(n string) string {
-	v := os.Getenv(n)
-	if v == "" {
-		panic("could not find env var " + n)
+const (
+	exitError          = 1
+	exitPartialFailure = 2
+	exitTotalFailure   = 3
+)
+
+var (
+	rehash      bool
+	summaryJSON string
+)
+
+func init() {
+	syncCmd.Flags().BoolVar(&rehash, "rehash", false, "ignore the cached hashes and hash every file again")
+	syncCmd.Flags().StringVar(&syncProfile, "profile", "", "sync the roots of this profile from the config file")
+	syncCmd.Flags().StringVar(&summaryJSON, "summary-json", "", "write the summary of the sync as JSON to this file")
+	addScanFlags(syncCmd)
+	addProgressFlags(syncCmd)
+	addThrottleFlags(syncCmd)
+	addLockFlags(syncCmd)
+}
+
+// stateDir is where local state - the progress of interrupted uploads and the
+// hash cache - is kept.
+func stateDir() string {
+	if d := os.Getenv("MIRROR_STATE_DIR"); d != "" {
+		return d
+	}
+	return filepath.Join(os.Getenv("HOME"), ".mirror")
+}
+
+func uploadStateDir() string {
+	return filepath.Join(stateDir(), "uploads")
+}
+
+func newHashCache(fs afero.Fs) *storage.HashCache {
+	c := storage.NewHashCache(fs, filepath.Join(stateDir(), "hashes.json"))
+	if rehash {
+		c.Reset()
 	}
-	return v
+	return c
 }
 
-func runSync(dir string) {
+func runSync(cmd *cobra.Command, args []string) int {
+	cfg := loadConfig()
+	profile, err := loadProfile(cmd, cfg)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	roots, err := syncRoots(args, profile)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	rules, err := scanRules()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	sched, downLimiter, err := uploadSchedule()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	observer, logOut := progressOutput()
 	logFile, err := os.Create("log.json")
 	if err != nil {
 		log.Fatal("error creating log file")
 	}
 	defer logFile.Close()
 	log.SetHandler(multi.New(
-		text.New(os.Stderr),
+		text.New(logOut),
 		json.New(logFile),
 	))
 
@@ -66,19 +131,18 @@ func runSync(dir string) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	logctx := log.WithFields(log.Fields{
-		"cmd":         "mirror-cli",
-		"syncing_dir": dir,
+		"cmd":          "mirror-cli",
+		"syncing_dirs": roots,
 	})
 
-	encryptionKey := getenv("ENCR_KEY")
-	b2id := getenv("B2_ACCOUNT_ID")
-	b2key := getenv("B2_ACCOUNT_KEY")
-	bucketName := getenv("B2_BUCKET_NAME")
-	rsBackend := remotebackend.NewB2(ctx, b2id, b2key, bucketName)
-	rs := storage.NewRemote(rsBackend, crypto.NewService(encryptionKey))
+	rsBackend := newBackend(ctx, cfg)
+	rs := storage.NewRemote(rsBackend, newCrypto(ctx, cfg, rsBackend),
+		storage.WithResumeState(afero.NewOsFs(), uploadStateDir()))
+	device := deviceID(cfg)
+	l := acquireLock(ctx, logctx, rsBackend, lock.DeviceObject(device), cancel, lock.ObjectName)
+	defer releaseLock(logctx, l)
 
-	dbPath := getenv("REPO")
-	repo, err := repo.NewHashmap(ctx, rs, dbPath)
+	repo, err := repo.NewSegmentStore(ctx, l.Guard(rs), rs, cfg.Repo, device)
 	if err != nil {
 		log.Fatalf("error creating metadata repository: %v", err)
 	}
@@ -97,11 +161,44 @@ func runSync(dir string) {
 		}
 	}()
 	appFs := afero.NewOsFs()
-	localFilesRepo := storage.NewLocal(appFs, crypto.GenerateSha256)
-	syncronizer := syncronizer.New(rs,
+	hashCache := newHashCache(appFs)
+	localFilesRepo := storage.NewLocal(appFs, crypto.GenerateSha256,
+		storage.WithHashCache(hashCache),
+		storage.WithScanRules(rules),
+		storage.WithLogger(logctx))
+	// the catalog is written with rs, so it can be saved while uploads are paused
+	upLimiter := storage.NewRateLimiter(sched.DefaultRate)
+	throttled := storage.NewThrottled(rs, downLimiter, upLimiter)
+	syncronizer := syncronizer.New(throttled,
 		repo,
 		localFilesRepo,
-		metadata.NewExtractor(localFilesRepo))
-	syncronizer.Execute(ctx, logctx, dir)
+		metadata.NewExtractor(localFilesRepo),
+		syncronizer.WithObserver(observer),
+		syncronizer.WithSchedule(sched, upLimiter),
+		syncronizer.WithMaxConcurrentUploads(profile.MaxConcurrentUploads),
+		syncronizer.WithTimeout(profile.Timeout),
+		syncronizer.WithFileExts(normalizeExts(profile.Exts)...))
+	res, err := syncronizer.Execute(ctx, logctx, roots...)
+	if err := hashCache.Save(); err != nil {
+		logctx.WithError(err).Error("error saving the hash cache")
+	}
+	printSummary(logOut, res)
+	if summaryJSON != "" {
+		if err := writeSummary(summaryJSON, res); err != nil {
+			logctx.WithError(err).Error("error writing the summary")
+		}
+	}
+	switch {
+	case err != nil:
+		logctx.WithError(err).Error("sync failed.")
+		return exitError
+	case res.Failed > 0 && res.Uploaded == 0:
+		logctx.Error("no file could be synced.")
+		return exitTotalFailure
+	case res.Failed > 0:
+		logctx.Warn("done syncing, some files could not be synced.")
+		return exitPartialFailure
+	}
 	logctx.Info("done syncing.")
+	return 0
 }
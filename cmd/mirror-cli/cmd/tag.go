@@ -0,0 +1,115 @@
+// Copyright © 2017 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/apex/log"
+	"github.com/marpio/mirror/metadata/repo"
+	"github.com/spf13/cobra"
+)
+
+var tagCmd = &cobra.Command{
+	Use:   "tag",
+	Short: "Manage the tags of the photos.",
+	Long: `Manage the tags of the photos. Tags are free-form words or phrases, a photo
+can have any number of them. Photos are given by their id or a unique prefix
+of it.`,
+}
+
+var tagAddCmd = &cobra.Command{
+	Use:   "add PHOTO TAG...",
+	Short: "Tag a photo.",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		runCatalog(func(r *repo.SegmentStore) error {
+			id, err := findPhoto(r, args[0])
+			if err != nil {
+				return err
+			}
+			for _, t := range args[1:] {
+				if err := r.Tag(id, t); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		log.Infof("tagged %s.", args[0])
+	},
+}
+
+var tagRemoveCmd = &cobra.Command{
+	Use:   "remove PHOTO TAG...",
+	Short: "Remove tags from a photo.",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		runCatalog(func(r *repo.SegmentStore) error {
+			id, err := findPhoto(r, args[0])
+			if err != nil {
+				return err
+			}
+			for _, t := range args[1:] {
+				if err := r.Untag(id, t); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		log.Infof("untagged %s.", args[0])
+	},
+}
+
+var tagListCmd = &cobra.Command{
+	Use:   "list [PHOTO]",
+	Short: "List all tags with the number of photos, or the tags of a photo.",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		r := loadCatalog()
+		if len(args) == 1 {
+			id, err := findPhoto(r, args[0])
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			for _, t := range r.Tags(id) {
+				fmt.Println(t)
+			}
+			return
+		}
+		counts := r.TagCounts()
+		tags := make([]string, 0, len(counts))
+		for t := range counts {
+			tags = append(tags, t)
+		}
+		sort.Strings(tags)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "TAG\tPHOTOS")
+		for _, t := range tags {
+			fmt.Fprintf(w, "%s\t%d\n", t, counts[t])
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	for _, c := range []*cobra.Command{tagAddCmd, tagRemoveCmd} {
+		addLockFlags(c)
+		tagCmd.AddCommand(c)
+	}
+	tagCmd.AddCommand(tagListCmd)
+}
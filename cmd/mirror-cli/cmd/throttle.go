@@ -0,0 +1,111 @@
+// Copyright © 2017 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/marpio/mirror/config"
+	"github.com/marpio/mirror/storage"
+	"github.com/marpio/mirror/syncronizer"
+	"github.com/spf13/cobra"
+)
+
+var (
+	limitUp      string
+	limitDown    string
+	limitWindows []string
+)
+
+func addThrottleFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&limitUp, "limit-up", "", "upload rate per second outside of the windows, e.g. 500K, or pause")
+	cmd.Flags().StringVar(&limitDown, "limit-down", "", "download rate per second, e.g. 2M")
+	cmd.Flags().StringArrayVar(&limitWindows, "window", nil, "time of day window with its own upload rate, e.g. 01:00-07:00 (unlimited) or 09:00-17:00=100K (repeatable)")
+}
+
+// parseRate parses a rate in bytes per second. Empty and "unlimited" mean no
+// limit, "pause" stops the uploads.
+func parseRate(s string) (int64, error) {
+	switch s {
+	case "", "unlimited":
+		return storage.Unlimited, nil
+	case "pause":
+		return storage.Paused, nil
+	}
+	r, err := config.ParseSize(s)
+	if err != nil {
+		return 0, err
+	}
+	if r == 0 {
+		return 0, fmt.Errorf("a rate of 0 is not allowed, use pause")
+	}
+	return r, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day (HH:MM)", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// parseWindow parses START-END[=RATE].
+func parseWindow(s string) (syncronizer.Window, error) {
+	var w syncronizer.Window
+	spec, rate := s, ""
+	if i := strings.Index(s, "="); i >= 0 {
+		spec, rate = s[:i], s[i+1:]
+	}
+	bounds := strings.Split(spec, "-")
+	if len(bounds) != 2 {
+		return w, fmt.Errorf("invalid window %q, expected START-END[=RATE]", s)
+	}
+	var err error
+	if w.Start, err = parseClock(bounds[0]); err != nil {
+		return w, err
+	}
+	if w.End, err = parseClock(bounds[1]); err != nil {
+		return w, err
+	}
+	if w.Rate, err = parseRate(rate); err != nil {
+		return w, err
+	}
+	return w, nil
+}
+
+// uploadSchedule returns the schedule for the upload rate and the limiter
+// for the downloads.
+func uploadSchedule() (syncronizer.Schedule, *storage.RateLimiter, error) {
+	var sched syncronizer.Schedule
+	var err error
+	if sched.DefaultRate, err = parseRate(limitUp); err != nil {
+		return sched, nil, fmt.Errorf("invalid upload limit: %v", err)
+	}
+	for _, s := range limitWindows {
+		w, err := parseWindow(s)
+		if err != nil {
+			return sched, nil, err
+		}
+		sched.Windows = append(sched.Windows, w)
+	}
+	down, err := parseRate(limitDown)
+	if err != nil || down < 0 {
+		return sched, nil, fmt.Errorf("invalid download limit %q", limitDown)
+	}
+	return sched, storage.NewRateLimiter(down), nil
+}
@@ -0,0 +1,194 @@
+// Copyright © 2017 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/text"
+	"github.com/marpio/mirror/lock"
+	"github.com/marpio/mirror/secret"
+	"github.com/marpio/mirror/storage"
+	"github.com/marpio/mirror/users"
+	"github.com/spf13/cobra"
+)
+
+var (
+	userRole     string
+	userPassword string
+)
+
+var userCmd = &cobra.Command{
+	Use:   "user",
+	Short: "Manage the users of mirror-web.",
+	Long: `Manage the users who can log in to mirror-web. The users are kept encrypted
+in the bucket, their passwords as bcrypt hashes. Admins can in addition reload
+the catalog and see the server's statistics, viewers can only look at the
+photos.
+
+mirror-web picks up the changes within a minute. Changing the password or
+removing a user ends their sessions.`,
+}
+
+var userAddCmd = &cobra.Command{
+	Use:   "add NAME",
+	Short: "Add a user.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runUser(func(st *users.Store) error {
+			pass, err := userPasswordSecret()
+			if err != nil {
+				return err
+			}
+			return st.Add(args[0], pass, userRole)
+		})
+		log.Infof("added %s as %s.", args[0], userRole)
+	},
+}
+
+var userPasswdCmd = &cobra.Command{
+	Use:   "passwd NAME",
+	Short: "Change the password of a user.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runUser(func(st *users.Store) error {
+			if _, ok := st.Get(args[0]); !ok {
+				return fmt.Errorf("no user %s", args[0])
+			}
+			pass, err := userPasswordSecret()
+			if err != nil {
+				return err
+			}
+			return st.SetPassword(args[0], pass)
+		})
+		log.Infof("changed the password of %s.", args[0])
+	},
+}
+
+var userRoleCmd = &cobra.Command{
+	Use:   "role NAME ROLE",
+	Short: "Change the role of a user, admin or viewer.",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		runUser(func(st *users.Store) error {
+			return st.SetRole(args[0], args[1])
+		})
+		log.Infof("%s is now %s.", args[0], args[1])
+	},
+}
+
+var userRemoveCmd = &cobra.Command{
+	Use:   "remove NAME",
+	Short: "Remove a user.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runUser(func(st *users.Store) error {
+			return st.Remove(args[0])
+		})
+		log.Infof("removed %s.", args[0])
+	},
+}
+
+var userListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the users.",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		log.SetHandler(text.New(os.Stderr))
+		ctx := context.Background()
+		st := loadUsers(ctx)
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tROLE\tCREATED")
+		for _, u := range st.List() {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", u.Name, u.Role, u.Created.Format("2006-01-02"))
+		}
+		w.Flush()
+	},
+}
+
+func init() {
+	userAddCmd.Flags().StringVar(&userRole, "role", users.RoleViewer, "admin or viewer")
+	for _, c := range []*cobra.Command{userAddCmd, userPasswdCmd} {
+		c.Flags().StringVar(&userPassword, "password", "prompt", "the password, a secret reference")
+	}
+	for _, c := range []*cobra.Command{userAddCmd, userPasswdCmd, userRoleCmd, userRemoveCmd} {
+		addLockFlags(c)
+	}
+	userCmd.AddCommand(userAddCmd)
+	userCmd.AddCommand(userPasswdCmd)
+	userCmd.AddCommand(userRoleCmd)
+	userCmd.AddCommand(userRemoveCmd)
+	userCmd.AddCommand(userListCmd)
+}
+
+func loadUsers(ctx context.Context) *users.Store {
+	cfg := loadConfig()
+	backend := newBackend(ctx, cfg)
+	rs := storage.NewRemote(backend, newCrypto(ctx, cfg, backend))
+	st, err := users.Load(ctx, rs)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return st
+}
+
+// runUser changes the users with f and saves them, holding the repository
+// lock so that concurrent changes are not lost.
+func runUser(f func(st *users.Store) error) {
+	log.SetHandler(text.New(os.Stderr))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logctx := log.WithFields(log.Fields{
+		"cmd": "mirror-cli",
+	})
+
+	cfg := loadConfig()
+	backend := newBackend(ctx, cfg)
+	rs := storage.NewRemote(backend, newCrypto(ctx, cfg, backend))
+	l := acquireLock(ctx, logctx, backend, lock.ObjectName, cancel)
+	st, err := users.Load(ctx, l.Guard(rs))
+	if err == nil {
+		err = f(st)
+	}
+	if err == nil {
+		err = st.Save(ctx)
+	}
+	releaseLock(logctx, l)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+// userPasswordSecret resolves --password, asking twice when prompting.
+func userPasswordSecret() (string, error) {
+	pass, err := secret.Resolve(userPassword, "password")
+	if err != nil {
+		return "", err
+	}
+	if userPassword == "prompt" {
+		again, err := secret.Resolve(userPassword, "repeat password")
+		if err != nil {
+			return "", err
+		}
+		if again != pass {
+			return "", fmt.Errorf("the passwords do not match")
+		}
+	}
+	return pass, nil
+}
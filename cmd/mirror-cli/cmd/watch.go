@@ -0,0 +1,153 @@
+// Copyright © 2017 NAME HERE <EMAIL ADDRESS>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/apex/log/handlers/text"
+	"github.com/marpio/mirror/crypto"
+	"github.com/marpio/mirror/lock"
+	"github.com/marpio/mirror/metadata"
+	"github.com/marpio/mirror/metadata/repo"
+	"github.com/marpio/mirror/storage"
+	"github.com/marpio/mirror/syncronizer"
+	"github.com/marpio/mirror/watcher"
+	"github.com/spf13/afero"
+	"github.com/spf13/cobra"
+)
+
+var (
+	watchQuietPeriod     time.Duration
+	watchPersistInterval time.Duration
+)
+
+var watchCmd = &cobra.Command{
+	Use:   "watch DIR",
+	Short: "Sync local directory with a remote and keep syncing new and changed files.",
+	Long: `Sync a local directory with a remote, then keep watching it and sync the
+files which are created or changed once they stopped changing for the quiet
+period. The catalog is saved periodically and when the watch is stopped with
+Ctrl-C. If too many changes happen at once to follow them, the whole directory
+is scanned again.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runWatch(cmd, args[0])
+	},
+}
+
+func init() {
+	watchCmd.Flags().DurationVar(&watchQuietPeriod, "quiet", 10*time.Second, "how long a file must stay unchanged before it is synced")
+	watchCmd.Flags().BoolVar(&rehash, "rehash", false, "ignore the cached hashes and hash every file again")
+	watchCmd.Flags().DurationVar(&watchPersistInterval, "persist", 5*time.Minute, "how often the catalog is saved")
+	addScanFlags(watchCmd)
+	addProgressFlags(watchCmd)
+	addThrottleFlags(watchCmd)
+	addLockFlags(watchCmd)
+}
+
+func runWatch(cmd *cobra.Command, dir string) {
+	observer, logOut := progressOutput()
+	log.SetHandler(text.New(logOut))
+	cfg := loadConfig()
+	settings, err := loadProfile(cmd, cfg)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	rules, err := scanRules()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	sched, downLimiter, err := uploadSchedule()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	logctx := log.WithFields(log.Fields{
+		"cmd":          "mirror-cli",
+		"watching_dir": dir,
+	})
+
+	rsBackend := newBackend(ctx, cfg)
+	rs := storage.NewRemote(rsBackend, newCrypto(ctx, cfg, rsBackend),
+		storage.WithResumeState(afero.NewOsFs(), uploadStateDir()))
+	device := deviceID(cfg)
+	l := acquireLock(ctx, logctx, rsBackend, lock.DeviceObject(device), cancel, lock.ObjectName)
+
+	repo, err := repo.NewSegmentStore(ctx, l.Guard(rs), rs, cfg.Repo, device)
+	if err != nil {
+		log.Fatalf("error creating metadata repository: %v", err)
+	}
+
+	// start watching before the initial sync, so nothing copied in the meantime gets lost
+	w, err := watcher.New(dir, watcher.WithQuietPeriod(watchQuietPeriod))
+	if err != nil {
+		log.Fatalf("error watching %s: %v", dir, err)
+	}
+	changes := w.Run(ctx, logctx)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sigs
+		logctx.Warnf("%v - finishing current uploads, saving and terminating...", s)
+		cancel()
+	}()
+
+	appFs := afero.NewOsFs()
+	hashCache := newHashCache(appFs)
+	localFilesRepo := storage.NewLocal(appFs, crypto.GenerateSha256,
+		storage.WithHashCache(hashCache),
+		storage.WithScanRules(rules),
+		storage.WithLogger(logctx))
+	// the catalog is written with rs, so it can be saved while uploads are paused
+	upLimiter := storage.NewRateLimiter(sched.DefaultRate)
+	throttled := storage.NewThrottled(rs, downLimiter, upLimiter)
+	syncronizer := syncronizer.New(throttled,
+		repo,
+		localFilesRepo,
+		metadata.NewExtractor(localFilesRepo),
+		syncronizer.WithPersistInterval(watchPersistInterval),
+		syncronizer.WithObserver(observer),
+		syncronizer.WithSchedule(sched, upLimiter),
+		syncronizer.WithMaxConcurrentUploads(settings.MaxConcurrentUploads),
+		syncronizer.WithTimeout(settings.Timeout),
+		syncronizer.WithFileExts(normalizeExts(settings.Exts)...))
+	res, err := syncronizer.Execute(ctx, logctx, dir)
+	if err := hashCache.Save(); err != nil {
+		logctx.WithError(err).Error("error saving the hash cache")
+	}
+	if err != nil {
+		logctx.WithError(err).Error("initial sync failed")
+	} else {
+		logctx.WithFields(summaryFields(res)).Info("initial sync done, watching for changes.")
+	}
+	err = syncronizer.Watch(ctx, logctx, changes)
+	if err := hashCache.Save(); err != nil {
+		logctx.WithError(err).Error("error saving the hash cache")
+	}
+	releaseLock(logctx, l)
+	if err != nil {
+		log.Fatalf("error saving the catalog: %v", err)
+	}
+	logctx.Info("done watching.")
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/gorilla/mux"
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/users"
+)
+
+// Album ids are 16 hex digits, which keeps /albums/photos free.
+const albumIDPattern = "{id:[0-9a-f]{16}}"
+
+// collections are the albums and tags, which admins can change in mirror-web.
+type collections interface {
+	mirror.CollectionRepo
+	Persist(ctx context.Context) error
+}
+
+type albumPages struct {
+	metadataStore mirror.MetadataRepoReader
+	collections   collections
+}
+
+// configureAlbums adds the pages of the albums and tags. Everybody can look
+// at them, only admins can change them.
+func configureAlbums(r *mux.Router, metadataStore mirror.MetadataRepoReader, c collections) {
+	p := &albumPages{metadataStore: metadataStore, collections: c}
+	r.HandleFunc("/albums", p.listHandler).Methods("GET")
+	r.HandleFunc("/albums", requireAdmin(p.createHandler)).Methods("POST")
+	r.HandleFunc("/albums/photos", requireAdmin(p.addPhotosHandler)).Methods("POST")
+	r.HandleFunc("/albums/"+albumIDPattern, p.albumHandler).Methods("GET")
+	r.HandleFunc("/albums/"+albumIDPattern, requireAdmin(p.editHandler)).Methods("POST")
+	r.HandleFunc("/albums/"+albumIDPattern+"/photos/{photo}", requireAdmin(p.photoHandler)).Methods("POST")
+	r.HandleFunc("/albums/"+albumIDPattern+"/delete", requireAdmin(p.deleteHandler)).Methods("POST")
+	r.HandleFunc("/tags", p.tagsHandler).Methods("GET")
+	r.HandleFunc("/tags", requireAdmin(p.tagHandler)).Methods("POST")
+	// tags are free-form and may contain slashes
+	r.HandleFunc("/tags/{tag:.+}", p.taggedHandler).Methods("GET")
+	r.HandleFunc("/tags/{tag:.+}", requireAdmin(p.untagHandler)).Methods("POST")
+}
+
+func albumURL(id string) string {
+	return "/albums/" + id
+}
+
+func tagURL(tag string) string {
+	return "/tags/" + url.PathEscape(tag)
+}
+
+func isAdmin(r *http.Request) bool {
+	u, _ := userFrom(r.Context())
+	return u.Role == users.RoleAdmin
+}
+
+// albumPhotos returns the photos of a in their order, each once.
+func albumPhotos(metadataStore mirror.MetadataRepoReader, a mirror.Album) []mirror.RemotePhoto {
+	byID := make(map[string]mirror.RemotePhoto)
+	for _, p := range metadataStore.GetAll() {
+		if cur, ok := byID[p.ID()]; !ok || p.Dir() < cur.Dir() {
+			byID[p.ID()] = p
+		}
+	}
+	res := make([]mirror.RemotePhoto, 0, len(a.Photos))
+	for _, id := range a.Photos {
+		if p, ok := byID[id]; ok {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// change applies f and writes the catalog, then sends the admin to next.
+func (p *albumPages) change(w http.ResponseWriter, r *http.Request, next string, f func() error) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := f(); err != nil {
+		status := http.StatusBadRequest
+		if err == mirror.ErrAlbumNotFound {
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if err := p.collections.Persist(r.Context()); err != nil {
+		log.WithError(err).Error("error saving the catalog")
+		http.Error(w, "error saving the catalog: "+err.Error(), 500)
+		return
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
+}
+
+func (p *albumPages) listHandler(w http.ResponseWriter, r *http.Request) {
+	list := make([]interface{}, 0)
+	for _, a := range p.collections.Albums() {
+		cover := ""
+		if id := a.CoverID(); id != "" {
+			cover = "/files/thumb_" + id
+		}
+		list = append(list, map[string]interface{}{
+			"URL":         albumURL(a.ID),
+			"Title":       a.Title,
+			"Description": a.Description,
+			"Count":       len(a.Photos),
+			"Cover":       cover,
+		})
+	}
+	renderTemplate(w, http.StatusOK, "albums", map[string]interface{}{
+		"albums": list,
+		"admin":  isAdmin(r),
+	})
+}
+
+func (p *albumPages) createHandler(w http.ResponseWriter, r *http.Request) {
+	p.change(w, r, "/albums", func() error {
+		_, err := p.collections.CreateAlbum(r.PostFormValue("title"), r.PostFormValue("description"))
+		return err
+	})
+}
+
+func (p *albumPages) albumHandler(w http.ResponseWriter, r *http.Request) {
+	a, err := p.collections.GetAlbum(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	photos := albumPhotos(p.metadataStore, a)
+	cover := a.CoverID()
+	imgs := make([]interface{}, 0, len(photos))
+	for i, ph := range photos {
+		imgs = append(imgs, map[string]interface{}{
+			"ID":      ph.ID(),
+			"ThumbID": ph.ThumbID(),
+			"URL":     photoURL(ph.ID(), url.Values{"album": {a.ID}}),
+			"Cover":   ph.ID() == cover,
+			"First":   i == 0,
+			"Last":    i == len(photos)-1,
+		})
+	}
+	renderTemplate(w, http.StatusOK, "album", map[string]interface{}{
+		"URL":         albumURL(a.ID),
+		"zip":         "/zip?album=" + url.QueryEscape(a.ID),
+		"title":       a.Title,
+		"description": a.Description,
+		"imgs":        imgs,
+		"admin":       isAdmin(r),
+	})
+}
+
+func (p *albumPages) editHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	p.change(w, r, albumURL(id), func() error {
+		a, err := p.collections.GetAlbum(id)
+		if err != nil {
+			return err
+		}
+		a.Title = r.PostFormValue("title")
+		a.Description = r.PostFormValue("description")
+		return p.collections.UpdateAlbum(a)
+	})
+}
+
+// addPhotosHandler adds the photos selected on a directory or tag page to
+// the end of an album.
+func (p *albumPages) addPhotosHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PostFormValue("album")
+	p.change(w, r, albumURL(id), func() error {
+		a, err := p.collections.GetAlbum(id)
+		if err != nil {
+			return err
+		}
+		for _, ph := range r.PostForm["photo"] {
+			if !a.Contains(ph) {
+				a.Photos = append(a.Photos, ph)
+			}
+		}
+		return p.collections.UpdateAlbum(a)
+	})
+}
+
+// photoHandler moves a photo of an album up or down, makes it the cover or
+// removes it from the album, as given by action.
+func (p *albumPages) photoHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, photo := vars["id"], vars["photo"]
+	p.change(w, r, albumURL(id), func() error {
+		a, err := p.collections.GetAlbum(id)
+		if err != nil {
+			return err
+		}
+		i := -1
+		for j, ph := range a.Photos {
+			if ph == photo {
+				i = j
+			}
+		}
+		if i < 0 {
+			return fmt.Errorf("%s is not in the album", photo)
+		}
+		switch r.PostFormValue("action") {
+		case "up":
+			if i > 0 {
+				a.Photos[i-1], a.Photos[i] = a.Photos[i], a.Photos[i-1]
+			}
+		case "down":
+			if i < len(a.Photos)-1 {
+				a.Photos[i+1], a.Photos[i] = a.Photos[i], a.Photos[i+1]
+			}
+		case "cover":
+			a.Cover = photo
+		case "remove":
+			a.Photos = append(a.Photos[:i], a.Photos[i+1:]...)
+			if a.Cover == photo {
+				a.Cover = ""
+			}
+		default:
+			return fmt.Errorf("unknown action %q", r.PostFormValue("action"))
+		}
+		return p.collections.UpdateAlbum(a)
+	})
+}
+
+func (p *albumPages) deleteHandler(w http.ResponseWriter, r *http.Request) {
+	p.change(w, r, "/albums", func() error {
+		return p.collections.DeleteAlbum(mux.Vars(r)["id"])
+	})
+}
+
+func (p *albumPages) tagsHandler(w http.ResponseWriter, r *http.Request) {
+	counts := p.collections.TagCounts()
+	tags := make([]string, 0, len(counts))
+	for t := range counts {
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	list := make([]interface{}, 0, len(tags))
+	for _, t := range tags {
+		list = append(list, map[string]interface{}{"Name": t, "Count": counts[t], "URL": tagURL(t)})
+	}
+	renderTemplate(w, http.StatusOK, "tags", map[string]interface{}{"tags": list})
+}
+
+func (p *albumPages) taggedHandler(w http.ResponseWriter, r *http.Request) {
+	tag := mux.Vars(r)["tag"]
+	photos, err := findPhotos(p.metadataStore, "", "", tag)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	renderPhotos(w, r, p.metadataStore, photos, "Tagged "+tag, url.Values{"tag": {tag}})
+}
+
+// tagHandler tags the photos selected on a directory or tag page.
+func (p *albumPages) tagHandler(w http.ResponseWriter, r *http.Request) {
+	p.change(w, r, safeNext(r.PostFormValue("next")), func() error {
+		for _, ph := range r.PostForm["photo"] {
+			if err := p.collections.Tag(ph, r.PostFormValue("tag")); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p *albumPages) untagHandler(w http.ResponseWriter, r *http.Request) {
+	tag := mux.Vars(r)["tag"]
+	p.change(w, r, tagURL(tag), func() error {
+		for _, ph := range r.PostForm["photo"] {
+			if err := p.collections.Untag(ph, tag); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// renderPhotos renders the thumbnails of a directory or tag in the order
+// they were taken, query selects them for the zip and the photo pages.
+// Admins can select photos to tag them or add them to an album.
+func renderPhotos(w http.ResponseWriter, r *http.Request, metadataStore mirror.MetadataRepoReader, photos []mirror.RemotePhoto, title string, query url.Values) {
+	imgs := make([]interface{}, 0, len(photos))
+	for _, p := range byTaken(photos) {
+		imgs = append(imgs, map[string]string{"ID": p.ID(), "ThumbID": p.ThumbID(), "URL": photoURL(p.ID(), query)})
+	}
+	ctx := map[string]interface{}{
+		"title": title,
+		"self":  r.URL.EscapedPath(),
+		"zip":   "/zip?" + query.Encode(),
+		"imgs":  imgs,
+		"admin": isAdmin(r),
+	}
+	if c, ok := metadataStore.(mirror.CollectionRepoReader); ok {
+		albums := make([]interface{}, 0)
+		for _, a := range c.Albums() {
+			albums = append(albums, map[string]string{"ID": a.ID, "Title": a.Title})
+		}
+		ctx["albums"] = albums
+		if v := mux.Vars(r)["tag"]; v != "" {
+			ctx["untag"] = tagURL(v)
+		}
+	}
+	renderTemplate(w, http.StatusOK, "dir", ctx)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/marpio/mirror/metadata/repo"
+	"github.com/marpio/mirror/storage"
+	"github.com/marpio/mirror/users"
+)
+
+func newTestAlbums(t *testing.T) (*storage.RemoteStorage, *repo.SegmentStore, http.Handler) {
+	ctx := context.Background()
+	rs := testStorage(t, nil)
+	st, err := repo.NewSegmentStore(ctx, rs, rs, "catalog", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Add(photo{photoID, "/2017"})
+	st.Add(photo{otherID, "/2018"})
+	router := configureRouter(ctx, st, rs, "catalog")
+	configureAlbums(router, st, st)
+	return rs, st, router
+}
+
+func postAs(h http.Handler, role, path string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	asUser(h, role).ServeHTTP(rec, req)
+	return rec
+}
+
+func getAs(h http.Handler, role, path string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	asUser(h, role).ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	return rec
+}
+
+func TestAlbums(t *testing.T) {
+	rs, st, h := newTestAlbums(t)
+	if rec := postAs(h, users.RoleViewer, "/albums", url.Values{"title": {"Summer"}}); rec.Code != http.StatusForbidden {
+		t.Errorf("expected viewers not to create albums, got %d", rec.Code)
+	}
+	if rec := postAs(h, users.RoleAdmin, "/albums", url.Values{"title": {"Summer"}}); rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected the album to be created, got %d: %s", rec.Code, rec.Body)
+	}
+	albums := st.Albums()
+	if len(albums) != 1 {
+		t.Fatalf("expected an album, got %+v", albums)
+	}
+	link := albumURL(albums[0].ID)
+
+	rec := postAs(h, users.RoleAdmin, "/albums/photos", url.Values{"album": {albums[0].ID}, "photo": {photoID, otherID}})
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != link {
+		t.Fatalf("expected the photos to be added, got %d %s", rec.Code, rec.Body)
+	}
+	postAs(h, users.RoleAdmin, link+"/photos/"+otherID, url.Values{"action": {"up"}})
+	postAs(h, users.RoleAdmin, link+"/photos/"+otherID, url.Values{"action": {"cover"}})
+	if rec := postAs(h, users.RoleAdmin, link+"/photos/"+otherID, url.Values{"action": {"rotate"}}); rec.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown action to be refused, got %d", rec.Code)
+	}
+
+	rec = getAs(h, users.RoleViewer, link)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), "thumb_"+photoID) || strings.Contains(rec.Body.String(), "Delete the album") {
+		t.Errorf("expected the album without the admin forms, got %d", rec.Code)
+	}
+	rec = getAs(h, users.RoleViewer, apiPrefix+"/albums/"+albums[0].ID)
+	var res apiAlbumDetails
+	json.NewDecoder(rec.Body).Decode(&res)
+	if len(res.Photos) != 2 || res.Photos[0].ID != otherID || res.Cover != "/files/thumb_"+otherID {
+		t.Errorf("expected the moved photo first and as cover, got %+v", res)
+	}
+
+	// the changes are in the catalog segment of mirror-web
+	other, err := repo.NewSegmentStore(context.Background(), rs, rs, "catalog", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, err := other.GetAlbum(albums[0].ID); err != nil || !reflect.DeepEqual(a.Photos, []string{otherID, photoID}) {
+		t.Errorf("expected the album to be saved, got %+v, %v", a, err)
+	}
+
+	if rec := postAs(h, users.RoleAdmin, link+"/delete", nil); rec.Code != http.StatusSeeOther || len(st.Albums()) != 0 {
+		t.Errorf("expected the album to be deleted, got %d", rec.Code)
+	}
+	if rec := getAs(h, users.RoleViewer, link); rec.Code != http.StatusNotFound {
+		t.Errorf("expected the deleted album to be gone, got %d", rec.Code)
+	}
+}
+
+func TestTags(t *testing.T) {
+	_, st, h := newTestAlbums(t)
+	rec := postAs(h, users.RoleAdmin, "/tags", url.Values{"tag": {"at the beach"}, "photo": {photoID}, "next": {"/dirs/2017"}})
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/dirs/2017" {
+		t.Fatalf("expected the photo to be tagged, got %d %s", rec.Code, rec.Body)
+	}
+	if got := st.Tags(photoID); !reflect.DeepEqual(got, []string{"at the beach"}) {
+		t.Errorf("unexpected tags %v", got)
+	}
+	link := tagURL("at the beach")
+	if rec := getAs(h, users.RoleViewer, "/tags"); !strings.Contains(rec.Body.String(), link) {
+		t.Errorf("expected the tag to be listed, got %s", rec.Body)
+	}
+	rec = getAs(h, users.RoleViewer, link)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), "thumb_"+photoID) || strings.Contains(rec.Body.String(), otherID) {
+		t.Errorf("expected only the tagged photo, got %d", rec.Code)
+	}
+	if rec := postAs(h, users.RoleAdmin, link, url.Values{"photo": {photoID}}); rec.Code != http.StatusSeeOther || len(st.Tags(photoID)) != 0 {
+		t.Errorf("expected the tag to be removed, got %d", rec.Code)
+	}
+}
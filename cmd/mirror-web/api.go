@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/cache"
+)
+
+// The JSON API, versioned by its path prefix. Directories are passed as query
+// parameters, since they contain slashes.
+const apiPrefix = "/api/v1"
+
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// tagReader is implemented by catalogs which know the tags of the photos.
+type tagReader interface {
+	Tags(id string) []string
+}
+
+type apiDir struct {
+	Name   string `json:"name"`
+	Count  int    `json:"count"`
+	Photos string `json:"photos"`
+}
+
+type apiURLs struct {
+	Thumbnail string `json:"thumbnail"`
+	Preview   string `json:"preview"`
+	Original  string `json:"original"`
+}
+
+// Taken is when the photo was taken as the camera showed it, like
+// 2017-08-25T17:03:30 without an offset since cameras do not record their
+// time zone, and Day the date of it. Both are left out if it is not known.
+type apiPhoto struct {
+	ID    string   `json:"id"`
+	Dir   string   `json:"dir"`
+	Taken string   `json:"taken,omitempty"`
+	Day   string   `json:"day,omitempty"`
+	Tags  []string `json:"tags"`
+	URLs  apiURLs  `json:"urls"`
+	Self  string   `json:"self"`
+}
+
+type apiPhotoDetails struct {
+	ID    string   `json:"id"`
+	Dirs  []string `json:"dirs"`
+	Taken string   `json:"taken,omitempty"`
+	Tags  []string `json:"tags"`
+	URLs  apiURLs  `json:"urls"`
+}
+
+type apiPage struct {
+	Photos []apiPhoto `json:"photos"`
+	Total  int        `json:"total"`
+	Offset int        `json:"offset"`
+	Limit  int        `json:"limit"`
+	Next   string     `json:"next,omitempty"`
+}
+
+type apiAlbum struct {
+	ID          string `json:"id"`
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	Cover       string `json:"cover,omitempty"`
+	Count       int    `json:"count"`
+	Self        string `json:"self"`
+}
+
+type apiAlbumDetails struct {
+	apiAlbum
+	Photos []apiPhoto `json:"photos"`
+}
+
+type apiTag struct {
+	Name   string `json:"name"`
+	Count  int    `json:"count"`
+	Photos string `json:"photos"`
+}
+
+// cacheStatser is implemented by the storages which cache the files.
+type cacheStatser interface {
+	Stats() cache.Stats
+}
+
+func configureAPI(ctx context.Context, r *mux.Router, metadataStore mirror.MetadataRepoReader, tl *timeline, remotestorage mirror.StorageReader) {
+	api := r.PathPrefix(apiPrefix).Subrouter()
+	api.HandleFunc("/dirs", apiDirsHandler(metadataStore)).Methods("GET")
+	api.HandleFunc("/photos", apiPhotosHandler(metadataStore, false)).Methods("GET")
+	api.HandleFunc("/photos/{id}", apiPhotoHandler(metadataStore)).Methods("GET")
+	api.HandleFunc("/search", apiPhotosHandler(metadataStore, true)).Methods("GET")
+	api.HandleFunc("/albums", apiAlbumsHandler(metadataStore)).Methods("GET")
+	api.HandleFunc("/albums/{id}", apiAlbumHandler(metadataStore)).Methods("GET")
+	api.HandleFunc("/tags", apiTagsHandler(metadataStore)).Methods("GET")
+	api.HandleFunc("/timeline", apiTimelineHandler(metadataStore, tl)).Methods("GET")
+	api.HandleFunc("/timeline/months", apiMonthsHandler(tl)).Methods("GET")
+	api.HandleFunc("/reload", requireAdmin(apiReloadHandler(ctx, metadataStore, tl))).Methods("POST")
+	api.HandleFunc("/stats", requireAdmin(apiStatsHandler(metadataStore, remotestorage))).Methods("GET")
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "not found")
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func photoURLs(p mirror.RemotePhoto) apiURLs {
+	return apiURLs{
+		Thumbnail: "/files/" + url.PathEscape(p.ThumbID()),
+		Preview:   "/files/" + url.PathEscape(previewID(p.ID())),
+		Original:  "/files/" + url.PathEscape(p.ID()),
+	}
+}
+
+func photoTags(s mirror.MetadataRepoReader, id string) []string {
+	if t, ok := s.(tagReader); ok {
+		return t.Tags(id)
+	}
+	return []string{}
+}
+
+func apiDirsHandler(metadataStore mirror.MetadataRepoReader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dirs, err := metadataStore.GetDirs()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		res := make([]apiDir, 0, len(dirs))
+		for _, d := range dirs {
+			photos, err := metadataStore.GetByDir(d)
+			if err != nil {
+				writeError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			res = append(res, apiDir{
+				Name:   d,
+				Count:  len(photos),
+				Photos: apiPrefix + "/photos?dir=" + url.QueryEscape(d),
+			})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"dirs": res})
+	}
+}
+
+// apiPhotosHandler lists the photos matching the query parameters:
+//
+//	dir     photos in this directory
+//	q       photos whose directory contains q or whose id starts with q
+//	tag     photos with this tag
+//	offset  the first photo, 0 by default
+//	limit   the number of photos, 100 by default
+//
+// A search needs q or tag.
+func apiPhotosHandler(metadataStore mirror.MetadataRepoReader, search bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		dir, q, tag := query.Get("dir"), query.Get("q"), query.Get("tag")
+		if search && q == "" && tag == "" {
+			writeError(w, http.StatusBadRequest, "q or tag is required")
+			return
+		}
+		offset, err := intParam(query, "offset", 0)
+		if err != nil || offset < 0 {
+			writeError(w, http.StatusBadRequest, "offset must be a non-negative number")
+			return
+		}
+		limit, err := intParam(query, "limit", defaultPageSize)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxPageSize))
+			return
+		}
+
+		photos, err := findPhotos(metadataStore, dir, q, tag)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		matching := make([]apiPhoto, 0, len(photos))
+		for _, p := range photos {
+			matching = append(matching, newAPIPhoto(metadataStore, p))
+		}
+
+		page := apiPage{Photos: []apiPhoto{}, Total: len(matching), Offset: offset, Limit: limit}
+		if offset < len(matching) {
+			end := offset + limit
+			if end > len(matching) {
+				end = len(matching)
+			}
+			page.Photos = matching[offset:end]
+			if end < len(matching) {
+				next := r.URL.Query()
+				next.Set("offset", strconv.Itoa(end))
+				next.Set("limit", strconv.Itoa(limit))
+				page.Next = r.URL.Path + "?" + next.Encode()
+			}
+		}
+		writeJSON(w, http.StatusOK, page)
+	}
+}
+
+// findPhotos returns the photos in dir, or all if dir is empty, whose
+// directory contains q or whose id starts with q and which have tag. They are
+// sorted by directory and id.
+func findPhotos(metadataStore mirror.MetadataRepoReader, dir, q, tag string) ([]mirror.RemotePhoto, error) {
+	var photos []mirror.RemotePhoto
+	if dir != "" {
+		var err error
+		if photos, err = metadataStore.GetByDir(dir); err != nil {
+			return nil, err
+		}
+	} else {
+		photos = metadataStore.GetAll()
+	}
+	q = strings.ToLower(q)
+	matching := make([]mirror.RemotePhoto, 0)
+	for _, p := range photos {
+		if q != "" && !strings.Contains(strings.ToLower(p.Dir()), q) && !strings.HasPrefix(p.ID(), q) {
+			continue
+		}
+		if tag != "" && !containsString(photoTags(metadataStore, p.ID()), tag) {
+			continue
+		}
+		matching = append(matching, p)
+	}
+	sort.Slice(matching, func(i, j int) bool {
+		if matching[i].Dir() != matching[j].Dir() {
+			return matching[i].Dir() < matching[j].Dir()
+		}
+		return matching[i].ID() < matching[j].ID()
+	})
+	return matching, nil
+}
+
+func apiPhotoHandler(metadataStore mirror.MetadataRepoReader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		var found mirror.RemotePhoto
+		dirs := make([]string, 0)
+		for _, p := range metadataStore.GetAll() {
+			if p.ID() == id {
+				found = p
+				dirs = append(dirs, p.Dir())
+			}
+		}
+		if found == nil {
+			writeError(w, http.StatusNotFound, "photo not found")
+			return
+		}
+		sort.Strings(dirs)
+		taken, _ := formatTaken(found)
+		writeJSON(w, http.StatusOK, apiPhotoDetails{
+			ID:    id,
+			Dirs:  dirs,
+			Taken: taken,
+			Tags:  photoTags(metadataStore, id),
+			URLs:  photoURLs(found),
+		})
+	}
+}
+
+func newAPIAlbum(a mirror.Album) apiAlbum {
+	res := apiAlbum{
+		ID:          a.ID,
+		Title:       a.Title,
+		Description: a.Description,
+		Count:       len(a.Photos),
+		Self:        apiPrefix + "/albums/" + url.PathEscape(a.ID),
+	}
+	if id := a.CoverID(); id != "" {
+		res.Cover = "/files/thumb_" + url.PathEscape(id)
+	}
+	return res
+}
+
+func newAPIPhoto(metadataStore mirror.MetadataRepoReader, p mirror.RemotePhoto) apiPhoto {
+	taken, day := formatTaken(p)
+	return apiPhoto{
+		ID:    p.ID(),
+		Dir:   p.Dir(),
+		Taken: taken,
+		Day:   day,
+		Tags:  photoTags(metadataStore, p.ID()),
+		URLs:  photoURLs(p),
+		Self:  apiPrefix + "/photos/" + url.PathEscape(p.ID()),
+	}
+}
+
+// formatTaken returns the time and the day p was taken, as the camera showed
+// them, or empty strings if that is not known.
+func formatTaken(p mirror.RemotePhoto) (string, string) {
+	t := takenAt(p)
+	if t.IsZero() {
+		return "", ""
+	}
+	return t.Format("2006-01-02T15:04:05"), t.Format(dayLayout)
+}
+
+// apiAlbumsHandler lists the albums sorted by title.
+func apiAlbumsHandler(metadataStore mirror.MetadataRepoReader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := make([]apiAlbum, 0)
+		if c, ok := metadataStore.(mirror.CollectionRepoReader); ok {
+			for _, a := range c.Albums() {
+				res = append(res, newAPIAlbum(a))
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"albums": res})
+	}
+}
+
+// apiAlbumHandler returns an album with its photos in their order.
+func apiAlbumHandler(metadataStore mirror.MetadataRepoReader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := metadataStore.(mirror.CollectionRepoReader)
+		if !ok {
+			writeError(w, http.StatusNotFound, "album not found")
+			return
+		}
+		a, err := c.GetAlbum(mux.Vars(r)["id"])
+		if err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		res := apiAlbumDetails{apiAlbum: newAPIAlbum(a), Photos: []apiPhoto{}}
+		for _, p := range albumPhotos(metadataStore, a) {
+			res.Photos = append(res.Photos, newAPIPhoto(metadataStore, p))
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+// apiTagsHandler lists the tags with the number of photos having them.
+func apiTagsHandler(metadataStore mirror.MetadataRepoReader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := make([]apiTag, 0)
+		if c, ok := metadataStore.(mirror.CollectionRepoReader); ok {
+			for t, n := range c.TagCounts() {
+				res = append(res, apiTag{Name: t, Count: n, Photos: apiPrefix + "/photos?tag=" + url.QueryEscape(t)})
+			}
+		}
+		sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+		writeJSON(w, http.StatusOK, map[string]interface{}{"tags": res})
+	}
+}
+
+func apiReloadHandler(ctx context.Context, metadataStore mirror.MetadataRepoReader, tl *timeline) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := tl.Reload(ctx); err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"photos": len(metadataStore.GetAll())})
+	}
+}
+
+// apiStatsHandler reports the size of the catalog and the hits and misses of
+// the thumbnail cache.
+func apiStatsHandler(metadataStore mirror.MetadataRepoReader, remotestorage mirror.StorageReader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		res := map[string]interface{}{"photos": len(metadataStore.GetAll())}
+		if c, ok := remotestorage.(cacheStatser); ok {
+			res["cache"] = c.Stats()
+		}
+		writeJSON(w, http.StatusOK, res)
+	}
+}
+
+func intParam(query url.Values, name string, def int) (int, error) {
+	v := query.Get(name)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
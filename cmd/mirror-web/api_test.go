@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/users"
+)
+
+type photo struct{ id, dir string }
+
+func (p photo) ID() string      { return p.id }
+func (p photo) ThumbID() string { return "thumb_" + p.id }
+func (p photo) Dir() string     { return p.dir }
+
+type fakeCatalog struct {
+	photos  []photo
+	tags    map[string][]string
+	reloads int
+}
+
+func (c *fakeCatalog) GetAll() []mirror.RemotePhoto {
+	res := make([]mirror.RemotePhoto, 0, len(c.photos))
+	for _, p := range c.photos {
+		res = append(res, p)
+	}
+	return res
+}
+
+func (c *fakeCatalog) Exists(id string) (bool, error) {
+	for _, p := range c.photos {
+		if p.id == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (c *fakeCatalog) GetByDir(dir string) ([]mirror.RemotePhoto, error) {
+	res := make([]mirror.RemotePhoto, 0)
+	for _, p := range c.photos {
+		if p.dir == dir {
+			res = append(res, p)
+		}
+	}
+	return res, nil
+}
+
+func (c *fakeCatalog) GetByDirAndId(dir, id string) (mirror.RemotePhoto, error) {
+	for _, p := range c.photos {
+		if p.dir == dir && p.id == id {
+			return p, nil
+		}
+	}
+	return nil, nil
+}
+
+func (c *fakeCatalog) GetDirs() ([]string, error) {
+	return []string{"/photos/2018", "/photos/2017"}, nil
+}
+
+func (c *fakeCatalog) Reload(ctx context.Context) error {
+	c.reloads++
+	return nil
+}
+
+func (c *fakeCatalog) Tags(id string) []string {
+	if t, ok := c.tags[id]; ok {
+		return t
+	}
+	return []string{}
+}
+
+func newTestAPI() (*fakeCatalog, http.Handler) {
+	c := &fakeCatalog{
+		photos: []photo{{"c3", "/photos/2018"}, {"a1", "/photos/2017"}, {"b2", "/photos/2017"}, {"a1", "/photos/2018"}},
+		tags:   map[string][]string{"b2": {"beach"}},
+	}
+	return c, asUser(configureRouter(context.Background(), c, nil, "catalog"), users.RoleAdmin)
+}
+
+func get(t *testing.T, h http.Handler, method, url string, status int, v interface{}) {
+	req := httptest.NewRequest(method, url, nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != status {
+		t.Fatalf("%s %s: expected status %d, got %d: %s", method, url, status, rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json; charset=utf-8" {
+		t.Errorf("%s %s: unexpected content type %q", method, url, ct)
+	}
+	if v != nil {
+		reflect.ValueOf(v).Elem().Set(reflect.Zero(reflect.TypeOf(v).Elem()))
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAPIDirs(t *testing.T) {
+	_, h := newTestAPI()
+	var res struct{ Dirs []apiDir }
+	get(t, h, "GET", "/api/v1/dirs", 200, &res)
+	want := []apiDir{
+		{Name: "/photos/2018", Count: 2, Photos: "/api/v1/photos?dir=%2Fphotos%2F2018"},
+		{Name: "/photos/2017", Count: 2, Photos: "/api/v1/photos?dir=%2Fphotos%2F2017"},
+	}
+	if !reflect.DeepEqual(res.Dirs, want) {
+		t.Errorf("expected %v, got %v", want, res.Dirs)
+	}
+}
+
+func TestAPIPhotosPagination(t *testing.T) {
+	_, h := newTestAPI()
+	var page apiPage
+	get(t, h, "GET", "/api/v1/photos?limit=3", 200, &page)
+	if page.Total != 4 || len(page.Photos) != 3 || page.Next == "" {
+		t.Fatalf("unexpected first page: %+v", page)
+	}
+	if p := page.Photos[0]; p.ID != "a1" || p.Dir != "/photos/2017" || p.URLs.Thumbnail != "/files/thumb_a1" || p.Self != "/api/v1/photos/a1" {
+		t.Errorf("unexpected first photo: %+v", p)
+	}
+	get(t, h, "GET", page.Next, 200, &page)
+	if len(page.Photos) != 1 || page.Photos[0].ID != "c3" || page.Next != "" {
+		t.Errorf("unexpected last page: %+v", page)
+	}
+	get(t, h, "GET", "/api/v1/photos?dir=/photos/2017", 200, &page)
+	if page.Total != 2 {
+		t.Errorf("expected 2 photos in the directory, got %+v", page)
+	}
+	get(t, h, "GET", "/api/v1/photos?limit=0", 400, nil)
+	get(t, h, "GET", "/api/v1/photos?offset=x", 400, nil)
+}
+
+func TestAPISearch(t *testing.T) {
+	_, h := newTestAPI()
+	var page apiPage
+	get(t, h, "GET", "/api/v1/search?tag=beach", 200, &page)
+	if page.Total != 1 || page.Photos[0].ID != "b2" || !reflect.DeepEqual(page.Photos[0].Tags, []string{"beach"}) {
+		t.Errorf("unexpected tag search result: %+v", page)
+	}
+	get(t, h, "GET", "/api/v1/search?q=2018", 200, &page)
+	if page.Total != 2 {
+		t.Errorf("expected the photos of 2018, got %+v", page)
+	}
+	get(t, h, "GET", "/api/v1/search?q=a", 200, &page)
+	if page.Total != 2 || page.Photos[0].ID != "a1" {
+		t.Errorf("expected the photos with id a..., got %+v", page)
+	}
+	get(t, h, "GET", "/api/v1/search", 400, nil)
+}
+
+func TestAPIPhotoAndReload(t *testing.T) {
+	c, h := newTestAPI()
+	var p apiPhotoDetails
+	get(t, h, "GET", "/api/v1/photos/a1", 200, &p)
+	if !reflect.DeepEqual(p.Dirs, []string{"/photos/2017", "/photos/2018"}) || p.URLs.Original != "/files/a1" {
+		t.Errorf("unexpected photo: %+v", p)
+	}
+	get(t, h, "GET", "/api/v1/photos/zz", 404, nil)
+	get(t, h, "GET", "/api/v1/nothing", 404, nil)
+	get(t, h, "POST", "/api/v1/reload", 200, nil)
+	if c.reloads != 1 {
+		t.Errorf("expected a reload, got %d", c.reloads)
+	}
+}
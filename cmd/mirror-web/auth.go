@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marpio/mirror/users"
+)
+
+const (
+	sessionCookie = "mirror_session"
+	sessionTTL    = 30 * 24 * time.Hour
+)
+
+type ctxKey int
+
+const userKey ctxKey = 0
+
+// accounts are the users who can log in.
+type accounts interface {
+	Authenticate(name, password string) (users.User, bool)
+	Get(name string) (users.User, bool)
+}
+
+// withLegacyUser lets the single username and password of the config log in
+// as admin, as long as there are no users in the bucket.
+type withLegacyUser struct {
+	*users.Store
+	name, password string
+}
+
+func (a withLegacyUser) legacy() bool {
+	return a.name != "" && a.Store.Len() == 0
+}
+
+func (a withLegacyUser) Authenticate(name, password string) (users.User, bool) {
+	if !a.legacy() {
+		return a.Store.Authenticate(name, password)
+	}
+	ok := subtle.ConstantTimeCompare([]byte(name), []byte(a.name)) == 1
+	ok = subtle.ConstantTimeCompare([]byte(password), []byte(a.password)) == 1 && ok
+	if !ok {
+		return users.User{}, false
+	}
+	return a.Get(name)
+}
+
+func (a withLegacyUser) Get(name string) (users.User, bool) {
+	if !a.legacy() {
+		return a.Store.Get(name)
+	}
+	if name != a.name {
+		return users.User{}, false
+	}
+	return users.User{Name: a.name, Role: users.RoleAdmin}, true
+}
+
+// deriveSecret derives a signing key for label from the repository key, so
+// that sessions and share links survive restarts.
+func deriveSecret(key, label string) []byte {
+	b, _ := hex.DecodeString(key)
+	m := hmac.New(sha256.New, b)
+	m.Write([]byte(label))
+	return m.Sum(nil)
+}
+
+func sessionSecret(key string) []byte {
+	return deriveSecret(key, "mirror-web sessions")
+}
+
+// auth lets in the requests with a session cookie or basic auth credentials,
+// others are sent to the login page. The API answers 401 instead.
+type auth struct {
+	accounts accounts
+	secret   []byte
+	throttle *throttle
+	now      func() time.Time
+}
+
+func newAuth(a accounts, secret []byte) *auth {
+	return &auth{accounts: a, secret: secret, throttle: newThrottle(), now: time.Now}
+}
+
+func userFrom(ctx context.Context) (users.User, bool) {
+	u, ok := ctx.Value(userKey).(users.User)
+	return u, ok
+}
+
+func withUser(r *http.Request, u users.User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userKey, u))
+}
+
+func (a *auth) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/login":
+			a.loginHandler(w, r)
+			return
+		case r.URL.Path == "/logout":
+			a.logoutHandler(w, r)
+			return
+		case strings.HasPrefix(r.URL.Path, "/public/"), strings.HasPrefix(r.URL.Path, sharePrefix):
+			next.ServeHTTP(w, r)
+			return
+		}
+		if u, ok := a.sessionUser(r); ok {
+			next.ServeHTTP(w, withUser(r, u))
+			return
+		}
+		if name, password, ok := r.BasicAuth(); ok {
+			if u, status, msg := a.login(r, name, password); status == http.StatusOK {
+				next.ServeHTTP(w, withUser(r, u))
+				return
+			} else if strings.HasPrefix(r.URL.Path, apiPrefix) {
+				writeError(w, status, msg)
+				return
+			}
+		}
+		if strings.HasPrefix(r.URL.Path, apiPrefix) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mirror"`)
+			writeError(w, http.StatusUnauthorized, "not logged in")
+			return
+		}
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+	})
+}
+
+// login checks the credentials, throttled by client address and user name.
+func (a *auth) login(r *http.Request, name, password string) (users.User, int, string) {
+	keys := []string{"addr:" + clientAddr(r), "user:" + name}
+	if d := a.throttle.wait(keys...); d > 0 {
+		return users.User{}, http.StatusTooManyRequests, fmt.Sprintf("too many failed logins, try again in %s", d.Round(time.Second))
+	}
+	u, ok := a.accounts.Authenticate(name, password)
+	if !ok {
+		a.throttle.fail(keys...)
+		return users.User{}, http.StatusUnauthorized, "wrong user name or password"
+	}
+	a.throttle.reset(keys...)
+	return u, http.StatusOK, ""
+}
+
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func (a *auth) sign(v string) string {
+	m := hmac.New(sha256.New, a.secret)
+	m.Write([]byte(v))
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// The session cookie is the user name, the nonce of the account, the
+// generation of its password and the expiry, signed. Changing the password or
+// removing the user ends it, also if a user of the same name is added again.
+func (a *auth) sessionValue(u users.User, expires time.Time) string {
+	v := base64.RawURLEncoding.EncodeToString([]byte(u.Name)) + "." + u.Nonce + "." + strconv.Itoa(u.Generation) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return v + "." + a.sign(v)
+}
+
+func (a *auth) sessionUser(r *http.Request) (users.User, bool) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return users.User{}, false
+	}
+	parts := strings.Split(c.Value, ".")
+	if len(parts) != 5 {
+		return users.User{}, false
+	}
+	v := strings.Join(parts[:4], ".")
+	if !hmac.Equal([]byte(parts[4]), []byte(a.sign(v))) {
+		return users.User{}, false
+	}
+	name, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return users.User{}, false
+	}
+	gen, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return users.User{}, false
+	}
+	exp, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil || a.now().Unix() > exp {
+		return users.User{}, false
+	}
+	u, ok := a.accounts.Get(string(name))
+	if !ok || u.Nonce != parts[1] || u.Generation != gen {
+		return users.User{}, false
+	}
+	return u, true
+}
+
+func secureRequest(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+func (a *auth) setSession(w http.ResponseWriter, r *http.Request, u users.User) {
+	expires := a.now().Add(sessionTTL)
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    a.sessionValue(u, expires),
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// safeNext returns where to go after logging in, only paths on this server.
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func (a *auth) loginHandler(w http.ResponseWriter, r *http.Request) {
+	next := safeNext(r.FormValue("next"))
+	switch r.Method {
+	case "GET":
+		if _, ok := a.sessionUser(r); ok {
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+		renderLogin(w, http.StatusOK, next, "")
+	case "POST":
+		u, status, msg := a.login(r, r.PostFormValue("username"), r.PostFormValue("password"))
+		if status != http.StatusOK {
+			renderLogin(w, status, next, msg)
+			return
+		}
+		a.setSession(w, r, u)
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (a *auth) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func renderLogin(w http.ResponseWriter, status int, next, msg string) {
+	renderTemplate(w, status, "login", map[string]string{"next": next, "error": msg})
+}
+
+// requireAdmin lets only admins use h.
+func requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if u, ok := userFrom(r.Context()); !ok || u.Role != users.RoleAdmin {
+			if strings.HasPrefix(r.URL.Path, apiPrefix) {
+				writeError(w, http.StatusForbidden, "admins only")
+			} else {
+				http.Error(w, "admins only", http.StatusForbidden)
+			}
+			return
+		}
+		h(w, r)
+	}
+}
+
+// throttle delays the logins after repeated failures: after freeFailures
+// every failure doubles the wait, up to maxDelay. Failures are forgotten
+// after forgetAfter.
+type throttle struct {
+	mu       sync.Mutex
+	failures map[string]*failures
+	now      func() time.Time
+}
+
+type failures struct {
+	n    int
+	last time.Time
+}
+
+const (
+	freeFailures = 5
+	baseDelay    = time.Second
+	maxDelay     = 15 * time.Minute
+	forgetAfter  = time.Hour
+)
+
+func newThrottle() *throttle {
+	return &throttle{failures: make(map[string]*failures), now: time.Now}
+}
+
+func delay(n int) time.Duration {
+	if n < freeFailures {
+		return 0
+	}
+	d := baseDelay
+	for i := freeFailures; i < n && d < maxDelay; i++ {
+		d *= 2
+	}
+	if d > maxDelay {
+		d = maxDelay
+	}
+	return d
+}
+
+// wait returns how long the logins for keys have to wait.
+func (t *throttle) wait(keys ...string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var res time.Duration
+	now := t.now()
+	for _, k := range keys {
+		f, ok := t.failures[k]
+		if !ok {
+			continue
+		}
+		if d := f.last.Add(delay(f.n)).Sub(now); d > res {
+			res = d
+		}
+	}
+	return res
+}
+
+func (t *throttle) fail(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	for k, f := range t.failures {
+		if now.Sub(f.last) > forgetAfter {
+			delete(t.failures, k)
+		}
+	}
+	for _, k := range keys {
+		f, ok := t.failures[k]
+		if !ok {
+			f = &failures{}
+			t.failures[k] = f
+		}
+		f.n++
+		f.last = now
+	}
+}
+
+func (t *throttle) reset(keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, k := range keys {
+		delete(t.failures, k)
+	}
+}
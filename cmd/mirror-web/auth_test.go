@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marpio/mirror/users"
+)
+
+// asUser serves h as a logged in user with role.
+func asUser(h http.Handler, role string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, withUser(r, users.User{Name: "test", Role: role}))
+	})
+}
+
+func newTestAuth(t *testing.T) (*users.Store, *auth, http.Handler) {
+	ctx := context.Background()
+	rs := testStorage(t, nil)
+	st, err := users.Load(ctx, rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Add("anna", "correct horse", users.RoleAdmin)
+	st.Add("ben", "battery staple", users.RoleViewer)
+	router := configureRouter(ctx, &fakeCatalog{}, nil, "catalog")
+	a := newAuth(withLegacyUser{Store: st}, sessionSecret(testKey))
+	return st, a, a.handler(router)
+}
+
+func login(t *testing.T, h http.Handler, name, password string) *httptest.ResponseRecorder {
+	form := url.Values{"username": {name}, "password": {password}, "next": {"/api/v1/dirs"}}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func withCookies(h http.Handler, method, url string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestLogin(t *testing.T) {
+	st, _, h := newTestAuth(t)
+	rec := withCookies(h, "GET", "/dirs/2017", nil)
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login?next=%2Fdirs%2F2017" {
+		t.Errorf("expected a redirect to the login page, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := withCookies(h, "GET", "/api/v1/dirs", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 from the API, got %d", rec.Code)
+	}
+	if rec := login(t, h, "anna", "wrong password"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected a wrong password to be refused, got %d", rec.Code)
+	}
+
+	rec = login(t, h, "anna", "correct horse")
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/api/v1/dirs" {
+		t.Fatalf("expected a redirect after logging in, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("expected a session cookie, got %v", cookies)
+	}
+	if rec := withCookies(h, "POST", "/api/v1/reload", cookies); rec.Code != 200 {
+		t.Errorf("expected the admin to reload, got %d", rec.Code)
+	}
+	tampered := []*http.Cookie{{Name: sessionCookie, Value: strings.Replace(cookies[0].Value, "YW5uYQ", "YmVu", 1)}}
+	if rec := withCookies(h, "GET", "/api/v1/dirs", tampered); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected a tampered session to be refused, got %d", rec.Code)
+	}
+
+	// a new password ends the sessions
+	st.SetPassword("anna", "new password")
+	if rec := withCookies(h, "GET", "/api/v1/dirs", cookies); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected the session to end with the password change, got %d", rec.Code)
+	}
+
+	// so does removing the user, also if it is added again
+	cookies = login(t, h, "ben", "battery staple").Result().Cookies()
+	st.Remove("ben")
+	st.Add("ben", "battery staple", users.RoleViewer)
+	if rec := withCookies(h, "GET", "/api/v1/dirs", cookies); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected the session of the removed user to end, got %d", rec.Code)
+	}
+
+	rec = withCookies(h, "POST", "/logout", cookies)
+	if c := rec.Result().Cookies(); rec.Code != http.StatusSeeOther || len(c) != 1 || c[0].MaxAge >= 0 {
+		t.Errorf("expected the logout to remove the cookie, got %d %v", rec.Code, c)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	_, _, h := newTestAuth(t)
+	cookies := login(t, h, "ben", "battery staple").Result().Cookies()
+	if rec := withCookies(h, "GET", "/api/v1/dirs", cookies); rec.Code != 200 {
+		t.Errorf("expected the viewer to see the photos, got %d", rec.Code)
+	}
+	for _, u := range []string{"/api/v1/reload", "/api/v1/stats", "/reloaddb"} {
+		method := "GET"
+		if u == "/api/v1/reload" {
+			method = "POST"
+		}
+		if rec := withCookies(h, method, u, cookies); rec.Code != http.StatusForbidden {
+			t.Errorf("%s: expected 403 for the viewer, got %d", u, rec.Code)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/v1/stats", nil)
+	req.SetBasicAuth("anna", "correct horse")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Errorf("expected basic auth to work for the API, got %d", rec.Code)
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	_, a, h := newTestAuth(t)
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	a.throttle.now = func() time.Time { return now }
+	for i := 0; i < freeFailures; i++ {
+		if rec := login(t, h, "anna", "wrong password"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i, rec.Code)
+		}
+	}
+	if rec := login(t, h, "anna", "correct horse"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the login to be throttled, got %d", rec.Code)
+	}
+	now = now.Add(baseDelay)
+	if rec := login(t, h, "anna", "correct horse"); rec.Code != http.StatusSeeOther {
+		t.Errorf("expected the login after the delay, got %d", rec.Code)
+	}
+	if d := a.throttle.wait("user:anna"); d != 0 {
+		t.Errorf("expected the failures to be reset, got %s", d)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	for n, want := range map[int]time.Duration{0: 0, 4: 0, 5: time.Second, 7: 4 * time.Second, 100: maxDelay} {
+		if got := delay(n); got != want {
+			t.Errorf("%d failures: expected %s, got %s", n, want, got)
+		}
+	}
+}
+
+func TestSafeNext(t *testing.T) {
+	for next, want := range map[string]string{"/dirs/2017": "/dirs/2017", "//evil.com": "/", "https://evil.com": "/", "/\\evil.com": "/", "": "/"} {
+		if got := safeNext(next); got != want {
+			t.Errorf("%q: expected %q, got %q", next, want, got)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/gorilla/mux"
+	"github.com/marpio/mirror"
+)
+
+// Photos and thumbnails are named by the sha256 of their content, anything
+// else in the bucket (the catalog, the manifest, locks) is not served. The
+// previews are named after their photo.
+var fileIDPattern = regexp.MustCompile(`^(thumb_|preview_)?[0-9a-f]{64}$`)
+
+// The objects are immutable, so they can be cached for good.
+const fileCacheControl = "private, max-age=31536000, immutable"
+
+// existsChecker is implemented by the storages which can tell a missing
+// object from a failing read.
+type existsChecker interface {
+	Exists(ctx context.Context, path string) bool
+}
+
+func fileETag(id string) string {
+	return `"` + id + `"`
+}
+
+// etagMatches reports whether the If-None-Match header h matches etag, using
+// the weak comparison RFC 7232 asks for.
+func etagMatches(h, etag string) bool {
+	for _, t := range strings.Split(h, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// fileHandler streams a photo or thumbnail, decrypting it as it is sent. The
+// download from the bucket stops when the client goes away.
+func fileHandler(remotestorage mirror.StorageReader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if !fileIDPattern.MatchString(id) {
+			http.NotFound(w, r)
+			return
+		}
+		etag := fileETag(id)
+		h := w.Header()
+		h.Set("ETag", etag)
+		h.Set("Cache-Control", fileCacheControl)
+		if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		ctx := r.Context()
+		rd, err := remotestorage.NewReader(ctx, id)
+		if err != nil {
+			fileError(w, r, remotestorage, id, err)
+			return
+		}
+		defer rd.Close()
+		br := bufio.NewReaderSize(rd, 512)
+		head, err := br.Peek(512)
+		if err != nil && err != io.EOF {
+			fileError(w, r, remotestorage, id, err)
+			return
+		}
+		ct := http.DetectContentType(head)
+		h.Set("Content-Type", ct)
+		if r.URL.Query().Get("download") != "" {
+			h.Set("Content-Disposition", `attachment; filename="`+id+fileExt(ct)+`"`)
+		}
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Accept-Ranges", "none")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == "HEAD" {
+			return
+		}
+		if _, err := io.Copy(w, br); err != nil && ctx.Err() == nil {
+			log.WithError(err).WithField("id", id).Error("error sending file")
+		}
+	}
+}
+
+func fileExt(contentType string) string {
+	switch contentType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/png":
+		return ".png"
+	}
+	return ""
+}
+
+func fileError(w http.ResponseWriter, r *http.Request, remotestorage mirror.StorageReader, id string, err error) {
+	w.Header().Del("ETag")
+	w.Header().Del("Cache-Control")
+	if r.Context().Err() != nil {
+		return
+	}
+	if s, ok := remotestorage.(existsChecker); ok && !s.Exists(r.Context(), id) {
+		http.NotFound(w, r)
+		return
+	}
+	log.WithError(err).WithField("id", id).Error("error reading file")
+	http.Error(w, "error reading the file", http.StatusBadGateway)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/marpio/mirror/cache"
+	"github.com/marpio/mirror/users"
+)
+
+func newTestFiles(t *testing.T) ([]byte, http.Handler) {
+	content := append([]byte("\xff\xd8\xff\xe0"), bytes.Repeat([]byte("photo"), 1000)...)
+	rs := testStorage(t, map[string][]byte{photoID: content, "catalog": content})
+	return content, configureRouter(context.Background(), &fakeCatalog{}, rs, "catalog")
+}
+
+func TestFileHandler(t *testing.T) {
+	content, h := newTestFiles(t)
+	rec := serve(h, "GET", "/files/"+photoID, nil)
+	if rec.Code != 200 {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), content) {
+		t.Errorf("expected the decrypted content, got %d bytes", rec.Body.Len())
+	}
+	for k, v := range map[string]string{
+		"Content-Type":  "image/jpeg",
+		"ETag":          `"` + photoID + `"`,
+		"Cache-Control": fileCacheControl,
+	} {
+		if got := rec.Header().Get(k); got != v {
+			t.Errorf("expected %s %q, got %q", k, v, got)
+		}
+	}
+
+	rec = serve(h, "HEAD", "/files/"+photoID, nil)
+	if rec.Code != 200 || rec.Body.Len() != 0 || rec.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("unexpected HEAD response %d, %d bytes, %q", rec.Code, rec.Body.Len(), rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestFileHandlerNotModified(t *testing.T) {
+	_, h := newTestFiles(t)
+	for _, inm := range []string{`"` + photoID + `"`, `"other", W/"` + photoID + `"`, "*"} {
+		rec := serve(h, "GET", "/files/"+photoID, map[string]string{"If-None-Match": inm})
+		if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Errorf("%s: expected 304, got %d", inm, rec.Code)
+		}
+		if rec.Header().Get("ETag") == "" {
+			t.Errorf("%s: expected the etag with the 304", inm)
+		}
+	}
+	if rec := serve(h, "GET", "/files/"+photoID, map[string]string{"If-None-Match": `"other"`}); rec.Code != 200 {
+		t.Errorf("expected 200 for another etag, got %d", rec.Code)
+	}
+}
+
+func TestFileHandlerNotFound(t *testing.T) {
+	_, h := newTestFiles(t)
+	for _, id := range []string{"catalog", "mirror.json", strings.Repeat("cd", 32), "thumb_" + strings.Repeat("cd", 32)} {
+		rec := serve(h, "GET", "/files/"+id, nil)
+		if rec.Code != 404 {
+			t.Errorf("%s: expected 404, got %d", id, rec.Code)
+		}
+		if rec.Header().Get("Cache-Control") != "" {
+			t.Errorf("%s: expected a 404 not to be cached", id)
+		}
+	}
+}
+
+func TestFileHandlerCache(t *testing.T) {
+	ctx := context.Background()
+	thumbID := "thumb_" + photoID
+	rs := testStorage(t, map[string][]byte{thumbID: []byte("\xff\xd8\xff\xe0thumbnail")})
+	files, err := cache.New(rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := asUser(configureRouter(ctx, &fakeCatalog{}, files, "catalog"), users.RoleAdmin)
+	for i := 0; i < 3; i++ {
+		if rec := serve(h, "GET", "/files/"+thumbID, nil); rec.Code != 200 || rec.Body.String() != "\xff\xd8\xff\xe0thumbnail" {
+			t.Fatalf("unexpected response %d: %q", rec.Code, rec.Body)
+		}
+	}
+	if rec := serve(h, "GET", "/files/thumb_"+strings.Repeat("cd", 32), nil); rec.Code != 404 {
+		t.Errorf("expected 404 for a missing thumbnail, got %d", rec.Code)
+	}
+
+	var res struct{ Cache cache.Stats }
+	get(t, h, "GET", "/api/v1/stats", 200, &res)
+	if res.Cache.Hits != 2 || res.Cache.Misses != 1 || res.Cache.Errors != 1 {
+		t.Errorf("unexpected cache stats %+v", res.Cache)
+	}
+}
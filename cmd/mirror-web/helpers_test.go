@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marpio/mirror/crypto"
+	"github.com/marpio/mirror/storage"
+	"github.com/marpio/mirror/storage/remotebackend"
+	"github.com/spf13/afero"
+)
+
+const testKey = "b40b3de5e3ef0fc5c7c0b2a9d3d6c82f0c4a0fa7b9d7e2e3a8c1f1d0e9b8a7c6"
+
+// The ids of the photos in the test catalogs.
+var (
+	photoID = strings.Repeat("ab", 32)
+	otherID = strings.Repeat("ef", 32)
+)
+
+// testStorage returns an encrypted storage in memory holding objects. The
+// blocks are small, so that ranges span several of them.
+func testStorage(t *testing.T, objects map[string][]byte) *storage.RemoteStorage {
+	ctx := context.Background()
+	rs := storage.NewRemote(remotebackend.NewFileSystem(afero.NewMemMapFs()), crypto.NewService(testKey, crypto.WithBlockSize(1024)))
+	for name, b := range objects {
+		w := rs.NewWriter(ctx, name)
+		w.Write(b)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rs
+}
+
+// samplePhotos returns the originals of photoID and otherID, the sample
+// photos of the repository.
+func samplePhotos(t *testing.T) map[string][]byte {
+	res := make(map[string][]byte)
+	for id, p := range map[string]string{photoID: "../../test/sample.jpg", otherID: "../../test/sample2.jpg"} {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res[id] = b
+	}
+	return res
+}
+
+type datedPhoto struct {
+	photo
+	taken time.Time
+}
+
+func (p datedPhoto) CreatedAt() time.Time { return p.taken }
+
+func serve(h http.Handler, method, url string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, url, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
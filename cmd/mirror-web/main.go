@@ -1,73 +1,174 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"time"
 
+	"github.com/apex/log"
 	"github.com/aymerick/raymond"
-	"github.com/goji/httpauth"
 	"github.com/gorilla/mux"
 	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/cache"
+	"github.com/marpio/mirror/config"
 	"github.com/marpio/mirror/crypto"
+	"github.com/marpio/mirror/lock"
+	"github.com/marpio/mirror/manifest"
 	"github.com/marpio/mirror/metadata/repo"
+	"github.com/marpio/mirror/shares"
 	"github.com/marpio/mirror/storage"
 	"github.com/marpio/mirror/storage/remotebackend"
+	"github.com/marpio/mirror/users"
 
 	"github.com/spf13/afero"
 )
 
-func getenv(n string) string {
-	v := os.Getenv(n)
-	if v == "" {
-		panic("could not find env var " + n)
+// loadConfig reads the config file given by -config or $MIRROR_CONFIG, if
+// any, and applies the environment. All problems are reported at once.
+func loadConfig() *config.Config {
+	path := flag.String("config", os.Getenv("MIRROR_CONFIG"), "config file")
+	flag.Parse()
+	c := &config.Config{}
+	if *path != "" {
+		var err error
+		if c, err = config.Load(*path); err != nil {
+			fmt.Fprintf(os.Stderr, "error loading the config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	c.ApplyEnv(os.Getenv)
+	c.SetDefaults()
+	if err := c.ValidateWeb(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	return v
+	if err := c.ResolveWebSecrets(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return c
+}
+
+func newBackend(ctx context.Context, c *config.Config) mirror.Storage {
+	if c.Backend.Type == config.BackendFilesystem {
+		return remotebackend.NewFileSystem(afero.NewBasePathFs(afero.NewOsFs(), c.Backend.Filesystem.Path))
+	}
+	return remotebackend.NewB2(ctx, c.Backend.B2.AccountID, c.Backend.B2.AccountKey, c.Backend.B2.Bucket)
 }
 
 func main() {
-	encryptionKey := getenv("ENCR_KEY")
-	b2id := getenv("B2_ACCOUNT_ID")
-	b2key := getenv("B2_ACCOUNT_KEY")
-	bucketName := getenv("B2_BUCKET_NAME")
-	repoFileName := getenv("REPO")
-	username := getenv("MIRROR_USERNAME")
-	password := getenv("MIRROR_PASSWORD")
+	cfg := loadConfig()
 	ctx := context.Background()
-	rsBackend := remotebackend.NewB2(ctx, b2id, b2key, bucketName)
-	rs := storage.NewRemote(rsBackend, crypto.NewService(encryptionKey))
+	rsBackend := newBackend(ctx, cfg)
+	m, err := manifest.Open(ctx, rsBackend, cfg.Repo)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	key, err := m.ResolveKey(cfg.Key.Value, cfg.Key.Passphrase)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	crpt := crypto.NewService(key, crypto.WithBlockSize(m.BlockSize))
+	rs := storage.NewRemote(rsBackend, crpt)
 	appFs := afero.NewOsFs()
-	metadataStore := createMetadataStore(ctx, appFs, repoFileName, rs)
+	metadataStore := createMetadataStore(ctx, rsBackend, rs, cfg.Repo, cfg.Web.Device)
+	files, err := newThumbnailCache(appFs, cfg.Web.Cache, newPreviewStorage(rs), crpt)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
-	router := configureRouter(ctx, metadataStore, rs, repoFileName)
-	http.Handle("/", httpauth.SimpleBasicAuth(username, password)(router))
+	accounts, err := users.Load(ctx, rs)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if accounts.Len() == 0 && cfg.Web.Username == "" {
+		fmt.Fprintln(os.Stderr, "there are no users, add one with mirror-cli user add")
+		os.Exit(1)
+	}
+	go reloadUsers(ctx, accounts)
+
+	shareStore, err := shares.Load(ctx, rs, shareSecret(key))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	router := configureRouter(ctx, metadataStore, files, cfg.Repo)
+	configureShares(router, metadataStore, files, shareStore)
+	configureAlbums(router, metadataStore, metadataStore)
+	a := newAuth(withLegacyUser{Store: accounts, name: cfg.Web.Username, password: cfg.Web.Password}, sessionSecret(key))
+	http.Handle("/", a.handler(router))
 
-	http.ListenAndServe(":5000", nil)
+	http.ListenAndServe(cfg.Web.Addr, nil)
 }
 
 func configureRouter(ctx context.Context, metadataStore mirror.MetadataRepoReader, remotestorage mirror.StorageReader, imgDBPath string) *mux.Router {
 	r := mux.NewRouter()
+	tl := newTimeline(metadataStore)
 	r.HandleFunc("/", mainPageHandler(metadataStore))
 	r.HandleFunc("/dirs/{dir}", dirHandler(metadataStore))
-	r.HandleFunc("/files/{id}", fileHandler(ctx, remotestorage))
-	r.HandleFunc("/reloaddb", func(w http.ResponseWriter, r *http.Request) {
-		err := metadataStore.Reload(ctx)
+	r.HandleFunc("/timeline", timelineHandler(tl)).Methods("GET")
+	r.HandleFunc("/photos/{id:[0-9a-f]{64}}", photoHandler(metadataStore, remotestorage)).Methods("GET")
+	r.HandleFunc("/files/{id}", fileHandler(remotestorage))
+	r.HandleFunc("/zip", zipHandler(metadataStore, remotestorage)).Methods("GET")
+	r.HandleFunc("/reloaddb", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+		err := tl.Reload(ctx)
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
 		fmt.Fprint(w, "ok")
-	})
+	}))
+	configureAPI(ctx, r, metadataStore, tl, remotestorage)
 	r.PathPrefix("/public/").Handler(http.StripPrefix("/public/", http.FileServer(http.Dir("public/"))))
 	return r
 }
 
-func createMetadataStore(ctx context.Context, fs afero.Fs, imgDBPath string, remotestorage mirror.Storage) mirror.MetadataRepoReader {
-	repo, err := repo.NewHashmap(ctx, remotestorage, imgDBPath)
+// reloadUsers reads the users every minute, so that the changes made with
+// mirror-cli user take effect.
+func reloadUsers(ctx context.Context, accounts *users.Store) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for range t.C {
+		if err := accounts.Reload(ctx); err != nil {
+			log.WithError(err).Error("error reloading the users")
+		}
+	}
+}
+
+// newThumbnailCache keeps the decrypted thumbnails read from rs and the
+// previews rendered by it, so the gallery pages do not download them again.
+func newThumbnailCache(fs afero.Fs, c config.WebCache, rs mirror.StorageReader, crpt crypto.Service) (*cache.Cache, error) {
+	mem, _ := config.ParseSize(c.Memory)
+	disk, _ := config.ParseSize(c.Disk)
+	if !c.Encrypt {
+		crpt = nil
+	}
+	return cache.New(rs, cache.WithMemory(mem), cache.WithDisk(fs, c.Dir, disk), cache.WithEncryption(crpt), cache.WithFilter(cacheable))
+}
+
+// createMetadataStore reads the catalog merged with the segments of all
+// devices. The albums and tags changed in mirror-web are written to the
+// segment of device, whose lock is held as long as the server runs.
+func createMetadataStore(ctx context.Context, backend mirror.Storage, remotestorage *storage.RemoteStorage, imgDBPath, device string) *repo.SegmentStore {
+	l, err := lock.Acquire(ctx, log.Log, backend, lock.Holder(), lock.WithObject(lock.DeviceObject(device)), lock.WithExclude(lock.ObjectName))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error locking the catalog segment %s, set web.device if another mirror-web uses it: %v\n", device, err)
+		os.Exit(1)
+	}
+	go func() {
+		<-l.Lost()
+		log.Error("lost the lock of the catalog segment to another process, changes to the albums and tags are not saved anymore")
+	}()
+	repo, err := repo.NewSegmentStore(ctx, l.Guard(remotestorage), remotestorage, imgDBPath, device)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error creating metadata repository: %v", err)
 		os.Exit(-1)
@@ -83,8 +184,10 @@ func mainPageHandler(metadataStore mirror.MetadataRepoReader) func(w http.Respon
 			return
 		}
 
-		ctx := map[string][]string{
+		u, _ := userFrom(r.Context())
+		ctx := map[string]interface{}{
 			"folders": dirs,
+			"admin":   u.Role == users.RoleAdmin,
 		}
 		tmpl, err := raymond.ParseFile("templates/index.hbs")
 		if err != nil {
@@ -106,49 +209,27 @@ func dirHandler(metadataStore mirror.MetadataRepoReader) func(w http.ResponseWri
 		dir := vars["dir"]
 
 		items, err := metadataStore.GetByDir(dir)
-		photos := make([]interface{}, 0)
-		for _, it := range items {
-			p := struct {
-				ID      string
-				ThumbID string
-			}{
-				it.ID(),
-				it.ThumbID(),
-			}
-			photos = append(photos, p)
-		}
-
-		ctx := map[string][]interface{}{
-			"imgs": photos,
-		}
-		tmpl, err := raymond.ParseFile("templates/dir.hbs")
 		if err != nil {
 			http.Error(w, err.Error(), 500)
 			return
 		}
-		result, err := tmpl.Exec(ctx)
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		fmt.Fprint(w, result)
+		renderPhotos(w, r, metadataStore, items, dir, url.Values{"dir": {dir}})
 	}
 }
 
-func fileHandler(ctx context.Context, remotestorage mirror.StorageReader) func(w http.ResponseWriter, r *http.Request) {
-	return func(w http.ResponseWriter, r *http.Request) {
-		vars := mux.Vars(r)
-		id := vars["id"]
-		rd, err := remotestorage.NewReader(ctx, id)
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		b, err := ioutil.ReadAll(rd)
-		if err != nil {
-			http.Error(w, err.Error(), 500)
-			return
-		}
-		http.ServeContent(w, r, id, time.Now(), bytes.NewReader(b))
+// renderTemplate renders templates/name.hbs with ctx.
+func renderTemplate(w http.ResponseWriter, status int, name string, ctx interface{}) {
+	tmpl, err := raymond.ParseFile("templates/" + name + ".hbs")
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	result, err := tmpl.Exec(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
 	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	fmt.Fprint(w, result)
 }
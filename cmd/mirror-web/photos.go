@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+
+	"github.com/apex/log"
+	"github.com/gorilla/mux"
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/metadata"
+)
+
+const takenLayout = "Monday, 2 January 2006, 15:04"
+
+func photoURL(id string, query url.Values) string {
+	if len(query) == 0 {
+		return "/photos/" + id
+	}
+	return "/photos/" + id + "?" + query.Encode()
+}
+
+// photoSequence returns the photos the page of id goes through, those of the
+// album, directory or tag of the query, or of the directory of id by
+// default. The query selecting them is returned as well, the title and the
+// URL of their page.
+func photoSequence(metadataStore mirror.MetadataRepoReader, id string, query url.Values) ([]mirror.RemotePhoto, url.Values, string, string, error) {
+	switch {
+	case query.Get("album") != "":
+		c, ok := metadataStore.(mirror.CollectionRepoReader)
+		if !ok {
+			return nil, nil, "", "", mirror.ErrAlbumNotFound
+		}
+		a, err := c.GetAlbum(query.Get("album"))
+		if err != nil {
+			return nil, nil, "", "", err
+		}
+		return albumPhotos(metadataStore, a), url.Values{"album": {a.ID}}, a.Title, albumURL(a.ID), nil
+	case query.Get("tag") != "":
+		tag := query.Get("tag")
+		photos, err := findPhotos(metadataStore, "", "", tag)
+		if err != nil {
+			return nil, nil, "", "", err
+		}
+		return byTaken(photos), url.Values{"tag": {tag}}, "Tagged " + tag, tagURL(tag), nil
+	}
+	dir := query.Get("dir")
+	if dir == "" {
+		for _, p := range metadataStore.GetAll() {
+			if p.ID() == id && (dir == "" || p.Dir() < dir) {
+				dir = p.Dir()
+			}
+		}
+	}
+	photos, err := metadataStore.GetByDir(dir)
+	if err != nil {
+		return nil, nil, "", "", err
+	}
+	return byTaken(photos), url.Values{"dir": {dir}}, dir, "/dirs/" + dir, nil
+}
+
+// photoHandler renders the page of a photo: its preview, when it was taken,
+// a summary of its EXIF data, its tags and albums and the links to the
+// photos before and after it in its directory, album or tag.
+func photoHandler(metadataStore mirror.MetadataRepoReader, remotestorage mirror.StorageReader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		photos, query, title, back, err := photoSequence(metadataStore, id, r.URL.Query())
+		if err == mirror.ErrAlbumNotFound {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		i := -1
+		for j, p := range photos {
+			if p.ID() == id {
+				i = j
+			}
+		}
+		if i < 0 {
+			http.Error(w, "the photo is not there", http.StatusNotFound)
+			return
+		}
+		p := photos[i]
+
+		ctx := map[string]interface{}{
+			"title":     title,
+			"back":      back,
+			"position":  i + 1,
+			"count":     len(photos),
+			"preview":   "/files/" + previewID(id),
+			"original":  "/files/" + id + "?download=1",
+			"slideshow": slideshow(photos, query),
+			"index":     i,
+		}
+		if i > 0 {
+			ctx["prev"] = photoURL(photos[i-1].ID(), query)
+		}
+		if i < len(photos)-1 {
+			ctx["next"] = photoURL(photos[i+1].ID(), query)
+		}
+
+		taken := takenAt(p)
+		head, err := readHead(r, remotestorage, id)
+		if err != nil {
+			log.WithError(err).WithField("id", id).Warn("error reading the EXIF data")
+		}
+		if taken.IsZero() && head != nil {
+			taken, _ = metadata.CaptureTime(bytes.NewReader(head))
+		}
+		if !taken.IsZero() {
+			ctx["taken"] = taken.Format(takenLayout)
+		}
+		if x, err := metadata.ReadExif(bytes.NewReader(head)); err == nil {
+			ctx["exif"] = exifRows(x)
+		}
+
+		tags := make([]interface{}, 0)
+		for _, t := range photoTags(metadataStore, id) {
+			tags = append(tags, map[string]string{"Name": t, "URL": tagURL(t)})
+		}
+		ctx["tags"] = tags
+		if c, ok := metadataStore.(mirror.CollectionRepoReader); ok {
+			albums := make([]interface{}, 0)
+			for _, a := range c.Albums() {
+				if a.Contains(id) {
+					albums = append(albums, map[string]string{"Title": a.Title, "URL": albumURL(a.ID)})
+				}
+			}
+			ctx["albums"] = albums
+		}
+		renderTemplate(w, http.StatusOK, "photo", ctx)
+	}
+}
+
+// readHead reads the start of the original of id, which has its EXIF data.
+func readHead(r *http.Request, remotestorage mirror.StorageReader, id string) ([]byte, error) {
+	rd, err := remotestorage.NewReader(r.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return ioutil.ReadAll(io.LimitReader(rd, zipPeek))
+}
+
+func exifRows(x *metadata.Exif) []interface{} {
+	rows := make([]interface{}, 0)
+	for _, f := range []struct{ name, value string }{
+		{"Camera", x.Camera},
+		{"Lens", x.Lens},
+		{"Exposure", x.Exposure},
+		{"Aperture", x.Aperture},
+		{"Sensitivity", x.ISO},
+		{"Focal length", x.FocalLength},
+		{"Location", x.Location},
+	} {
+		if f.value != "" {
+			rows = append(rows, map[string]string{"Name": f.name, "Value": f.value})
+		}
+	}
+	return rows
+}
+
+// slideshow returns the previews and pages of photos as JSON, for the
+// slideshow of the photo page.
+func slideshow(photos []mirror.RemotePhoto, query url.Values) string {
+	type slide struct {
+		Preview string `json:"preview"`
+		Page    string `json:"page"`
+	}
+	slides := make([]slide, 0, len(photos))
+	for _, p := range photos {
+		slides = append(slides, slide{Preview: "/files/" + previewID(p.ID()), Page: photoURL(p.ID(), query)})
+	}
+	b, _ := json.Marshal(slides)
+	return string(b)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"image/jpeg"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marpio/mirror/metadata/repo"
+	"github.com/marpio/mirror/users"
+)
+
+func newTestPhotos(t *testing.T) (string, http.Handler) {
+	ctx := context.Background()
+	rs := testStorage(t, samplePhotos(t))
+	st, err := repo.NewSegmentStore(ctx, rs, rs, "catalog", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	taken := time.Date(2017, 8, 25, 17, 3, 30, 0, time.UTC)
+	st.Add(datedPhoto{photo{photoID, "2017-08"}, taken})
+	st.Add(datedPhoto{photo{otherID, "2017-08"}, taken.Add(time.Hour)})
+	st.Tag(photoID, "beach")
+	a, _ := st.CreateAlbum("Summer", "")
+	a.Photos = []string{otherID, photoID}
+	st.UpdateAlbum(a)
+	router := configureRouter(ctx, st, newPreviewStorage(rs), "catalog")
+	configureAlbums(router, st, st)
+	return a.ID, asUser(router, users.RoleViewer)
+}
+
+func TestPhotoPage(t *testing.T) {
+	album, h := newTestPhotos(t)
+	rec := serve(h, "GET", "/photos/"+photoID, nil)
+	body := rec.Body.String()
+	if rec.Code != 200 {
+		t.Fatalf("expected the photo page, got %d: %s", rec.Code, body)
+	}
+	for _, want := range []string{
+		`src="/files/preview_` + photoID + `"`,
+		`href="/files/` + photoID + `?download=1"`,
+		`id="next" href="/photos/` + otherID + `?dir=2017-08"`,
+		"Friday, 25 August 2017, 17:03",
+		"Fairphone FP2",
+		`href="/tags/beach"`,
+		`href="/albums/` + album + `"`,
+		"1 of 2",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %s on the page", want)
+		}
+	}
+	if strings.Contains(body, `id="prev"`) {
+		t.Error("expected no previous photo")
+	}
+
+	// in the album the other photo comes first
+	body = serve(h, "GET", "/photos/"+photoID+"?album="+album, nil).Body.String()
+	if !strings.Contains(body, `id="prev" href="/photos/`+otherID+`?album=`+album+`"`) || strings.Contains(body, `id="next"`) {
+		t.Errorf("expected the previous photo of the album, got %s", body)
+	}
+	if rec := serve(h, "GET", "/photos/"+otherID+"?tag=beach", nil); rec.Code != 404 {
+		t.Errorf("expected 404 for a photo without the tag, got %d", rec.Code)
+	}
+	if rec := serve(h, "GET", "/photos/"+strings.Repeat("cd", 32), nil); rec.Code != 404 {
+		t.Errorf("expected 404 for an unknown photo, got %d", rec.Code)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	_, h := newTestPhotos(t)
+	rec := serve(h, "GET", "/files/preview_"+photoID, nil)
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("expected the preview, got %d %s", rec.Code, rec.Body)
+	}
+	c, err := jpeg.DecodeConfig(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil || c.Width != 1200 || c.Height != 1600 {
+		t.Errorf("expected a 1200x1600 preview, got %dx%d, %v", c.Width, c.Height, err)
+	}
+	if rec := serve(h, "GET", "/files/preview_"+strings.Repeat("cd", 32), nil); rec.Code != 404 {
+		t.Errorf("expected 404 for the preview of an unknown photo, got %d", rec.Code)
+	}
+}
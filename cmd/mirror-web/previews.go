@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"strings"
+
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/manifest"
+	"github.com/marpio/mirror/metadata"
+)
+
+// previewPrefix names the previews. They are not in the bucket but rendered
+// from the originals and kept in the thumbnail cache.
+const previewPrefix = "preview_"
+
+func previewID(id string) string {
+	return previewPrefix + id
+}
+
+// cacheable reports whether the object id is kept in the thumbnail cache.
+func cacheable(id string) bool {
+	return strings.HasPrefix(id, manifest.ThumbnailPrefix) || strings.HasPrefix(id, previewPrefix)
+}
+
+// previewStorage reads the objects of rd and renders the previews of the
+// photos, a few at a time since decoding a photo takes a lot of memory.
+type previewStorage struct {
+	rd  mirror.StorageReader
+	sem chan struct{}
+}
+
+func newPreviewStorage(rd mirror.StorageReader) *previewStorage {
+	return &previewStorage{rd: rd, sem: make(chan struct{}, runtime.NumCPU())}
+}
+
+func (s *previewStorage) NewReader(ctx context.Context, id string) (io.ReadCloser, error) {
+	orig := strings.TrimPrefix(id, previewPrefix)
+	if orig == id {
+		return s.rd.NewReader(ctx, id)
+	}
+	select {
+	case s.sem <- struct{}{}:
+		defer func() { <-s.sem }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	rd, err := s.rd.NewReader(ctx, orig)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	b, err := metadata.NewPreview(rd, metadata.PreviewSize)
+	if err != nil {
+		return nil, fmt.Errorf("error rendering the preview of %s: %v", orig, err)
+	}
+	return ioutil.NopCloser(bytes.NewReader(b)), nil
+}
+
+// Exists reports whether the object or the original of the preview exists,
+// if rd can tell.
+func (s *previewStorage) Exists(ctx context.Context, id string) bool {
+	if e, ok := s.rd.(existsChecker); ok {
+		return e.Exists(ctx, strings.TrimPrefix(id, previewPrefix))
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+// The arrow keys go to the previous and next photo. The slideshow shows the
+// previews from the current photo on in fullscreen, one every five seconds;
+// the arrow keys move, space pauses and escape ends it on the page of the
+// photo shown last.
+(function () {
+  var show = document.getElementById('show');
+  var img = show.querySelector('img');
+  var slides = JSON.parse(show.getAttribute('data-slides'));
+  var index = +show.getAttribute('data-index');
+  var timer = null;
+  var running = false;
+
+  function follow(id) {
+    var a = document.getElementById(id);
+    if (a) {
+      location.href = a.href;
+    }
+  }
+
+  function display(i) {
+    index = (i + slides.length) % slides.length;
+    img.src = slides[index].preview;
+    // load the next one while this one is shown
+    new Image().src = slides[(index + 1) % slides.length].preview;
+  }
+
+  function play() {
+    clearInterval(timer);
+    timer = setInterval(function () { display(index + 1); }, 5000);
+  }
+
+  function start() {
+    running = true;
+    show.classList.add('active');
+    display(index);
+    play();
+    var el = document.documentElement;
+    var request = el.requestFullscreen || el.webkitRequestFullscreen;
+    if (request) {
+      request.call(el);
+    }
+  }
+
+  function stop() {
+    if (!running) {
+      return;
+    }
+    running = false;
+    clearInterval(timer);
+    show.classList.remove('active');
+    var exit = document.exitFullscreen || document.webkitExitFullscreen;
+    if (exit && (document.fullscreenElement || document.webkitFullscreenElement)) {
+      exit.call(document);
+    }
+    location.href = slides[index].page;
+  }
+
+  function fullscreenChanged() {
+    if (!document.fullscreenElement && !document.webkitFullscreenElement) {
+      stop();
+    }
+  }
+
+  document.getElementById('slideshow').addEventListener('click', start);
+  show.addEventListener('click', function () { display(index + 1); play(); });
+  document.addEventListener('fullscreenchange', fullscreenChanged);
+  document.addEventListener('webkitfullscreenchange', fullscreenChanged);
+  document.addEventListener('keydown', function (e) {
+    if (!running) {
+      if (e.key === 'ArrowLeft') {
+        follow('prev');
+      } else if (e.key === 'ArrowRight') {
+        follow('next');
+      }
+      return;
+    }
+    if (e.key === 'ArrowLeft') {
+      display(index - 1);
+      play();
+    } else if (e.key === 'ArrowRight') {
+      display(index + 1);
+      play();
+    } else if (e.key === ' ') {
+      e.preventDefault();
+      if (timer === null) {
+        play();
+      } else {
+        clearInterval(timer);
+        timer = null;
+      }
+    } else if (e.key === 'Escape') {
+      stop();
+    }
+  });
+})();
@@ -0,0 +1,77 @@
+// Loads the pages of the timeline as it is scrolled and puts the photos
+// under a heading for each day.
+(function () {
+  var timeline = document.getElementById('timeline');
+  var more = document.getElementById('more');
+  var next = timeline.getAttribute('data-next');
+  var day = null;
+  var list = null;
+  var loading = false;
+
+  function heading(d) {
+    if (!d) {
+      return 'Unknown date';
+    }
+    var parts = d.split('-');
+    var date = new Date(+parts[0], parts[1] - 1, +parts[2]);
+    return date.toLocaleDateString(undefined, {weekday: 'long', year: 'numeric', month: 'long', day: 'numeric'});
+  }
+
+  function add(photo) {
+    var d = photo.day || '';
+    if (list === null || d !== day) {
+      day = d;
+      var h = document.createElement('h2');
+      h.className = 'day';
+      h.textContent = heading(d);
+      list = document.createElement('ul');
+      list.className = 'container';
+      timeline.appendChild(h);
+      timeline.appendChild(list);
+    }
+    var img = document.createElement('img');
+    img.src = photo.urls.thumbnail;
+    img.setAttribute('loading', 'lazy');
+    var a = document.createElement('a');
+    a.href = '/photos/' + encodeURIComponent(photo.id) + '?dir=' + encodeURIComponent(photo.dir);
+    a.appendChild(img);
+    var li = document.createElement('li');
+    li.className = 'img-item';
+    li.appendChild(a);
+    list.appendChild(li);
+  }
+
+  function load() {
+    if (loading || !next) {
+      return;
+    }
+    loading = true;
+    fetch(next, {credentials: 'same-origin'}).then(function (res) {
+      if (!res.ok) {
+        throw new Error(res.statusText);
+      }
+      return res.json();
+    }).then(function (page) {
+      page.photos.forEach(add);
+      next = page.next || null;
+      if (!next) {
+        more.style.display = 'none';
+      }
+      loading = false;
+    }).catch(function (err) {
+      more.textContent = 'Error loading the photos, try again';
+      loading = false;
+    });
+  }
+
+  more.addEventListener('click', load);
+  if ('IntersectionObserver' in window) {
+    new IntersectionObserver(function (entries) {
+      if (entries[0].isIntersecting) {
+        load();
+      }
+    }, {rootMargin: '800px'}).observe(more);
+  } else {
+    load();
+  }
+})();
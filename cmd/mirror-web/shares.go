@@ -0,0 +1,293 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/gorilla/mux"
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/shares"
+)
+
+// The share links are served under sharePrefix without logging in.
+const sharePrefix = "/s/"
+
+const (
+	defaultShareDays = 7
+	maxShareDays     = 365
+)
+
+func shareSecret(key string) []byte {
+	return deriveSecret(key, "mirror-web shares")
+}
+
+type sharing struct {
+	metadataStore mirror.MetadataRepoReader
+	remotestorage mirror.StorageReader
+	shares        *shares.Store
+	throttle      *throttle
+}
+
+// configureShares adds the pages of the share links and the admin page
+// listing the shares.
+func configureShares(r *mux.Router, metadataStore mirror.MetadataRepoReader, remotestorage mirror.StorageReader, st *shares.Store) {
+	s := &sharing{metadataStore: metadataStore, remotestorage: remotestorage, shares: st, throttle: newThrottle()}
+	r.HandleFunc(sharePrefix+"{token}", s.pageHandler).Methods("GET", "POST")
+	r.HandleFunc(sharePrefix+"{token}/files/{id}", s.fileHandler).Methods("GET", "HEAD")
+	r.HandleFunc(sharePrefix+"{token}/zip", s.zipHandler).Methods("GET")
+	r.HandleFunc("/shares", requireAdmin(s.listHandler)).Methods("GET")
+	r.HandleFunc("/shares", requireAdmin(s.createHandler)).Methods("POST")
+	r.HandleFunc("/shares/{id}/revoke", requireAdmin(s.revokeHandler)).Methods("POST")
+}
+
+// sharePhotos returns the photos of sh, each once.
+func sharePhotos(metadataStore mirror.MetadataRepoReader, sh shares.Share) ([]mirror.RemotePhoto, error) {
+	var photos []mirror.RemotePhoto
+	var err error
+	switch sh.Kind {
+	case shares.KindDir:
+		photos, err = findPhotos(metadataStore, sh.Target, "", "")
+	case shares.KindPhoto:
+		photos, err = findPhotos(metadataStore, "", sh.Target, "")
+		matching := photos[:0]
+		for _, p := range photos {
+			if p.ID() == sh.Target {
+				matching = append(matching, p)
+			}
+		}
+		photos = matching
+	case shares.KindSearch:
+		query, _ := url.ParseQuery(sh.Target)
+		photos, err = findPhotos(metadataStore, "", query.Get("q"), query.Get("tag"))
+	}
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	res := make([]mirror.RemotePhoto, 0, len(photos))
+	for _, p := range photos {
+		if !seen[p.ID()] {
+			seen[p.ID()] = true
+			res = append(res, p)
+		}
+	}
+	return res, nil
+}
+
+func shareCookie(sh shares.Share) string {
+	return "mirror_share_" + sh.ID
+}
+
+func (s *sharing) unlocked(r *http.Request, sh shares.Share) bool {
+	if !sh.Protected() {
+		return true
+	}
+	c, err := r.Cookie(shareCookie(sh))
+	return err == nil && c.Value == s.shares.Unlocked(sh)
+}
+
+func (s *sharing) pageHandler(w http.ResponseWriter, r *http.Request) {
+	token := mux.Vars(r)["token"]
+	sh, err := s.shares.Lookup(token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if r.Method == "POST" {
+		s.unlock(w, r, token, sh)
+		return
+	}
+	if !s.unlocked(r, sh) {
+		renderTemplate(w, http.StatusOK, "share_password", map[string]string{})
+		return
+	}
+	photos, err := sharePhotos(s.metadataStore, sh)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	imgs := make([]interface{}, 0, len(photos))
+	for _, p := range photos {
+		// without downloads the thumbnails open the previews
+		img := map[string]string{
+			"URL":      sharePrefix + token + "/files/" + previewID(p.ID()),
+			"ThumbURL": sharePrefix + token + "/files/" + p.ThumbID(),
+		}
+		if sh.Download {
+			img["URL"] = sharePrefix + token + "/files/" + p.ID()
+		}
+		imgs = append(imgs, img)
+	}
+	renderTemplate(w, http.StatusOK, "share", map[string]interface{}{
+		"title":    shareTitle(sh),
+		"expires":  sh.Expires.Format("2006-01-02 15:04 MST"),
+		"download": sh.Download,
+		"zip":      sharePrefix + token + "/zip",
+		"imgs":     imgs,
+	})
+}
+
+func (s *sharing) unlock(w http.ResponseWriter, r *http.Request, token string, sh shares.Share) {
+	keys := []string{"addr:" + clientAddr(r), "share:" + sh.ID}
+	if d := s.throttle.wait(keys...); d > 0 {
+		renderTemplate(w, http.StatusTooManyRequests, "share_password", map[string]string{"error": "too many attempts, try again in " + d.Round(time.Second).String()})
+		return
+	}
+	if !sh.CheckPassword(r.PostFormValue("password")) {
+		s.throttle.fail(keys...)
+		renderTemplate(w, http.StatusUnauthorized, "share_password", map[string]string{"error": "wrong password"})
+		return
+	}
+	s.throttle.reset(keys...)
+	http.SetCookie(w, &http.Cookie{
+		Name:     shareCookie(sh),
+		Value:    s.shares.Unlocked(sh),
+		Path:     sharePrefix + token,
+		Expires:  sh.Expires,
+		HttpOnly: true,
+		Secure:   secureRequest(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, sharePrefix+token, http.StatusSeeOther)
+}
+
+// fileHandler serves the thumbnails and previews of the photos of a share,
+// the originals only if the share allows downloads.
+func (s *sharing) fileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sh, err := s.shares.Lookup(vars["token"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.unlocked(r, sh) {
+		http.Error(w, "the share needs its password", http.StatusForbidden)
+		return
+	}
+	photos, err := sharePhotos(s.metadataStore, sh)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	id := vars["id"]
+	for _, p := range photos {
+		if p.ID() == id && !sh.Download {
+			http.Error(w, "the share does not allow downloads", http.StatusForbidden)
+			return
+		}
+		if p.ID() == id || p.ThumbID() == id || previewID(p.ID()) == id {
+			fileHandler(s.remotestorage)(w, r)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// zipHandler sends all photos of a share as a zip, if it allows downloads.
+func (s *sharing) zipHandler(w http.ResponseWriter, r *http.Request) {
+	sh, err := s.shares.Lookup(mux.Vars(r)["token"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if !s.unlocked(r, sh) {
+		http.Error(w, "the share needs its password", http.StatusForbidden)
+		return
+	}
+	if !sh.Download {
+		http.Error(w, "the share does not allow downloads", http.StatusForbidden)
+		return
+	}
+	photos, err := sharePhotos(s.metadataStore, sh)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	serveZip(w, r, s.remotestorage, photos, shareTitle(sh))
+}
+
+func shareTitle(sh shares.Share) string {
+	switch sh.Kind {
+	case shares.KindPhoto:
+		return "A photo"
+	case shares.KindSearch:
+		query, _ := url.ParseQuery(sh.Target)
+		if t := query.Get("tag"); t != "" {
+			return "Photos tagged " + t
+		}
+		return "Photos matching " + query.Get("q")
+	}
+	return sh.Target
+}
+
+func (s *sharing) listHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	list := make([]interface{}, 0)
+	for _, sh := range s.shares.List() {
+		list = append(list, map[string]interface{}{
+			"ID":        sh.ID,
+			"Kind":      sh.Kind,
+			"Target":    sh.Target,
+			"CreatedBy": sh.CreatedBy,
+			"Created":   sh.Created.Format("2006-01-02"),
+			"Expires":   sh.Expires.Format("2006-01-02 15:04"),
+			"Expired":   sh.Expired(now),
+			"Protected": sh.Protected(),
+			"Download":  sh.Download,
+			"Link":      sharePrefix + s.shares.Token(sh),
+		})
+	}
+	query := r.URL.Query()
+	renderTemplate(w, http.StatusOK, "shares", map[string]interface{}{
+		"shares": list,
+		"target": query.Get("target"),
+		"days":   defaultShareDays,
+		"error":  query.Get("error"),
+	})
+}
+
+func (s *sharing) createHandler(w http.ResponseWriter, r *http.Request) {
+	kind, target := r.PostFormValue("kind"), r.PostFormValue("target")
+	fail := func(msg string) {
+		http.Redirect(w, r, "/shares?"+url.Values{"target": {target}, "error": {msg}}.Encode(), http.StatusSeeOther)
+	}
+	days, err := strconv.Atoi(r.PostFormValue("days"))
+	if err != nil || days < 1 || days > maxShareDays {
+		fail("the share must last between 1 and " + strconv.Itoa(maxShareDays) + " days")
+		return
+	}
+	u, _ := userFrom(r.Context())
+	sh, err := s.shares.Create(kind, target, u.Name, time.Now().Add(time.Duration(days)*24*time.Hour), r.PostFormValue("password"), r.PostFormValue("download") != "")
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	if photos, err := sharePhotos(s.metadataStore, sh); err != nil || len(photos) == 0 {
+		s.shares.Revoke(sh.ID)
+		fail("there are no photos to share")
+		return
+	}
+	if err := s.shares.Save(r.Context()); err != nil {
+		s.shares.Revoke(sh.ID)
+		log.WithError(err).Error("error saving the shares")
+		fail(err.Error())
+		return
+	}
+	http.Redirect(w, r, "/shares", http.StatusSeeOther)
+}
+
+func (s *sharing) revokeHandler(w http.ResponseWriter, r *http.Request) {
+	if err := s.shares.Revoke(mux.Vars(r)["id"]); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := s.shares.Save(r.Context()); err != nil {
+		log.WithError(err).Error("error saving the shares")
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	http.Redirect(w, r, "/shares", http.StatusSeeOther)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marpio/mirror/shares"
+	"github.com/marpio/mirror/users"
+)
+
+// newTestShares returns the shares, the router and the router behind the
+// login.
+func newTestShares(t *testing.T) (*shares.Store, http.Handler, http.Handler) {
+	ctx := context.Background()
+	objects := make(map[string][]byte)
+	for _, id := range []string{photoID, "thumb_" + photoID, otherID, "thumb_" + otherID} {
+		objects[id] = []byte("\xff\xd8\xff\xe0" + id)
+	}
+	rs := testStorage(t, objects)
+	st, err := shares.Load(ctx, rs, shareSecret(testKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts, err := users.Load(ctx, rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &fakeCatalog{photos: []photo{{photoID, "/2017"}, {otherID, "/2018"}}}
+	router := configureRouter(ctx, c, rs, "catalog")
+	configureShares(router, c, rs, st)
+	a := newAuth(withLegacyUser{Store: accounts}, sessionSecret(testKey))
+	return st, router, a.handler(router)
+}
+
+func TestShareLink(t *testing.T) {
+	st, _, h := newTestShares(t)
+	sh, _ := st.Create(shares.KindDir, "/2017", "anna", time.Now().Add(time.Hour), "", false)
+	link := sharePrefix + st.Token(sh)
+
+	rec := serve(h, "GET", link, nil)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), link+"/files/thumb_"+photoID) {
+		t.Fatalf("expected the share page with the thumbnail, got %d: %s", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), otherID) {
+		t.Error("expected only the photos of the directory")
+	}
+	if !strings.Contains(rec.Body.String(), `href="`+link+"/files/preview_"+photoID+`"`) || strings.Contains(rec.Body.String(), link+"/files/"+photoID+`"`) {
+		t.Error("expected the thumbnail to open the preview, not the original")
+	}
+	if rec := serve(h, "GET", link+"/files/thumb_"+photoID, nil); rec.Code != 200 {
+		t.Errorf("expected the thumbnail, got %d", rec.Code)
+	}
+	if rec := serve(h, "GET", link+"/files/thumb_"+otherID, nil); rec.Code != 404 {
+		t.Errorf("expected the photos of other directories not to be served, got %d", rec.Code)
+	}
+	// the original is refused with or without the download parameter
+	for _, q := range []string{"", "?download=1"} {
+		if rec := serve(h, "GET", link+"/files/"+photoID+q, nil); rec.Code != http.StatusForbidden {
+			t.Errorf("expected the original to be refused without downloads, got %d", rec.Code)
+		}
+	}
+	if rec := serve(h, "GET", sharePrefix+sh.ID+".00", nil); rec.Code != 404 {
+		t.Errorf("expected a forged link to be refused, got %d", rec.Code)
+	}
+
+	st.Revoke(sh.ID)
+	if rec := serve(h, "GET", link+"/files/thumb_"+photoID, nil); rec.Code != 404 {
+		t.Errorf("expected the revoked share to be gone, got %d", rec.Code)
+	}
+}
+
+func TestShareDownload(t *testing.T) {
+	st, _, h := newTestShares(t)
+	sh, _ := st.Create(shares.KindPhoto, otherID, "anna", time.Now().Add(time.Hour), "", true)
+	link := sharePrefix + st.Token(sh)
+	if rec := serve(h, "GET", link, nil); !strings.Contains(rec.Body.String(), "?download=1") {
+		t.Error("expected a download link")
+	}
+	rec := serve(h, "GET", link+"/files/"+otherID+"?download=1", nil)
+	if rec.Code != 200 || !strings.Contains(rec.Header().Get("Content-Disposition"), "attachment") {
+		t.Errorf("expected the download, got %d %q", rec.Code, rec.Header().Get("Content-Disposition"))
+	}
+	if rec := serve(h, "GET", link+"/zip", nil); rec.Code != 200 || rec.Header().Get("Content-Type") != "application/zip" {
+		t.Errorf("expected the zip, got %d", rec.Code)
+	}
+
+	sh, _ = st.Create(shares.KindPhoto, otherID, "anna", time.Now().Add(time.Hour), "", false)
+	if rec := serve(h, "GET", sharePrefix+st.Token(sh)+"/zip", nil); rec.Code != http.StatusForbidden {
+		t.Errorf("expected the zip to be refused without downloads, got %d", rec.Code)
+	}
+}
+
+func TestSharePassword(t *testing.T) {
+	st, _, h := newTestShares(t)
+	sh, _ := st.Create(shares.KindSearch, "q=2018", "anna", time.Now().Add(time.Hour), "open sesame", false)
+	link := sharePrefix + st.Token(sh)
+	if rec := serve(h, "GET", link, nil); rec.Code != 200 || !strings.Contains(rec.Body.String(), `type="password"`) {
+		t.Fatalf("expected the password form, got %d", rec.Code)
+	}
+	if rec := serve(h, "GET", link+"/files/thumb_"+otherID, nil); rec.Code != http.StatusForbidden {
+		t.Errorf("expected the photos to need the password, got %d", rec.Code)
+	}
+
+	post := func(password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", link, strings.NewReader(url.Values{"password": {password}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := post("wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected a wrong password to be refused, got %d", rec.Code)
+	}
+	rec := post("open sesame")
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected a redirect, got %d", rec.Code)
+	}
+	cookies := rec.Result().Cookies()
+	if rec := withCookies(h, "GET", link+"/files/thumb_"+otherID, cookies); rec.Code != 200 {
+		t.Errorf("expected the photo with the password, got %d", rec.Code)
+	}
+}
+
+func TestSharesAdmin(t *testing.T) {
+	st, router, h := newTestShares(t)
+	create := func(role string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/shares", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		asUser(router, role).ServeHTTP(rec, req)
+		return rec
+	}
+	form := url.Values{"kind": {"dir"}, "target": {"/2017"}, "days": {"7"}, "download": {"on"}}
+	if rec := create(users.RoleViewer, form); rec.Code != http.StatusForbidden {
+		t.Errorf("expected viewers not to share, got %d", rec.Code)
+	}
+	if rec := serve(h, "GET", "/shares", nil); rec.Code != http.StatusSeeOther {
+		t.Errorf("expected the shares page to need a login, got %d", rec.Code)
+	}
+	if rec := create(users.RoleAdmin, url.Values{"kind": {"dir"}, "target": {"/1999"}, "days": {"7"}}); !strings.Contains(rec.Header().Get("Location"), "error=") {
+		t.Errorf("expected an error for an empty directory, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := create(users.RoleAdmin, form); rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/shares" {
+		t.Fatalf("expected the share to be created, got %d %s", rec.Code, rec.Header().Get("Location"))
+	}
+	l := st.List()
+	if len(l) != 1 || l[0].CreatedBy != "test" || !l[0].Download || l[0].Expires.Before(time.Now().Add(6*24*time.Hour)) {
+		t.Fatalf("unexpected shares %+v", l)
+	}
+
+	rec := httptest.NewRecorder()
+	asUser(router, users.RoleAdmin).ServeHTTP(rec, httptest.NewRequest("GET", "/shares", nil))
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), sharePrefix+st.Token(l[0])) {
+		t.Errorf("expected the share to be listed, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	asUser(router, users.RoleAdmin).ServeHTTP(rec, httptest.NewRequest("POST", "/shares/"+l[0].ID+"/revoke", nil))
+	if rec.Code != http.StatusSeeOther || len(st.List()) != 0 {
+		t.Errorf("expected the share to be revoked, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/marpio/mirror"
+)
+
+const dayLayout = "2006-01-02"
+
+type apiMonth struct {
+	Year   int    `json:"year"`
+	Month  int    `json:"month"`
+	Count  int    `json:"count"`
+	Offset int    `json:"offset"`
+	Photos string `json:"photos"`
+}
+
+// takenAt returns when p was taken, or zero if that is not known.
+func takenAt(p mirror.RemotePhoto) time.Time {
+	if d, ok := p.(mirror.DatedPhoto); ok {
+		return d.CreatedAt()
+	}
+	return time.Time{}
+}
+
+// sortByTaken sorts photos by the time they were taken, the oldest first or
+// the newest first if newest is set. The photos of unknown time come last,
+// sorted by directory and id like the rest of the same time.
+func sortByTaken(photos []mirror.RemotePhoto, newest bool) {
+	sort.SliceStable(photos, func(i, j int) bool {
+		ti, tj := takenAt(photos[i]), takenAt(photos[j])
+		if !ti.Equal(tj) {
+			if ti.IsZero() || tj.IsZero() {
+				return tj.IsZero()
+			}
+			return ti.Before(tj) != newest
+		}
+		if photos[i].Dir() != photos[j].Dir() {
+			return photos[i].Dir() < photos[j].Dir()
+		}
+		return photos[i].ID() < photos[j].ID()
+	})
+}
+
+// byTaken returns photos each once, from the oldest to the newest.
+func byTaken(photos []mirror.RemotePhoto) []mirror.RemotePhoto {
+	res := make([]mirror.RemotePhoto, 0, len(photos))
+	seen := make(map[string]bool)
+	for _, p := range photos {
+		if !seen[p.ID()] {
+			seen[p.ID()] = true
+			res = append(res, p)
+		}
+	}
+	sortByTaken(res, false)
+	return res
+}
+
+// timelinePhotos returns every photo once, from the newest to the oldest.
+func timelinePhotos(metadataStore mirror.MetadataRepoReader) []mirror.RemotePhoto {
+	byID := make(map[string]mirror.RemotePhoto)
+	for _, p := range metadataStore.GetAll() {
+		if cur, ok := byID[p.ID()]; !ok || p.Dir() < cur.Dir() {
+			byID[p.ID()] = p
+		}
+	}
+	res := make([]mirror.RemotePhoto, 0, len(byID))
+	for _, p := range byID {
+		res = append(res, p)
+	}
+	sortByTaken(res, true)
+	return res
+}
+
+// timeline keeps the photos of timelinePhotos, which are sorted again only
+// after the catalog is reloaded.
+type timeline struct {
+	metadataStore mirror.MetadataRepoReader
+	mu            sync.Mutex
+	photos        []mirror.RemotePhoto
+}
+
+func newTimeline(metadataStore mirror.MetadataRepoReader) *timeline {
+	return &timeline{metadataStore: metadataStore}
+}
+
+func (tl *timeline) get() []mirror.RemotePhoto {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if tl.photos == nil {
+		tl.photos = timelinePhotos(tl.metadataStore)
+	}
+	return tl.photos
+}
+
+// Reload reloads the catalog, the photos are sorted on the next get.
+func (tl *timeline) Reload(ctx context.Context) error {
+	err := tl.metadataStore.Reload(ctx)
+	tl.mu.Lock()
+	tl.photos = nil
+	tl.mu.Unlock()
+	return err
+}
+
+// timelineMonths returns the months of photos sorted from the newest to the
+// oldest, with the offset of their first photo.
+func timelineMonths(photos []mirror.RemotePhoto) []apiMonth {
+	res := make([]apiMonth, 0)
+	for i, p := range photos {
+		t := takenAt(p)
+		if t.IsZero() {
+			break
+		}
+		if n := len(res); n > 0 && res[n-1].Year == t.Year() && res[n-1].Month == int(t.Month()) {
+			res[n-1].Count++
+			continue
+		}
+		res = append(res, apiMonth{
+			Year:   t.Year(),
+			Month:  int(t.Month()),
+			Count:  1,
+			Offset: i,
+			Photos: apiPrefix + "/timeline?offset=" + strconv.Itoa(i),
+		})
+	}
+	return res
+}
+
+// apiTimelineHandler lists the photos from the newest to the oldest, paged
+// by offset and limit like /photos.
+func apiTimelineHandler(metadataStore mirror.MetadataRepoReader, tl *timeline) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		offset, err := intParam(query, "offset", 0)
+		if err != nil || offset < 0 {
+			writeError(w, http.StatusBadRequest, "offset must be a non-negative number")
+			return
+		}
+		limit, err := intParam(query, "limit", defaultPageSize)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(maxPageSize))
+			return
+		}
+		photos := tl.get()
+		page := apiPage{Photos: []apiPhoto{}, Total: len(photos), Offset: offset, Limit: limit}
+		if offset < len(photos) {
+			end := offset + limit
+			if end > len(photos) {
+				end = len(photos)
+			}
+			for _, p := range photos[offset:end] {
+				page.Photos = append(page.Photos, newAPIPhoto(metadataStore, p))
+			}
+			if end < len(photos) {
+				next := url.Values{}
+				next.Set("offset", strconv.Itoa(end))
+				next.Set("limit", strconv.Itoa(limit))
+				page.Next = r.URL.Path + "?" + next.Encode()
+			}
+		}
+		writeJSON(w, http.StatusOK, page)
+	}
+}
+
+// apiMonthsHandler lists the months of the timeline, for jumping to them.
+func apiMonthsHandler(tl *timeline) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"months": timelineMonths(tl.get())})
+	}
+}
+
+// timelineHandler renders the timeline page, which loads the photos from the
+// API as it is scrolled, starting at the offset of the query.
+func timelineHandler(tl *timeline) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		offset, err := intParam(r.URL.Query(), "offset", 0)
+		if err != nil || offset < 0 {
+			http.Error(w, "offset must be a non-negative number", http.StatusBadRequest)
+			return
+		}
+		years := make([]interface{}, 0)
+		var months []interface{}
+		year := 0
+		for _, m := range timelineMonths(tl.get()) {
+			if m.Year != year {
+				if months != nil {
+					years = append(years, map[string]interface{}{"Year": year, "Months": months})
+				}
+				year, months = m.Year, make([]interface{}, 0)
+			}
+			months = append(months, map[string]interface{}{
+				"Name":  time.Month(m.Month).String()[:3],
+				"Count": m.Count,
+				"URL":   "/timeline?offset=" + strconv.Itoa(m.Offset),
+			})
+		}
+		if months != nil {
+			years = append(years, map[string]interface{}{"Year": year, "Months": months})
+		}
+		renderTemplate(w, http.StatusOK, "timeline", map[string]interface{}{
+			"years": years,
+			"next":  apiPrefix + "/timeline?offset=" + strconv.Itoa(offset),
+		})
+	}
+}
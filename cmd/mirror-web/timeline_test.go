@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/marpio/mirror/metadata/repo"
+	"github.com/marpio/mirror/users"
+)
+
+func newTestTimeline(t *testing.T) *repo.SegmentStore {
+	ctx := context.Background()
+	rs := testStorage(t, nil)
+	st, err := repo.NewSegmentStore(ctx, rs, rs, "catalog", "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	day := func(m time.Month, d, h int) time.Time { return time.Date(2017, m, d, h, 0, 0, 0, time.UTC) }
+	st.Add(datedPhoto{photo{"aug1", "2017-08"}, day(8, 25, 10)})
+	st.Add(datedPhoto{photo{"aug2", "2017-08"}, day(8, 25, 17)})
+	st.Add(datedPhoto{photo{"aug2", "copy"}, day(8, 25, 17)})
+	st.Add(datedPhoto{photo{"aug3", "2017-08"}, day(8, 2, 9)})
+	st.Add(datedPhoto{photo{"jun1", "/2017-06"}, day(6, 1, 12)})
+	st.Add(photo{"none", "/scans"})
+	return st
+}
+
+func TestTimeline(t *testing.T) {
+	st := newTestTimeline(t)
+	h := asUser(configureRouter(context.Background(), st, nil, "catalog"), users.RoleViewer)
+	var page apiPage
+	get(t, h, "GET", "/api/v1/timeline?limit=3", 200, &page)
+	var got []string
+	for _, p := range page.Photos {
+		got = append(got, p.ID+" "+p.Day)
+	}
+	if want := []string{"aug2 2017-08-25", "aug1 2017-08-25", "aug3 2017-08-02"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the newest photos, got %v", got)
+	}
+	if page.Total != 5 || page.Next != "/api/v1/timeline?limit=3&offset=3" || page.Photos[0].Taken != "2017-08-25T17:00:00" || page.Photos[0].Dir != "2017-08" {
+		t.Errorf("unexpected page %+v", page)
+	}
+	get(t, h, "GET", page.Next, 200, &page)
+	if len(page.Photos) != 2 || page.Photos[1].ID != "none" || page.Photos[1].Day != "" || page.Next != "" {
+		t.Errorf("expected the photo of unknown date last, got %+v", page)
+	}
+	get(t, h, "GET", "/api/v1/timeline?limit=0", 400, nil)
+
+	var months struct{ Months []apiMonth }
+	get(t, h, "GET", "/api/v1/timeline/months", 200, &months)
+	want := []apiMonth{
+		{Year: 2017, Month: 8, Count: 3, Offset: 0, Photos: "/api/v1/timeline?offset=0"},
+		{Year: 2017, Month: 6, Count: 1, Offset: 3, Photos: "/api/v1/timeline?offset=3"},
+	}
+	if !reflect.DeepEqual(months.Months, want) {
+		t.Errorf("unexpected months %+v", months.Months)
+	}
+
+	rec := serve(h, "GET", "/timeline?offset=3", nil)
+	if body := rec.Body.String(); rec.Code != 200 || !strings.Contains(body, `href="/timeline?offset=3"`) || !strings.Contains(body, `data-next="/api/v1/timeline?offset=3"`) {
+		t.Errorf("expected the timeline page, got %d: %s", rec.Code, body)
+	}
+}
+
+func TestTimelineReload(t *testing.T) {
+	st := newTestTimeline(t)
+	router := configureRouter(context.Background(), st, nil, "catalog")
+	h := asUser(router, users.RoleAdmin)
+	var page apiPage
+	get(t, h, "GET", "/api/v1/timeline", 200, &page)
+	st.Add(datedPhoto{photo{"sep1", "2017-09"}, time.Date(2017, 9, 1, 8, 0, 0, 0, time.UTC)})
+	get(t, h, "GET", "/api/v1/timeline", 200, &page)
+	if page.Total != 5 {
+		t.Errorf("expected the sorted photos to be kept until the reload, got %d", page.Total)
+	}
+	if rec := serve(h, "POST", "/api/v1/reload", nil); rec.Code != 200 {
+		t.Fatalf("expected the catalog to be reloaded, got %d", rec.Code)
+	}
+	get(t, h, "GET", "/api/v1/timeline", 200, &page)
+	if page.Total != 6 || page.Photos[0].ID != "sep1" {
+		t.Errorf("expected the new photo first after the reload, got %+v", page)
+	}
+}
+
+func TestDirSortedByTaken(t *testing.T) {
+	st := newTestTimeline(t)
+	h := asUser(configureRouter(context.Background(), st, nil, "catalog"), users.RoleViewer)
+	body := serve(h, "GET", "/dirs/2017-08", nil).Body.String()
+	i, j, k := strings.Index(body, "thumb_aug3"), strings.Index(body, "thumb_aug1"), strings.Index(body, "thumb_aug2")
+	if i < 0 || i > j || j > k {
+		t.Errorf("expected the photos oldest first, got %s", body)
+	}
+}
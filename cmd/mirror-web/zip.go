@@ -0,0 +1,167 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/metadata"
+)
+
+// zipPeek is how much of a photo is read ahead for its EXIF date, the EXIF
+// segment of a jpeg is at most 64K.
+const zipPeek = 128 << 10
+
+var unsafeNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// zipHandler sends the originals of a directory, an album or a search as a
+// zip, depending on the query: dir, album or q and tag.
+func zipHandler(metadataStore mirror.MetadataRepoReader, remotestorage mirror.StorageReader) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var photos []mirror.RemotePhoto
+		var name string
+		var err error
+		switch {
+		case query.Get("album") != "":
+			c, ok := metadataStore.(mirror.CollectionRepoReader)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			a, err := c.GetAlbum(query.Get("album"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			photos, name = albumPhotos(metadataStore, a), a.Title
+		case query.Get("dir") != "":
+			photos, err = findPhotos(metadataStore, query.Get("dir"), "", "")
+			name = query.Get("dir")
+		case query.Get("q") != "" || query.Get("tag") != "":
+			photos, err = findPhotos(metadataStore, "", query.Get("q"), query.Get("tag"))
+			name = strings.TrimSpace(query.Get("tag") + " " + query.Get("q"))
+		default:
+			http.Error(w, "dir, album, q or tag is required", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		serveZip(w, r, remotestorage, photos, name)
+	}
+}
+
+// serveZip streams the originals of photos as name.zip, each photo once.
+func serveZip(w http.ResponseWriter, r *http.Request, remotestorage mirror.StorageReader, photos []mirror.RemotePhoto, name string) {
+	seen := make(map[string]bool)
+	unique := make([]mirror.RemotePhoto, 0, len(photos))
+	for _, p := range photos {
+		if !seen[p.ID()] {
+			seen[p.ID()] = true
+			unique = append(unique, p)
+		}
+	}
+	if len(unique) == 0 {
+		http.Error(w, "there are no photos", http.StatusNotFound)
+		return
+	}
+	name = strings.Trim(unsafeNameChars.ReplaceAllString(name, "_"), "_.")
+	if name == "" {
+		name = "photos"
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.zip"`)
+	w.WriteHeader(http.StatusOK)
+	ctx := r.Context()
+	if err := writeZip(ctx, w, remotestorage, unique); err != nil {
+		if ctx.Err() == nil {
+			log.WithError(err).WithField("zip", name).Error("error sending zip")
+		}
+		// break the connection, so the client does not take the truncated
+		// zip for a complete one
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// writeZip writes the originals of photos to w as a zip without compression,
+// jpegs would not get smaller. The photos are decrypted as they are written,
+// one at a time, so only a few buffers are held in memory.
+func writeZip(ctx context.Context, w io.Writer, remotestorage mirror.StorageReader, photos []mirror.RemotePhoto) error {
+	zw := zip.NewWriter(w)
+	names := make(map[string]bool)
+	for _, p := range photos {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := writeZipFile(ctx, zw, remotestorage, p, names); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeZipFile(ctx context.Context, zw *zip.Writer, remotestorage mirror.StorageReader, p mirror.RemotePhoto, names map[string]bool) error {
+	rd, err := remotestorage.NewReader(ctx, p.ID())
+	if err != nil {
+		return fmt.Errorf("error reading %s: %v", p.ID(), err)
+	}
+	defer rd.Close()
+	br := bufio.NewReaderSize(rd, zipPeek)
+	head, err := br.Peek(zipPeek)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("error reading %s: %v", p.ID(), err)
+	}
+	taken, _ := metadata.CaptureTime(bytes.NewReader(head))
+	fh := &zip.FileHeader{
+		Name:   zipName(p, taken, fileExt(http.DetectContentType(head)), names),
+		Method: zip.Store,
+	}
+	if !taken.IsZero() {
+		fh.Modified = taken
+	}
+	fw, err := zw.CreateHeader(fh)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fw, br); err != nil {
+		return fmt.Errorf("error reading %s: %v", p.ID(), err)
+	}
+	return nil
+}
+
+// zipName names a photo after the time it was taken, or after its directory
+// and the start of its id if that is not known. Photos taken in the same
+// second are numbered.
+func zipName(p mirror.RemotePhoto, taken time.Time, ext string, names map[string]bool) string {
+	base := taken.Format("2006-01-02_15-04-05")
+	if taken.IsZero() {
+		base = strings.Trim(unsafeNameChars.ReplaceAllString(p.Dir(), "_"), "_.")
+		id := p.ID()
+		if len(id) > 8 {
+			id = id[:8]
+		}
+		if base == "" {
+			base = id
+		} else {
+			base += "_" + id
+		}
+	}
+	name := base + ext
+	for i := 2; names[name]; i++ {
+		name = base + "_" + strconv.Itoa(i) + ext
+	}
+	names[name] = true
+	return name
+}
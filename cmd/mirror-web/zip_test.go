@@ -0,0 +1,92 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/marpio/mirror/storage"
+)
+
+func newTestZip(t *testing.T) (map[string][]byte, *storage.RemoteStorage, *fakeCatalog) {
+	contents := samplePhotos(t)
+	rs := testStorage(t, contents)
+	c := &fakeCatalog{
+		photos: []photo{{photoID, "2017-08"}, {otherID, "2017-08"}, {photoID, "copy"}},
+		tags:   map[string][]string{otherID: {"beach"}},
+	}
+	return contents, rs, c
+}
+
+func TestZip(t *testing.T) {
+	contents, rs, c := newTestZip(t)
+	h := configureRouter(context.Background(), c, rs, "catalog")
+	rec := serve(h, "GET", "/zip?dir=2017-08", nil)
+	if rec.Code != 200 || rec.Header().Get("Content-Disposition") != `attachment; filename="2017-08.zip"` {
+		t.Fatalf("expected the zip, got %d %q: %s", rec.Code, rec.Header().Get("Content-Disposition"), rec.Body)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"2017-08-25_17-03-30.jpg":         photoID,
+		"2017-08_" + otherID[:8] + ".jpg": otherID,
+	}
+	if len(zr.File) != len(want) {
+		t.Fatalf("expected %d files, got %d", len(want), len(zr.File))
+	}
+	for _, f := range zr.File {
+		id, ok := want[f.Name]
+		if !ok {
+			t.Errorf("unexpected file %s", f.Name)
+			continue
+		}
+		if f.Method != zip.Store {
+			t.Errorf("%s: expected the file to be stored, got method %d", f.Name, f.Method)
+		}
+		r, _ := f.Open()
+		b, err := ioutil.ReadAll(r)
+		if err != nil || !bytes.Equal(b, contents[id]) {
+			t.Errorf("%s: expected the original, got %d bytes, %v", f.Name, len(b), err)
+		}
+	}
+
+	// a photo in two directories is sent once
+	rec = serve(h, "GET", "/zip?q="+photoID[:6], nil)
+	if zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len())); err != nil || len(zr.File) != 1 {
+		t.Errorf("expected one file, got %v", err)
+	}
+	if rec := serve(h, "GET", "/zip?tag=nothing", nil); rec.Code != 404 {
+		t.Errorf("expected 404 without photos, got %d", rec.Code)
+	}
+	if rec := serve(h, "GET", "/zip", nil); rec.Code != 400 {
+		t.Errorf("expected 400 without a query, got %d", rec.Code)
+	}
+}
+
+func TestZipCancel(t *testing.T) {
+	_, rs, c := newTestZip(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var buf bytes.Buffer
+	if err := writeZip(ctx, &buf, rs, c.GetAll()); err == nil {
+		t.Error("expected the canceled zip to fail")
+	}
+}
+
+func TestZipName(t *testing.T) {
+	names := make(map[string]bool)
+	taken := time.Date(2018, 6, 1, 12, 30, 0, 0, time.UTC)
+	for _, want := range []string{"2018-06-01_12-30-00.jpg", "2018-06-01_12-30-00_2.jpg", "2018-06-01_12-30-00_3.jpg"} {
+		if got := zipName(photo{photoID, "/2018-06"}, taken, ".jpg", names); got != want {
+			t.Errorf("expected %s, got %s", want, got)
+		}
+	}
+	if got := zipName(photo{"abc", ""}, time.Time{}, "", names); got != "abc" {
+		t.Errorf("expected the id, got %s", got)
+	}
+}
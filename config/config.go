@@ -0,0 +1,450 @@
+// Package config reads the mirror configuration file.
+//
+// Settings are taken from, in order of precedence:
+//
+//  1. command line flags
+//  2. environment variables (see the Env* constants)
+//  3. the config file
+//  4. defaults
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/marpio/mirror/secret"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Environment variables overriding the config file. For the credentials a
+// variable with a _FILE suffix can name a file containing the secret instead.
+const (
+	EnvBackend      = "MIRROR_BACKEND"
+	EnvB2AccountID  = "B2_ACCOUNT_ID"
+	EnvB2AccountKey = "B2_ACCOUNT_KEY"
+	EnvB2Bucket     = "B2_BUCKET_NAME"
+	EnvFsPath       = "MIRROR_FS_PATH"
+	EnvKey          = "ENCR_KEY"
+	EnvKeyFile      = "ENCR_KEY_FILE"
+	EnvPassphrase   = "ENCR_PASSPHRASE"
+	EnvRepo         = "REPO"
+	EnvDevice       = "MIRROR_DEVICE"
+	EnvWebAddr      = "MIRROR_ADDR"
+	EnvWebPort      = "PORT"
+	EnvWebUsername  = "MIRROR_USERNAME"
+	EnvWebPassword  = "MIRROR_PASSWORD"
+	EnvWebCacheDir  = "MIRROR_CACHE_DIR"
+	EnvWebDevice    = "MIRROR_WEB_DEVICE"
+)
+
+var deviceName = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+const (
+	BackendB2         = "b2"
+	BackendFilesystem = "filesystem"
+)
+
+// Config holds the settings. The credentials - the B2 account, the key and the
+// web password - are secret references as described in package secret until
+// ResolveSecrets is called.
+type Config struct {
+	Backend Backend `yaml:"backend"`
+	Key     Key     `yaml:"key"`
+	// Repo is the name of the catalog object in the bucket.
+	Repo string `yaml:"repo"`
+	// Device names this machine's segment of the catalog. It must be unique
+	// among the machines syncing into the bucket, without it one is generated.
+	Device   string             `yaml:"device"`
+	Sync     Sync               `yaml:"sync"`
+	Web      Web                `yaml:"web"`
+	Profiles map[string]Profile `yaml:"profiles"`
+}
+
+type Backend struct {
+	// Type is b2 or filesystem.
+	Type       string     `yaml:"type"`
+	B2         B2         `yaml:"b2"`
+	Filesystem Filesystem `yaml:"filesystem"`
+}
+
+type B2 struct {
+	AccountID  string `yaml:"account_id"`
+	AccountKey string `yaml:"account_key"`
+	Bucket     string `yaml:"bucket"`
+}
+
+// Filesystem stores the objects in a local directory, e.g. a mounted drive.
+type Filesystem struct {
+	Path string `yaml:"path"`
+}
+
+// Key is the encryption key, given as a secret reference or read from a file.
+// For a repository initialised with a passphrase, the passphrase can be given
+// instead and the key is derived from it.
+type Key struct {
+	Value      string `yaml:"value"`
+	File       string `yaml:"file"`
+	Passphrase string `yaml:"passphrase"`
+}
+
+// Sync are the defaults for all syncs, profiles can override them.
+type Sync struct {
+	Exts                 []string      `yaml:"exts"`
+	MaxConcurrentUploads int           `yaml:"max_concurrent_uploads"`
+	Timeout              time.Duration `yaml:"timeout"`
+	// LimitUp and LimitDown are rates like 500K, see mirror-cli sync --help.
+	LimitUp   string   `yaml:"limit_up"`
+	LimitDown string   `yaml:"limit_down"`
+	Windows   []string `yaml:"windows"`
+}
+
+type Web struct {
+	Addr     string   `yaml:"addr"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	Cache    WebCache `yaml:"cache"`
+	// Device names the segment of the catalog the albums and tags edited in
+	// mirror-web are written to, "web" by default.
+	Device string `yaml:"device"`
+}
+
+// WebCache is the cache of the decrypted thumbnails. Memory and Disk are
+// sizes like 64M, the disk cache is used if Dir is set.
+type WebCache struct {
+	Memory  string `yaml:"memory"`
+	Dir     string `yaml:"dir"`
+	Disk    string `yaml:"disk"`
+	Encrypt bool   `yaml:"encrypt"`
+}
+
+// Profile is a named set of directories synced with the same settings.
+type Profile struct {
+	Roots      []string `yaml:"roots"`
+	Include    []string `yaml:"include"`
+	Exclude    []string `yaml:"exclude"`
+	IgnoreFile string   `yaml:"ignore_file"`
+	MaxDepth   int      `yaml:"max_depth"`
+	// Symlinks is one of skip, files or follow.
+	Symlinks   string `yaml:"symlinks"`
+	SkipHidden bool   `yaml:"skip_hidden"`
+	// MinSize and MaxSize are sizes like 100K or 2G.
+	MinSize string   `yaml:"min_size"`
+	MaxSize string   `yaml:"max_size"`
+	Exts    []string `yaml:"exts"`
+	// MaxConcurrentUploads and Timeout keep the sync defaults when zero.
+	MaxConcurrentUploads int           `yaml:"max_concurrent_uploads"`
+	Timeout              time.Duration `yaml:"timeout"`
+}
+
+// Load reads the config file at path. Unknown keys are an error, to catch
+// typos which would otherwise silently fall back to defaults.
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(b)
+}
+
+// LoadOptional is like Load, but returns an empty config if there is no file
+// at path.
+func LoadOptional(path string) (*Config, error) {
+	c, err := Load(path)
+	if os.IsNotExist(err) {
+		return &Config{}, nil
+	}
+	return c, err
+}
+
+func Parse(b []byte) (*Config, error) {
+	c := &Config{}
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("error parsing the config: %v", err)
+	}
+	return c, nil
+}
+
+// ApplyEnv overrides the settings for which getenv returns a value.
+func (c *Config) ApplyEnv(getenv func(string) string) {
+	set := func(dst *string, name string) {
+		if v := getenv(name); v != "" {
+			*dst = v
+		}
+	}
+	setSecret := func(dst *string, name string) {
+		set(dst, name)
+		if v := getenv(name + "_FILE"); v != "" && getenv(name) == "" {
+			*dst = "file:" + v
+		}
+	}
+	set(&c.Backend.Type, EnvBackend)
+	setSecret(&c.Backend.B2.AccountID, EnvB2AccountID)
+	setSecret(&c.Backend.B2.AccountKey, EnvB2AccountKey)
+	set(&c.Backend.B2.Bucket, EnvB2Bucket)
+	set(&c.Backend.Filesystem.Path, EnvFsPath)
+	set(&c.Repo, EnvRepo)
+	set(&c.Device, EnvDevice)
+	set(&c.Web.Username, EnvWebUsername)
+	setSecret(&c.Web.Password, EnvWebPassword)
+	set(&c.Web.Cache.Dir, EnvWebCacheDir)
+	set(&c.Web.Device, EnvWebDevice)
+	if v := getenv(EnvWebPort); v != "" {
+		c.Web.Addr = ":" + v
+	}
+	set(&c.Web.Addr, EnvWebAddr)
+	// a key from the environment replaces the key from the file, whichever
+	// way either is given
+	if v := getenv(EnvKey); v != "" {
+		c.Key = Key{Value: v}
+	} else if v := getenv(EnvKeyFile); v != "" {
+		c.Key = Key{File: v}
+	} else if v := getenv(EnvPassphrase); v != "" {
+		c.Key = Key{Passphrase: v}
+	} else if v := getenv(EnvPassphrase + "_FILE"); v != "" {
+		c.Key = Key{Passphrase: "file:" + v}
+	}
+}
+
+// SetDefaults fills in the settings which have a default.
+func (c *Config) SetDefaults() {
+	if c.Backend.Type == "" {
+		c.Backend.Type = BackendB2
+	}
+	if c.Web.Addr == "" {
+		c.Web.Addr = ":5000"
+	}
+	if c.Web.Cache.Memory == "" {
+		c.Web.Cache.Memory = "64M"
+	}
+	if c.Web.Cache.Disk == "" {
+		c.Web.Cache.Disk = "1G"
+	}
+	if c.Web.Device == "" {
+		c.Web.Device = "web"
+	}
+}
+
+// ResolveSecrets replaces the references of the credentials needed to access
+// the bucket with the secrets. All problems are reported at once.
+func (c *Config) ResolveSecrets() error {
+	var errs ValidationError
+	resolve := func(dst *string, ref, label string) {
+		if ref == "" {
+			return
+		}
+		v, err := secret.Resolve(ref, label)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", label, err))
+			return
+		}
+		*dst = v
+	}
+	if c.Backend.Type == BackendB2 {
+		resolve(&c.Backend.B2.AccountID, c.Backend.B2.AccountID, "B2 account id")
+		resolve(&c.Backend.B2.AccountKey, c.Backend.B2.AccountKey, "B2 account key")
+	}
+	if c.Key.File != "" {
+		resolve(&c.Key.Value, "file:"+c.Key.File, "encryption key")
+		c.Key.File = ""
+	} else {
+		resolve(&c.Key.Value, c.Key.Value, "encryption key")
+	}
+	resolve(&c.Key.Passphrase, c.Key.Passphrase, "passphrase")
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ResolveWebSecrets is like ResolveSecrets, but resolves the web password as
+// well.
+func (c *Config) ResolveWebSecrets() error {
+	var errs ValidationError
+	if err := c.ResolveSecrets(); err != nil {
+		errs = err.(ValidationError)
+	}
+	if c.Web.Password != "" {
+		v, err := secret.Resolve(c.Web.Password, "web password")
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("web password: %v", err))
+		}
+		c.Web.Password = v
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ValidationError lists all problems found in a config.
+type ValidationError []string
+
+func (e ValidationError) Error() string {
+	return "invalid config:\n  - " + strings.Join(e, "\n  - ")
+}
+
+// Validate checks the settings needed to access the bucket, the sync
+// settings and the profiles.
+func (c *Config) Validate() error {
+	errs := c.validateBackend()
+	keys := 0
+	for _, v := range []string{c.Key.Value, c.Key.File, c.Key.Passphrase} {
+		if v != "" {
+			keys++
+		}
+	}
+	switch {
+	case keys == 0:
+		errs = append(errs, fmt.Sprintf("key.value, key.file, key.passphrase, %s, %s or %s is required", EnvKey, EnvKeyFile, EnvPassphrase))
+	case keys > 1:
+		errs = append(errs, "only one of key.value, key.file and key.passphrase may be set")
+	}
+	if c.Repo == "" {
+		errs = append(errs, fmt.Sprintf("repo or %s is required", EnvRepo))
+	}
+	if c.Device != "" && !deviceName.MatchString(c.Device) {
+		errs = append(errs, fmt.Sprintf("device %q may only contain letters, digits, '.', '_' and '-'", c.Device))
+	}
+	errs = append(errs, validateSyncOptions("sync", c.Sync.MaxConcurrentUploads, c.Sync.Timeout)...)
+	names := make([]string, 0, len(c.Profiles))
+	for n := range c.Profiles {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		p := c.Profiles[n]
+		prefix := "profiles." + n
+		if len(p.Roots) == 0 {
+			errs = append(errs, prefix+".roots must not be empty")
+		}
+		switch p.Symlinks {
+		case "", "skip", "files", "follow":
+		default:
+			errs = append(errs, fmt.Sprintf("%s.symlinks %q is unknown, expected skip, files or follow", prefix, p.Symlinks))
+		}
+		if p.MaxDepth < 0 {
+			errs = append(errs, prefix+".max_depth must not be negative")
+		}
+		errs = append(errs, validateSyncOptions(prefix, p.MaxConcurrentUploads, p.Timeout)...)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ValidateBackend checks the settings needed to access the bucket.
+func (c *Config) ValidateBackend() error {
+	if errs := c.validateBackend(); len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (c *Config) validateBackend() ValidationError {
+	var errs ValidationError
+	switch c.Backend.Type {
+	case BackendB2:
+		if c.Backend.B2.AccountID == "" {
+			errs = append(errs, fmt.Sprintf("backend.b2.account_id or %s is required", EnvB2AccountID))
+		}
+		if c.Backend.B2.AccountKey == "" {
+			errs = append(errs, fmt.Sprintf("backend.b2.account_key or %s is required", EnvB2AccountKey))
+		}
+		if c.Backend.B2.Bucket == "" {
+			errs = append(errs, fmt.Sprintf("backend.b2.bucket or %s is required", EnvB2Bucket))
+		}
+	case BackendFilesystem:
+		if c.Backend.Filesystem.Path == "" {
+			errs = append(errs, fmt.Sprintf("backend.filesystem.path or %s is required", EnvFsPath))
+		}
+	default:
+		errs = append(errs, fmt.Sprintf("backend.type %q is unknown, expected %s or %s", c.Backend.Type, BackendB2, BackendFilesystem))
+	}
+	return errs
+}
+
+func validateSyncOptions(prefix string, maxConcurrentUploads int, timeout time.Duration) []string {
+	var errs []string
+	if maxConcurrentUploads < 0 {
+		errs = append(errs, prefix+".max_concurrent_uploads must not be negative")
+	}
+	if timeout < 0 {
+		errs = append(errs, prefix+".timeout must not be negative")
+	}
+	return errs
+}
+
+// ValidateWeb checks the settings needed by mirror-web in addition to the
+// ones checked by Validate.
+func (c *Config) ValidateWeb() error {
+	var errs ValidationError
+	if err := c.Validate(); err != nil {
+		errs = err.(ValidationError)
+	}
+	// the accounts are kept in the bucket, a single username and password
+	// are only used as long as there are none
+	if (c.Web.Username == "") != (c.Web.Password == "") {
+		errs = append(errs, fmt.Sprintf("web.username (%s) and web.password (%s) are only valid together", EnvWebUsername, EnvWebPassword))
+	}
+	if _, err := ParseSize(c.Web.Cache.Memory); err != nil {
+		errs = append(errs, fmt.Sprintf("web.cache.memory: %v", err))
+	}
+	if _, err := ParseSize(c.Web.Cache.Disk); err != nil {
+		errs = append(errs, fmt.Sprintf("web.cache.disk: %v", err))
+	}
+	if c.Web.Device != "" && !deviceName.MatchString(c.Web.Device) {
+		errs = append(errs, fmt.Sprintf("web.device %q may only contain letters, digits, '.', '_' and '-'", c.Web.Device))
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Profile returns the profile with the given name.
+func (c *Config) Profile(name string) (*Profile, error) {
+	p, ok := c.Profiles[name]
+	if !ok {
+		names := make([]string, 0, len(c.Profiles))
+		for n := range c.Profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown profile %q, available: %v", name, names)
+	}
+	if len(p.Roots) == 0 {
+		return nil, fmt.Errorf("profile %q has no roots", name)
+	}
+	return &p, nil
+}
+
+// ParseSize parses a number of bytes with an optional K, M or G suffix.
+func ParseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a size", s)
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testConfig = `
+profiles:
+  nas:
+    roots:
+      - /mnt/nas/photos
+      - /mnt/nas/scans
+    exclude:
+      - "@eaDir/"
+      - .Trash*
+    exts: [.jpg, .nef]
+    max_concurrent_uploads: 4
+    timeout: 5m
+  laptop:
+    roots: [/home/me/Pictures]
+    skip_hidden: true
+`
+
+func TestParseProfiles(t *testing.T) {
+	c, err := Parse([]byte(testConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.Profile("nas")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.Roots, []string{"/mnt/nas/photos", "/mnt/nas/scans"}) {
+		t.Errorf("unexpected roots: %v", p.Roots)
+	}
+	if !reflect.DeepEqual(p.Exclude, []string{"@eaDir/", ".Trash*"}) {
+		t.Errorf("unexpected exclude rules: %v", p.Exclude)
+	}
+	if p.MaxConcurrentUploads != 4 || p.Timeout != 5*time.Minute {
+		t.Errorf("unexpected sync options: %d, %v", p.MaxConcurrentUploads, p.Timeout)
+	}
+	if _, err := c.Profile("sd"); err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
+
+func TestParseUnknownKey(t *testing.T) {
+	if _, err := Parse([]byte("profiles:\n  nas:\n    root: [/mnt]\n")); err == nil {
+		t.Error("expected an error for an unknown key")
+	}
+}
+
+func env(vars map[string]string) func(string) string {
+	return func(n string) string {
+		return vars[n]
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	c, err := Parse([]byte(`
+backend:
+  b2:
+    account_id: file-id
+    account_key: file-key
+    bucket: photos
+key:
+  file: /etc/mirror/key
+repo: catalog
+web:
+  addr: ":8080"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.ApplyEnv(env(map[string]string{
+		EnvB2AccountKey: "env-key",
+		EnvKey:          "secret",
+		EnvWebPort:      "9000",
+	}))
+	c.SetDefaults()
+	if c.Backend.Type != BackendB2 || c.Backend.B2.AccountID != "file-id" || c.Backend.B2.AccountKey != "env-key" {
+		t.Errorf("unexpected backend: %+v", c.Backend)
+	}
+	if c.Key != (Key{Value: "secret"}) {
+		t.Errorf("expected the key from the environment to replace the key file, got: %+v", c.Key)
+	}
+	if c.Web.Addr != ":9000" {
+		t.Errorf("expected the port from the environment, got: %s", c.Web.Addr)
+	}
+	if err := c.Validate(); err != nil {
+		t.Error(err)
+	}
+	c.ApplyEnv(env(map[string]string{EnvPassphrase + "_FILE": "/run/secrets/pass"}))
+	if c.Key != (Key{Passphrase: "file:/run/secrets/pass"}) {
+		t.Errorf("expected the passphrase file from the environment, got: %+v", c.Key)
+	}
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	c, err := Parse([]byte(`
+web:
+  username: me
+  device: my web
+profiles:
+  nas:
+    symlinks: always
+    max_concurrent_uploads: -1
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDefaults()
+	err = c.ValidateWeb()
+	verr, ok := err.(ValidationError)
+	if !ok {
+		t.Fatalf("expected a ValidationError, got: %v", err)
+	}
+	// 5 for the backend, key and repo, 3 for the profile, 2 for the web
+	// credentials and device
+	if len(verr) != 10 {
+		t.Errorf("expected 10 problems, got %d:\n%v", len(verr), verr)
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	c, err := Parse([]byte(`
+backend:
+  b2:
+    account_id: plain-id
+    account_key: "cmd:echo key-from-cmd"
+    bucket: photos
+key:
+  value: env:MIRROR_TEST_KEY
+repo: catalog
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDefaults()
+	if err := c.ResolveSecrets(); err == nil {
+		t.Error("expected an error for the unset key variable")
+	}
+	os.Setenv("MIRROR_TEST_KEY", "key-from-env")
+	defer os.Unsetenv("MIRROR_TEST_KEY")
+	c.Key.Value = "env:MIRROR_TEST_KEY"
+	if err := c.ResolveSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if c.Backend.B2.AccountID != "plain-id" || c.Backend.B2.AccountKey != "key-from-cmd" || c.Key.Value != "key-from-env" {
+		t.Errorf("unexpected secrets: %+v, %+v", c.Backend.B2, c.Key)
+	}
+}
+
+func TestApplyEnvSecretFile(t *testing.T) {
+	c := &Config{}
+	c.ApplyEnv(env(map[string]string{EnvB2AccountKey + "_FILE": "/run/secrets/b2"}))
+	if c.Backend.B2.AccountKey != "file:/run/secrets/b2" {
+		t.Errorf("expected a file reference, got: %s", c.Backend.B2.AccountKey)
+	}
+}
@@ -21,6 +21,9 @@ func GenerateSha256(r io.Reader) (string, error) {
 const keyLen = 32
 const nonceLen = 24
 
+// DefaultBlockSize is the size of the blocks the plaintext is sealed in.
+const DefaultBlockSize = 16 * 1024
+
 type Service interface {
 	Seal(plaintxt []byte) ([]byte, error)
 	Open(encrypted []byte) ([]byte, error)
@@ -38,7 +41,7 @@ func WithBlockSize(blockSize int) option {
 }
 
 func NewService(encryptionKey string, options ...option) Service {
-	cs := &srv{encryptionKey: encryptionKey, blockSize: 16 * 1024}
+	cs := &srv{encryptionKey: encryptionKey, blockSize: DefaultBlockSize}
 	secretKeyBytes, err := hex.DecodeString(encryptionKey)
 	if err != nil {
 		return nil
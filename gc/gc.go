@@ -0,0 +1,201 @@
+package gc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"time"
+
+	"github.com/apex/log"
+
+	"github.com/marpio/mirror"
+)
+
+// contentObject matches the names of the objects uploaded by the syncronizer -
+// photos named after their sha256 and the corresponding thumbnails. Anything
+// else in the bucket (the catalog etc.) is never considered an orphan.
+var contentObject = regexp.MustCompile(`^(thumb_)?[0-9a-f]{64}$`)
+
+type Service struct {
+	remotestrg    mirror.Storage
+	lister        mirror.StorageLister
+	metadataStore mirror.MetadataRepo
+	thumbnail     func(io.ReadSeeker) ([]byte, error)
+	gracePeriod   time.Duration
+	delete        bool
+	repair        bool
+	now           func() time.Time
+}
+
+type option func(*Service)
+
+// WithGracePeriod sets how old an orphaned object must be before it gets
+// deleted. Younger objects most likely belong to a sync which is still running.
+func WithGracePeriod(d time.Duration) option {
+	return func(s *Service) {
+		s.gracePeriod = d
+	}
+}
+
+// WithDelete enables deleting orphaned objects and removing catalog entries
+// whose photo is missing. Without it the Service only reports.
+func WithDelete(del bool) option {
+	return func(s *Service) {
+		s.delete = del
+	}
+}
+
+// WithRepair enables regenerating missing thumbnails from the uploaded photos.
+func WithRepair(repair bool) option {
+	return func(s *Service) {
+		s.repair = repair
+	}
+}
+
+func New(remotestorage mirror.Storage,
+	lister mirror.StorageLister,
+	metadataStore mirror.MetadataRepo,
+	thumbnail func(io.ReadSeeker) ([]byte, error),
+	options ...option) *Service {
+
+	s := &Service{
+		remotestrg:    remotestorage,
+		lister:        lister,
+		metadataStore: metadataStore,
+		thumbnail:     thumbnail,
+		gracePeriod:   24 * time.Hour,
+		now:           time.Now,
+	}
+	for _, opt := range options {
+		opt(s)
+	}
+	return s
+}
+
+// Report describes the inconsistencies found between the bucket and the catalog
+// and what has been done about them.
+type Report struct {
+	Orphans        []mirror.ObjectInfo
+	Deleted        []string
+	MissingPhotos  []string
+	Pruned         []string
+	MissingThumbs  []string
+	RepairedThumbs []string
+	Errors         []error
+}
+
+func (s *Service) Run(ctx context.Context, logctx log.Interface) (*Report, error) {
+	objects, err := s.lister.List(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]mirror.ObjectInfo, len(objects))
+	for _, o := range objects {
+		stored[o.Name] = o
+	}
+	rep := &Report{}
+	referenced := make(map[string]bool)
+	for _, p := range s.metadataStore.GetAll() {
+		referenced[p.ID()] = true
+		referenced[p.ThumbID()] = true
+		if _, ok := stored[p.ID()]; !ok {
+			rep.MissingPhotos = append(rep.MissingPhotos, p.ID())
+			continue
+		}
+		if _, ok := stored[p.ThumbID()]; !ok {
+			rep.MissingThumbs = append(rep.MissingThumbs, p.ID())
+		}
+	}
+	for _, o := range objects {
+		if contentObject.MatchString(o.Name) && !referenced[o.Name] {
+			rep.Orphans = append(rep.Orphans, o)
+		}
+	}
+	logctx.Infof("found %d orphaned objects, %d catalog entries without photo, %d without thumbnail",
+		len(rep.Orphans), len(rep.MissingPhotos), len(rep.MissingThumbs))
+
+	if s.repair {
+		s.repairThumbs(ctx, logctx, rep)
+	}
+	if s.delete {
+		s.deleteOrphans(ctx, logctx, rep)
+		if err := s.pruneCatalog(ctx, logctx, rep); err != nil {
+			return rep, err
+		}
+	}
+	return rep, nil
+}
+
+func (s *Service) deleteOrphans(ctx context.Context, logctx log.Interface, rep *Report) {
+	threshold := s.now().Add(-s.gracePeriod)
+	for _, o := range rep.Orphans {
+		if o.ModTime.After(threshold) {
+			logctx.WithField("object", o.Name).Info("orphan within the grace period - keeping")
+			continue
+		}
+		if err := s.remotestrg.Delete(ctx, o.Name); err != nil {
+			logctx.WithError(err).WithField("object", o.Name).Error("error deleting orphan")
+			rep.Errors = append(rep.Errors, err)
+			continue
+		}
+		rep.Deleted = append(rep.Deleted, o.Name)
+	}
+}
+
+func (s *Service) pruneCatalog(ctx context.Context, logctx log.Interface, rep *Report) error {
+	for _, id := range rep.MissingPhotos {
+		if err := s.metadataStore.Delete(id); err != nil {
+			rep.Errors = append(rep.Errors, err)
+			continue
+		}
+		rep.Pruned = append(rep.Pruned, id)
+	}
+	if len(rep.Pruned) == 0 {
+		return nil
+	}
+	logctx.Infof("removed %d catalog entries", len(rep.Pruned))
+	return s.metadataStore.Persist(ctx)
+}
+
+func (s *Service) repairThumbs(ctx context.Context, logctx log.Interface, rep *Report) {
+	byID := make(map[string]mirror.RemotePhoto)
+	for _, p := range s.metadataStore.GetAll() {
+		byID[p.ID()] = p
+	}
+	for _, id := range rep.MissingThumbs {
+		p, ok := byID[id]
+		if !ok {
+			continue
+		}
+		if err := s.repairThumb(ctx, p); err != nil {
+			logctx.WithError(err).WithField("photo", id).Error("error repairing thumbnail")
+			rep.Errors = append(rep.Errors, err)
+			continue
+		}
+		rep.RepairedThumbs = append(rep.RepairedThumbs, id)
+	}
+}
+
+func (s *Service) repairThumb(ctx context.Context, p mirror.RemotePhoto) error {
+	r, err := s.remotestrg.NewReader(ctx, p.ID())
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	thumb, err := s.thumbnail(bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	w := s.remotestrg.NewWriter(ctx, p.ThumbID())
+	if _, err := io.Copy(w, bytes.NewReader(thumb)); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,123 @@
+package gc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/crypto"
+	"github.com/marpio/mirror/metadata"
+	"github.com/marpio/mirror/metadata/repo"
+	"github.com/marpio/mirror/storage"
+	"github.com/marpio/mirror/storage/remotebackend"
+	"github.com/spf13/afero"
+)
+
+const key string = "b567ef1d391e8a10d94100faa34b7d28fdab13e3f51f94b8"
+
+var ctx context.Context = context.Background()
+
+type nopCloser struct {
+	io.Reader
+}
+
+func (nopCloser) Close() error { return nil }
+
+func newPhoto(id string) mirror.LocalPhoto {
+	fi := storage.NewFileInfo("/path/to/"+id+".jpg",
+		func(string) (io.ReadCloser, error) { return nopCloser{bytes.NewBuffer(make([]byte, 0))}, nil },
+		func(io.Reader) (string, error) { return id, nil })
+	return metadata.NewPhoto(
+		fi,
+		&metadata.Metadata{CreatedAt: time.Date(2017, 5, 1, 0, 0, 0, 0, time.UTC)},
+		func() (io.ReadCloser, error) { return nopCloser{bytes.NewReader(make([]byte, 0))}, nil })
+}
+
+func upload(rs mirror.Storage, name string) {
+	w := rs.NewWriter(ctx, name)
+	w.Write([]byte("content of " + name))
+	w.Close()
+}
+
+func setup(t *testing.T) (*storage.RemoteStorage, mirror.MetadataRepo) {
+	rs := storage.NewRemote(remotebackend.NewFileSystem(afero.NewMemMapFs()), crypto.NewService(key))
+	r, err := repo.NewHashmap(ctx, rs, "mirror.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	complete := newPhoto(strings.Repeat("a", 64))
+	noThumb := newPhoto(strings.Repeat("b", 64))
+	noPhoto := newPhoto(strings.Repeat("c", 64))
+	for _, p := range []mirror.LocalPhoto{complete, noThumb, noPhoto} {
+		r.Add(p)
+	}
+	upload(rs, complete.ID())
+	upload(rs, complete.ThumbID())
+	upload(rs, noThumb.ID())
+	upload(rs, strings.Repeat("d", 64))
+	r.Persist(ctx)
+	return rs, r
+}
+
+func thumbnail(r io.ReadSeeker) ([]byte, error) {
+	return []byte("thumb"), nil
+}
+
+func TestReport(t *testing.T) {
+	rs, r := setup(t)
+	rep, err := New(rs, rs, r, thumbnail).Run(ctx, log.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Orphans) != 1 || rep.Orphans[0].Name != strings.Repeat("d", 64) {
+		t.Errorf("expected exactly one orphan, got: %v", rep.Orphans)
+	}
+	if len(rep.MissingThumbs) != 1 || rep.MissingThumbs[0] != strings.Repeat("b", 64) {
+		t.Errorf("expected one entry without thumbnail, got: %v", rep.MissingThumbs)
+	}
+	if len(rep.MissingPhotos) != 1 || rep.MissingPhotos[0] != strings.Repeat("c", 64) {
+		t.Errorf("expected one entry without photo, got: %v", rep.MissingPhotos)
+	}
+	if len(rep.Deleted) != 0 || len(rep.RepairedThumbs) != 0 || len(rep.Pruned) != 0 {
+		t.Error("report only run should not change anything")
+	}
+	if !rs.Exists(ctx, strings.Repeat("d", 64)) {
+		t.Error("orphan deleted during report only run")
+	}
+}
+
+func TestDeleteAndRepair(t *testing.T) {
+	rs, r := setup(t)
+	_, err := New(rs, rs, r, thumbnail, WithDelete(true), WithRepair(true), WithGracePeriod(0)).Run(ctx, log.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rs.Exists(ctx, strings.Repeat("d", 64)) {
+		t.Error("expected orphan to be deleted")
+	}
+	if !rs.Exists(ctx, "thumb_"+strings.Repeat("b", 64)) {
+		t.Error("expected thumbnail to be repaired")
+	}
+	if exists, _ := r.Exists(strings.Repeat("c", 64)); exists {
+		t.Error("expected entry without photo to be removed from the catalog")
+	}
+	if !rs.Exists(ctx, "mirror.db") {
+		t.Error("catalog must never be collected")
+	}
+}
+
+func TestGracePeriod(t *testing.T) {
+	rs, r := setup(t)
+	rep, err := New(rs, rs, r, thumbnail, WithDelete(true), WithGracePeriod(time.Hour)).Run(ctx, log.Log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rep.Deleted) != 0 || !rs.Exists(ctx, strings.Repeat("d", 64)) {
+		t.Error("expected fresh orphan to be kept")
+	}
+}
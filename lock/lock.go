@@ -0,0 +1,460 @@
+// Package lock serialises the writers of a repository with a lease kept in
+// the bucket. The holder renews the lease with a heartbeat, a lease which has
+// not changed for its TTL, as seen by the clock of the process watching it,
+// is stale and can be taken over. The clocks of different machines are not
+// compared, the heartbeat of another holder only hints at a stale lease.
+// Released
+// leases are overwritten rather than deleted, because deleting the object
+// from a bucket keeping versions brings back the previous lease.
+package lock
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/marpio/mirror"
+)
+
+// ObjectName is the name of the lock object of the whole repository.
+const ObjectName = "mirror-lock.json"
+
+const devicePrefix = "mirror-lock-"
+
+// DeviceObject returns the name of the lock object of device, held while the
+// device writes its segment of the catalog.
+func DeviceObject(device string) string {
+	return devicePrefix + device + ".json"
+}
+
+// DeviceObjects lists the lock objects of the devices in s.
+func DeviceObjects(ctx context.Context, s mirror.StorageLister) ([]string, error) {
+	objs, err := s.List(ctx, devicePrefix)
+	if err != nil {
+		return nil, fmt.Errorf("error listing the device locks: %v", err)
+	}
+	res := make([]string, 0, len(objs))
+	for _, o := range objs {
+		if strings.HasSuffix(o.Name, ".json") {
+			res = append(res, o.Name)
+		}
+	}
+	return res, nil
+}
+
+// ErrLost is returned by the writers of a Guard once the lock is lost.
+var ErrLost = errors.New("the repository lock has been lost")
+
+// Lease is the content of the lock object.
+type Lease struct {
+	ID        string        `json:"id"`
+	Holder    string        `json:"holder"`
+	Acquired  time.Time     `json:"acquired"`
+	Heartbeat time.Time     `json:"heartbeat"`
+	TTL       time.Duration `json:"ttl"`
+	Released  bool          `json:"released,omitempty"`
+}
+
+// stale compares the heartbeat with now, which is only reliable for the
+// leases of this process.
+func (l Lease) stale(now time.Time) bool {
+	return now.Sub(l.Heartbeat) > l.TTL
+}
+
+func (l Lease) String() string {
+	return fmt.Sprintf("%s since %s, last heartbeat %s", l.Holder, l.Acquired.Format(time.RFC3339), l.Heartbeat.Format(time.RFC3339))
+}
+
+// LockedError is returned by Acquire if another holder has the lock.
+type LockedError struct {
+	Lease Lease
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("the repository is locked by %s", e.Lease)
+}
+
+// Lock is a held lease.
+type Lock struct {
+	s        mirror.Storage
+	name     string
+	lease    Lease
+	ttl      time.Duration
+	wait     time.Duration
+	settle   time.Duration
+	exclude  []string
+	seen     map[string]observation
+	now      func() time.Time
+	mu       sync.Mutex
+	lost     chan struct{}
+	lostOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// observation is when a lease was first seen with its heartbeat.
+type observation struct {
+	id        string
+	heartbeat time.Time
+	since     time.Time
+}
+
+type option func(*Lock)
+
+// WithTTL sets after how long without heartbeat the lease is stale, the
+// heartbeat is sent three times per TTL.
+func WithTTL(ttl time.Duration) option {
+	return func(l *Lock) {
+		if ttl > 0 {
+			l.ttl = ttl
+		}
+	}
+}
+
+// WithObject sets the name of the lock object, ObjectName by default.
+func WithObject(name string) option {
+	return func(l *Lock) {
+		l.name = name
+	}
+}
+
+// WithWait makes Acquire wait up to d for the lock to be released.
+func WithWait(d time.Duration) option {
+	return func(l *Lock) {
+		l.wait = d
+	}
+}
+
+// WithSettle sets how long Acquire waits before reading the lease back, to
+// notice another holder which wrote its lease at the same time.
+func WithSettle(d time.Duration) option {
+	return func(l *Lock) {
+		l.settle = d
+	}
+}
+
+// WithExclude makes Acquire fail while another holder has one of the lock
+// objects names, like the lock of the whole repository for the device locks.
+// The leases of the same holder do not count, so that a process can hold
+// both.
+func WithExclude(names ...string) option {
+	return func(l *Lock) {
+		l.exclude = append(l.exclude, names...)
+	}
+}
+
+// Holder describes this process: user, host and pid.
+func Holder() string {
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s@%s (pid %d)", name, host, os.Getpid())
+}
+
+// Acquire takes the lock of the repository in s for holder. A lease which
+// does not change for its TTL while Acquire waits is taken over, Acquire
+// waits that long for a lease whose heartbeat looks overdue even without
+// WithWait. The heartbeat runs until Release is called or the lock is lost.
+func Acquire(ctx context.Context, logctx log.Interface, s mirror.Storage, holder string, options ...option) (*Lock, error) {
+	l := &Lock{
+		s:      s,
+		name:   ObjectName,
+		ttl:    2 * time.Minute,
+		settle: 2 * time.Second,
+		seen:   make(map[string]observation),
+		now:    time.Now,
+		lost:   make(chan struct{}),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	for _, opt := range options {
+		opt(l)
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	deadline := l.now().Add(l.wait)
+	watching := false
+	for {
+		err := l.try(ctx, logctx, hex.EncodeToString(id), holder)
+		if err == nil {
+			break
+		}
+		e, ok := err.(*LockedError)
+		if !ok {
+			return nil, err
+		}
+		// the clock of the holder may be off, watch the lease to tell
+		if now := l.now(); !watching && e.Lease.stale(now) {
+			watching = true
+			if d := now.Add(2 * e.Lease.TTL); d.After(deadline) {
+				deadline = d
+			}
+			logctx.WithError(err).Warnf("the repository lock looks stale, watching it until %s", deadline.Format(time.RFC3339))
+		}
+		if !l.now().Before(deadline) {
+			return nil, err
+		}
+		logctx.WithError(err).Info("waiting for the repository lock")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(l.ttl / 3):
+		}
+	}
+	go l.heartbeat(logctx)
+	return l, nil
+}
+
+func (l *Lock) try(ctx context.Context, logctx log.Interface, id, holder string) error {
+	cur, err := Read(ctx, l.s, l.name)
+	if err != nil {
+		return err
+	}
+	if cur != nil {
+		if !l.abandoned(l.name, cur) {
+			return &LockedError{Lease: *cur}
+		}
+		logctx.Warnf("taking over the stale repository lock of %s", cur)
+	}
+	now := l.now()
+	lease := Lease{ID: id, Holder: holder, Acquired: now, Heartbeat: now, TTL: l.ttl}
+	if err := write(ctx, l.s, l.name, lease); err != nil {
+		return err
+	}
+	// another process may have written its lease at the same time, the last
+	// write wins
+	if l.settle > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(l.settle):
+		}
+	}
+	cur, err = Read(ctx, l.s, l.name)
+	if err != nil {
+		return err
+	}
+	if cur == nil || cur.ID != id {
+		if cur == nil {
+			return fmt.Errorf("the repository lock disappeared while acquiring it")
+		}
+		return &LockedError{Lease: *cur}
+	}
+	for _, name := range l.exclude {
+		if name == l.name {
+			continue
+		}
+		other, err := Read(ctx, l.s, name)
+		if err == nil && (other == nil || other.Holder == holder || l.abandoned(name, other)) {
+			continue
+		}
+		// give way, the other holder might be checking our lease as well
+		if cur, _ := Read(ctx, l.s, l.name); cur != nil && cur.ID == id {
+			release(ctx, l.s, l.name, lease)
+		}
+		if err != nil {
+			return err
+		}
+		return &LockedError{Lease: *other}
+	}
+	l.lease = lease
+	return nil
+}
+
+// abandoned tells whether the lease cur of the lock object name has not
+// changed for its TTL since Acquire first saw it.
+func (l *Lock) abandoned(name string, cur *Lease) bool {
+	now := l.now()
+	o, ok := l.seen[name]
+	if !ok || o.id != cur.ID || !o.heartbeat.Equal(cur.Heartbeat) {
+		l.seen[name] = observation{id: cur.ID, heartbeat: cur.Heartbeat, since: now}
+		return false
+	}
+	return now.Sub(o.since) > cur.TTL
+}
+
+func (l *Lock) heartbeat(logctx log.Interface) {
+	defer close(l.done)
+	t := time.NewTicker(l.ttl / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-t.C:
+		}
+		if err := l.renew(context.Background()); err != nil {
+			logctx.WithError(err).Error("error renewing the repository lock")
+			if err == ErrLost {
+				l.markLost()
+				return
+			}
+		}
+	}
+}
+
+// renew writes a new heartbeat, unless another holder took the lock over.
+func (l *Lock) renew(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// without heartbeat for longer than the TTL another process may have
+	// taken the lock over in the meantime
+	failed := func(err error) error {
+		if l.lease.stale(l.now()) {
+			return ErrLost
+		}
+		return err
+	}
+	cur, err := Read(ctx, l.s, l.name)
+	if err != nil {
+		return failed(err)
+	}
+	if cur == nil || cur.ID != l.lease.ID {
+		return ErrLost
+	}
+	lease := l.lease
+	lease.Heartbeat = l.now()
+	if err := write(ctx, l.s, l.name, lease); err != nil {
+		return failed(err)
+	}
+	l.lease = lease
+	return nil
+}
+
+func (l *Lock) markLost() {
+	l.lostOnce.Do(func() { close(l.lost) })
+}
+
+// Lost is closed when the lock is lost, e.g. because the heartbeat could not
+// be written for longer than the TTL and another process took it over.
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+func (l *Lock) isLost() bool {
+	select {
+	case <-l.lost:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release stops the heartbeat and releases the lease, if it is still ours.
+func (l *Lock) Release(ctx context.Context) error {
+	close(l.stop)
+	<-l.done
+	if l.isLost() {
+		return ErrLost
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cur, err := Read(ctx, l.s, l.name)
+	if err != nil {
+		return err
+	}
+	if cur == nil || cur.ID != l.lease.ID {
+		return ErrLost
+	}
+	return release(ctx, l.s, l.name, l.lease)
+}
+
+func release(ctx context.Context, s mirror.Storage, name string, l Lease) error {
+	l.Released = true
+	return write(ctx, s, name, l)
+}
+
+// Read returns the current lease of the lock object name, or nil if it is
+// not locked.
+func Read(ctx context.Context, s mirror.Storage, name string) (*Lease, error) {
+	if !s.Exists(ctx, name) {
+		return nil, nil
+	}
+	r, err := s.NewReader(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the repository lock: %v", err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the repository lock: %v", err)
+	}
+	l := &Lease{}
+	if err := json.Unmarshal(b, l); err != nil {
+		return nil, fmt.Errorf("error parsing the repository lock: %v", err)
+	}
+	if l.Released {
+		return nil, nil
+	}
+	return l, nil
+}
+
+// Break releases the lock object name regardless of its holder.
+func Break(ctx context.Context, s mirror.Storage, name string) error {
+	return release(ctx, s, name, Lease{})
+}
+
+func write(ctx context.Context, s mirror.Storage, name string, l Lease) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	w := s.NewWriter(ctx, name)
+	if _, err := w.Write(b); err != nil {
+		w.Close()
+		return fmt.Errorf("error writing the repository lock: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("error writing the repository lock: %v", err)
+	}
+	return nil
+}
+
+// Guard returns s, whose writes fail with ErrLost once l is lost. The catalog
+// is written through it, so a process which lost the lock does not overwrite
+// the catalog of the new holder.
+func (l *Lock) Guard(s mirror.Storage) mirror.Storage {
+	return &guarded{Storage: s, l: l}
+}
+
+type guarded struct {
+	mirror.Storage
+	l *Lock
+}
+
+func (g *guarded) NewWriter(ctx context.Context, path string) io.WriteCloser {
+	if g.l.isLost() {
+		return errWriter{}
+	}
+	return g.Storage.NewWriter(ctx, path)
+}
+
+func (g *guarded) Delete(ctx context.Context, path string) error {
+	if g.l.isLost() {
+		return ErrLost
+	}
+	return g.Storage.Delete(ctx, path)
+}
+
+type errWriter struct{}
+
+func (errWriter) Write(p []byte) (int, error) { return 0, ErrLost }
+func (errWriter) Close() error                { return ErrLost }
@@ -0,0 +1,295 @@
+package lock
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/storage/remotebackend"
+	"github.com/spf13/afero"
+)
+
+func withClock(now func() time.Time) option {
+	return func(l *Lock) {
+		l.now = now
+	}
+}
+
+func TestAcquireRelease(t *testing.T) {
+	ctx := context.Background()
+	s := remotebackend.NewFileSystem(afero.NewMemMapFs())
+	l, err := Acquire(ctx, log.Log, s, "laptop", WithSettle(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Acquire(ctx, log.Log, s, "nas", WithSettle(0))
+	if e, ok := err.(*LockedError); !ok || e.Lease.Holder != "laptop" {
+		t.Fatalf("expected the lock to be held by laptop, got %v", err)
+	}
+	if err := l.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if cur, _ := Read(ctx, s, ObjectName); cur != nil {
+		t.Errorf("expected the lock to be released, got %v", cur)
+	}
+	l, err = Acquire(ctx, log.Log, s, "nas", WithSettle(0))
+	if err != nil {
+		t.Fatalf("expected the released lock to be acquired: %v", err)
+	}
+	defer l.Release(ctx)
+	d, err := Acquire(ctx, log.Log, s, "laptop", WithSettle(0), WithObject(DeviceObject("laptop")))
+	if err != nil {
+		t.Fatalf("expected the device lock to be independent: %v", err)
+	}
+	d.Release(ctx)
+}
+
+func TestStaleTakeover(t *testing.T) {
+	ctx := context.Background()
+	s := remotebackend.NewFileSystem(afero.NewMemMapFs())
+	first, err := Acquire(ctx, log.Log, s, "laptop", WithSettle(0), WithTTL(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first holder hangs, its lease is no longer renewed
+	hung := first.lease
+	hung.TTL = 30 * time.Millisecond
+	if err := write(ctx, s, ObjectName, hung); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * hung.TTL)
+	second, err := Acquire(ctx, log.Log, s, "nas", WithSettle(0), WithTTL(30*time.Millisecond))
+	if err != nil {
+		t.Fatalf("expected the stale lock to be taken over: %v", err)
+	}
+	defer second.Release(ctx)
+
+	if err := first.renew(ctx); err != ErrLost {
+		t.Fatalf("expected the first holder to notice the takeover, got %v", err)
+	}
+	first.markLost()
+	select {
+	case <-first.Lost():
+	default:
+		t.Error("expected Lost to be closed")
+	}
+	w := first.Guard(s).NewWriter(ctx, "catalog")
+	w.Write([]byte("{}"))
+	if err := w.Close(); err != ErrLost {
+		t.Errorf("expected writes of the lost lock to fail, got %v", err)
+	}
+	if s.Exists(ctx, "catalog") {
+		t.Error("expected nothing to be written")
+	}
+	if err := first.Release(ctx); err != ErrLost {
+		t.Errorf("expected the release of a lost lock to fail, got %v", err)
+	}
+	if cur, _ := Read(ctx, s, ObjectName); cur == nil || cur.Holder != "nas" {
+		t.Errorf("expected the lock of nas to be kept, got %v", cur)
+	}
+}
+
+func TestClockSkew(t *testing.T) {
+	ctx := context.Background()
+	s := remotebackend.NewFileSystem(afero.NewMemMapFs())
+	behind := func() time.Time { return time.Now().Add(-time.Hour) }
+	first, err := Acquire(ctx, log.Log, s, "laptop", WithSettle(0), WithTTL(30*time.Millisecond), withClock(behind))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Acquire(ctx, log.Log, s, "nas", WithSettle(0), WithTTL(30*time.Millisecond))
+	if e, ok := err.(*LockedError); !ok || e.Lease.Holder != "laptop" {
+		t.Fatalf("expected the renewed lock to be kept despite the clock of laptop, got %v", err)
+	}
+	if err := first.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crashed holder whose clock is ahead
+	ahead := time.Now().Add(time.Hour)
+	err = write(ctx, s, ObjectName, Lease{ID: "crashed", Holder: "laptop", Acquired: ahead, Heartbeat: ahead, TTL: 30 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := Acquire(ctx, log.Log, s, "nas", WithSettle(0), WithTTL(30*time.Millisecond), WithWait(time.Second))
+	if err != nil {
+		t.Fatalf("expected the unchanged lock to be taken over: %v", err)
+	}
+	second.Release(ctx)
+}
+
+func TestWait(t *testing.T) {
+	ctx := context.Background()
+	s := remotebackend.NewFileSystem(afero.NewMemMapFs())
+	first, err := Acquire(ctx, log.Log, s, "laptop", WithSettle(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		first.Release(ctx)
+	}()
+	second, err := Acquire(ctx, log.Log, s, "nas", WithSettle(0), WithTTL(30*time.Millisecond), WithWait(5*time.Second))
+	if err != nil {
+		t.Fatalf("expected the lock to be acquired after waiting: %v", err)
+	}
+	second.Release(ctx)
+}
+
+func TestSameDeviceRace(t *testing.T) {
+	ctx := context.Background()
+	s := remotebackend.NewFileSystem(afero.NewMemMapFs())
+	errs := make(chan error, 2)
+	for _, holder := range []string{"laptop", "nas"} {
+		go func(holder string) {
+			_, err := Acquire(ctx, log.Log, s, holder, WithSettle(50*time.Millisecond), WithObject(DeviceObject("photos")))
+			errs <- err
+		}(holder)
+	}
+	acquired := 0
+	for i := 0; i < 2; i++ {
+		err := <-errs
+		if err == nil {
+			acquired++
+		} else if _, ok := err.(*LockedError); !ok {
+			t.Errorf("expected the device to be locked, got %v", err)
+		}
+	}
+	if acquired != 1 {
+		t.Errorf("expected one writer of the device to get the lock, got %d", acquired)
+	}
+}
+
+func TestExclude(t *testing.T) {
+	ctx := context.Background()
+	s := remotebackend.NewFileSystem(afero.NewMemMapFs())
+	repo, err := Acquire(ctx, log.Log, s, "laptop", WithSettle(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Acquire(ctx, log.Log, s, "nas", WithSettle(0), WithObject(DeviceObject("nas")), WithExclude(ObjectName))
+	if e, ok := err.(*LockedError); !ok || e.Lease.Holder != "laptop" {
+		t.Fatalf("expected the repository lock to exclude the device lock, got %v", err)
+	}
+	if cur, _ := Read(ctx, s, DeviceObject("nas")); cur != nil {
+		t.Errorf("expected the lease of the device to be released, got %v", cur)
+	}
+	d, err := Acquire(ctx, log.Log, s, "laptop", WithSettle(0), WithObject(DeviceObject("laptop")), WithExclude(ObjectName))
+	if err != nil {
+		t.Fatalf("expected the holder of the repository lock to lock its device: %v", err)
+	}
+	d.Release(ctx)
+	repo.Release(ctx)
+
+	d, err = Acquire(ctx, log.Log, s, "nas", WithSettle(0), WithObject(DeviceObject("nas")), WithExclude(ObjectName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Release(ctx)
+	// the released lock of laptop is listed but does not count
+	devices, err := DeviceObjects(ctx, s)
+	if err != nil || len(devices) != 2 {
+		t.Fatalf("expected the locks of both devices to be listed, got %v, %v", devices, err)
+	}
+	_, err = Acquire(ctx, log.Log, s, "laptop", WithSettle(0), WithExclude(devices...))
+	if e, ok := err.(*LockedError); !ok || e.Lease.Holder != "nas" {
+		t.Errorf("expected the device lock to exclude the repository lock, got %v", err)
+	}
+	if cur, _ := Read(ctx, s, ObjectName); cur != nil {
+		t.Errorf("expected the lease of the repository to be released, got %v", cur)
+	}
+}
+
+// versionedBackend keeps every version of the objects like B2, Delete only
+// removes the newest one.
+type versionedBackend struct {
+	mirror.Storage
+	mu       sync.Mutex
+	versions map[string][][]byte
+}
+
+type versionWriter struct {
+	bytes.Buffer
+	b    *versionedBackend
+	name string
+}
+
+func (w *versionWriter) Close() error {
+	w.b.mu.Lock()
+	defer w.b.mu.Unlock()
+	w.b.versions[w.name] = append(w.b.versions[w.name], w.Bytes())
+	return nil
+}
+
+func (b *versionedBackend) NewWriter(ctx context.Context, name string) io.WriteCloser {
+	return &versionWriter{b: b, name: name}
+}
+
+func (b *versionedBackend) NewReader(ctx context.Context, name string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	v := b.versions[name]
+	if len(v) == 0 {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.NopCloser(bytes.NewReader(v[len(v)-1])), nil
+}
+
+func (b *versionedBackend) Exists(ctx context.Context, name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.versions[name]) > 0
+}
+
+func (b *versionedBackend) Delete(ctx context.Context, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if v := b.versions[name]; len(v) > 0 {
+		b.versions[name] = v[:len(v)-1]
+	}
+	return nil
+}
+
+func TestReleaseWithVersions(t *testing.T) {
+	ctx := context.Background()
+	s := &versionedBackend{versions: make(map[string][][]byte)}
+	first, err := Acquire(ctx, log.Log, s, "laptop", WithSettle(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a heartbeat adds another version
+	if err := first.renew(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.Release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	second, err := Acquire(ctx, log.Log, s, "nas", WithSettle(0))
+	if err != nil {
+		t.Fatalf("expected the released lock to be acquired: %v", err)
+	}
+	second.Release(ctx)
+
+	third, err := Acquire(ctx, log.Log, s, "laptop", WithSettle(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Release(ctx)
+	if err := Break(ctx, s, ObjectName); err != nil {
+		t.Fatal(err)
+	}
+	if cur, err := Read(ctx, s, ObjectName); cur != nil || err != nil {
+		t.Errorf("expected the broken lock to be released, got %v, %v", cur, err)
+	}
+	_, err = Acquire(ctx, log.Log, s, "nas", WithSettle(0), WithObject(DeviceObject("nas")), WithExclude(ObjectName))
+	if err != nil {
+		t.Errorf("expected the broken lock not to exclude the device lock: %v", err)
+	}
+}
@@ -0,0 +1,315 @@
+// Package manifest describes a repository - the bucket the photos, thumbnails
+// and the catalog are stored in. The manifest is a plain JSON object written
+// when the repository is initialised, so it can be read without the key.
+//
+// The format versions are:
+//
+//	1  the catalog is the bare map of directories, repositories without a
+//	   manifest have this version
+//	2  the catalog records its version
+//	3  the devices keep their changes to the catalog in their own segments
+//	4  the catalog records when the photos were taken
+//
+// Repositories of an older version are upgraded by mirror-cli migrate.
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/crypto"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ObjectName is the name of the manifest object in the bucket.
+const ObjectName = "mirror.json"
+
+// MigrationObject is the name of the object keeping the progress of an
+// unfinished migration.
+const MigrationObject = "mirror-migration.json"
+
+const (
+	// LegacyVersion is the version of a repository without manifest.
+	LegacyVersion = 1
+	// Version is the version understood by this binary and written by init.
+	Version = 4
+)
+
+const (
+	CipherSecretbox = "nacl-secretbox"
+	KDFNone         = "none"
+	KDFScrypt       = "scrypt"
+	NamingSha256    = "sha256-hex"
+	ThumbnailPrefix = "thumb_"
+)
+
+const keyLen = 32
+
+// keyCheck is sealed with the key, so a wrong key is noticed before anything
+// is decrypted or uploaded with it.
+var keyCheck = []byte("mirror key check")
+
+type Manifest struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	Cipher    string    `json:"cipher"`
+	// BlockSize is the size of the blocks the objects are encrypted in.
+	BlockSize int    `json:"block_size"`
+	KDF       KDF    `json:"kdf"`
+	KeyCheck  string `json:"key_check"`
+	Naming    Naming `json:"naming"`
+}
+
+// KDF describes how the key is derived from a passphrase. For a randomly
+// generated key Name is none.
+type KDF struct {
+	Name string `json:"name"`
+	N    int    `json:"n,omitempty"`
+	R    int    `json:"r,omitempty"`
+	P    int    `json:"p,omitempty"`
+	Salt string `json:"salt,omitempty"`
+}
+
+// Naming describes the object names: a photo is named by the hex encoded
+// sha256 of its content, its thumbnail by the same name with ThumbnailPrefix.
+type Naming struct {
+	Photo           string `json:"photo"`
+	ThumbnailPrefix string `json:"thumbnail_prefix"`
+	Catalog         string `json:"catalog"`
+}
+
+// New returns the manifest of a new repository with the given catalog object.
+func New(catalog string) *Manifest {
+	return &Manifest{
+		Version:   Version,
+		CreatedAt: time.Now().UTC(),
+		Cipher:    CipherSecretbox,
+		BlockSize: crypto.DefaultBlockSize,
+		KDF:       KDF{Name: KDFNone},
+		Naming: Naming{
+			Photo:           NamingSha256,
+			ThumbnailPrefix: ThumbnailPrefix,
+			Catalog:         catalog,
+		},
+	}
+}
+
+// GenerateKey returns a random hex encoded key.
+func GenerateKey() (string, error) {
+	b := make([]byte, keyLen)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating the key: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// UseScrypt sets up the manifest for a key derived from a passphrase with a
+// new random salt.
+func (m *Manifest) UseScrypt() error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("error generating the salt: %v", err)
+	}
+	m.KDF = KDF{Name: KDFScrypt, N: 1 << 15, R: 8, P: 1, Salt: hex.EncodeToString(salt)}
+	return nil
+}
+
+// DeriveKey derives the hex encoded key from passphrase.
+func (m *Manifest) DeriveKey(passphrase string) (string, error) {
+	if m.KDF.Name != KDFScrypt {
+		return "", fmt.Errorf("the repository key is not derived from a passphrase")
+	}
+	salt, err := hex.DecodeString(m.KDF.Salt)
+	if err != nil {
+		return "", fmt.Errorf("invalid kdf salt in the manifest: %v", err)
+	}
+	k, err := scrypt.Key([]byte(passphrase), salt, m.KDF.N, m.KDF.R, m.KDF.P, keyLen)
+	if err != nil {
+		return "", fmt.Errorf("error deriving the key: %v", err)
+	}
+	return hex.EncodeToString(k), nil
+}
+
+// SetKey stores a check value of key in the manifest.
+func (m *Manifest) SetKey(key string) error {
+	c, err := m.crypto(key)
+	if err != nil {
+		return err
+	}
+	sealed, err := c.Seal(keyCheck)
+	if err != nil {
+		return fmt.Errorf("error sealing the key check: %v", err)
+	}
+	m.KeyCheck = hex.EncodeToString(sealed)
+	return nil
+}
+
+// CheckKey returns an error if key is not the key of the repository.
+func (m *Manifest) CheckKey(key string) error {
+	if m.KeyCheck == "" {
+		return nil
+	}
+	c, err := m.crypto(key)
+	if err != nil {
+		return err
+	}
+	sealed, err := hex.DecodeString(m.KeyCheck)
+	if err != nil {
+		return fmt.Errorf("invalid key check in the manifest: %v", err)
+	}
+	if b, err := c.Open(sealed); err != nil || !bytes.Equal(b, keyCheck) {
+		return fmt.Errorf("the key does not match the repository")
+	}
+	return nil
+}
+
+func (m *Manifest) crypto(key string) (crypto.Service, error) {
+	if b, err := hex.DecodeString(key); err != nil || len(b) != keyLen {
+		return nil, fmt.Errorf("the key must be %d hex encoded bytes", keyLen)
+	}
+	return crypto.NewService(key, crypto.WithBlockSize(m.BlockSize)), nil
+}
+
+// NormalizeKey removes the separators of a paper key.
+func NormalizeKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '-', '\t', '\n', '\r':
+			return -1
+		}
+		return r
+	}, strings.ToLower(key))
+}
+
+// PaperKey formats key for writing it down: groups of 8 characters, 4 groups
+// per line. NormalizeKey turns it back into the key.
+func PaperKey(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i += 8 {
+		switch {
+		case i == 0:
+		case i%32 == 0:
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(' ')
+		}
+		end := i + 8
+		if end > len(key) {
+			end = len(key)
+		}
+		b.WriteString(key[i:end])
+	}
+	return b.String()
+}
+
+// Exists reports whether the repository has a manifest.
+func Exists(ctx context.Context, s mirror.Storage) bool {
+	return s.Exists(ctx, ObjectName)
+}
+
+// Read reads the manifest from the bucket.
+func Read(ctx context.Context, r mirror.StorageReader) (*Manifest, error) {
+	rd, err := r.NewReader(ctx, ObjectName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the manifest: %v", err)
+	}
+	defer rd.Close()
+	b, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the manifest: %v", err)
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("error parsing the manifest: %v", err)
+	}
+	return m, nil
+}
+
+// Write writes m to the bucket.
+func Write(ctx context.Context, w mirror.StorageWriter, m *Manifest) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	wr := w.NewWriter(ctx, ObjectName)
+	if _, err := wr.Write(b); err != nil {
+		wr.Close()
+		return fmt.Errorf("error writing the manifest: %v", err)
+	}
+	if err := wr.Close(); err != nil {
+		return fmt.Errorf("error writing the manifest: %v", err)
+	}
+	return nil
+}
+
+// Load reads the manifest of the repository in s. For a repository without
+// manifest it returns the manifest of the LegacyVersion, which has no key
+// check and names its catalog after the given one, if the catalog exists.
+func Load(ctx context.Context, s mirror.Storage, catalog string) (*Manifest, error) {
+	if !Exists(ctx, s) {
+		if !s.Exists(ctx, catalog) {
+			return nil, fmt.Errorf("the repository is not initialised: run mirror-cli init")
+		}
+		m := New(catalog)
+		m.Version = LegacyVersion
+		return m, nil
+	}
+	m, err := Read(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	if catalog != "" && m.Naming.Catalog != catalog {
+		return nil, fmt.Errorf("the catalog of the repository is %q, not %q", m.Naming.Catalog, catalog)
+	}
+	return m, nil
+}
+
+// Open is like Load, but also checks that the repository can be used by this
+// binary: it must have the current version and no unfinished migration.
+func Open(ctx context.Context, s mirror.Storage, catalog string) (*Manifest, error) {
+	m, err := Load(ctx, s, catalog)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.CheckVersion(); err != nil {
+		return nil, err
+	}
+	if m.Version < Version || s.Exists(ctx, MigrationObject) {
+		return nil, fmt.Errorf("the repository has version %d, this mirror needs version %d: run mirror-cli migrate", m.Version, Version)
+	}
+	return m, nil
+}
+
+// CheckVersion returns an error if the repository is newer than this binary
+// understands.
+func (m *Manifest) CheckVersion() error {
+	if m.Version > Version {
+		return fmt.Errorf("the repository has version %d, this mirror only understands up to version %d: please upgrade mirror", m.Version, Version)
+	}
+	return nil
+}
+
+// ResolveKey returns the key of the repository: key, which may be a paper key,
+// or the key derived from passphrase if key is empty. The key is checked if
+// the manifest has a key check.
+func (m *Manifest) ResolveKey(key, passphrase string) (string, error) {
+	var err error
+	if key == "" {
+		if key, err = m.DeriveKey(passphrase); err != nil {
+			return "", err
+		}
+	}
+	key = NormalizeKey(key)
+	if err := m.CheckKey(key); err != nil {
+		return "", err
+	}
+	return key, nil
+}
@@ -0,0 +1,119 @@
+package manifest
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/marpio/mirror/storage/remotebackend"
+	"github.com/spf13/afero"
+)
+
+func TestWriteRead(t *testing.T) {
+	ctx := context.Background()
+	s := remotebackend.NewFileSystem(afero.NewMemMapFs())
+	if Exists(ctx, s) {
+		t.Fatal("expected no manifest in an empty bucket")
+	}
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := New("catalog")
+	if err := m.SetKey(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(ctx, s, m); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Read(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != Version || got.Naming.Catalog != "catalog" || got.BlockSize != m.BlockSize {
+		t.Errorf("unexpected manifest: %+v", got)
+	}
+	if err := got.CheckKey(key); err != nil {
+		t.Errorf("expected the key to match: %v", err)
+	}
+	other, _ := GenerateKey()
+	if err := got.CheckKey(other); err == nil {
+		t.Error("expected an error for another key")
+	}
+}
+
+func TestPaperKey(t *testing.T) {
+	key, _ := GenerateKey()
+	p := PaperKey(key)
+	if lines := strings.Split(p, "\n"); len(lines) != 2 || len(strings.Fields(lines[0])) != 4 {
+		t.Errorf("unexpected paper key layout: %q", p)
+	}
+	if got := NormalizeKey(strings.ToUpper(p)); got != key {
+		t.Errorf("expected %s, got %s", key, got)
+	}
+}
+
+func TestResolveKey(t *testing.T) {
+	legacy := New("catalog")
+	if k, err := legacy.ResolveKey("AB CD", ""); err != nil || k != "abcd" {
+		t.Errorf("expected the key of a repository without key check to be taken as is, got %q, %v", k, err)
+	}
+	if _, err := legacy.ResolveKey("", "secret"); err == nil {
+		t.Error("expected an error for a passphrase without kdf")
+	}
+
+	m := New("catalog")
+	if err := m.UseScrypt(); err != nil {
+		t.Fatal(err)
+	}
+	// cheap parameters, the defaults take a while
+	m.KDF.N = 1 << 10
+	key, err := m.DeriveKey("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.SetKey(key)
+	if k, err := m.ResolveKey("", "secret"); err != nil || k != key {
+		t.Errorf("expected the derived key, got %q, %v", k, err)
+	}
+	if k, err := m.ResolveKey(PaperKey(key), ""); err != nil || k != key {
+		t.Errorf("expected the paper key to be accepted, got %q, %v", k, err)
+	}
+	if _, err := m.ResolveKey("", "wrong"); err == nil {
+		t.Error("expected an error for a wrong passphrase")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	ctx := context.Background()
+	s := remotebackend.NewFileSystem(afero.NewMemMapFs())
+	if _, err := Open(ctx, s, "catalog"); err == nil || !strings.Contains(err.Error(), "init") {
+		t.Errorf("expected an error for an empty bucket, got %v", err)
+	}
+
+	w := s.NewWriter(ctx, "catalog")
+	w.Write([]byte("{}"))
+	w.Close()
+	m, err := Load(ctx, s, "catalog")
+	if err != nil || m.Version != LegacyVersion {
+		t.Fatalf("expected a legacy repository, got %+v, %v", m, err)
+	}
+	if _, err := Open(ctx, s, "catalog"); err == nil || !strings.Contains(err.Error(), "migrate") {
+		t.Errorf("expected an error for a legacy repository, got %v", err)
+	}
+
+	m = New("catalog")
+	Write(ctx, s, m)
+	if _, err := Open(ctx, s, "catalog"); err != nil {
+		t.Errorf("expected the repository to open: %v", err)
+	}
+	if _, err := Open(ctx, s, "other"); err == nil {
+		t.Error("expected an error for another catalog")
+	}
+
+	m.Version = Version + 1
+	Write(ctx, s, m)
+	if _, err := Open(ctx, s, "catalog"); err == nil || !strings.Contains(err.Error(), "upgrade") {
+		t.Errorf("expected an error for a newer repository, got %v", err)
+	}
+}
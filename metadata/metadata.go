@@ -206,6 +206,12 @@ func extractJpgNEF(path string) (io.ReadCloser, error) {
 	return r, nil
 }
 
+// CaptureTime returns the time a photo was taken according to its EXIF data,
+// which is at the start of a jpeg.
+func CaptureTime(r io.Reader) (time.Time, error) {
+	return extractCreatedAt(r)
+}
+
 func extractCreatedAt(r io.Reader) (time.Time, error) {
 	x, err := exif.Decode(r)
 	if err != nil {
@@ -218,6 +224,16 @@ func extractCreatedAt(r io.Reader) (time.Time, error) {
 	return imgCreatedAt, nil
 }
 
+// NewThumbnail creates a thumbnail for the jpeg read from r. The embedded EXIF
+// thumbnail is used when present, otherwise the image gets downscaled.
+func NewThumbnail(r io.ReadSeeker) ([]byte, error) {
+	thumb, err := extractThumb(r)
+	if err == nil {
+		return thumb, nil
+	}
+	return resizeImg(r)
+}
+
 func extractThumb(r io.Reader) ([]byte, error) {
 	x, err := exif.Decode(r)
 	if err != nil {
@@ -0,0 +1,163 @@
+package metadata
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/nfnt/resize"
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// PreviewSize is the longer side of a preview in pixels.
+const PreviewSize = 1600
+
+// Exif is a summary of the EXIF data of a photo. The fields the photo does
+// not have are empty.
+type Exif struct {
+	Camera      string
+	Lens        string
+	Exposure    string
+	Aperture    string
+	ISO         string
+	FocalLength string
+	Location    string
+	// Orientation is the EXIF orientation, 1 if the photo is upright.
+	Orientation int
+}
+
+// ReadExif returns the summary of the EXIF data read from r, which is at the
+// start of a jpeg.
+func ReadExif(r io.Reader) (*Exif, error) {
+	x, err := exif.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	e := &Exif{Orientation: orientation(x)}
+	e.Camera = strings.TrimSpace(exifString(x, exif.Make) + " " + exifString(x, exif.Model))
+	e.Lens = exifString(x, exif.LensModel)
+	if n, d, ok := exifRat(x, exif.ExposureTime); ok {
+		if n < d && n > 0 {
+			e.Exposure = fmt.Sprintf("1/%.0f s", float64(d)/float64(n))
+		} else {
+			e.Exposure = fmt.Sprintf("%g s", float64(n)/float64(d))
+		}
+	}
+	if n, d, ok := exifRat(x, exif.FNumber); ok {
+		e.Aperture = fmt.Sprintf("f/%.1f", float64(n)/float64(d))
+	}
+	if t, err := x.Get(exif.ISOSpeedRatings); err == nil {
+		if iso, err := t.Int(0); err == nil {
+			e.ISO = fmt.Sprintf("ISO %d", iso)
+		}
+	}
+	if n, d, ok := exifRat(x, exif.FocalLength); ok {
+		e.FocalLength = fmt.Sprintf("%g mm", float64(n)/float64(d))
+	}
+	if lat, long, err := x.LatLong(); err == nil {
+		e.Location = fmt.Sprintf("%.5f, %.5f", lat, long)
+	}
+	return e, nil
+}
+
+func exifString(x *exif.Exif, name exif.FieldName) string {
+	t, err := x.Get(name)
+	if err != nil {
+		return ""
+	}
+	s, err := t.StringVal()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimRight(s, "\x00"))
+}
+
+func exifRat(x *exif.Exif, name exif.FieldName) (int64, int64, bool) {
+	t, err := x.Get(name)
+	if err != nil {
+		return 0, 0, false
+	}
+	n, d, err := t.Rat2(0)
+	if err != nil || d == 0 {
+		return 0, 0, false
+	}
+	return n, d, true
+}
+
+func orientation(x *exif.Exif) int {
+	t, err := x.Get(exif.Orientation)
+	if err != nil {
+		return 1
+	}
+	o, err := t.Int(0)
+	if err != nil {
+		return 1
+	}
+	return o
+}
+
+// NewPreview scales the photo read from r down to fit into size by size
+// pixels and turns it upright as its EXIF orientation says. The preview is a
+// jpeg without EXIF data, so browsers show it the same way whether they
+// follow the orientation or not.
+func NewPreview(r io.Reader, size uint) ([]byte, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	o := 1
+	if x, err := exif.Decode(bytes.NewReader(b)); err == nil {
+		o = orientation(x)
+	}
+	img = orient(resize.Thumbnail(size, size, img, resize.Bilinear), o)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// orient applies the EXIF orientation o to img.
+func orient(img image.Image, o int) image.Image {
+	if o < 2 || o > 8 {
+		return img
+	}
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if o >= 5 {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch o {
+			case 2: // mirrored
+				dx, dy = w-1-x, y
+			case 3: // upside down
+				dx, dy = w-1-x, h-1-y
+			case 4: // mirrored upside down
+				dx, dy = x, h-1-y
+			case 5: // mirrored, turned left
+				dx, dy = y, x
+			case 6: // turned left, shown turned right
+				dx, dy = h-1-y, x
+			case 7: // mirrored, turned right
+				dx, dy = h-1-y, w-1-x
+			case 8: // turned right, shown turned left
+				dx, dy = y, w-1-x
+			}
+			dst.Set(dx, dy, img.At(b.Min.X+x, b.Min.Y+y))
+		}
+	}
+	return dst
+}
@@ -0,0 +1,68 @@
+package metadata
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"os"
+	"testing"
+)
+
+func TestPreview(t *testing.T) {
+	f, err := os.Open("../test/sample.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := NewPreview(f, 400)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := jpeg.DecodeConfig(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sample is 2448x3264 and upright
+	if c.Width != 300 || c.Height != 400 {
+		t.Errorf("expected 300x400, got %dx%d", c.Width, c.Height)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// a b
+	// c d
+	img := image.NewGray(image.Rect(0, 0, 2, 2))
+	for i, v := range []uint8{'a', 'b', 'c', 'd'} {
+		img.SetGray(i%2, i/2, color.Gray{v})
+	}
+	for o, want := range map[int]string{1: "abcd", 2: "badc", 3: "dcba", 4: "cdab", 5: "acbd", 6: "cadb", 7: "dbca", 8: "bdac"} {
+		res := orient(img, o)
+		got := ""
+		for y := 0; y < 2; y++ {
+			for x := 0; x < 2; x++ {
+				g := color.GrayModel.Convert(res.At(x, y)).(color.Gray)
+				got += string(rune(g.Y))
+			}
+		}
+		if got != want {
+			t.Errorf("orientation %d: expected %s, got %s", o, want, got)
+		}
+	}
+}
+
+func TestReadExif(t *testing.T) {
+	f, err := os.Open("../test/sample.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	e, err := ReadExif(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Exif{Camera: "Fairphone FP2", Exposure: "1/235 s", ISO: "ISO 100", FocalLength: "3.7 mm", Location: "48.21589, 16.35347", Orientation: 1}
+	if *e != want {
+		t.Errorf("expected %+v, got %+v", want, *e)
+	}
+}
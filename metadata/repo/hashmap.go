@@ -4,16 +4,20 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/marpio/mirror"
 )
 
 type entry struct {
-	FileID      string `json:"id"`
-	FileModTime string `json:"modTime"`
-	Directory   string `json:"directory"`
+	FileID      string     `json:"id"`
+	FileModTime string     `json:"modTime"`
+	Directory   string     `json:"directory"`
+	Taken       *time.Time `json:"taken,omitempty"`
 }
 
 func (it entry) ID() string {
@@ -28,8 +32,63 @@ func (it entry) Dir() string {
 	return it.Directory
 }
 
+// CreatedAt returns when the photo was taken, or zero if that is not known.
+func (it entry) CreatedAt() time.Time {
+	if it.Taken == nil {
+		return time.Time{}
+	}
+	return *it.Taken
+}
+
+// takenAt returns the capture time of it, or nil if it is not known.
+func takenAt(it mirror.RemotePhoto) *time.Time {
+	if d, ok := it.(mirror.DatedPhoto); ok {
+		if t := d.CreatedAt(); !t.IsZero() {
+			return &t
+		}
+	}
+	return nil
+}
+
 type m map[string]map[string]*entry
 
+// CatalogVersion is the version of the catalog written by Persist. Version 1
+// catalogs are the bare map of directories, they are still read.
+const CatalogVersion = 2
+
+const catalogFormat = "mirror-catalog"
+
+type catalog struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Dirs    m      `json:"dirs"`
+}
+
+func decode(r io.Reader) (m, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var c catalog
+	if err := json.Unmarshal(b, &c); err == nil && c.Format == catalogFormat {
+		if c.Version > CatalogVersion {
+			return nil, fmt.Errorf("catalog version %d is not supported", c.Version)
+		}
+		if c.Dirs == nil {
+			c.Dirs = make(m)
+		}
+		return c.Dirs, nil
+	}
+	var d m
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, fmt.Errorf("error decoding the catalog: %v", err)
+	}
+	if d == nil {
+		d = make(m)
+	}
+	return d, nil
+}
+
 type HashmapStore struct {
 	rs       mirror.Storage
 	data     m
@@ -48,8 +107,7 @@ func NewHashmap(ctx context.Context, rs mirror.Storage, filename string) (*Hashm
 			return nil, err
 		}
 		defer r.Close()
-		dec := json.NewDecoder(r)
-		if err := dec.Decode(&decodedMetadata); err != nil {
+		if decodedMetadata, err = decode(r); err != nil {
 			decodedMetadata = make(m)
 		}
 	}
@@ -57,14 +115,13 @@ func NewHashmap(ctx context.Context, rs mirror.Storage, filename string) (*Hashm
 }
 
 func (s *HashmapStore) Reload(ctx context.Context) error {
-	var decodedMetadata m
 	r, err := s.rs.NewReader(ctx, s.filename)
 	if err != nil {
 		return err
 	}
 	defer r.Close()
-	dec := json.NewDecoder(r)
-	if err := dec.Decode(&decodedMetadata); err != nil {
+	decodedMetadata, err := decode(r)
+	if err != nil {
 		s.data = make(m)
 		return err
 	}
@@ -114,7 +171,7 @@ func (s *HashmapStore) getByID(id string) *entry {
 func (s *HashmapStore) Add(it mirror.RemotePhoto) error {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
-	x := &entry{FileID: it.ID(), Directory: it.Dir()}
+	x := &entry{FileID: it.ID(), Directory: it.Dir(), Taken: takenAt(it)}
 	if _, ok := s.data[x.Directory]; !ok {
 		s.data[x.Directory] = make(map[string]*entry)
 	}
@@ -125,12 +182,32 @@ func (s *HashmapStore) Add(it mirror.RemotePhoto) error {
 }
 
 func (s *HashmapStore) Persist(ctx context.Context) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	w := s.rs.NewWriter(ctx, s.filename)
-	defer w.Close()
 	en := json.NewEncoder(w)
 	en.SetIndent("", "    ")
-	en.Encode(s.data)
-	return nil
+	if err := en.Encode(catalog{Format: catalogFormat, Version: CatalogVersion, Dirs: s.data}); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// Upgrade rewrites the catalog filename with the current CatalogVersion.
+// Unlike NewHashmap it fails if the catalog cannot be read.
+func Upgrade(ctx context.Context, rs mirror.Storage, filename string) error {
+	r, err := rs.NewReader(ctx, filename)
+	if err != nil {
+		return err
+	}
+	data, err := decode(r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	s := &HashmapStore{rs: rs, data: data, filename: filename}
+	return s.Persist(ctx)
 }
 
 func (s *HashmapStore) GetAll() []mirror.RemotePhoto {
@@ -0,0 +1,783 @@
+package repo
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marpio/mirror"
+)
+
+// The catalog is shared by several devices. Each device keeps its changes in
+// its own segment, a log of operations, next to the catalog object, which is
+// the base all segments apply to. Reading the catalog merges the base with
+// all segments, the result does not depend on the order the segments are
+// read in:
+//
+// Every operation has a Lamport clock, so together with the device it is
+// unique. A photo or a tag is present if it has been added and not every add
+// has been removed by a delete. A delete removes only the adds the deleting
+// device had seen, so an add concurrent to a delete wins and no upload gets
+// lost.
+//
+// An album op sets all fields of the album. Of the album ops not removed by a
+// delete the one with the highest clock wins, ties are broken by the device.
+// The capture time of a photo, given by an add or a date op, is resolved the
+// same way.
+//
+// A device compacts its segment when writing it: its adds, tags and album ops
+// removed by its own ops are dropped together with their removal, and so are
+// its album and date ops overridden by a later op of its own. The segment
+// keeps the highest clock, so the clocks of the dropped ops are not reused.
+
+const (
+	opAdd         = "add"
+	opDelete      = "delete"
+	opTag         = "tag"
+	opUntag       = "untag"
+	opAlbum       = "album"
+	opDeleteAlbum = "delete-album"
+	opDate        = "date"
+)
+
+const segmentFormat = "mirror-catalog-segment"
+
+// dot identifies an add, tag or album operation. The entries of the base catalog
+// have no device and are told apart by their directory.
+type dot struct {
+	Device string `json:"device"`
+	Clock  uint64 `json:"clock"`
+	Dir    string `json:"dir,omitempty"`
+}
+
+type op struct {
+	Clock uint64 `json:"clock"`
+	Type  string `json:"op"`
+	ID    string `json:"id"`
+	Dir   string `json:"dir,omitempty"`
+	Tag   string `json:"tag,omitempty"`
+	Album *album `json:"album,omitempty"`
+	// Taken is when the photo of an add or date op was taken.
+	Taken *time.Time `json:"taken,omitempty"`
+	// Removes are the adds a delete, the tags an untag and the album ops a
+	// delete-album removes.
+	Removes []dot `json:"removes,omitempty"`
+}
+
+type album struct {
+	Title       string   `json:"title"`
+	Description string   `json:"description,omitempty"`
+	Cover       string   `json:"cover,omitempty"`
+	Photos      []string `json:"photos"`
+}
+
+type segment struct {
+	Format string `json:"format"`
+	Device string `json:"device"`
+	// Clock is the highest clock the device used, the ops of which may have
+	// been compacted.
+	Clock uint64 `json:"clock,omitempty"`
+	Ops   []op   `json:"ops"`
+}
+
+// SegmentPrefix returns the prefix of the names of the segments of catalog.
+func SegmentPrefix(catalog string) string {
+	return catalog + ".dev-"
+}
+
+// SegmentStore is the catalog as seen and changed by one device.
+type SegmentStore struct {
+	rs       mirror.Storage
+	lister   mirror.StorageLister
+	filename string
+	device   string
+
+	mutex  sync.RWMutex
+	clock  uint64
+	floor  uint64 // the clock of the segment of this device when loaded
+	own    []op
+	loaded bool
+	// base and others are the ops of the base catalog and the other devices
+	// as of the last Reload
+	base   m
+	others map[string][]op
+
+	photos map[string]map[dot]string
+	tags   map[string]map[string]map[dot]bool
+	albums map[string]map[dot]*album
+	taken  map[string]dated
+}
+
+// dated is the latest capture time of a photo and the op which set it.
+type dated struct {
+	dot  dot
+	time time.Time
+}
+
+// NewSegmentStore reads the catalog filename and its segments. Changes are
+// written to the segment of device, without a device the store is read only.
+func NewSegmentStore(ctx context.Context, rs mirror.Storage, lister mirror.StorageLister, filename, device string) (*SegmentStore, error) {
+	s := &SegmentStore{rs: rs, lister: lister, filename: filename, device: device}
+	if err := s.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SegmentStore) segmentName(device string) string {
+	return SegmentPrefix(s.filename) + device
+}
+
+// Reload reads the base catalog and the segments of the other devices again.
+// The changes of this device are kept.
+func (s *SegmentStore) Reload(ctx context.Context) error {
+	base := make(m)
+	if s.rs.Exists(ctx, s.filename) {
+		r, err := s.rs.NewReader(ctx, s.filename)
+		if err != nil {
+			return err
+		}
+		base, err = decode(r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+	objs, err := s.lister.List(ctx, SegmentPrefix(s.filename))
+	if err != nil {
+		return fmt.Errorf("error listing the catalog segments: %v", err)
+	}
+	others := make(map[string][]op)
+	var own []op
+	var floor uint64
+	for _, o := range objs {
+		seg, err := s.readSegment(ctx, o.Name)
+		if err != nil {
+			return err
+		}
+		if seg.Device == s.device && s.device != "" {
+			own, floor = seg.Ops, seg.Clock
+			continue
+		}
+		others[seg.Device] = seg.Ops
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	// after the first load the ops of this device are in memory, including
+	// the ones not written yet
+	if !s.loaded {
+		s.own = own
+		s.floor = floor
+		s.loaded = true
+	}
+	s.base = base
+	s.others = others
+	s.merge()
+	return nil
+}
+
+func (s *SegmentStore) readSegment(ctx context.Context, name string) (*segment, error) {
+	r, err := s.rs.NewReader(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	seg := &segment{}
+	if err := json.NewDecoder(r).Decode(seg); err != nil {
+		return nil, fmt.Errorf("error decoding the catalog segment %s: %v", name, err)
+	}
+	if seg.Format != segmentFormat {
+		return nil, fmt.Errorf("%s is not a catalog segment", name)
+	}
+	if seg.Device == "" {
+		seg.Device = strings.TrimPrefix(name, SegmentPrefix(s.filename))
+	}
+	return seg, nil
+}
+
+// merge computes the catalog from the base and all ops.
+func (s *SegmentStore) merge() {
+	s.photos = make(map[string]map[dot]string)
+	s.tags = make(map[string]map[string]map[dot]bool)
+	s.albums = make(map[string]map[dot]*album)
+	s.taken = make(map[string]dated)
+	s.clock = s.floor
+	for dir, entries := range s.base {
+		for id, e := range entries {
+			s.addPhoto(id, dot{Dir: dir}, dir)
+			s.setTaken(id, dot{Dir: dir}, e.Taken)
+		}
+	}
+	removed := make(map[dot]bool)
+	apply := func(device string, ops []op) {
+		for _, o := range ops {
+			if o.Clock > s.clock {
+				s.clock = o.Clock
+			}
+			d := dot{Device: device, Clock: o.Clock}
+			switch o.Type {
+			case opAdd:
+				s.addPhoto(o.ID, d, o.Dir)
+				s.setTaken(o.ID, d, o.Taken)
+			case opDate:
+				s.setTaken(o.ID, d, o.Taken)
+			case opTag:
+				s.addTag(o.ID, o.Tag, d)
+			case opAlbum:
+				s.setAlbum(o.ID, d, o.Album)
+			case opDelete, opUntag, opDeleteAlbum:
+				for _, r := range o.Removes {
+					removed[r] = true
+				}
+			}
+		}
+	}
+	for device, ops := range s.others {
+		apply(device, ops)
+	}
+	apply(s.device, s.own)
+	for id, adds := range s.photos {
+		for d := range adds {
+			if removed[d] {
+				delete(adds, d)
+			}
+		}
+		if len(adds) == 0 {
+			delete(s.photos, id)
+		}
+	}
+	for id, tags := range s.tags {
+		for t, dots := range tags {
+			for d := range dots {
+				if removed[d] {
+					delete(dots, d)
+				}
+			}
+			if len(dots) == 0 {
+				delete(tags, t)
+			}
+		}
+		if len(tags) == 0 {
+			delete(s.tags, id)
+		}
+	}
+	for id, sets := range s.albums {
+		for d := range sets {
+			if removed[d] {
+				delete(sets, d)
+			}
+		}
+		if len(sets) == 0 {
+			delete(s.albums, id)
+		}
+	}
+}
+
+func (s *SegmentStore) addPhoto(id string, d dot, dir string) {
+	if _, ok := s.photos[id]; !ok {
+		s.photos[id] = make(map[dot]string)
+	}
+	s.photos[id][d] = dir
+}
+
+func (s *SegmentStore) addTag(id, tag string, d dot) {
+	if _, ok := s.tags[id]; !ok {
+		s.tags[id] = make(map[string]map[dot]bool)
+	}
+	if _, ok := s.tags[id][tag]; !ok {
+		s.tags[id][tag] = make(map[dot]bool)
+	}
+	s.tags[id][tag][d] = true
+}
+
+// newer reports whether the op a wins over the op b.
+func newer(a, b dot) bool {
+	if a.Clock != b.Clock {
+		return a.Clock > b.Clock
+	}
+	if a.Device != b.Device {
+		return a.Device > b.Device
+	}
+	return a.Dir > b.Dir
+}
+
+func (s *SegmentStore) setTaken(id string, d dot, t *time.Time) {
+	if t == nil {
+		return
+	}
+	if cur, ok := s.taken[id]; ok && !newer(d, cur.dot) {
+		return
+	}
+	s.taken[id] = dated{dot: d, time: *t}
+}
+
+func (s *SegmentStore) setAlbum(id string, d dot, a *album) {
+	if a == nil {
+		return
+	}
+	if _, ok := s.albums[id]; !ok {
+		s.albums[id] = make(map[dot]*album)
+	}
+	s.albums[id][d] = a
+}
+
+// record appends an op of this device with the next clock and applies it.
+func (s *SegmentStore) record(o op) error {
+	if s.device == "" {
+		return fmt.Errorf("the catalog is read only")
+	}
+	s.clock++
+	o.Clock = s.clock
+	s.own = append(s.own, o)
+	d := dot{Device: s.device, Clock: o.Clock}
+	switch o.Type {
+	case opAdd:
+		s.addPhoto(o.ID, d, o.Dir)
+		s.setTaken(o.ID, d, o.Taken)
+	case opDate:
+		s.setTaken(o.ID, d, o.Taken)
+	case opTag:
+		s.addTag(o.ID, o.Tag, d)
+	case opAlbum:
+		s.setAlbum(o.ID, d, o.Album)
+	}
+	return nil
+}
+
+// Add adds the photo it to its directory, with the time it was taken if it
+// is a DatedPhoto.
+func (s *SegmentStore) Add(it mirror.RemotePhoto) error {
+	taken := takenAt(it)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, dir := range s.photos[it.ID()] {
+		if dir == it.Dir() {
+			if _, ok := s.taken[it.ID()]; !ok && taken != nil {
+				return s.record(op{Type: opDate, ID: it.ID(), Taken: taken})
+			}
+			return nil
+		}
+	}
+	return s.record(op{Type: opAdd, ID: it.ID(), Dir: it.Dir(), Taken: taken})
+}
+
+// SetCreatedAt records when the photo id was taken.
+func (s *SegmentStore) SetCreatedAt(id string, t time.Time) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.photos[id]; !ok {
+		return fmt.Errorf("could not find %v", id)
+	}
+	if cur, ok := s.taken[id]; ok && cur.time.Equal(t) {
+		return nil
+	}
+	return s.record(op{Type: opDate, ID: id, Taken: &t})
+}
+
+// entry returns the photo id in dir with its capture time.
+func (s *SegmentStore) entry(id, dir string) *entry {
+	e := &entry{FileID: id, Directory: dir}
+	if d, ok := s.taken[id]; ok {
+		t := d.time
+		e.Taken = &t
+	}
+	return e
+}
+
+// Delete removes the photo id from all directories.
+func (s *SegmentStore) Delete(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	adds, ok := s.photos[id]
+	if !ok {
+		return fmt.Errorf("could not find %v", id)
+	}
+	o := op{Type: opDelete, ID: id, Removes: sortedDots(adds)}
+	if err := s.record(o); err != nil {
+		return err
+	}
+	delete(s.photos, id)
+	return nil
+}
+
+// normTag trims the spaces around tag, which must not be empty.
+func normTag(tag string) (string, error) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return "", fmt.Errorf("the tag is empty")
+	}
+	return tag, nil
+}
+
+// Tag adds tag to the photo id.
+func (s *SegmentStore) Tag(id, tag string) error {
+	tag, err := normTag(tag)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.photos[id]; !ok {
+		return fmt.Errorf("could not find %v", id)
+	}
+	if len(s.tags[id][tag]) > 0 {
+		return nil
+	}
+	return s.record(op{Type: opTag, ID: id, Tag: tag})
+}
+
+// Untag removes tag from the photo id.
+func (s *SegmentStore) Untag(id, tag string) error {
+	tag = strings.TrimSpace(tag)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	dots := s.tags[id][tag]
+	if len(dots) == 0 {
+		return nil
+	}
+	removes := make([]dot, 0, len(dots))
+	for d := range dots {
+		removes = append(removes, d)
+	}
+	sort.Slice(removes, func(i, j int) bool { return dotLess(removes[i], removes[j]) })
+	if err := s.record(op{Type: opUntag, ID: id, Tag: tag, Removes: removes}); err != nil {
+		return err
+	}
+	delete(s.tags[id], tag)
+	return nil
+}
+
+// Tags returns the tags of the photo id in alphabetical order.
+func (s *SegmentStore) Tags(id string) []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	res := make([]string, 0, len(s.tags[id]))
+	for t := range s.tags[id] {
+		res = append(res, t)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// TagCounts returns the tags of the photos in the catalog with the number of
+// photos having them.
+func (s *SegmentStore) TagCounts() map[string]int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	res := make(map[string]int)
+	for id, tags := range s.tags {
+		if _, ok := s.photos[id]; !ok {
+			continue
+		}
+		for t := range tags {
+			res[t]++
+		}
+	}
+	return res
+}
+
+func newAlbumID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating the album id: %v", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CreateAlbum adds an empty album.
+func (s *SegmentStore) CreateAlbum(title, description string) (mirror.Album, error) {
+	title = strings.TrimSpace(title)
+	if title == "" {
+		return mirror.Album{}, fmt.Errorf("the album needs a title")
+	}
+	id, err := newAlbumID()
+	if err != nil {
+		return mirror.Album{}, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	a := &album{Title: title, Description: strings.TrimSpace(description), Photos: []string{}}
+	if err := s.record(op{Type: opAlbum, ID: id, Album: a}); err != nil {
+		return mirror.Album{}, err
+	}
+	return s.album(id)
+}
+
+// UpdateAlbum replaces the fields of the album a.ID. The photos must be in
+// the catalog, duplicates are dropped.
+func (s *SegmentStore) UpdateAlbum(a mirror.Album) error {
+	title := strings.TrimSpace(a.Title)
+	if title == "" {
+		return fmt.Errorf("the album needs a title")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.albums[a.ID]) == 0 {
+		return mirror.ErrAlbumNotFound
+	}
+	seen := make(map[string]bool)
+	photos := make([]string, 0, len(a.Photos))
+	for _, id := range a.Photos {
+		if seen[id] {
+			continue
+		}
+		if _, ok := s.photos[id]; !ok {
+			return fmt.Errorf("could not find %v", id)
+		}
+		seen[id] = true
+		photos = append(photos, id)
+	}
+	if a.Cover != "" && !seen[a.Cover] {
+		return fmt.Errorf("the cover %v is not in the album", a.Cover)
+	}
+	return s.record(op{Type: opAlbum, ID: a.ID, Album: &album{
+		Title:       title,
+		Description: strings.TrimSpace(a.Description),
+		Cover:       a.Cover,
+		Photos:      photos,
+	}})
+}
+
+// DeleteAlbum removes the album id, the photos stay in the catalog.
+func (s *SegmentStore) DeleteAlbum(id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sets := s.albums[id]
+	if len(sets) == 0 {
+		return mirror.ErrAlbumNotFound
+	}
+	removes := make([]dot, 0, len(sets))
+	for d := range sets {
+		removes = append(removes, d)
+	}
+	sort.Slice(removes, func(i, j int) bool { return dotLess(removes[i], removes[j]) })
+	if err := s.record(op{Type: opDeleteAlbum, ID: id, Removes: removes}); err != nil {
+		return err
+	}
+	delete(s.albums, id)
+	return nil
+}
+
+// album returns the latest state of the album id, without the photos
+// deleted from the catalog since.
+func (s *SegmentStore) album(id string) (mirror.Album, error) {
+	var latest dot
+	var cur *album
+	for d, a := range s.albums[id] {
+		if cur == nil || newer(d, latest) {
+			latest, cur = d, a
+		}
+	}
+	if cur == nil {
+		return mirror.Album{}, mirror.ErrAlbumNotFound
+	}
+	res := mirror.Album{ID: id, Title: cur.Title, Description: cur.Description, Photos: make([]string, 0, len(cur.Photos))}
+	for _, p := range cur.Photos {
+		if _, ok := s.photos[p]; ok {
+			res.Photos = append(res.Photos, p)
+		}
+	}
+	if res.Contains(cur.Cover) {
+		res.Cover = cur.Cover
+	}
+	return res, nil
+}
+
+// GetAlbum returns the album id or ErrAlbumNotFound.
+func (s *SegmentStore) GetAlbum(id string) (mirror.Album, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.album(id)
+}
+
+// Albums returns all albums sorted by title.
+func (s *SegmentStore) Albums() []mirror.Album {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	res := make([]mirror.Album, 0, len(s.albums))
+	for id := range s.albums {
+		if a, err := s.album(id); err == nil {
+			res = append(res, a)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		ti, tj := strings.ToLower(res[i].Title), strings.ToLower(res[j].Title)
+		if ti != tj {
+			return ti < tj
+		}
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
+
+func sortedDots(adds map[dot]string) []dot {
+	res := make([]dot, 0, len(adds))
+	for d := range adds {
+		res = append(res, d)
+	}
+	sort.Slice(res, func(i, j int) bool { return dotLess(res[i], res[j]) })
+	return res
+}
+
+func dotLess(a, b dot) bool {
+	if a.Device != b.Device {
+		return a.Device < b.Device
+	}
+	if a.Clock != b.Clock {
+		return a.Clock < b.Clock
+	}
+	return a.Dir < b.Dir
+}
+
+// Persist compacts and writes the segment of this device.
+func (s *SegmentStore) Persist(ctx context.Context) error {
+	if s.device == "" {
+		return fmt.Errorf("the catalog is read only")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.own = compact(s.device, s.own)
+	w := s.rs.NewWriter(ctx, s.segmentName(s.device))
+	if err := json.NewEncoder(w).Encode(segment{Format: segmentFormat, Device: s.device, Clock: s.clock, Ops: s.own}); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// compact drops the ops of device which no longer change the catalog. The
+// removals of the ops of other devices are kept, as they may not have been
+// applied to the base catalog yet.
+func compact(device string, ops []op) []op {
+	removed := make(map[uint64]bool)
+	latestDate := make(map[string]uint64)
+	latestAlbum := make(map[string]uint64)
+	for _, o := range ops {
+		for _, r := range o.Removes {
+			if r.Device == device {
+				removed[r.Clock] = true
+			}
+		}
+		if o.Taken != nil && (o.Type == opAdd || o.Type == opDate) && o.Clock > latestDate[o.ID] {
+			latestDate[o.ID] = o.Clock
+		}
+		if o.Type == opAlbum && o.Clock > latestAlbum[o.ID] {
+			latestAlbum[o.ID] = o.Clock
+		}
+	}
+	res := make([]op, 0, len(ops))
+	for _, o := range ops {
+		switch o.Type {
+		case opAdd, opTag:
+			// the capture time of a deleted add is dropped with it, a photo
+			// added again has the same time
+			if removed[o.Clock] {
+				continue
+			}
+		case opAlbum:
+			if removed[o.Clock] || o.Clock < latestAlbum[o.ID] {
+				continue
+			}
+		case opDate:
+			if o.Clock < latestDate[o.ID] {
+				continue
+			}
+		case opDelete, opUntag, opDeleteAlbum:
+			removes := make([]dot, 0, len(o.Removes))
+			for _, r := range o.Removes {
+				if r.Device != device {
+					removes = append(removes, r)
+				}
+			}
+			if len(removes) == 0 {
+				continue
+			}
+			o.Removes = removes
+		}
+		res = append(res, o)
+	}
+	return res
+}
+
+func (s *SegmentStore) GetAll() []mirror.RemotePhoto {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	res := make([]mirror.RemotePhoto, 0, len(s.photos))
+	for id, adds := range s.photos {
+		for _, dir := range uniqueDirs(adds) {
+			res = append(res, s.entry(id, dir))
+		}
+	}
+	return res
+}
+
+func (s *SegmentStore) Exists(id string) (bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, ok := s.photos[id]
+	return ok, nil
+}
+
+func (s *SegmentStore) GetByDir(dir string) ([]mirror.RemotePhoto, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	res := make([]mirror.RemotePhoto, 0)
+	for id, adds := range s.photos {
+		for _, d := range uniqueDirs(adds) {
+			if d == dir {
+				res = append(res, s.entry(id, dir))
+			}
+		}
+	}
+	return res, nil
+}
+
+func (s *SegmentStore) GetByDirAndId(dir, id string) (mirror.RemotePhoto, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, d := range s.photos[id] {
+		if d == dir {
+			return s.entry(id, dir), nil
+		}
+	}
+	return nil, nil
+}
+
+func (s *SegmentStore) GetDirs() ([]string, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	seen := make(map[string]bool)
+	ds := make(sort.StringSlice, 0)
+	for _, adds := range s.photos {
+		for _, d := range adds {
+			if !seen[d] {
+				seen[d] = true
+				ds = append(ds, d)
+			}
+		}
+	}
+	sort.Sort(sort.Reverse(ds))
+	return ds, nil
+}
+
+// uniqueDirs returns the directories of the adds of a photo, which may have
+// been added to the same directory by several devices.
+func uniqueDirs(adds map[dot]string) []string {
+	seen := make(map[string]bool)
+	var res []string
+	for _, d := range adds {
+		if !seen[d] {
+			seen[d] = true
+			res = append(res, d)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,345 @@
+package repo
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/crypto"
+	"github.com/marpio/mirror/storage"
+	"github.com/marpio/mirror/storage/remotebackend"
+	"github.com/spf13/afero"
+)
+
+func newSegmentStores(t *testing.T, devices ...string) (*storage.RemoteStorage, []*SegmentStore) {
+	rs := storage.NewRemote(remotebackend.NewFileSystem(afero.NewMemMapFs()), crypto.NewService(key))
+	var res []*SegmentStore
+	for _, d := range devices {
+		s, err := NewSegmentStore(ctx, rs, rs, dbPath, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = append(res, s)
+	}
+	return rs, res
+}
+
+func ids(photos []mirror.RemotePhoto) []string {
+	res := make([]string, 0, len(photos))
+	for _, p := range photos {
+		res = append(res, p.Dir()+"/"+p.ID())
+	}
+	sort.Strings(res)
+	return res
+}
+
+func exchange(t *testing.T, stores ...*SegmentStore) {
+	for _, s := range stores {
+		if err := s.Persist(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, s := range stores {
+		if err := s.Reload(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSegmentsUnion(t *testing.T) {
+	rs, st := newSegmentStores(t, "laptop", "nas")
+	laptop, nas := st[0], st[1]
+	laptop.Add(&entry{FileID: "a", Directory: "/2017"})
+	nas.Add(&entry{FileID: "b", Directory: "/2018"})
+	nas.Add(&entry{FileID: "a", Directory: "/2017"})
+	exchange(t, laptop, nas)
+
+	want := []string{"/2017/a", "/2018/b"}
+	for _, s := range st {
+		if got := ids(s.GetAll()); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: expected %v, got %v", s.device, want, got)
+		}
+	}
+	web, err := NewSegmentStore(ctx, rs, rs, dbPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ids(web.GetAll()); !reflect.DeepEqual(got, want) {
+		t.Errorf("read only: expected %v, got %v", want, got)
+	}
+	if dirs, _ := web.GetDirs(); !reflect.DeepEqual(dirs, []string{"/2018", "/2017"}) {
+		t.Errorf("unexpected dirs %v", dirs)
+	}
+	if err := web.Add(&entry{FileID: "c"}); err == nil {
+		t.Error("expected the read only catalog to refuse changes")
+	}
+}
+
+func TestSegmentsAddWins(t *testing.T) {
+	rs, st := newSegmentStores(t, "laptop", "nas")
+	laptop, nas := st[0], st[1]
+	laptop.Add(&entry{FileID: "a", Directory: "/2017"})
+	exchange(t, laptop, nas)
+
+	// nas deletes a while laptop uploads it again without having seen that
+	if err := nas.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	laptop.Add(&entry{FileID: "a", Directory: "/copy"})
+	exchange(t, laptop, nas)
+	for _, s := range st {
+		if got := ids(s.GetAll()); !reflect.DeepEqual(got, []string{"/copy/a"}) {
+			t.Errorf("%s: expected the concurrent add to win, got %v", s.device, got)
+		}
+	}
+
+	// a delete which has seen all adds removes the photo everywhere
+	nas.Delete("a")
+	exchange(t, laptop, nas)
+	gc, _ := NewSegmentStore(ctx, rs, rs, dbPath, "gc")
+	for _, s := range append(st, gc) {
+		if ok, _ := s.Exists("a"); ok {
+			t.Errorf("%s: expected a to be deleted", s.device)
+		}
+	}
+}
+
+func TestSegmentsBase(t *testing.T) {
+	rs, _ := newSegmentStores(t)
+	base, _ := NewHashmap(ctx, rs, dbPath)
+	base.Add(&entry{FileID: "old", Directory: "/2016"})
+	base.Persist(ctx)
+
+	laptop, err := NewSegmentStore(ctx, rs, rs, dbPath, "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := laptop.Exists("old"); !ok {
+		t.Fatal("expected the entries of the base catalog")
+	}
+	laptop.Delete("old")
+	laptop.Persist(ctx)
+	nas, _ := NewSegmentStore(ctx, rs, rs, dbPath, "nas")
+	if ok, _ := nas.Exists("old"); ok {
+		t.Error("expected the base entry to be deleted")
+	}
+}
+
+func TestSegmentsTags(t *testing.T) {
+	_, st := newSegmentStores(t, "laptop", "nas", "phone")
+	laptop, nas, phone := st[0], st[1], st[2]
+	laptop.Add(&entry{FileID: "a", Directory: "/2017"})
+	laptop.Tag("a", "beach")
+	exchange(t, laptop, nas)
+
+	// phone has not seen the tag of laptop removed by nas
+	nas.Untag("a", "beach")
+	phone.Add(&entry{FileID: "a", Directory: "/2017"})
+	phone.Tag("a", "beach")
+	phone.Tag("a", "family")
+	exchange(t, st...)
+	for _, s := range st {
+		if got := s.Tags("a"); !reflect.DeepEqual(got, []string{"beach", "family"}) {
+			t.Errorf("%s: expected the concurrent tag to win, got %v", s.device, got)
+		}
+	}
+	laptop.Untag("a", "beach")
+	exchange(t, st...)
+	for _, s := range st {
+		if got := s.Tags("a"); !reflect.DeepEqual(got, []string{"family"}) {
+			t.Errorf("%s: expected beach to be removed, got %v", s.device, got)
+		}
+	}
+	if err := laptop.Tag("a", "  "); err == nil {
+		t.Error("expected an empty tag to be refused")
+	}
+	if got := nas.TagCounts(); !reflect.DeepEqual(got, map[string]int{"family": 1}) {
+		t.Errorf("unexpected tag counts %v", got)
+	}
+}
+
+func TestSegmentsAlbums(t *testing.T) {
+	_, st := newSegmentStores(t, "laptop", "nas")
+	laptop, nas := st[0], st[1]
+	for _, id := range []string{"a", "b", "c"} {
+		laptop.Add(&entry{FileID: id, Directory: "/2017"})
+	}
+	a, err := laptop.CreateAlbum("Summer", "at the lake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Photos = []string{"c", "a", "c"}
+	a.Cover = "a"
+	if err := laptop.UpdateAlbum(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := laptop.UpdateAlbum(mirror.Album{ID: a.ID, Title: "x", Photos: []string{"nothing"}}); err == nil {
+		t.Error("expected photos not in the catalog to be refused")
+	}
+	exchange(t, laptop, nas)
+	got, err := nas.GetAlbum(a.ID)
+	if err != nil || got.Title != "Summer" || !reflect.DeepEqual(got.Photos, []string{"c", "a"}) || got.CoverID() != "a" {
+		t.Fatalf("unexpected album %+v, %v", got, err)
+	}
+
+	// nas deletes the album while laptop renames it, the later change wins
+	nas.DeleteAlbum(a.ID)
+	got.Title = "Lake"
+	laptop.UpdateAlbum(got)
+	exchange(t, laptop, nas)
+	for _, s := range st {
+		if got, err := s.GetAlbum(a.ID); err != nil || got.Title != "Lake" {
+			t.Errorf("%s: expected the concurrent change to win, got %+v, %v", s.device, got, err)
+		}
+	}
+
+	// the photos deleted from the catalog drop out of the album
+	laptop.Delete("a")
+	exchange(t, laptop, nas)
+	if got, _ := nas.GetAlbum(a.ID); !reflect.DeepEqual(got.Photos, []string{"c"}) || got.CoverID() != "c" {
+		t.Errorf("expected only c, got %+v", got)
+	}
+
+	other, _ := nas.CreateAlbum("autumn", "")
+	nas.DeleteAlbum(a.ID)
+	exchange(t, laptop, nas)
+	if l := laptop.Albums(); len(l) != 1 || l[0].ID != other.ID {
+		t.Errorf("unexpected albums %+v", l)
+	}
+	if _, err := laptop.GetAlbum(a.ID); err != mirror.ErrAlbumNotFound {
+		t.Errorf("expected ErrAlbumNotFound, got %v", err)
+	}
+}
+
+func takenOf(t *testing.T, s *SegmentStore, id string) time.Time {
+	p, err := s.GetByDirAndId("/2017", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.(mirror.DatedPhoto).CreatedAt()
+}
+
+func TestSegmentsTaken(t *testing.T) {
+	rs, st := newSegmentStores(t, "laptop", "nas")
+	laptop, nas := st[0], st[1]
+	june := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	july := june.AddDate(0, 1, 0)
+	laptop.Add(&entry{FileID: "a", Directory: "/2017", Taken: &june})
+	laptop.Add(&entry{FileID: "b", Directory: "/2017"})
+	nas.Add(&entry{FileID: "b", Directory: "/2017"})
+	exchange(t, laptop, nas)
+	if got := takenOf(t, nas, "a"); !got.Equal(june) {
+		t.Errorf("expected the time of the add, got %v", got)
+	}
+	if got := takenOf(t, nas, "b"); !got.IsZero() {
+		t.Errorf("expected no time, got %v", got)
+	}
+
+	// adding a photo again gives it the time it did not have
+	nas.Add(&entry{FileID: "b", Directory: "/2017", Taken: &july})
+	if err := laptop.SetCreatedAt("a", july); err != nil {
+		t.Fatal(err)
+	}
+	if err := laptop.SetCreatedAt("nothing", july); err == nil {
+		t.Error("expected photos not in the catalog to be refused")
+	}
+	exchange(t, laptop, nas)
+	for _, s := range st {
+		if a, b := takenOf(t, s, "a"), takenOf(t, s, "b"); !a.Equal(july) || !b.Equal(july) {
+			t.Errorf("%s: expected the later times, got %v and %v", s.device, a, b)
+		}
+	}
+
+	// the times of a base catalog are kept
+	base, _ := NewHashmap(ctx, rs, "base")
+	base.Add(&entry{FileID: "c", Directory: "/2017", Taken: &june})
+	base.Persist(ctx)
+	s, err := NewSegmentStore(ctx, rs, rs, "base", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := takenOf(t, s, "c"); !got.Equal(june) {
+		t.Errorf("expected the time of the base catalog, got %v", got)
+	}
+}
+
+func TestSegmentsClock(t *testing.T) {
+	_, st := newSegmentStores(t, "laptop", "nas")
+	laptop, nas := st[0], st[1]
+	for _, id := range []string{"a", "b", "c"} {
+		laptop.Add(&entry{FileID: id, Directory: "/"})
+	}
+	exchange(t, laptop, nas)
+	nas.Add(&entry{FileID: "d", Directory: "/"})
+	if c := nas.own[len(nas.own)-1].Clock; c != 4 {
+		t.Errorf("expected the clock to follow the ops seen, got %d", c)
+	}
+	// the unsaved ops of a device survive a reload
+	nas.Reload(ctx)
+	if ok, _ := nas.Exists("d"); !ok {
+		t.Error("expected the unsaved add to be kept")
+	}
+}
+
+func TestSegmentsCompact(t *testing.T) {
+	rs, st := newSegmentStores(t, "laptop", "nas")
+	laptop, nas := st[0], st[1]
+	nas.Add(&entry{FileID: "n", Directory: "/2017"})
+	exchange(t, laptop, nas)
+	laptop.Add(&entry{FileID: "a", Directory: "/2017"})
+	laptop.Add(&entry{FileID: "b", Directory: "/2017"})
+	laptop.Delete("a")
+	laptop.Delete("n")
+	laptop.Tag("b", "cat")
+	laptop.Untag("b", "cat")
+	laptop.Tag("b", "dog")
+	june := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+	laptop.SetCreatedAt("b", june.AddDate(0, -1, 0))
+	laptop.SetCreatedAt("b", june)
+	a, _ := laptop.CreateAlbum("Trip", "")
+	a.Title = "Summer trip"
+	a.Photos = []string{"b"}
+	laptop.UpdateAlbum(a)
+	gone, _ := laptop.CreateAlbum("Gone", "")
+	laptop.DeleteAlbum(gone.ID)
+	if err := laptop.Persist(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, o := range laptop.own {
+		types = append(types, o.Type)
+	}
+	want := []string{opAdd, opDelete, opTag, opDate, opAlbum}
+	if !reflect.DeepEqual(types, want) {
+		t.Errorf("expected the ops %v to be kept, got %v", want, types)
+	}
+
+	reread, err := NewSegmentStore(ctx, rs, rs, dbPath, "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*SegmentStore{reread, nas} {
+		if err := s.Reload(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(s.GetAll()); !reflect.DeepEqual(got, []string{"/2017/b"}) {
+			t.Errorf("expected only b, got %v", got)
+		}
+		if got := s.Tags("b"); !reflect.DeepEqual(got, []string{"dog"}) {
+			t.Errorf("expected the tag dog, got %v", got)
+		}
+		if got := takenOf(t, s, "b"); !got.Equal(june) {
+			t.Errorf("expected the latest capture time, got %v", got)
+		}
+		if albums := s.Albums(); len(albums) != 1 || albums[0].Title != "Summer trip" {
+			t.Errorf("expected the updated album, got %v", albums)
+		}
+	}
+	// the clocks of the dropped ops are not used again
+	reread.Add(&entry{FileID: "c", Directory: "/2017"})
+	if c := reread.own[len(reread.own)-1].Clock; c <= laptop.clock {
+		t.Errorf("expected a clock above %d, got %d", laptop.clock, c)
+	}
+}
@@ -0,0 +1,330 @@
+// Package migration upgrades repositories to the format version of this
+// binary, see package manifest.
+package migration
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/manifest"
+	"github.com/marpio/mirror/metadata"
+	"github.com/marpio/mirror/metadata/repo"
+)
+
+// Env is what the steps of a migration work with.
+type Env struct {
+	// Backend is the bucket, Remote the same bucket encrypting with Key.
+	Backend mirror.Storage
+	Remote  mirror.Storage
+	// Lister lists the objects of the bucket, it is not guarded by the lock
+	// since listing writes nothing.
+	Lister   mirror.StorageLister
+	Manifest *manifest.Manifest
+	Key      string
+}
+
+// Step is a part of a migration. It is run again if the migration is
+// interrupted before it is finished, a step going through many objects can
+// record its progress with State.MarkDone.
+type Step struct {
+	Name string
+	Run  func(ctx context.Context, logctx log.Interface, env *Env, st *State) error
+}
+
+// Migration upgrades a repository from one version to the next.
+type Migration struct {
+	From        int
+	To          int
+	Description string
+	Steps       []Step
+}
+
+var migrations = []Migration{
+	{
+		From:        1,
+		To:          2,
+		Description: "record the version in the catalog and add a key check to the manifest",
+		Steps: []Step{
+			{Name: "catalog", Run: upgradeCatalog},
+			{Name: "key-check", Run: addKeyCheck},
+		},
+	},
+	{
+		// the segments start empty, the version keeps older binaries from
+		// writing the catalog without them
+		From:        2,
+		To:          3,
+		Description: "keep the changes of each device to the catalog in its own segment",
+	},
+	{
+		From:        3,
+		To:          4,
+		Description: "record in the catalog when the photos were taken",
+		Steps: []Step{
+			{Name: "capture-times", Run: addCaptureTimes},
+		},
+	},
+}
+
+// Pending returns the migrations from version to manifest.Version.
+func Pending(version int) ([]Migration, error) {
+	return pending(migrations, version, manifest.Version)
+}
+
+func pending(all []Migration, from, to int) ([]Migration, error) {
+	var res []Migration
+	for v := from; v < to; {
+		found := false
+		for _, m := range all {
+			if m.From == v {
+				res = append(res, m)
+				v = m.To
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no migration from version %d", v)
+		}
+	}
+	return res, nil
+}
+
+// State is the progress of a migration. It is saved in the bucket after every
+// step and every batch of objects marked done, so an interrupted migration continues
+// where it stopped.
+type State struct {
+	From  int      `json:"from"`
+	To    int      `json:"to"`
+	Steps []string `json:"steps"`
+	// Objects are the objects done by the current step.
+	Objects []string `json:"objects,omitempty"`
+
+	done map[string]bool
+	save func(ctx context.Context) error
+}
+
+// Done reports whether the current step marked name done.
+func (st *State) Done(name string) bool {
+	return st.done[name]
+}
+
+// MarkDone records that the current step is done with names. The state is
+// saved once for all of them, steps going through many objects mark them in
+// batches.
+func (st *State) MarkDone(ctx context.Context, names ...string) error {
+	added := false
+	for _, name := range names {
+		if st.done[name] {
+			continue
+		}
+		st.done[name] = true
+		st.Objects = append(st.Objects, name)
+		added = true
+	}
+	if !added {
+		return nil
+	}
+	return st.save(ctx)
+}
+
+func (st *State) stepDone(name string) bool {
+	for _, s := range st.Steps {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Run applies ms to the repository in order. After each migration the
+// manifest is written with its new version.
+func Run(ctx context.Context, logctx log.Interface, env *Env, ms []Migration) error {
+	for _, mg := range ms {
+		if env.Manifest.Version != mg.From {
+			return fmt.Errorf("the repository has version %d, the migration is from version %d", env.Manifest.Version, mg.From)
+		}
+		st, err := loadState(ctx, env.Backend, mg)
+		if err != nil {
+			return err
+		}
+		mlog := logctx.WithFields(log.Fields{"from": mg.From, "to": mg.To})
+		mlog.Infof("migrating: %s", mg.Description)
+		for _, step := range mg.Steps {
+			if st.stepDone(step.Name) {
+				mlog.WithField("step", step.Name).Info("step already done")
+				continue
+			}
+			slog := mlog.WithField("step", step.Name)
+			slog.Info("running step")
+			if err := step.Run(ctx, slog, env, st); err != nil {
+				return fmt.Errorf("error migrating from version %d, step %s: %v", mg.From, step.Name, err)
+			}
+			st.Steps = append(st.Steps, step.Name)
+			st.Objects = nil
+			st.done = make(map[string]bool)
+			if err := st.save(ctx); err != nil {
+				return err
+			}
+		}
+		env.Manifest.Version = mg.To
+		if err := manifest.Write(ctx, env.Backend, env.Manifest); err != nil {
+			return err
+		}
+		if err := env.Backend.Delete(ctx, manifest.MigrationObject); err != nil {
+			return fmt.Errorf("error removing the migration progress: %v", err)
+		}
+		mlog.Info("migrated")
+	}
+	return nil
+}
+
+// loadState returns the saved progress of mg, or a new state if there is
+// none. The progress of another migration is left over from one which was
+// finished and is discarded.
+func loadState(ctx context.Context, s mirror.Storage, mg Migration) (*State, error) {
+	st := &State{From: mg.From, To: mg.To}
+	if s.Exists(ctx, manifest.MigrationObject) {
+		r, err := s.NewReader(ctx, manifest.MigrationObject)
+		if err != nil {
+			return nil, fmt.Errorf("error reading the migration progress: %v", err)
+		}
+		b, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading the migration progress: %v", err)
+		}
+		saved := &State{}
+		if err := json.Unmarshal(b, saved); err != nil {
+			return nil, fmt.Errorf("error parsing the migration progress: %v", err)
+		}
+		if saved.From == mg.From && saved.To == mg.To {
+			st = saved
+		}
+	}
+	st.done = make(map[string]bool)
+	for _, o := range st.Objects {
+		st.done[o] = true
+	}
+	st.save = func(ctx context.Context) error {
+		b, err := json.Marshal(st)
+		if err != nil {
+			return err
+		}
+		w := s.NewWriter(ctx, manifest.MigrationObject)
+		if _, err := w.Write(b); err != nil {
+			w.Close()
+			return fmt.Errorf("error saving the migration progress: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("error saving the migration progress: %v", err)
+		}
+		return nil
+	}
+	return st, st.save(ctx)
+}
+
+func upgradeCatalog(ctx context.Context, logctx log.Interface, env *Env, st *State) error {
+	return repo.Upgrade(ctx, env.Remote, env.Manifest.Naming.Catalog)
+}
+
+func addKeyCheck(ctx context.Context, logctx log.Interface, env *Env, st *State) error {
+	if env.Manifest.KeyCheck != "" {
+		return nil
+	}
+	if err := env.Manifest.SetKey(env.Key); err != nil {
+		return err
+	}
+	return manifest.Write(ctx, env.Backend, env.Manifest)
+}
+
+// captureTimePeek is how much of an original is read for its EXIF date.
+const captureTimePeek = 128 << 10
+
+// minCaptureYear is the first year taken for a capture time. Photos without
+// a known time were put in the directory 0001-01 before the catalog kept it,
+// and cameras without a set clock write zero dates.
+const minCaptureYear = 1900
+
+// addCaptureTimes records the capture time of the photos which were uploaded
+// before the catalog kept it, in the segment of the device "migration". It is
+// read from the EXIF data of the original, photos without it get the first
+// day of their directory if that is named after a month.
+func addCaptureTimes(ctx context.Context, logctx log.Interface, env *Env, st *State) error {
+	if env.Lister == nil {
+		return fmt.Errorf("the storage cannot list the catalog segments")
+	}
+	catalog, err := repo.NewSegmentStore(ctx, env.Remote, env.Lister, env.Manifest.Naming.Catalog, "migration")
+	if err != nil {
+		return err
+	}
+	// the photos are marked done once their times are written, an interrupted
+	// migration reads the others again
+	var unsaved []string
+	seen := make(map[string]bool)
+	save := func() error {
+		if err := catalog.Persist(ctx); err != nil {
+			return err
+		}
+		if err := st.MarkDone(ctx, unsaved...); err != nil {
+			return err
+		}
+		unsaved = nil
+		return nil
+	}
+	for _, p := range catalog.GetAll() {
+		if st.Done(p.ID()) || seen[p.ID()] {
+			continue
+		}
+		seen[p.ID()] = true
+		if d, ok := p.(mirror.DatedPhoto); ok && !d.CreatedAt().IsZero() {
+			continue
+		}
+		taken, err := captureTime(ctx, env.Remote, p)
+		if err != nil {
+			return err
+		}
+		if taken.IsZero() {
+			logctx.WithField("photo", p.ID()).Warn("could not find when the photo was taken")
+		} else if err := catalog.SetCreatedAt(p.ID(), taken); err != nil {
+			return err
+		}
+		unsaved = append(unsaved, p.ID())
+		if len(unsaved) == 100 {
+			if err := save(); err != nil {
+				return err
+			}
+		}
+	}
+	return save()
+}
+
+func captureTime(ctx context.Context, rs mirror.Storage, p mirror.RemotePhoto) (time.Time, error) {
+	if rs.Exists(ctx, p.ID()) {
+		r, err := rs.NewReader(ctx, p.ID())
+		if err != nil {
+			return time.Time{}, fmt.Errorf("error reading %s: %v", p.ID(), err)
+		}
+		head, err := ioutil.ReadAll(io.LimitReader(r, captureTimePeek))
+		r.Close()
+		if err != nil {
+			return time.Time{}, fmt.Errorf("error reading %s: %v", p.ID(), err)
+		}
+		if t, err := metadata.CaptureTime(bytes.NewReader(head)); err == nil && t.Year() >= minCaptureYear {
+			return t, nil
+		}
+	}
+	// EXIF times have no time zone and are read as local times
+	if t, err := time.ParseInLocation("2006-01", path.Base(p.Dir()), time.Local); err == nil && t.Year() >= minCaptureYear {
+		return t, nil
+	}
+	return time.Time{}, nil
+}
@@ -0,0 +1,188 @@
+package migration
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/crypto"
+	"github.com/marpio/mirror/manifest"
+	"github.com/marpio/mirror/metadata/repo"
+	"github.com/marpio/mirror/storage"
+	"github.com/marpio/mirror/storage/remotebackend"
+	"github.com/spf13/afero"
+)
+
+const key = "b567ef1d391e8a10d94100faa34b7d28fdab13e3f51f94b8b567ef1d391e8a10"
+
+type photo struct {
+	id, dir string
+}
+
+func (p photo) ID() string      { return p.id }
+func (p photo) ThumbID() string { return "thumb_" + p.id }
+func (p photo) Dir() string     { return p.dir }
+
+func newEnv(t *testing.T) *Env {
+	ctx := context.Background()
+	b := remotebackend.NewFileSystem(afero.NewMemMapFs())
+	rs := storage.NewRemote(b, crypto.NewService(key))
+	w := rs.NewWriter(ctx, "catalog")
+	fmt.Fprint(w, `{"/photos": {"abc": {"id": "abc", "directory": "/photos"}}}`)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := manifest.Load(ctx, b, "catalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Env{Backend: b, Remote: rs, Lister: b, Manifest: m, Key: key}
+}
+
+func TestRunLegacy(t *testing.T) {
+	ctx := context.Background()
+	env := newEnv(t)
+	ms, err := Pending(env.Manifest.Version)
+	if err != nil || len(ms) == 0 {
+		t.Fatalf("expected pending migrations, got %v, %v", ms, err)
+	}
+	if err := Run(ctx, log.Log, env, ms); err != nil {
+		t.Fatal(err)
+	}
+	m, err := manifest.Open(ctx, env.Backend, "catalog")
+	if err != nil {
+		t.Fatalf("expected the migrated repository to open: %v", err)
+	}
+	if err := m.CheckKey(key); err != nil || m.KeyCheck == "" {
+		t.Errorf("expected a key check, got %q, %v", m.KeyCheck, err)
+	}
+	r, _ := env.Remote.NewReader(ctx, "catalog")
+	b, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !strings.Contains(string(b), `"version": 2`) {
+		t.Errorf("expected the catalog to have a version: %s", b)
+	}
+	s, _ := repo.NewHashmap(ctx, env.Remote, "catalog")
+	if ok, _ := s.Exists("abc"); !ok {
+		t.Error("expected the catalog entries to be kept")
+	}
+}
+
+func TestRunResumes(t *testing.T) {
+	ctx := context.Background()
+	env := newEnv(t)
+	var runs []string
+	fail := true
+	objects := func(ctx context.Context, logctx log.Interface, env *Env, st *State) error {
+		for _, o := range []string{"a", "b", "c"} {
+			if st.Done(o) {
+				continue
+			}
+			if o == "b" && fail {
+				fail = false
+				return fmt.Errorf("interrupted")
+			}
+			runs = append(runs, o)
+			if err := st.MarkDone(ctx, o); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	first := 0
+	ms := []Migration{{From: 1, To: 2, Steps: []Step{
+		{Name: "first", Run: func(context.Context, log.Interface, *Env, *State) error { first++; return nil }},
+		{Name: "objects", Run: objects},
+	}}}
+	if err := Run(ctx, log.Log, env, ms); err == nil {
+		t.Fatal("expected the interrupted migration to fail")
+	}
+	if _, err := manifest.Open(ctx, env.Backend, "catalog"); err == nil {
+		t.Error("expected the repository not to open during a migration")
+	}
+	if err := Run(ctx, log.Log, env, ms); err != nil {
+		t.Fatal(err)
+	}
+	if first != 1 || strings.Join(runs, ",") != "a,b,c" {
+		t.Errorf("expected the finished steps and objects to be skipped, got %d, %v", first, runs)
+	}
+	if env.Backend.Exists(ctx, manifest.MigrationObject) {
+		t.Error("expected the progress to be removed")
+	}
+	if env.Manifest.Version != 2 {
+		t.Errorf("expected version 2, got %d", env.Manifest.Version)
+	}
+}
+
+func TestMarkDoneBatch(t *testing.T) {
+	ctx := context.Background()
+	saves := 0
+	st := &State{done: make(map[string]bool), save: func(context.Context) error { saves++; return nil }}
+	if err := st.MarkDone(ctx, "a", "b", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.MarkDone(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if saves != 1 || strings.Join(st.Objects, ",") != "a,b" || !st.Done("a") {
+		t.Errorf("expected one save of a,b, got %d saves of %v", saves, st.Objects)
+	}
+}
+
+func TestCaptureTimes(t *testing.T) {
+	ctx := context.Background()
+	env := newEnv(t)
+	env.Manifest.Version = 3
+	b, err := ioutil.ReadFile("../test/sample.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := env.Remote.NewWriter(ctx, "exif")
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	base, _ := repo.NewHashmap(ctx, env.Remote, "catalog")
+	base.Add(photo{"exif", "/2017-01"})
+	base.Add(photo{"month", "/2016-03"})
+	base.Add(photo{"unknown", "/0001-01"})
+	base.Persist(ctx)
+
+	ms, _ := Pending(3)
+	if err := Run(ctx, log.Log, env, ms); err != nil {
+		t.Fatal(err)
+	}
+	s, err := repo.NewSegmentStore(ctx, env.Remote, env.Lister, "catalog", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]time.Time{
+		"exif":    time.Date(2017, 8, 25, 17, 3, 30, 0, time.Local),
+		"month":   time.Date(2016, 3, 1, 0, 0, 0, 0, time.Local),
+		"abc":     {},
+		"unknown": {},
+	}
+	for _, p := range s.GetAll() {
+		if got := p.(mirror.DatedPhoto).CreatedAt(); !got.Equal(want[p.ID()]) {
+			t.Errorf("%s: expected %v, got %v", p.ID(), want[p.ID()], got)
+		}
+	}
+}
+
+func TestPending(t *testing.T) {
+	all := []Migration{{From: 1, To: 2}, {From: 2, To: 3}}
+	if ms, err := pending(all, 1, 3); err != nil || len(ms) != 2 {
+		t.Errorf("expected 2 migrations, got %v, %v", ms, err)
+	}
+	if ms, err := pending(all, 3, 3); err != nil || len(ms) != 0 {
+		t.Errorf("expected no migrations, got %v, %v", ms, err)
+	}
+	if _, err := pending(all, 0, 3); err == nil {
+		t.Error("expected an error for a missing migration")
+	}
+}
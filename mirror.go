@@ -2,12 +2,21 @@ package mirror
 
 import (
 	"context"
+	"errors"
 	"io"
 	"time"
 
 	"github.com/apex/log"
 )
 
+// ErrUploadNotFound is returned by MultipartStorage.ResumeMultipart when the
+// upload has been finished, aborted or expired in the meantime.
+var ErrUploadNotFound = errors.New("unfinished upload not found")
+
+// ErrAlbumNotFound is returned for albums which do not exist or have been
+// deleted.
+var ErrAlbumNotFound = errors.New("album not found")
+
 type Storage interface {
 	StorageReader
 	StorageWriter
@@ -23,6 +32,40 @@ type StorageWriter interface {
 	Delete(ctx context.Context, path string) error
 }
 
+// MultipartStorage is implemented by backends which can assemble an object
+// from separately uploaded parts and continue such an upload later.
+type MultipartStorage interface {
+	StartMultipart(ctx context.Context, path string) (MultipartUpload, error)
+	// ResumeMultipart reopens an unfinished upload and returns the checksums of
+	// the parts the backend already has.
+	ResumeMultipart(ctx context.Context, path, uploadID string) (MultipartUpload, map[int]string, error)
+}
+
+type MultipartUpload interface {
+	ID() string
+	// WritePart stores part n (starting at 1) and returns its checksum.
+	WritePart(ctx context.Context, n int, p []byte) (string, error)
+	Complete(ctx context.Context) error
+	Abort(ctx context.Context) error
+}
+
+// ResumableStorageWriter is implemented by storages which can continue an
+// interrupted upload where it stopped. It must only be used for immutable
+// objects, written with the same content on every attempt.
+type ResumableStorageWriter interface {
+	NewResumableWriter(ctx context.Context, path string) io.WriteCloser
+}
+
+type StorageLister interface {
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
 type ReadOnlyStorage interface {
 	StorageReader
 	FindFiles(rootPath string, fileExt ...string) []FileInfo
@@ -48,6 +91,63 @@ type MetadataRepoReader interface {
 	Reload(ctx context.Context) error
 }
 
+// Album is a user defined, ordered selection of photos. Cover is one of the
+// photos, the first one if it is empty.
+type Album struct {
+	ID          string
+	Title       string
+	Description string
+	Cover       string
+	Photos      []string
+}
+
+// Contains reports whether the photo id is in the album.
+func (a Album) Contains(id string) bool {
+	for _, p := range a.Photos {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+// CoverID returns the cover of the album, or "" if it is empty.
+func (a Album) CoverID() string {
+	if a.Cover != "" && a.Contains(a.Cover) {
+		return a.Cover
+	}
+	if len(a.Photos) > 0 {
+		return a.Photos[0]
+	}
+	return ""
+}
+
+// CollectionRepoReader is implemented by catalogs which group the photos in
+// albums and by tags in addition to their directory.
+type CollectionRepoReader interface {
+	// Tags returns the tags of the photo id.
+	Tags(id string) []string
+	// TagCounts returns all tags with the number of photos having them.
+	TagCounts() map[string]int
+	Albums() []Album
+	GetAlbum(id string) (Album, error)
+}
+
+type CollectionRepoWriter interface {
+	Tag(id, tag string) error
+	Untag(id, tag string) error
+	CreateAlbum(title, description string) (Album, error)
+	// UpdateAlbum replaces the title, description, cover and photos of the
+	// album a.ID.
+	UpdateAlbum(a Album) error
+	DeleteAlbum(id string) error
+}
+
+type CollectionRepo interface {
+	CollectionRepoReader
+	CollectionRepoWriter
+}
+
 type Extractor interface {
 	Extract(ctx context.Context, logctx log.Interface, photos []FileInfo) []LocalPhoto
 }
@@ -63,6 +163,13 @@ type RemotePhoto interface {
 	Dir() string
 }
 
+// DatedPhoto is implemented by the photos which know when they were taken.
+// CreatedAt is zero if the time is unknown.
+type DatedPhoto interface {
+	RemotePhoto
+	CreatedAt() time.Time
+}
+
 type LocalPhoto interface {
 	RemotePhoto
 	FilePath() string
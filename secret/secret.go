@@ -0,0 +1,130 @@
+// Package secret reads credentials from where they are kept. A secret is
+// given as a reference:
+//
+//	env:NAME        the environment variable NAME
+//	file:PATH       the content of a file, e.g. a Docker or Kubernetes secret
+//	cmd:COMMAND     the output of a shell command, e.g. cmd:pass show mirror/b2
+//	prompt          asks on the terminal without echoing the input
+//	value:SECRET    SECRET itself
+//
+// Anything else is taken literally.
+package secret
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+type Provider interface {
+	Secret() (string, error)
+}
+
+// Env reads the secret from an environment variable.
+type Env string
+
+func (e Env) Secret() (string, error) {
+	v := os.Getenv(string(e))
+	if v == "" {
+		return "", fmt.Errorf("environment variable %s is not set", string(e))
+	}
+	return v, nil
+}
+
+// File reads the secret from a file. A leading ~/ is the home directory and
+// trailing line breaks are removed.
+type File string
+
+func (f File) Secret() (string, error) {
+	b, err := ioutil.ReadFile(expandHome(string(f)))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+func expandHome(p string) string {
+	if strings.HasPrefix(p, "~/") {
+		return filepath.Join(os.Getenv("HOME"), p[2:])
+	}
+	return p
+}
+
+// Command runs a shell command and takes its output as the secret. The command
+// shares stdin and stderr, so it can ask for a passphrase itself.
+type Command string
+
+func (c Command) Secret() (string, error) {
+	var out bytes.Buffer
+	cmd := exec.Command("sh", "-c", string(c))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("error running %q: %v", string(c), err)
+	}
+	// pass and similar tools print the secret on the first line
+	s := strings.SplitN(out.String(), "\n", 2)[0]
+	s = strings.TrimRight(s, "\r")
+	if s == "" {
+		return "", fmt.Errorf("%q printed no secret", string(c))
+	}
+	return s, nil
+}
+
+// Prompt asks for the secret on the terminal.
+type Prompt struct {
+	Label string
+}
+
+func (p Prompt) Secret() (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("can not prompt for %s without a terminal: %v", p.Label, err)
+	}
+	defer tty.Close()
+	fmt.Fprintf(tty, "%s: ", p.Label)
+	s, err := readPassword(tty)
+	fmt.Fprintln(tty)
+	if err != nil {
+		return "", fmt.Errorf("error reading %s: %v", p.Label, err)
+	}
+	if s == "" {
+		return "", fmt.Errorf("no %s entered", p.Label)
+	}
+	return s, nil
+}
+
+// Value is a secret given directly.
+type Value string
+
+func (v Value) Secret() (string, error) {
+	return string(v), nil
+}
+
+// Parse returns the provider for ref, label describes the secret when
+// prompting for it.
+func Parse(ref, label string) Provider {
+	switch {
+	case ref == "prompt":
+		return Prompt{Label: label}
+	case strings.HasPrefix(ref, "env:"):
+		return Env(ref[len("env:"):])
+	case strings.HasPrefix(ref, "file:"):
+		return File(ref[len("file:"):])
+	case strings.HasPrefix(ref, "cmd:"):
+		return Command(ref[len("cmd:"):])
+	case strings.HasPrefix(ref, "value:"):
+		return Value(ref[len("value:"):])
+	}
+	return Value(ref)
+}
+
+// Resolve returns the secret ref refers to.
+func Resolve(ref, label string) (string, error) {
+	return Parse(ref, label).Secret()
+}
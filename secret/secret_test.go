@@ -0,0 +1,49 @@
+package secret
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "key")
+	ioutil.WriteFile(keyFile, []byte("from-file\n"), 0600)
+	os.Setenv("MIRROR_TEST_SECRET", "from-env")
+	defer os.Unsetenv("MIRROR_TEST_SECRET")
+
+	cases := []struct {
+		ref  string
+		want string
+	}{
+		{"plain", "plain"},
+		{"value:cmd:literal", "cmd:literal"},
+		{"env:MIRROR_TEST_SECRET", "from-env"},
+		{"file:" + keyFile, "from-file"},
+		{"cmd:printf 'from-cmd\\nsecond line\\n'", "from-cmd"},
+	}
+	for _, c := range cases {
+		got, err := Resolve(c.ref, "test secret")
+		if err != nil {
+			t.Errorf("%s: %v", c.ref, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%s: expected %q, got %q", c.ref, c.want, got)
+		}
+	}
+}
+
+func TestResolveErrors(t *testing.T) {
+	for _, ref := range []string{"env:MIRROR_TEST_UNSET", "file:/nonexistent/key", "cmd:exit 1", "cmd:true"} {
+		if _, err := Resolve(ref, "test secret"); err == nil {
+			t.Errorf("%s: expected an error", ref)
+		}
+	}
+}
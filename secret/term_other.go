@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package secret
+
+import (
+	"errors"
+	"os"
+)
+
+func readPassword(tty *os.File) (string, error) {
+	return "", errors.New("reading hidden input is not supported on this platform")
+}
@@ -0,0 +1,39 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package secret
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+func ioctl(fd uintptr, req uintptr, t *syscall.Termios) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(unsafe.Pointer(t))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// readPassword reads a line from tty with echo turned off.
+func readPassword(tty *os.File) (string, error) {
+	var old syscall.Termios
+	if err := ioctl(tty.Fd(), ioctlGetTermios, &old); err != nil {
+		return "", err
+	}
+	noEcho := old
+	noEcho.Lflag &^= syscall.ECHO
+	noEcho.Lflag |= syscall.ICANON | syscall.ISIG
+	if err := ioctl(tty.Fd(), ioctlSetTermios, &noEcho); err != nil {
+		return "", err
+	}
+	defer ioctl(tty.Fd(), ioctlSetTermios, &old)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,208 @@
+// Package shares keeps the share links of mirror-web in an encrypted object
+// in the bucket. A share gives access to a directory, a photo or the result
+// of a search without logging in, until it expires or is revoked.
+package shares
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/storage"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ObjectName is the name of the shares object in the bucket.
+const ObjectName = "mirror-shares.json"
+
+const format = "mirror-shares"
+
+// The kinds of shares, Target is the directory, the photo id or the search
+// query (q and tag as URL query) respectively.
+const (
+	KindDir    = "dir"
+	KindPhoto  = "photo"
+	KindSearch = "search"
+)
+
+// ErrNotFound is returned by Lookup for links which are invalid, expired or
+// revoked, they are not told apart.
+var ErrNotFound = errors.New("the share does not exist or has expired")
+
+// Share is a share link.
+type Share struct {
+	ID           string    `json:"id"`
+	Kind         string    `json:"kind"`
+	Target       string    `json:"target"`
+	CreatedBy    string    `json:"created_by"`
+	Created      time.Time `json:"created"`
+	Expires      time.Time `json:"expires"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+	// Download allows downloading the originals and archives.
+	Download bool `json:"download"`
+}
+
+// Expired reports whether the share is expired at now.
+func (s Share) Expired(now time.Time) bool {
+	return !now.Before(s.Expires)
+}
+
+// Protected reports whether the share needs a password.
+func (s Share) Protected() bool {
+	return s.PasswordHash != ""
+}
+
+// CheckPassword reports whether password opens the share.
+func (s Share) CheckPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(s.PasswordHash), []byte(password)) == nil
+}
+
+type sharesFile struct {
+	Format string  `json:"format"`
+	Shares []Share `json:"shares"`
+}
+
+// Store are the shares read from the bucket. The targets and creators of the
+// shares are kept from the storage provider by an encrypted storage, like
+// storage.RemoteStorage.
+type Store struct {
+	s      mirror.Storage
+	secret []byte
+	now    func() time.Time
+	mu     sync.RWMutex
+	shares map[string]Share
+}
+
+// Load reads the shares in s. The links are signed with secret.
+func Load(ctx context.Context, s mirror.Storage, secret []byte) (*Store, error) {
+	st := &Store{s: s, secret: secret, now: time.Now, shares: make(map[string]Share)}
+	f := sharesFile{}
+	ok, err := storage.ReadJSON(ctx, s, ObjectName, &f)
+	if err != nil {
+		return nil, fmt.Errorf("error reading the shares: %v", err)
+	}
+	if ok && f.Format != format {
+		return nil, fmt.Errorf("error parsing the shares, is the key right?")
+	}
+	for _, sh := range f.Shares {
+		st.shares[sh.ID] = sh
+	}
+	return st, nil
+}
+
+// Save writes the shares to the bucket.
+func (st *Store) Save(ctx context.Context) error {
+	if err := storage.WriteJSON(ctx, st.s, ObjectName, sharesFile{Format: format, Shares: st.List()}); err != nil {
+		return fmt.Errorf("error writing the shares: %v", err)
+	}
+	return nil
+}
+
+// List returns the shares, the newest first.
+func (st *Store) List() []Share {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	res := make([]Share, 0, len(st.shares))
+	for _, sh := range st.shares {
+		res = append(res, sh)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if !res[i].Created.Equal(res[j].Created) {
+			return res[i].Created.After(res[j].Created)
+		}
+		return res[i].ID < res[j].ID
+	})
+	return res
+}
+
+// Create adds a share of target until expires. An empty password leaves it
+// unprotected.
+func (st *Store) Create(kind, target, createdBy string, expires time.Time, password string, download bool) (Share, error) {
+	if kind != KindDir && kind != KindPhoto && kind != KindSearch {
+		return Share{}, fmt.Errorf("invalid kind %q, expected %s, %s or %s", kind, KindDir, KindPhoto, KindSearch)
+	}
+	if target == "" {
+		return Share{}, fmt.Errorf("the share needs a target")
+	}
+	now := st.now().UTC()
+	if !expires.After(now) {
+		return Share{}, fmt.Errorf("the share would be expired already")
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return Share{}, err
+	}
+	sh := Share{
+		ID:        hex.EncodeToString(id),
+		Kind:      kind,
+		Target:    target,
+		CreatedBy: createdBy,
+		Created:   now,
+		Expires:   expires.UTC(),
+		Download:  download,
+	}
+	if password != "" {
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return Share{}, err
+		}
+		sh.PasswordHash = string(h)
+	}
+	st.mu.Lock()
+	st.shares[sh.ID] = sh
+	st.mu.Unlock()
+	return sh, nil
+}
+
+// Revoke removes the share id, its links stop working.
+func (st *Store) Revoke(id string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.shares[id]; !ok {
+		return fmt.Errorf("no share %s", id)
+	}
+	delete(st.shares, id)
+	return nil
+}
+
+func (st *Store) sign(v string) string {
+	m := hmac.New(sha256.New, st.secret)
+	m.Write([]byte(v))
+	return hex.EncodeToString(m.Sum(nil)[:16])
+}
+
+// Token returns the token of the link of sh.
+func (st *Store) Token(sh Share) string {
+	return sh.ID + "." + st.sign("share:"+sh.ID+":"+sh.Expires.Format(time.RFC3339))
+}
+
+// Lookup returns the share of the link token, unless it is expired or
+// revoked.
+func (st *Store) Lookup(token string) (Share, error) {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return Share{}, ErrNotFound
+	}
+	st.mu.RLock()
+	sh, ok := st.shares[token[:i]]
+	st.mu.RUnlock()
+	if !ok || !hmac.Equal([]byte(token), []byte(st.Token(sh))) || sh.Expired(st.now()) {
+		return Share{}, ErrNotFound
+	}
+	return sh, nil
+}
+
+// Unlocked returns the value of the cookie set once the password of sh was
+// given.
+func (st *Store) Unlocked(sh Share) string {
+	return st.sign("unlocked:" + sh.ID + ":" + sh.PasswordHash)
+}
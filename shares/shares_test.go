@@ -0,0 +1,76 @@
+package shares
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/marpio/mirror/crypto"
+	"github.com/marpio/mirror/storage"
+	"github.com/marpio/mirror/storage/remotebackend"
+	"github.com/spf13/afero"
+)
+
+const key = "b40b3de5e3ef0fc5c7c0b2a9d3d6c82f0c4a0fa7b9d7e2e3a8c1f1d0e9b8a7c6"
+
+func TestShares(t *testing.T) {
+	ctx := context.Background()
+	rs := storage.NewRemote(remotebackend.NewFileSystem(afero.NewMemMapFs()), crypto.NewService(key))
+	st, err := Load(ctx, rs, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	st.now = func() time.Time { return now }
+
+	if _, err := st.Create("album", "/2017", "anna", now.Add(time.Hour), "", false); err == nil {
+		t.Error("expected an unknown kind to be refused")
+	}
+	if _, err := st.Create(KindDir, "/2017", "anna", now, "", false); err == nil {
+		t.Error("expected an expired share to be refused")
+	}
+	dir, err := st.Create(KindDir, "/2017", "anna", now.Add(24*time.Hour), "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	photo, _ := st.Create(KindPhoto, "abc", "anna", now.Add(time.Hour), "open sesame", false)
+	if err := st.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := Load(ctx, rs, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.now = st.now
+	got, err := other.Lookup(st.Token(dir))
+	if err != nil || got.Target != "/2017" || !got.Download || got.Protected() {
+		t.Errorf("expected the directory share, got %+v, %v", got, err)
+	}
+	got, _ = other.Lookup(st.Token(photo))
+	if !got.Protected() || !got.CheckPassword("open sesame") || got.CheckPassword("wrong") {
+		t.Errorf("expected the share to be protected by its password")
+	}
+
+	for _, token := range []string{dir.ID, dir.ID + ".0000", "nothing"} {
+		if _, err := other.Lookup(token); err != ErrNotFound {
+			t.Errorf("%s: expected ErrNotFound, got %v", token, err)
+		}
+	}
+	forged, _ := Load(ctx, rs, []byte("other secret"))
+	if _, err := other.Lookup(forged.Token(dir)); err != ErrNotFound {
+		t.Errorf("expected a link signed with another secret to be refused, got %v", err)
+	}
+
+	now = now.Add(2 * time.Hour)
+	if _, err := other.Lookup(st.Token(photo)); err != ErrNotFound {
+		t.Errorf("expected the share to expire, got %v", err)
+	}
+	other.Revoke(dir.ID)
+	if _, err := other.Lookup(st.Token(dir)); err != ErrNotFound {
+		t.Errorf("expected the revoked share to be refused, got %v", err)
+	}
+	if l := other.List(); len(l) != 1 || l[0].ID != photo.ID {
+		t.Errorf("unexpected shares %v", l)
+	}
+}
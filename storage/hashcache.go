@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// HashCache is a persistent index of the hashes of local files. An entry is
+// only used while the size, modification time and inode of the file stay the
+// same. The entries of the files which were not found when scanning their
+// directory are dropped on Save.
+type HashCache struct {
+	fs      afero.Fs
+	path    string
+	mu      sync.Mutex
+	entries map[string]hashEntry
+	dirty   bool
+	// roots are the directories scanned since loading the cache, seen are the
+	// files found in them
+	roots []string
+	seen  map[string]bool
+}
+
+type hashEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	Inode   uint64 `json:"inode"`
+	Hash    string `json:"hash"`
+}
+
+// NewHashCache loads the cache stored at path on fs. A missing or unreadable
+// cache file results in an empty cache.
+func NewHashCache(fs afero.Fs, path string) *HashCache {
+	c := &HashCache{fs: fs, path: path, entries: make(map[string]hashEntry), seen: make(map[string]bool)}
+	f, err := fs.Open(path)
+	if err != nil {
+		return c
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&c.entries); err != nil {
+		c.entries = make(map[string]hashEntry)
+	}
+	return c
+}
+
+func cacheKey(path string) string {
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+func newHashEntry(fi os.FileInfo, hash string) hashEntry {
+	return hashEntry{Size: fi.Size(), ModTime: fi.ModTime().UnixNano(), Inode: inode(fi), Hash: hash}
+}
+
+func (c *HashCache) Lookup(path string, fi os.FileInfo) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[cacheKey(path)]
+	if !ok {
+		return "", false
+	}
+	if e != newHashEntry(fi, e.Hash) {
+		return "", false
+	}
+	return e.Hash, true
+}
+
+func (c *HashCache) Store(path string, fi os.FileInfo, hash string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[cacheKey(path)] = newHashEntry(fi, hash)
+	c.dirty = true
+}
+
+// scanned records that dir is being scanned, so that the entries below it
+// which are not seen can be dropped.
+func (c *HashCache) scanned(dir string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.roots = append(c.roots, cacheKey(dir))
+}
+
+// visit records that the file at path still exists.
+func (c *HashCache) visit(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen[cacheKey(path)] = true
+}
+
+// prune drops the entries below the scanned directories of the files which
+// were not seen, c.mu must be held.
+func (c *HashCache) prune() {
+	for k := range c.entries {
+		if c.seen[k] {
+			continue
+		}
+		for _, r := range c.roots {
+			if !strings.HasSuffix(r, string(filepath.Separator)) {
+				r += string(filepath.Separator)
+			}
+			if strings.HasPrefix(k, r) {
+				delete(c.entries, k)
+				c.dirty = true
+				break
+			}
+		}
+	}
+}
+
+// Reset drops all entries, forcing every file to be hashed again.
+func (c *HashCache) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]hashEntry)
+	c.dirty = true
+}
+
+// Save drops the entries of the files gone from the scanned directories and
+// writes the cache back if anything changed.
+func (c *HashCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.prune()
+	if !c.dirty {
+		return nil
+	}
+	if err := c.fs.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	if err := afero.WriteFile(c.fs, c.path+".tmp", b, 0600); err != nil {
+		return err
+	}
+	if err := c.fs.Rename(c.path+".tmp", c.path); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
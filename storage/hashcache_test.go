@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/marpio/mirror/crypto"
+	"github.com/spf13/afero"
+)
+
+func TestHashCache(t *testing.T) {
+	afs := afero.NewMemMapFs()
+	afero.WriteFile(afs, "/photos/a.jpg", []byte("a"), 0600)
+	afero.WriteFile(afs, "/photos/b.jpg", []byte("b"), 0600)
+	hashed := 0
+	hash := func(r io.Reader) (string, error) {
+		hashed++
+		return crypto.GenerateSha256(r)
+	}
+	scan := func() map[string]string {
+		c := NewHashCache(afs, "/state/hashes.json")
+		local := NewLocal(afs, hash, WithHashCache(c))
+		ids := make(map[string]string)
+		for _, fi := range local.FindFiles("/photos", ".jpg") {
+			ids[fi.FilePath()] = fi.ID()
+		}
+		if err := c.Save(); err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+
+	first := scan()
+	if hashed != 2 {
+		t.Errorf("expected 2 files to be hashed, got: %d", hashed)
+	}
+	hashed = 0
+	second := scan()
+	if hashed != 0 {
+		t.Errorf("expected no file to be hashed again, got: %d", hashed)
+	}
+	if first["/photos/a.jpg"] != second["/photos/a.jpg"] {
+		t.Error("cached hash differs from the computed one")
+	}
+
+	afero.WriteFile(afs, "/photos/a.jpg", []byte("changed"), 0600)
+	afs.Chtimes("/photos/a.jpg", time.Now(), time.Now().Add(time.Hour))
+	hashed = 0
+	third := scan()
+	if hashed != 1 {
+		t.Errorf("expected only the changed file to be hashed, got: %d", hashed)
+	}
+	if third["/photos/a.jpg"] == first["/photos/a.jpg"] {
+		t.Error("expected a new hash for the changed file")
+	}
+}
+
+func TestHashCacheDropsGoneFiles(t *testing.T) {
+	afs := afero.NewMemMapFs()
+	for _, p := range []string{"/photos/a.jpg", "/photos/2017/b.jpg", "/other/c.jpg"} {
+		afero.WriteFile(afs, p, []byte(p), 0600)
+	}
+	scan := func(dir string) map[string]hashEntry {
+		c := NewHashCache(afs, "/state/hashes.json")
+		local := NewLocal(afs, crypto.GenerateSha256, WithHashCache(c))
+		for _, fi := range local.FindFiles(dir, ".jpg") {
+			fi.ID()
+		}
+		if err := c.Save(); err != nil {
+			t.Fatal(err)
+		}
+		return NewHashCache(afs, "/state/hashes.json").entries
+	}
+	scan("/photos")
+	if e := scan("/other"); len(e) != 3 {
+		t.Fatalf("expected the entries of both directories, got %v", e)
+	}
+
+	afs.Remove("/photos/2017/b.jpg")
+	e := scan("/photos")
+	if _, ok := e["/photos/2017/b.jpg"]; ok {
+		t.Error("expected the entry of the removed file to be dropped")
+	}
+	if _, ok := e["/photos/a.jpg"]; !ok {
+		t.Error("expected the entry of the scanned file to be kept")
+	}
+	if _, ok := e["/other/c.jpg"]; !ok {
+		t.Error("expected the entry of the file outside the scanned directory to be kept")
+	}
+}
+
+func TestFileInfoIDComputedOnce(t *testing.T) {
+	hashed := 0
+	fi := NewFileInfo("/a.jpg",
+		func(string) (io.ReadCloser, error) { return ioutil.NopCloser(nil), nil },
+		func(io.Reader) (string, error) {
+			hashed++
+			return "abc", nil
+		})
+	fi.ID()
+	fi.ID()
+	if hashed != 1 {
+		t.Errorf("expected the hash to be computed once, got: %d", hashed)
+	}
+}
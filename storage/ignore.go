@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"path"
+	"strings"
+)
+
+// pattern is a gitignore style pattern. Patterns without a slash match the
+// name of a file or directory at any level below base, the others match the
+// path relative to base. "**" matches any number of directories.
+type pattern struct {
+	base     string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+	segments []string
+}
+
+func parsePattern(line, base string) (pattern, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return pattern{}, false
+	}
+	p := pattern{base: base}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		p.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return pattern{}, false
+	}
+	p.segments = strings.Split(line, "/")
+	return p, true
+}
+
+func parsePatterns(data []byte, base string) []pattern {
+	res := make([]pattern, 0)
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		if p, ok := parsePattern(sc.Text(), base); ok {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// match reports whether rel, a slash separated path relative to the scan
+// root, matches the pattern.
+func (p pattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.base != "" {
+		if !strings.HasPrefix(rel, p.base+"/") {
+			return false
+		}
+		rel = rel[len(p.base)+1:]
+	}
+	if !p.anchored {
+		ok, _ := path.Match(p.segments[0], path.Base(rel))
+		return ok
+	}
+	return matchSegments(p.segments, strings.Split(rel, "/"))
+}
+
+func matchSegments(pat, segs []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			if len(pat) == 1 {
+				return len(segs) > 0
+			}
+			for i := 0; i <= len(segs); i++ {
+				if matchSegments(pat[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], segs[0]); !ok {
+			return false
+		}
+		pat, segs = pat[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
+
+// matches applies the patterns in order, the last matching one decides.
+func matches(patterns []pattern, rel string, isDir bool) bool {
+	res := false
+	for _, p := range patterns {
+		if p.match(rel, isDir) {
+			res = !p.negate
+		}
+	}
+	return res
+}
@@ -0,0 +1,14 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package storage
+
+import "os"
+
+func inode(fi os.FileInfo) uint64 {
+	return 0
+}
+
+func fileID(fi os.FileInfo) fileKey {
+	return fileKey{}
+}
@@ -0,0 +1,20 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+func inode(fi os.FileInfo) uint64 {
+	return fileID(fi).ino
+}
+
+func fileID(fi os.FileInfo) fileKey {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return fileKey{dev: uint64(st.Dev), ino: uint64(st.Ino)}
+	}
+	return fileKey{}
+}
@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/marpio/mirror"
+)
+
+// ReadJSON decodes the object name in s into v. Without the object it returns
+// false and leaves v alone. Encrypted objects read with the wrong key fail to
+// parse.
+func ReadJSON(ctx context.Context, s mirror.Storage, name string, v interface{}) (bool, error) {
+	if !s.Exists(ctx, name) {
+		return false, nil
+	}
+	r, err := s.NewReader(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return false, err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, fmt.Errorf("error parsing %s, is the key right? %v", name, err)
+	}
+	return true, nil
+}
+
+// WriteJSON writes v as the object name in s.
+func WriteJSON(ctx context.Context, s mirror.Storage, name string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w := s.NewWriter(ctx, name)
+	if _, err := w.Write(b); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
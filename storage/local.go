@@ -3,30 +3,44 @@ package storage
 import (
 	"context"
 	"io"
-	"log"
 	"os"
-	"strings"
+	"path/filepath"
+	"sync"
 
+	"github.com/apex/log"
 	"github.com/marpio/mirror"
 	"github.com/spf13/afero"
 )
 
 type FileInfo struct {
+	mu               sync.Mutex
 	id               string
 	readFile         func(string) (io.ReadCloser, error)
 	generateFileHash func(r io.Reader) (string, error)
 	filePath         string
 	fileExt          string
+	stat             os.FileInfo
+	cache            *HashCache
 }
 
-func (fi FileInfo) FilePath() string {
+func (fi *FileInfo) FilePath() string {
 	return fi.filePath
 }
 
-func (fi FileInfo) ID() string {
+// ID returns the hash of the file content. It is computed once and, if a
+// HashCache is used, only when the file changed since it was last hashed.
+func (fi *FileInfo) ID() string {
+	fi.mu.Lock()
+	defer fi.mu.Unlock()
 	if fi.id != "" {
 		return fi.id
 	}
+	if fi.cache != nil && fi.stat != nil {
+		if id, ok := fi.cache.Lookup(fi.filePath, fi.stat); ok {
+			fi.id = id
+			return fi.id
+		}
+	}
 	f, err := fi.readFile(fi.filePath)
 	if err != nil {
 		return ""
@@ -37,11 +51,14 @@ func (fi FileInfo) ID() string {
 		return ""
 	}
 	fi.id = id
+	if fi.cache != nil && fi.stat != nil {
+		fi.cache.Store(fi.filePath, fi.stat, id)
+	}
 	return fi.id
 }
 
-func NewFileInfo(filePath string, readFile func(string) (io.ReadCloser, error), generateFileHash func(io.Reader) (string, error)) FileInfo {
-	return FileInfo{
+func NewFileInfo(filePath string, readFile func(string) (io.ReadCloser, error), generateFileHash func(io.Reader) (string, error)) *FileInfo {
+	return &FileInfo{
 		readFile:         readFile,
 		generateFileHash: generateFileHash,
 		filePath:         filePath,
@@ -51,45 +68,63 @@ func NewFileInfo(filePath string, readFile func(string) (io.ReadCloser, error),
 type ReadOnlyLocalStorage struct {
 	fs               afero.Fs
 	generateFileHash func(io.Reader) (string, error)
+	hashCache        *HashCache
+	rules            ScanRules
+	logctx           log.Interface
+	rootsMu          sync.Mutex
+	roots            []string
+}
+
+type localOption func(*ReadOnlyLocalStorage)
+
+// WithHashCache makes the files found by FindFiles use c to avoid rehashing
+// unchanged files.
+func WithHashCache(c *HashCache) localOption {
+	return func(s *ReadOnlyLocalStorage) {
+		s.hashCache = c
+	}
+}
+
+// WithLogger sets where FindFiles logs the files and directories it skips
+// because they can not be read.
+func WithLogger(logctx log.Interface) localOption {
+	return func(s *ReadOnlyLocalStorage) {
+		s.logctx = logctx
+	}
 }
 
-func NewLocal(fs afero.Fs, generateFileHash func(io.Reader) (string, error)) *ReadOnlyLocalStorage {
-	return &ReadOnlyLocalStorage{fs: fs, generateFileHash: generateFileHash}
+func NewLocal(fs afero.Fs, generateFileHash func(io.Reader) (string, error), options ...localOption) *ReadOnlyLocalStorage {
+	s := &ReadOnlyLocalStorage{fs: fs, generateFileHash: generateFileHash, logctx: log.Log}
+	for _, opt := range options {
+		opt(s)
+	}
+	return s
 }
 
 func (repo *ReadOnlyLocalStorage) NewReader(ctx context.Context, path string) (io.ReadCloser, error) {
 	return repo.fs.Open(path)
 }
 
+// FindFiles returns the files below dir, or dir itself if it is a file, which
+// have one of the extensions and match the scan rules.
 func (repo *ReadOnlyLocalStorage) FindFiles(dir string, fileExt ...string) []mirror.FileInfo {
-	files := make([]mirror.FileInfo, 0)
-	open := func(p string) (io.ReadCloser, error) {
-		return os.Open(p)
+	s := repo.newScanner(fileExt)
+	fi, err := lstat(repo.fs, dir)
+	if err != nil {
+		// the file might have been removed since it was listed
+		repo.logctx.WithError(err).WithField("path", dir).Warn("skipping the file")
+		return s.files
 	}
-	err := afero.Walk(repo.fs, dir, func(pth string, fi os.FileInfo, err error) error {
-		isDir, err := afero.IsDir(repo.fs, pth)
-
-		if err != nil {
-			return err
-		}
-		if isDir {
-			return nil
+	if fi.IsDir() {
+		repo.addRoot(dir)
+		if repo.hashCache != nil {
+			repo.hashCache.scanned(dir)
 		}
-		hasExt := false
-		for _, ext := range fileExt {
-			hasExt = strings.HasSuffix(strings.ToLower(fi.Name()), ext)
-			if hasExt {
-				finf := NewFileInfo(pth, open, repo.generateFileHash)
-				files = append(files, finf)
-				break
-			}
-		}
-		return nil
-	})
-	if err != nil {
-		log.Fatalf(err.Error())
+		s.walkDir(dir, "", 0, s.exclude)
+		return s.files
 	}
-	return files
+	s.scanFile(repo.rootFor(filepath.Clean(dir)), filepath.Clean(dir), fi)
+	return s.files
 }
 
 func GenerateUniqueFileName(prefix string, id string) string {
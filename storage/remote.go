@@ -2,19 +2,53 @@ package storage
 
 import (
 	"context"
+	"fmt"
 	"io"
 
 	"github.com/marpio/mirror"
 	"github.com/marpio/mirror/crypto"
+	"github.com/spf13/afero"
 )
 
-func NewRemote(b mirror.Storage, c crypto.Service) *RemoteStorage {
-	return &RemoteStorage{backend: b, crpt: c}
+type option func(*RemoteStorage)
+
+// WithResumeState enables resumable uploads. The progress of unfinished uploads
+// is kept in dir on fs.
+func WithResumeState(fs afero.Fs, dir string) option {
+	return func(s *RemoteStorage) {
+		s.statefs = fs
+		s.stateDir = dir
+	}
+}
+
+// WithPartSize sets the size of the plaintext parts of resumable uploads. It is
+// rounded down to a multiple of the encryption block size.
+func WithPartSize(size int) option {
+	return func(s *RemoteStorage) {
+		s.partSize = size
+	}
+}
+
+func NewRemote(b mirror.Storage, c crypto.Service, options ...option) *RemoteStorage {
+	s := &RemoteStorage{backend: b, crpt: c, partSize: 5 * 1024 * 1024}
+	for _, opt := range options {
+		opt(s)
+	}
+	if c != nil {
+		s.partSize = (s.partSize / c.BlockSize()) * c.BlockSize()
+		if s.partSize == 0 {
+			s.partSize = c.BlockSize()
+		}
+	}
+	return s
 }
 
 type RemoteStorage struct {
-	backend mirror.Storage
-	crpt    crypto.Service
+	backend  mirror.Storage
+	crpt     crypto.Service
+	statefs  afero.Fs
+	stateDir string
+	partSize int
 }
 
 type reader struct {
@@ -59,7 +93,11 @@ func (b *reader) Read(p []byte) (n int, err error) {
 		b.r = 0
 		b.w = 0
 
-		n, b.err = b.rd.Read(b.buf)
+		// a block is only decrypted whole, network readers may return less
+		n, b.err = io.ReadFull(b.rd, b.buf)
+		if b.err == io.ErrUnexpectedEOF {
+			b.err = io.EOF
+		}
 		if n < 0 {
 			panic("errNegativeRead")
 		}
@@ -85,6 +123,7 @@ func (b *reader) Close() error {
 }
 
 type writer struct {
+	ctx  context.Context
 	err  error
 	buf  []byte
 	wr   io.WriteCloser
@@ -92,7 +131,7 @@ type writer struct {
 }
 
 func (b *RemoteStorage) NewWriter(ctx context.Context, path string) io.WriteCloser {
-	return &writer{wr: b.backend.NewWriter(ctx, path), buf: make([]byte, 0), crpt: b.crpt}
+	return &writer{ctx: ctx, wr: b.backend.NewWriter(ctx, path), buf: make([]byte, 0), crpt: b.crpt}
 }
 
 func (b *writer) Write(p []byte) (int, error) {
@@ -128,6 +167,12 @@ func (b *writer) flush() error {
 }
 
 func (b *writer) Close() error {
+	// the rest of a cancelled upload is not written, the backend does not
+	// complete it
+	if err := b.ctx.Err(); err != nil {
+		b.wr.Close()
+		return err
+	}
 	err := b.flush()
 	if err != nil {
 		return err
@@ -146,3 +191,13 @@ func (b *RemoteStorage) Exists(ctx context.Context, fileName string) bool {
 func (b *RemoteStorage) Delete(ctx context.Context, fileName string) error {
 	return b.backend.Delete(ctx, fileName)
 }
+
+// List returns the objects stored in the backend. The sizes are those of the
+// encrypted objects.
+func (b *RemoteStorage) List(ctx context.Context, prefix string) ([]mirror.ObjectInfo, error) {
+	l, ok := b.backend.(mirror.StorageLister)
+	if !ok {
+		return nil, fmt.Errorf("storage backend does not support listing")
+	}
+	return l.List(ctx, prefix)
+}
@@ -78,3 +78,22 @@ func TestWriteRead(t *testing.T) {
 		}
 	}
 }
+
+func TestJSON(t *testing.T) {
+	b := remotebackend.NewFileSystem(afero.NewMemMapFs())
+	rs := NewRemote(b, crypto.NewService(encKey))
+	var v map[string]int
+	if ok, err := ReadJSON(ctx, rs, "object.json", &v); ok || err != nil {
+		t.Fatalf("expected no object, got %v, %v", ok, err)
+	}
+	if err := WriteJSON(ctx, rs, "object.json", map[string]int{"a": 1}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := ReadJSON(ctx, rs, "object.json", &v); !ok || err != nil || v["a"] != 1 {
+		t.Errorf("expected the object to be read back, got %v, %v, %v", v, ok, err)
+	}
+	other := NewRemote(b, crypto.NewService("0123456789abcdef0123456789abcdef0123456789abcdef"))
+	if _, err := ReadJSON(ctx, other, "object.json", &v); err == nil {
+		t.Error("expected the object to fail with another key")
+	}
+}
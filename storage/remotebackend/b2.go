@@ -1,21 +1,36 @@
 package remotebackend
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha1"
+	"fmt"
 	"io"
 	"log"
+	"strconv"
+	"sync"
 
 	"github.com/kurin/blazer/b2"
+	"github.com/kurin/blazer/base"
+	"github.com/marpio/mirror"
 )
 
 type B2 struct {
 	ctx    context.Context
 	bucket *b2.Bucket
+	// api gives access to the large file API, which the b2 package does not
+	// expose in a way usable for resuming encrypted uploads.
+	apiMu      sync.Mutex
+	api        *base.B2
+	apiBucket  *base.Bucket
+	b2id       string
+	b2key      string
+	bucketName string
 }
 
 func NewB2(ctx context.Context, b2id, b2key, bucketName string) *B2 {
 	bucket := newB2Bucket(ctx, b2id, b2key, bucketName)
-	return &B2{ctx: ctx, bucket: bucket}
+	return &B2{ctx: ctx, bucket: bucket, b2id: b2id, b2key: b2key, bucketName: bucketName}
 }
 
 func (b *B2) NewReader(ctx context.Context, fileName string) (io.ReadCloser, error) {
@@ -40,6 +55,194 @@ func (b *B2) Exists(ctx context.Context, fileName string) bool {
 	return true
 }
 
+// List uses the file names API, whose responses already have the size and
+// upload time of the objects.
+func (b *B2) List(ctx context.Context, prefix string) ([]mirror.ObjectInfo, error) {
+	bk, err := b.apiClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]mirror.ObjectInfo, 0)
+	next := ""
+	for {
+		files, cont, err := bk.ListFileNames(ctx, 1000, next, prefix, "")
+		if err != nil && b.reauthorize(ctx, err) {
+			files, cont, err = bk.ListFileNames(ctx, 1000, next, prefix, "")
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			res = append(res, mirror.ObjectInfo{Name: f.Name, Size: f.Size, ModTime: f.Timestamp})
+		}
+		if cont == "" {
+			return res, nil
+		}
+		next = cont
+	}
+}
+
+type b2Multipart struct {
+	b  *B2
+	lf *base.LargeFile
+	id string
+}
+
+func (b *B2) apiClient(ctx context.Context) (*base.Bucket, error) {
+	b.apiMu.Lock()
+	defer b.apiMu.Unlock()
+	if b.apiBucket != nil {
+		return b.apiBucket, nil
+	}
+	api, err := base.AuthorizeAccount(ctx, b.b2id, b.b2key)
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := api.ListBuckets(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, bk := range buckets {
+		if bk.Name == b.bucketName {
+			b.api = api
+			b.apiBucket = bk
+			return bk, nil
+		}
+	}
+	return nil, fmt.Errorf("could not find bucket %s", b.bucketName)
+}
+
+// reauthorize refreshes the auth token of the large file API client in place,
+// the tokens expire after 24 hours.
+func (b *B2) reauthorize(ctx context.Context, err error) bool {
+	b.apiMu.Lock()
+	defer b.apiMu.Unlock()
+	if base.Action(err) != base.ReAuthenticate || b.api == nil {
+		return false
+	}
+	api, err := base.AuthorizeAccount(ctx, b.b2id, b.b2key)
+	if err != nil {
+		return false
+	}
+	b.api.Update(api)
+	return true
+}
+
+// findUnfinished returns the started but unfinished large file uploaded under
+// fileName at the given timestamp.
+func (b *B2) findUnfinished(ctx context.Context, bk *base.Bucket, fileName string, uploadID string) (*base.File, error) {
+	startName, startID := fileName, ""
+	for {
+		files, nextName, nextID, err := bk.ListFileVersions(ctx, 100, startName, startID, fileName, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range files {
+			if f.Name == fileName && f.Status == "start" && uploadIDOf(f) == uploadID {
+				return f, nil
+			}
+		}
+		if nextName != fileName || nextID == "" {
+			return nil, mirror.ErrUploadNotFound
+		}
+		startName, startID = nextName, nextID
+	}
+}
+
+func uploadIDOf(f *base.File) string {
+	return strconv.FormatInt(f.Timestamp.UnixNano()/1e6, 10)
+}
+
+func (b *B2) StartMultipart(ctx context.Context, fileName string) (mirror.MultipartUpload, error) {
+	bk, err := b.apiClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lf, err := bk.StartLargeFile(ctx, fileName, "application/octet-stream", nil)
+	if err != nil && b.reauthorize(ctx, err) {
+		lf, err = bk.StartLargeFile(ctx, fileName, "application/octet-stream", nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// b2 only identifies uploads by an unexported file id, the start timestamp
+	// of the newest unfinished upload of that name is used instead.
+	files, _, _, err := bk.ListFileVersions(ctx, 100, fileName, "", fileName, "")
+	if err != nil {
+		return nil, err
+	}
+	var started *base.File
+	for _, f := range files {
+		if f.Name == fileName && f.Status == "start" && (started == nil || f.Timestamp.After(started.Timestamp)) {
+			started = f
+		}
+	}
+	if started == nil {
+		return nil, fmt.Errorf("could not find the started upload of %s", fileName)
+	}
+	return &b2Multipart{b: b, lf: lf, id: uploadIDOf(started)}, nil
+}
+
+func (b *B2) ResumeMultipart(ctx context.Context, fileName, uploadID string) (mirror.MultipartUpload, map[int]string, error) {
+	bk, err := b.apiClient(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := b.findUnfinished(ctx, bk, fileName, uploadID)
+	if err != nil {
+		return nil, nil, err
+	}
+	parts := make(map[int]string)
+	var size int64
+	next := 1
+	for next != 0 {
+		ps, n, err := f.ListParts(ctx, next, 100)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, p := range ps {
+			parts[p.Number] = p.SHA1
+			size += p.Size
+		}
+		if len(ps) == 0 {
+			break
+		}
+		next = n
+	}
+	return &b2Multipart{b: b, lf: f.CompileParts(size, parts), id: uploadID}, parts, nil
+}
+
+func (u *b2Multipart) ID() string {
+	return u.id
+}
+
+func (u *b2Multipart) WritePart(ctx context.Context, n int, p []byte) (string, error) {
+	sum := fmt.Sprintf("%x", sha1.Sum(p))
+	fc, err := u.lf.GetUploadPartURL(ctx)
+	if err != nil && u.b.reauthorize(ctx, err) {
+		fc, err = u.lf.GetUploadPartURL(ctx)
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := fc.UploadPart(ctx, bytes.NewReader(p), sum, len(p), n); err != nil {
+		return "", err
+	}
+	return sum, nil
+}
+
+func (u *b2Multipart) Complete(ctx context.Context) error {
+	_, err := u.lf.FinishLargeFile(ctx)
+	if err != nil && u.b.reauthorize(ctx, err) {
+		_, err = u.lf.FinishLargeFile(ctx)
+	}
+	return err
+}
+
+func (u *b2Multipart) Abort(ctx context.Context) error {
+	return u.lf.CancelLargeFile(ctx)
+}
+
 func newB2Bucket(ctx context.Context, b2id string, b2key string, bucketName string) *b2.Bucket {
 	b2Client, err := b2.NewClient(ctx, b2id, b2key)
 	if err != nil {
@@ -2,8 +2,18 @@ package remotebackend
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
 
+	"github.com/marpio/mirror"
 	"github.com/spf13/afero"
 )
 
@@ -36,3 +46,133 @@ func (b *FileSystem) Exists(ctx context.Context, fileName string) bool {
 	e, _ := afero.Exists(b.fs, fileName)
 	return e
 }
+
+func (b *FileSystem) List(ctx context.Context, prefix string) ([]mirror.ObjectInfo, error) {
+	res := make([]mirror.ObjectInfo, 0)
+	err := afero.Walk(b.fs, ".", func(pth string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() || !strings.HasPrefix(pth, prefix) {
+			return nil
+		}
+		res = append(res, mirror.ObjectInfo{Name: pth, Size: fi.Size(), ModTime: fi.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+type fsMultipart struct {
+	fs   afero.Fs
+	path string
+	id   string
+}
+
+func partsDir(fileName, uploadID string) string {
+	return path.Join(fileName+".parts", uploadID)
+}
+
+func (b *FileSystem) StartMultipart(ctx context.Context, fileName string) (mirror.MultipartUpload, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	u := &fsMultipart{fs: b.fs, path: fileName, id: hex.EncodeToString(id)}
+	if err := b.fs.MkdirAll(partsDir(fileName, u.id), 0700); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (b *FileSystem) ResumeMultipart(ctx context.Context, fileName, uploadID string) (mirror.MultipartUpload, map[int]string, error) {
+	dir := partsDir(fileName, uploadID)
+	infos, err := afero.ReadDir(b.fs, dir)
+	if os.IsNotExist(err) {
+		return nil, nil, mirror.ErrUploadNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	parts := make(map[int]string)
+	for _, fi := range infos {
+		n, err := strconv.Atoi(fi.Name())
+		if err != nil {
+			continue
+		}
+		data, err := afero.ReadFile(b.fs, path.Join(dir, fi.Name()))
+		if err != nil {
+			return nil, nil, err
+		}
+		parts[n] = checksum(data)
+	}
+	return &fsMultipart{fs: b.fs, path: fileName, id: uploadID}, parts, nil
+}
+
+func checksum(p []byte) string {
+	return fmt.Sprintf("%x", sha1.Sum(p))
+}
+
+func (u *fsMultipart) ID() string {
+	return u.id
+}
+
+func (u *fsMultipart) dir() string {
+	return partsDir(u.path, u.id)
+}
+
+func (u *fsMultipart) WritePart(ctx context.Context, n int, p []byte) (string, error) {
+	if err := afero.WriteFile(u.fs, path.Join(u.dir(), strconv.Itoa(n)), p, 0600); err != nil {
+		return "", err
+	}
+	return checksum(p), nil
+}
+
+func (u *fsMultipart) Complete(ctx context.Context) error {
+	infos, err := afero.ReadDir(u.fs, u.dir())
+	if err != nil {
+		return err
+	}
+	parts := make([]int, 0, len(infos))
+	for _, fi := range infos {
+		if n, err := strconv.Atoi(fi.Name()); err == nil {
+			parts = append(parts, n)
+		}
+	}
+	sort.Ints(parts)
+	f, err := u.fs.Create(u.path)
+	if err != nil {
+		return err
+	}
+	for i, n := range parts {
+		if n != i+1 {
+			f.Close()
+			return fmt.Errorf("part %d of %s is missing", i+1, u.path)
+		}
+		data, err := afero.ReadFile(u.fs, path.Join(u.dir(), strconv.Itoa(n)))
+		if err != nil {
+			f.Close()
+			return err
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return u.Abort(ctx)
+}
+
+func (u *fsMultipart) Abort(ctx context.Context) error {
+	if err := u.fs.RemoveAll(u.dir()); err != nil {
+		return err
+	}
+	if empty, _ := afero.IsEmpty(u.fs, u.path+".parts"); empty {
+		return u.fs.Remove(u.path + ".parts")
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/marpio/mirror"
+	"github.com/spf13/afero"
+)
+
+// uploadState is the progress of an unfinished resumable upload. It is saved
+// after every completed part.
+type uploadState struct {
+	Path     string      `json:"path"`
+	UploadID string      `json:"uploadId"`
+	PartSize int         `json:"partSize"`
+	Parts    []partState `json:"parts"`
+}
+
+type partState struct {
+	Checksum string `json:"checksum"`
+	// Prefix is the sha256 of the plaintext up to the end of the part. It makes
+	// sure the data has not changed before an upload gets resumed.
+	Prefix string `json:"prefix"`
+}
+
+type resumableWriter struct {
+	ctx    context.Context
+	rs     *RemoteStorage
+	mp     mirror.MultipartStorage
+	path   string
+	upload mirror.MultipartUpload
+	state  *uploadState
+	buf    []byte
+	prefix hash.Hash
+	// skip is the number of plaintext bytes, already uploaded before the upload
+	// got interrupted, which still need to be discarded.
+	skip           int64
+	expectedPrefix string
+	err            error
+}
+
+// NewResumableWriter returns a writer which uploads the data in parts and
+// records its progress, so that writing the same data to the same path after
+// a crash only uploads the missing parts. It falls back to NewWriter if the
+// backend does not support multipart uploads or no state dir is configured.
+func (b *RemoteStorage) NewResumableWriter(ctx context.Context, path string) io.WriteCloser {
+	mp, ok := b.backend.(mirror.MultipartStorage)
+	if !ok || b.statefs == nil {
+		return b.NewWriter(ctx, path)
+	}
+	w := &resumableWriter{ctx: ctx, rs: b, mp: mp, path: path, prefix: sha256.New()}
+	w.err = w.resume()
+	return w
+}
+
+func (b *RemoteStorage) statePath(path string) string {
+	return filepath.Join(b.stateDir, fmt.Sprintf("%x.json", sha1.Sum([]byte(path))))
+}
+
+func (w *resumableWriter) resume() error {
+	f, err := w.rs.statefs.Open(w.rs.statePath(w.path))
+	if err != nil {
+		return nil
+	}
+	var st uploadState
+	err = json.NewDecoder(f).Decode(&st)
+	f.Close()
+	if err != nil || st.Path != w.path || st.PartSize != w.rs.partSize {
+		return w.removeState()
+	}
+	upload, uploaded, err := w.mp.ResumeMultipart(w.ctx, w.path, st.UploadID)
+	if err == mirror.ErrUploadNotFound {
+		return w.removeState()
+	}
+	if err != nil {
+		return err
+	}
+	// only the parts which made it to the backend, up to the first missing one, count
+	k := 0
+	for k < len(st.Parts) && uploaded[k+1] == st.Parts[k].Checksum {
+		k++
+	}
+	st.Parts = st.Parts[:k]
+	w.upload = upload
+	w.state = &st
+	w.skip = int64(k) * int64(w.rs.partSize)
+	if k > 0 {
+		w.expectedPrefix = st.Parts[k-1].Prefix
+	}
+	return nil
+}
+
+func (w *resumableWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := len(p)
+	if w.skip > 0 {
+		k := int64(len(p))
+		if k > w.skip {
+			k = w.skip
+		}
+		w.prefix.Write(p[:k])
+		w.skip -= k
+		p = p[k:]
+		if w.skip == 0 && hex.EncodeToString(w.prefix.Sum(nil)) != w.expectedPrefix {
+			w.abort()
+			w.err = fmt.Errorf("content of %s changed since its upload was interrupted", w.path)
+			return 0, w.err
+		}
+	}
+	w.buf = append(w.buf, p...)
+	// a part is only sent once more data follows, so multipart uploads always
+	// consist of at least two parts
+	for len(w.buf) > w.rs.partSize {
+		if err := w.writePart(w.buf[:w.rs.partSize]); err != nil {
+			w.err = err
+			return 0, err
+		}
+		w.buf = append([]byte(nil), w.buf[w.rs.partSize:]...)
+	}
+	return n, nil
+}
+
+func (w *resumableWriter) writePart(data []byte) error {
+	if w.upload == nil {
+		u, err := w.mp.StartMultipart(w.ctx, w.path)
+		if err != nil {
+			return err
+		}
+		w.upload = u
+		w.state = &uploadState{Path: w.path, UploadID: u.ID(), PartSize: w.rs.partSize}
+	}
+	encrypted, err := w.rs.seal(data)
+	if err != nil {
+		return err
+	}
+	sum, err := w.upload.WritePart(w.ctx, len(w.state.Parts)+1, encrypted)
+	if err != nil {
+		return err
+	}
+	w.prefix.Write(data)
+	w.state.Parts = append(w.state.Parts, partState{Checksum: sum, Prefix: hex.EncodeToString(w.prefix.Sum(nil))})
+	return w.saveState()
+}
+
+func (w *resumableWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	// a cancelled upload is resumed by the next attempt
+	if err := w.ctx.Err(); err != nil {
+		return err
+	}
+	if w.skip > 0 {
+		w.abort()
+		return fmt.Errorf("content of %s changed since its upload was interrupted", w.path)
+	}
+	if w.upload == nil {
+		wr := w.rs.NewWriter(w.ctx, w.path)
+		if _, err := wr.Write(w.buf); err != nil {
+			return err
+		}
+		return wr.Close()
+	}
+	if len(w.buf) > 0 {
+		if err := w.writePart(w.buf); err != nil {
+			return err
+		}
+	}
+	if err := w.upload.Complete(w.ctx); err != nil {
+		return err
+	}
+	return w.removeState()
+}
+
+func (w *resumableWriter) abort() {
+	if w.upload != nil {
+		w.upload.Abort(w.ctx)
+	}
+	w.removeState()
+}
+
+func (w *resumableWriter) saveState() error {
+	if err := w.rs.statefs.MkdirAll(w.rs.stateDir, 0700); err != nil {
+		return err
+	}
+	b, err := json.Marshal(w.state)
+	if err != nil {
+		return err
+	}
+	p := w.rs.statePath(w.path)
+	if err := afero.WriteFile(w.rs.statefs, p+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return w.rs.statefs.Rename(p+".tmp", p)
+}
+
+func (w *resumableWriter) removeState() error {
+	err := w.rs.statefs.Remove(w.rs.statePath(w.path))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// seal encrypts data of any length the same way the writer returned by
+// NewWriter does - in full blocks followed by the remainder.
+func (b *RemoteStorage) seal(data []byte) ([]byte, error) {
+	end := (len(data) / b.crpt.BlockSize()) * b.crpt.BlockSize()
+	full, err := b.crpt.Seal(data[:end])
+	if err != nil {
+		return nil, err
+	}
+	rem, err := b.crpt.Seal(data[end:])
+	if err != nil {
+		return nil, err
+	}
+	return append(full, rem...), nil
+}
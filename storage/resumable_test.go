@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/crypto"
+	"github.com/marpio/mirror/storage/remotebackend"
+	"github.com/spf13/afero"
+)
+
+// flakyBackend fails every part write after the first failAfter ones.
+type flakyBackend struct {
+	*remotebackend.FileSystem
+	failAfter int
+	written   int
+}
+
+type flakyUpload struct {
+	mirror.MultipartUpload
+	b *flakyBackend
+}
+
+func (b *flakyBackend) StartMultipart(ctx context.Context, path string) (mirror.MultipartUpload, error) {
+	u, err := b.FileSystem.StartMultipart(ctx, path)
+	return &flakyUpload{u, b}, err
+}
+
+func (b *flakyBackend) ResumeMultipart(ctx context.Context, path, id string) (mirror.MultipartUpload, map[int]string, error) {
+	u, parts, err := b.FileSystem.ResumeMultipart(ctx, path, id)
+	return &flakyUpload{u, b}, parts, err
+}
+
+func (u *flakyUpload) WritePart(ctx context.Context, n int, p []byte) (string, error) {
+	if u.b.failAfter >= 0 && u.b.written >= u.b.failAfter {
+		return "", errors.New("connection reset")
+	}
+	u.b.written++
+	return u.MultipartUpload.WritePart(ctx, n, p)
+}
+
+func randomData(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+	return data
+}
+
+func newResumableRemote(afs afero.Fs, b mirror.Storage) *RemoteStorage {
+	c := crypto.NewService(encKey, crypto.WithBlockSize(1024))
+	return NewRemote(b, c, WithResumeState(afs, "state"), WithPartSize(4096))
+}
+
+func readAll(t *testing.T, rs *RemoteStorage, path string) []byte {
+	r, err := rs.NewReader(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestResumableWriteRead(t *testing.T) {
+	afs := afero.NewMemMapFs()
+	rs := newResumableRemote(afs, remotebackend.NewFileSystem(afs))
+	for _, size := range []int{10, 4096, 4097, 3*4096 + 500} {
+		data := randomData(size)
+		w := rs.NewResumableWriter(ctx, "photo")
+		w.Write(data)
+		if err := w.Close(); err != nil {
+			t.Fatalf("error closing writer: %v", err)
+		}
+		if !bytes.Equal(data, readAll(t, rs, "photo")) {
+			t.Errorf("downloaded data of size %d does not match the uploaded.", size)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	afs := afero.NewMemMapFs()
+	backend := &flakyBackend{FileSystem: remotebackend.NewFileSystem(afs), failAfter: 2}
+	rs := newResumableRemote(afs, backend)
+	data := randomData(5*4096 + 100)
+
+	w := rs.NewResumableWriter(ctx, "photo")
+	if _, err := w.Write(data); err == nil {
+		t.Fatal("expected the first upload to fail")
+	}
+
+	backend.failAfter = -1
+	backend.written = 0
+	w = rs.NewResumableWriter(ctx, "photo")
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatalf("error resuming upload: %v", err)
+	}
+	if backend.written != 4 {
+		t.Errorf("expected only the 4 missing parts to be uploaded, got: %d", backend.written)
+	}
+	if !bytes.Equal(data, readAll(t, rs, "photo")) {
+		t.Error("downloaded data does not match the uploaded.")
+	}
+	if e, _ := afero.Exists(afs, rs.statePath("photo")); e {
+		t.Error("expected the upload state to be removed")
+	}
+}
+
+func TestResumeCancelled(t *testing.T) {
+	afs := afero.NewMemMapFs()
+	backend := &flakyBackend{FileSystem: remotebackend.NewFileSystem(afs), failAfter: -1}
+	rs := newResumableRemote(afs, backend)
+	data := randomData(3*4096 + 100)
+
+	c, cancel := context.WithCancel(ctx)
+	w := rs.NewResumableWriter(c, "photo")
+	w.Write(data[:2*4096+1])
+	cancel()
+	if err := w.Close(); err != context.Canceled {
+		t.Fatalf("expected the cancelled upload not to be completed, got %v", err)
+	}
+	if rs.Exists(ctx, "photo") {
+		t.Fatal("expected no object for the cancelled upload")
+	}
+
+	backend.written = 0
+	w = rs.NewResumableWriter(ctx, "photo")
+	w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatalf("error resuming upload: %v", err)
+	}
+	if backend.written != 2 {
+		t.Errorf("expected only the 2 missing parts to be uploaded, got: %d", backend.written)
+	}
+	if !bytes.Equal(data, readAll(t, rs, "photo")) {
+		t.Error("downloaded data does not match the uploaded.")
+	}
+}
+
+func TestResumeChangedContent(t *testing.T) {
+	afs := afero.NewMemMapFs()
+	backend := &flakyBackend{FileSystem: remotebackend.NewFileSystem(afs), failAfter: 2}
+	rs := newResumableRemote(afs, backend)
+
+	w := rs.NewResumableWriter(ctx, "photo")
+	w.Write(randomData(5 * 4096))
+
+	backend.failAfter = -1
+	w = rs.NewResumableWriter(ctx, "photo")
+	if _, err := w.Write(randomData(5 * 4096)); err == nil {
+		t.Error("expected an error when resuming with different content")
+	}
+	if e, _ := afero.Exists(afs, rs.statePath("photo")); e {
+		t.Error("expected the upload state to be removed")
+	}
+}
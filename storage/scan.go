@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/marpio/mirror"
+	"github.com/spf13/afero"
+)
+
+type SymlinkPolicy int
+
+const (
+	// FollowFileSymlinks includes symlinked files but does not descend into
+	// symlinked directories.
+	FollowFileSymlinks SymlinkPolicy = iota
+	SkipSymlinks
+	FollowSymlinks
+)
+
+// maxWalkDepth protects against symlink loops which can not be detected by
+// inode, e.g. on filesystems without inodes.
+const maxWalkDepth = 64
+
+// ScanRules decide which files FindFiles returns, in addition to the
+// extensions. The zero value accepts every file.
+type ScanRules struct {
+	// Include, if not empty, are the gitignore style patterns a file has to
+	// match. Like Exclude, they are relative to the scanned directory.
+	Include []string
+	Exclude []string
+	// IgnoreFile is the name of the per-directory files with additional exclude
+	// patterns, relative to the directory they are in.
+	IgnoreFile string
+	// MaxDepth limits how deep files may be below the scanned directory, files
+	// directly in it are at depth 1. Zero means no limit.
+	MaxDepth   int
+	Symlinks   SymlinkPolicy
+	SkipHidden bool
+	// MinSize and MaxSize limit the file size in bytes. Zero means no limit.
+	MinSize int64
+	MaxSize int64
+}
+
+// WithScanRules makes FindFiles skip the files not matching r.
+func WithScanRules(r ScanRules) localOption {
+	return func(s *ReadOnlyLocalStorage) {
+		s.rules = r
+	}
+}
+
+// fileKey identifies a file, inode numbers are only unique per device.
+type fileKey struct {
+	dev, ino uint64
+}
+
+type scanner struct {
+	repo    *ReadOnlyLocalStorage
+	exts    []string
+	exclude []pattern
+	include []pattern
+	stat    func(name string) (os.FileInfo, error)
+	visited map[fileKey]bool
+	files   []mirror.FileInfo
+}
+
+func (repo *ReadOnlyLocalStorage) newScanner(exts []string) *scanner {
+	s := &scanner{repo: repo, exts: exts, stat: repo.fs.Stat, visited: make(map[fileKey]bool), files: make([]mirror.FileInfo, 0)}
+	for _, l := range repo.rules.Exclude {
+		if p, ok := parsePattern(l, ""); ok {
+			s.exclude = append(s.exclude, p)
+		}
+	}
+	for _, l := range repo.rules.Include {
+		if p, ok := parsePattern(l, ""); ok {
+			s.include = append(s.include, p)
+		}
+	}
+	return s
+}
+
+func lstat(fs afero.Fs, p string) (os.FileInfo, error) {
+	if _, ok := fs.(*afero.OsFs); ok {
+		return os.Lstat(p)
+	}
+	return fs.Stat(p)
+}
+
+// resolve applies the symlink policy to fi.
+func (s *scanner) resolve(p string, fi os.FileInfo) (os.FileInfo, bool) {
+	if fi.Mode()&os.ModeSymlink == 0 {
+		return fi, true
+	}
+	if s.repo.rules.Symlinks == SkipSymlinks {
+		return nil, false
+	}
+	target, err := s.repo.fs.Stat(p)
+	if err != nil {
+		return nil, false
+	}
+	if target.IsDir() && s.repo.rules.Symlinks != FollowSymlinks {
+		return nil, false
+	}
+	return target, true
+}
+
+func (s *scanner) ignoreFile(dir, rel string) []pattern {
+	if s.repo.rules.IgnoreFile == "" {
+		return nil
+	}
+	data, err := afero.ReadFile(s.repo.fs, filepath.Join(dir, s.repo.rules.IgnoreFile))
+	if err != nil {
+		return nil
+	}
+	return parsePatterns(data, rel)
+}
+
+func (s *scanner) skipDir(name, rel string, depth int, patterns []pattern) bool {
+	if s.repo.rules.SkipHidden && strings.HasPrefix(name, ".") {
+		return true
+	}
+	if matches(patterns, rel, true) {
+		return true
+	}
+	// files in the directory would be at depth+2
+	return depth+1 >= maxWalkDepth || (s.repo.rules.MaxDepth > 0 && depth+1 >= s.repo.rules.MaxDepth)
+}
+
+// walkDir scans dir, which is at depth below the root and at the slash
+// separated path rel relative to it.
+func (s *scanner) walkDir(dir, rel string, depth int, patterns []pattern) {
+	if st, err := s.stat(dir); err == nil {
+		if id := fileID(st); id.ino != 0 {
+			if s.visited[id] {
+				return
+			}
+			s.visited[id] = true
+		}
+	}
+	patterns = append(patterns[:len(patterns):len(patterns)], s.ignoreFile(dir, rel)...)
+	infos, err := afero.ReadDir(s.repo.fs, dir)
+	if err != nil {
+		s.repo.logctx.WithError(err).WithField("path", dir).Warn("skipping the directory")
+		return
+	}
+	for _, fi := range infos {
+		p := filepath.Join(dir, fi.Name())
+		childRel := path.Join(rel, fi.Name())
+		fi, ok := s.resolve(p, fi)
+		if !ok {
+			continue
+		}
+		if fi.IsDir() {
+			if !s.skipDir(filepath.Base(p), childRel, depth, patterns) {
+				s.walkDir(p, childRel, depth+1, patterns)
+			}
+			continue
+		}
+		s.addFile(p, childRel, fi, patterns)
+	}
+}
+
+// scanFile checks a single file against the rules of the directories between
+// root and the file.
+func (s *scanner) scanFile(root, p string, fi os.FileInfo) {
+	fi, ok := s.resolve(p, fi)
+	if !ok || fi.IsDir() {
+		return
+	}
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return
+	}
+	segs := strings.Split(filepath.ToSlash(rel), "/")
+	if s.repo.rules.MaxDepth > 0 && len(segs) > s.repo.rules.MaxDepth {
+		return
+	}
+	patterns := append(s.exclude[:len(s.exclude):len(s.exclude)], s.ignoreFile(root, "")...)
+	dir := root
+	for i, seg := range segs[:len(segs)-1] {
+		dirRel := strings.Join(segs[:i+1], "/")
+		dir = filepath.Join(dir, seg)
+		if (s.repo.rules.SkipHidden && strings.HasPrefix(seg, ".")) || matches(patterns, dirRel, true) {
+			return
+		}
+		patterns = append(patterns, s.ignoreFile(dir, dirRel)...)
+	}
+	s.addFile(p, strings.Join(segs, "/"), fi, patterns)
+}
+
+func (s *scanner) addFile(p, rel string, fi os.FileInfo, patterns []pattern) {
+	name := strings.ToLower(fi.Name())
+	hasExt := false
+	for _, ext := range s.exts {
+		if strings.HasSuffix(name, ext) {
+			hasExt = true
+			break
+		}
+	}
+	if !hasExt {
+		return
+	}
+	r := s.repo.rules
+	if r.SkipHidden && strings.HasPrefix(fi.Name(), ".") {
+		return
+	}
+	if matches(patterns, rel, false) {
+		return
+	}
+	if len(s.include) > 0 && !matches(s.include, rel, false) {
+		return
+	}
+	if (r.MinSize > 0 && fi.Size() < r.MinSize) || (r.MaxSize > 0 && fi.Size() > r.MaxSize) {
+		return
+	}
+	open := func(p string) (io.ReadCloser, error) {
+		return s.repo.fs.Open(p)
+	}
+	if s.repo.hashCache != nil {
+		s.repo.hashCache.visit(p)
+	}
+	finf := NewFileInfo(p, open, s.repo.generateFileHash)
+	finf.stat = fi
+	finf.cache = s.repo.hashCache
+	s.files = append(s.files, finf)
+}
+
+// rootFor returns the previously scanned directory containing p, so that
+// single changed files are checked against the same rules as during the scan.
+func (repo *ReadOnlyLocalStorage) rootFor(p string) string {
+	repo.rootsMu.Lock()
+	defer repo.rootsMu.Unlock()
+	best := ""
+	for _, r := range repo.roots {
+		if strings.HasPrefix(p, r+string(filepath.Separator)) && len(r) > len(best) {
+			best = r
+		}
+	}
+	if best == "" {
+		return filepath.Dir(p)
+	}
+	return best
+}
+
+func (repo *ReadOnlyLocalStorage) addRoot(dir string) {
+	repo.rootsMu.Lock()
+	defer repo.rootsMu.Unlock()
+	dir = filepath.Clean(dir)
+	for _, r := range repo.roots {
+		if r == dir {
+			return
+		}
+	}
+	repo.roots = append(repo.roots, dir)
+}
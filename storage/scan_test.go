@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/marpio/mirror/crypto"
+	"github.com/spf13/afero"
+)
+
+func TestPatternMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		base    string
+		rel     string
+		isDir   bool
+		want    bool
+	}{
+		{"*.jpg", "", "a.jpg", false, true},
+		{"*.jpg", "", "x/y/a.jpg", false, true},
+		{"/*.jpg", "", "x/a.jpg", false, false},
+		{"tmp/", "", "x/tmp", true, true},
+		{"tmp/", "", "x/tmp", false, false},
+		{"x/*/a.jpg", "", "x/y/a.jpg", false, true},
+		{"x/**/a.jpg", "", "x/a.jpg", false, true},
+		{"x/**/a.jpg", "", "x/y/z/a.jpg", false, true},
+		{"**/raw", "", "x/y/raw", true, true},
+		{"a.jpg", "x", "x/y/a.jpg", false, true},
+		{"a.jpg", "x", "z/a.jpg", false, false},
+	}
+	for _, c := range cases {
+		p, ok := parsePattern(c.pattern, c.base)
+		if !ok {
+			t.Fatalf("%q: not parsed", c.pattern)
+		}
+		if got := p.match(c.rel, c.isDir); got != c.want {
+			t.Errorf("%q (base %q) on %q: expected %v, got %v", c.pattern, c.base, c.rel, c.want, got)
+		}
+	}
+}
+
+func TestMatchesLastPatternWins(t *testing.T) {
+	patterns := parsePatterns([]byte("# comment\n\n*.jpg\n!keep.jpg\n"), "")
+	if !matches(patterns, "a.jpg", false) {
+		t.Error("expected a.jpg to match")
+	}
+	if matches(patterns, "keep.jpg", false) {
+		t.Error("expected keep.jpg to be negated")
+	}
+}
+
+func findFiles(local *ReadOnlyLocalStorage, dir string) []string {
+	res := make([]string, 0)
+	for _, fi := range local.FindFiles(dir, ".jpg") {
+		res = append(res, fi.FilePath())
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestFindFilesScanRules(t *testing.T) {
+	afs := afero.NewMemMapFs()
+	afero.WriteFile(afs, "/photos/a.jpg", []byte("a"), 0600)
+	afero.WriteFile(afs, "/photos/big.jpg", []byte("0123456789"), 0600)
+	afero.WriteFile(afs, "/photos/.hidden.jpg", []byte("h"), 0600)
+	afero.WriteFile(afs, "/photos/2017/b.jpg", []byte("b"), 0600)
+	afero.WriteFile(afs, "/photos/2017/deep/c.jpg", []byte("c"), 0600)
+	afero.WriteFile(afs, "/photos/2017/.mirrorignore", []byte("deep/\n"), 0600)
+	afero.WriteFile(afs, "/photos/.cache/d.jpg", []byte("d"), 0600)
+	afero.WriteFile(afs, "/photos/tmp/e.jpg", []byte("e"), 0600)
+
+	cases := []struct {
+		name  string
+		rules ScanRules
+		want  []string
+	}{
+		{"zero value", ScanRules{}, []string{
+			"/photos/.cache/d.jpg", "/photos/.hidden.jpg", "/photos/2017/b.jpg", "/photos/2017/deep/c.jpg",
+			"/photos/a.jpg", "/photos/big.jpg", "/photos/tmp/e.jpg"}},
+		{"ignore file and hidden", ScanRules{IgnoreFile: ".mirrorignore", SkipHidden: true}, []string{
+			"/photos/2017/b.jpg", "/photos/a.jpg", "/photos/big.jpg", "/photos/tmp/e.jpg"}},
+		{"exclude", ScanRules{Exclude: []string{"tmp/", "big.jpg"}, SkipHidden: true}, []string{
+			"/photos/2017/b.jpg", "/photos/2017/deep/c.jpg", "/photos/a.jpg"}},
+		{"include", ScanRules{Include: []string{"2017/**"}}, []string{
+			"/photos/2017/b.jpg", "/photos/2017/deep/c.jpg"}},
+		{"max depth", ScanRules{MaxDepth: 1}, []string{
+			"/photos/.hidden.jpg", "/photos/a.jpg", "/photos/big.jpg"}},
+		{"size", ScanRules{MinSize: 2, MaxSize: 100}, []string{"/photos/big.jpg"}},
+	}
+	for _, c := range cases {
+		local := NewLocal(afs, crypto.GenerateSha256, WithScanRules(c.rules))
+		if got := findFiles(local, "/photos"); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.want, got)
+		}
+	}
+}
+
+func TestFindFilesSingleFileUsesScanRoot(t *testing.T) {
+	afs := afero.NewMemMapFs()
+	afero.WriteFile(afs, "/photos/.mirrorignore", []byte("raw/\n"), 0600)
+	afero.WriteFile(afs, "/photos/a.jpg", []byte("a"), 0600)
+	afero.WriteFile(afs, "/photos/2017/raw/b.jpg", []byte("b"), 0600)
+	afero.WriteFile(afs, "/photos/2017/c.jpg", []byte("c"), 0600)
+
+	local := NewLocal(afs, crypto.GenerateSha256, WithScanRules(ScanRules{IgnoreFile: ".mirrorignore"}))
+	findFiles(local, "/photos")
+	if got := findFiles(local, "/photos/2017/raw/b.jpg"); len(got) != 0 {
+		t.Errorf("expected the ignored file to be skipped, got %v", got)
+	}
+	if got := findFiles(local, "/photos/2017/c.jpg"); !reflect.DeepEqual(got, []string{"/photos/2017/c.jpg"}) {
+		t.Errorf("expected the file to be found, got %v", got)
+	}
+}
@@ -0,0 +1,58 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package storage
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/marpio/mirror/crypto"
+	"github.com/spf13/afero"
+)
+
+type statInfo struct {
+	os.FileInfo
+	sys *syscall.Stat_t
+}
+
+func (fi statInfo) Sys() interface{} {
+	return fi.sys
+}
+
+func TestWalkDirSameInodeOnOtherDevice(t *testing.T) {
+	afs := afero.NewMemMapFs()
+	afero.WriteFile(afs, "/photos/a/a.jpg", []byte("a"), 0600)
+	afero.WriteFile(afs, "/photos/b/b.jpg", []byte("b"), 0600)
+	afero.WriteFile(afs, "/photos/b/loop/c.jpg", []byte("c"), 0600)
+
+	// a and b are the roots of two mounts with the same inode, loop is a bind
+	// mount of b
+	ids := map[string]*syscall.Stat_t{
+		"/photos":        {Dev: 1, Ino: 2},
+		"/photos/a":      {Dev: 1, Ino: 7},
+		"/photos/b":      {Dev: 2, Ino: 7},
+		"/photos/b/loop": {Dev: 2, Ino: 7},
+	}
+	local := NewLocal(afs, crypto.GenerateSha256)
+	s := local.newScanner([]string{".jpg"})
+	s.stat = func(name string) (os.FileInfo, error) {
+		fi, err := afs.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		return statInfo{fi, ids[name]}, nil
+	}
+	s.walkDir("/photos", "", 0, s.exclude)
+	got := make([]string, 0)
+	for _, fi := range s.files {
+		got = append(got, fi.FilePath())
+	}
+	sort.Strings(got)
+	if want := []string{"/photos/a/a.jpg", "/photos/b/b.jpg"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/marpio/mirror"
+)
+
+// Unlimited and Paused are special rates of a RateLimiter.
+const (
+	Unlimited int64 = 0
+	Paused    int64 = -1
+)
+
+// maxBurst is how many bytes can be sent at once after being idle, a few
+// chunks so that the data flows evenly at low rates as well.
+const maxBurst = 4 * throttleChunk
+
+// RateLimiter is a token bucket limiting the bytes per second. Up to
+// maxBurst bytes, or one second worth of them at lower rates, can be sent at
+// once after being idle.
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    int64
+	tokens  float64
+	last    time.Time
+	changed chan struct{}
+	now     func() time.Time
+}
+
+func NewRateLimiter(bytesPerSec int64) *RateLimiter {
+	return &RateLimiter{rate: bytesPerSec, changed: make(chan struct{}), now: time.Now}
+}
+
+// SetRate changes the rate, waiting callers pick it up immediately.
+func (l *RateLimiter) SetRate(bytesPerSec int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == bytesPerSec {
+		return
+	}
+	l.refill()
+	l.rate = bytesPerSec
+	if l.rate > 0 && l.tokens > l.burst() {
+		l.tokens = l.burst()
+	}
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+func (l *RateLimiter) Rate() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// burst returns the size of the bucket, l.mu must be held.
+func (l *RateLimiter) burst() float64 {
+	if l.rate < maxBurst {
+		return float64(l.rate)
+	}
+	return maxBurst
+}
+
+// refill adds the tokens accumulated since the last call, l.mu must be held.
+func (l *RateLimiter) refill() {
+	now := l.now()
+	if l.rate > 0 && !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > l.burst() {
+			l.tokens = l.burst()
+		}
+	}
+	l.last = now
+}
+
+// WaitN blocks until n bytes may be sent or ctx is done.
+func (l *RateLimiter) WaitN(ctx context.Context, n int) error {
+	need := float64(n)
+	for need > 0 {
+		l.mu.Lock()
+		l.refill()
+		changed := l.changed
+		var wait time.Duration
+		switch {
+		case l.rate == Unlimited:
+			l.mu.Unlock()
+			return nil
+		case l.rate < 0:
+			wait = -1
+		default:
+			// requests bigger than the bucket are served in bucket sized chunks
+			take := need
+			if take > l.burst() {
+				take = l.burst()
+			}
+			if l.tokens >= take {
+				l.tokens -= take
+				need -= take
+			} else {
+				wait = time.Duration((take - l.tokens) / float64(l.rate) * float64(time.Second))
+			}
+		}
+		l.mu.Unlock()
+		if wait == 0 {
+			continue
+		}
+		var t *time.Timer
+		var timeout <-chan time.Time
+		if wait > 0 {
+			t = time.NewTimer(wait)
+			timeout = t.C
+		}
+		select {
+		case <-ctx.Done():
+		case <-changed:
+		case <-timeout:
+		}
+		if t != nil {
+			t.Stop()
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// release returns n unused bytes taken by WaitN.
+func (l *RateLimiter) release(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return
+	}
+	l.tokens += float64(n)
+	if l.tokens > l.burst() {
+		l.tokens = l.burst()
+	}
+}
+
+// ThrottledStorage limits the bandwidth used by the reads and writes of the
+// wrapped storage.
+type ThrottledStorage struct {
+	mirror.Storage
+	read  *RateLimiter
+	write *RateLimiter
+}
+
+// NewThrottled wraps s, a nil limiter doesn't limit the respective direction.
+func NewThrottled(s mirror.Storage, read, write *RateLimiter) *ThrottledStorage {
+	return &ThrottledStorage{Storage: s, read: read, write: write}
+}
+
+func (s *ThrottledStorage) NewReader(ctx context.Context, path string) (io.ReadCloser, error) {
+	r, err := s.Storage.NewReader(ctx, path)
+	if err != nil || s.read == nil {
+		return r, err
+	}
+	return &throttledReader{ReadCloser: r, ctx: ctx, l: s.read}, nil
+}
+
+func (s *ThrottledStorage) NewWriter(ctx context.Context, path string) io.WriteCloser {
+	return s.throttleWriter(ctx, s.Storage.NewWriter(ctx, path))
+}
+
+// NewResumableWriter uses the resumable writer of the wrapped storage if it
+// has one.
+func (s *ThrottledStorage) NewResumableWriter(ctx context.Context, path string) io.WriteCloser {
+	if rw, ok := s.Storage.(mirror.ResumableStorageWriter); ok {
+		return s.throttleWriter(ctx, rw.NewResumableWriter(ctx, path))
+	}
+	return s.NewWriter(ctx, path)
+}
+
+func (s *ThrottledStorage) List(ctx context.Context, prefix string) ([]mirror.ObjectInfo, error) {
+	l, ok := s.Storage.(mirror.StorageLister)
+	if !ok {
+		return nil, fmt.Errorf("storage does not support listing")
+	}
+	return l.List(ctx, prefix)
+}
+
+func (s *ThrottledStorage) throttleWriter(ctx context.Context, w io.WriteCloser) io.WriteCloser {
+	if s.write == nil {
+		return w
+	}
+	return &throttledWriter{WriteCloser: w, ctx: ctx, l: s.write}
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	ctx context.Context
+	l   *RateLimiter
+}
+
+// throttleChunk keeps single reads and writes small, so changed rates take
+// effect quickly and the data flows evenly.
+const throttleChunk = 32 * 1024
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	if err := r.l.WaitN(r.ctx, len(p)); err != nil {
+		return 0, err
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.l.release(len(p) - n)
+	return n, err
+}
+
+type throttledWriter struct {
+	io.WriteCloser
+	ctx context.Context
+	l   *RateLimiter
+}
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > throttleChunk {
+			chunk = chunk[:throttleChunk]
+		}
+		if err := w.l.WaitN(w.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := w.WriteCloser.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/marpio/mirror/storage/remotebackend"
+	"github.com/spf13/afero"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := NewRateLimiter(100 * 1024)
+	start := time.Now()
+	if err := l.WaitN(context.Background(), 20*1024); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond || d > time.Second {
+		t.Errorf("expected 20KiB at 100KiB/s to take about 200ms, took: %v", d)
+	}
+
+	l.SetRate(Unlimited)
+	start = time.Now()
+	l.WaitN(context.Background(), 10*1024*1024)
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("expected no wait when unlimited, took: %v", d)
+	}
+}
+
+type countingWriter struct {
+	n int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += len(p)
+	return len(p), nil
+}
+
+func (w *countingWriter) Close() error { return nil }
+
+func TestThrottledWriterBurst(t *testing.T) {
+	for _, c := range []struct {
+		rate  int64
+		burst int
+	}{
+		{10 * 1024 * 1024, maxBurst},
+		{2 * throttleChunk, 2 * throttleChunk},
+	} {
+		// the clock stands still after a minute of idling, so only the
+		// accumulated tokens can be sent
+		start := time.Now()
+		l := NewRateLimiter(c.rate)
+		l.last = start
+		l.now = func() time.Time { return start.Add(time.Minute) }
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		cw := &countingWriter{}
+		w := &throttledWriter{WriteCloser: cw, ctx: ctx, l: l}
+		n, err := w.Write(make([]byte, 5*1024*1024))
+		cancel()
+		if err != context.DeadlineExceeded {
+			t.Errorf("%d B/s: expected the writer to wait, got %v", c.rate, err)
+		}
+		if n != c.burst || cw.n != c.burst {
+			t.Errorf("%d B/s: expected a burst of %d bytes, got %d", c.rate, c.burst, cw.n)
+		}
+	}
+}
+
+func TestRateLimiterPaused(t *testing.T) {
+	l := NewRateLimiter(Paused)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := l.WaitN(ctx, 1); err != context.DeadlineExceeded {
+		t.Errorf("expected to wait until the deadline, got: %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- l.WaitN(context.Background(), 1)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	l.SetRate(Unlimited)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected the waiting caller to continue after resuming")
+	}
+}
+
+func TestThrottledStorage(t *testing.T) {
+	afs := afero.NewMemMapFs()
+	rs := NewThrottled(newResumableRemote(afs, remotebackend.NewFileSystem(afs)), NewRateLimiter(Unlimited), NewRateLimiter(Unlimited))
+	data := randomData(3*4096 + 500)
+	w := rs.NewResumableWriter(ctx, "a")
+	if _, err := io.Copy(w, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := rs.NewReader(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	var buf bytes.Buffer
+	io.Copy(&buf, r)
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Error("read data differs from the written data")
+	}
+}
@@ -0,0 +1,175 @@
+package syncronizer
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+type EventType string
+
+const (
+	ScanStarted    EventType = "scan_started"
+	ScanDone       EventType = "scan_done"
+	FileHashed     EventType = "file_hashed"
+	FileExtracted  EventType = "file_extracted"
+	UploadProgress EventType = "upload_progress"
+	FileUploaded   EventType = "file_uploaded"
+	UploadRetry    EventType = "upload_retry"
+	FileFailed     EventType = "file_failed"
+	SyncDone       EventType = "sync_done"
+)
+
+// Event is sent to the observers while syncing. Progress is a snapshot of the
+// whole sync after the event has been accounted for.
+type Event struct {
+	Type     EventType `json:"type"`
+	Time     time.Time `json:"time"`
+	FilePath string    `json:"file,omitempty"`
+	// Files is the number of files found, for ScanDone events.
+	Files int `json:"files,omitempty"`
+	// New is set for FileHashed events of files which are not in the catalog.
+	New bool `json:"new,omitempty"`
+	// Bytes is the number of bytes of FilePath uploaded so far.
+	Bytes    int64    `json:"bytes,omitempty"`
+	Attempt  int      `json:"attempt,omitempty"`
+	Err      string   `json:"error,omitempty"`
+	Progress Progress `json:"progress"`
+}
+
+type Progress struct {
+	FilesFound     int `json:"files_found"`
+	FilesHashed    int `json:"files_hashed"`
+	FilesNew       int `json:"files_new"`
+	FilesExtracted int `json:"files_extracted"`
+	FilesUploaded  int `json:"files_uploaded"`
+	FilesFailed    int `json:"files_failed"`
+	// BytesUploaded includes the bytes sent by failed attempts.
+	BytesUploaded int64 `json:"bytes_uploaded"`
+	Retries       int   `json:"retries"`
+	// ETA is the estimated time left, based on the upload rate so far. It is
+	// zero until the first file has been uploaded.
+	ETA time.Duration `json:"eta_ns"`
+}
+
+// Observer is notified about the progress of a sync. Events are delivered one
+// at a time, so OnEvent must not block for long.
+type Observer interface {
+	OnEvent(e Event)
+}
+
+type ObserverFunc func(e Event)
+
+func (f ObserverFunc) OnEvent(e Event) {
+	f(e)
+}
+
+// WithObserver adds o to the observers of the sync progress, a nil o is
+// ignored.
+func WithObserver(o Observer) option {
+	return func(s *Service) {
+		if o == nil {
+			return
+		}
+		s.observers = append(s.observers, o)
+	}
+}
+
+type progressTracker struct {
+	mu          sync.Mutex
+	observers   []Observer
+	p           Progress
+	uploadStart time.Time
+	now         func() time.Time
+}
+
+func (t *progressTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.p = Progress{}
+	t.uploadStart = time.Time{}
+}
+
+func (t *progressTracker) emit(e Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e.Time = t.now()
+	switch e.Type {
+	case ScanDone:
+		t.p.FilesFound += e.Files
+	case FileHashed:
+		t.p.FilesHashed++
+		if e.New {
+			t.p.FilesNew++
+		}
+	case FileExtracted:
+		t.p.FilesExtracted++
+		if t.uploadStart.IsZero() {
+			t.uploadStart = e.Time
+		}
+	case FileUploaded:
+		t.p.FilesUploaded++
+	case UploadRetry:
+		t.p.Retries++
+	case FileFailed:
+		t.p.FilesFailed++
+	}
+	t.p.ETA = 0
+	if e.Type != SyncDone {
+		t.p.ETA = t.eta(e.Time)
+	}
+	e.Progress = t.p
+	for _, o := range t.observers {
+		o.OnEvent(e)
+	}
+}
+
+func (t *progressTracker) snapshot() Progress {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.p
+}
+
+func (t *progressTracker) addBytes(n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.p.BytesUploaded += n
+}
+
+// eta extrapolates the time it took to upload the finished files to the new
+// files which are not finished yet.
+func (t *progressTracker) eta(now time.Time) time.Duration {
+	done := t.p.FilesUploaded + t.p.FilesFailed
+	if done == 0 || t.uploadStart.IsZero() {
+		return 0
+	}
+	left := t.p.FilesNew - done
+	if left <= 0 {
+		return 0
+	}
+	perFile := now.Sub(t.uploadStart) / time.Duration(done)
+	return perFile * time.Duration(left)
+}
+
+// progressReader reports the bytes read from r as upload progress of path,
+// at most once every progressStep bytes.
+type progressReader struct {
+	r        io.Reader
+	path     string
+	tracker  *progressTracker
+	read     int64
+	reported int64
+}
+
+const progressStep = 1 << 20
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	pr.read += int64(n)
+	pr.tracker.addBytes(int64(n))
+	if pr.read-pr.reported >= progressStep || (err == io.EOF && pr.read > pr.reported) {
+		pr.reported = pr.read
+		pr.tracker.emit(Event{Type: UploadProgress, FilePath: pr.path, Bytes: pr.read})
+	}
+	return n, err
+}
@@ -0,0 +1,66 @@
+package syncronizer
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestProgressTracker(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	events := make([]Event, 0)
+	tr := &progressTracker{
+		observers: []Observer{ObserverFunc(func(e Event) { events = append(events, e) })},
+		now:       func() time.Time { return now },
+	}
+	tr.emit(Event{Type: ScanDone, Files: 3})
+	for _, f := range []string{"a", "b", "c"} {
+		tr.emit(Event{Type: FileHashed, FilePath: f, New: f != "c"})
+	}
+	tr.emit(Event{Type: FileExtracted, FilePath: "a"})
+	tr.emit(Event{Type: FileExtracted, FilePath: "b"})
+	now = now.Add(10 * time.Second)
+	tr.emit(Event{Type: FileUploaded, FilePath: "a"})
+
+	p := events[len(events)-1].Progress
+	if p.FilesFound != 3 || p.FilesHashed != 3 || p.FilesNew != 2 || p.FilesExtracted != 2 || p.FilesUploaded != 1 {
+		t.Errorf("unexpected counters: %+v", p)
+	}
+	if p.ETA != 10*time.Second {
+		t.Errorf("expected an ETA of 10s, got: %v", p.ETA)
+	}
+	if !events[len(events)-1].Time.Equal(now) {
+		t.Error("expected the event time to be set")
+	}
+
+	tr.emit(Event{Type: SyncDone})
+	if eta := events[len(events)-1].Progress.ETA; eta != 0 {
+		t.Errorf("expected no ETA when done, got: %v", eta)
+	}
+	tr.reset()
+	tr.emit(Event{Type: ScanStarted})
+	if p := events[len(events)-1].Progress; p != (Progress{}) {
+		t.Errorf("expected the counters to be reset, got: %+v", p)
+	}
+}
+
+func TestProgressReader(t *testing.T) {
+	events := make([]Event, 0)
+	tr := &progressTracker{
+		observers: []Observer{ObserverFunc(func(e Event) { events = append(events, e) })},
+		now:       time.Now,
+	}
+	data := make([]byte, 2*progressStep+10)
+	if _, err := io.Copy(ioutil.Discard, &progressReader{r: bytes.NewReader(data), path: "a.jpg", tracker: tr}); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("expected 3 progress events, got: %d", len(events))
+	}
+	last := events[len(events)-1]
+	if last.Type != UploadProgress || last.Bytes != int64(len(data)) || last.Progress.BytesUploaded != int64(len(data)) {
+		t.Errorf("unexpected last event: %+v", last)
+	}
+}
@@ -0,0 +1,46 @@
+package syncronizer
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Result summarizes a sync.
+type Result struct {
+	Scanned int `json:"scanned"`
+	// Skipped are the files which already were in the catalog.
+	Skipped  int           `json:"skipped"`
+	Uploaded int           `json:"uploaded"`
+	Failed   int           `json:"failed"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration_ns"`
+	Failures []Failure     `json:"failures"`
+}
+
+func (f Failure) MarshalJSON() ([]byte, error) {
+	reason := ""
+	if f.Err != nil {
+		reason = f.Err.Error()
+	}
+	return json.Marshal(struct {
+		FilePath string `json:"file"`
+		Attempts int    `json:"attempts"`
+		Reason   string `json:"reason"`
+	}{f.FilePath, f.Attempts, reason})
+}
+
+func (s *Service) result(start time.Time, failures []Failure) *Result {
+	p := s.progress.snapshot()
+	if failures == nil {
+		failures = make([]Failure, 0)
+	}
+	return &Result{
+		Scanned:  p.FilesFound,
+		Skipped:  p.FilesHashed - p.FilesNew,
+		Uploaded: p.FilesUploaded,
+		Failed:   len(failures),
+		Bytes:    p.BytesUploaded,
+		Duration: s.now().Sub(start),
+		Failures: failures,
+	}
+}
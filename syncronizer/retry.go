@@ -0,0 +1,123 @@
+package syncronizer
+
+import (
+	"context"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/apex/log"
+)
+
+type ErrorClass int
+
+const (
+	// Transient errors are worth retrying - timeouts, dropped connections etc.
+	Transient ErrorClass = iota
+	// Permanent errors will not go away by trying again, e.g. an unreadable
+	// local file.
+	Permanent
+)
+
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter is the fraction (0-1) of each backoff which gets randomized.
+	Jitter   float64
+	Classify func(error) ErrorClass
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:    5,
+		InitialBackoff: 1 * time.Second,
+		MaxBackoff:     1 * time.Minute,
+		Multiplier:     2,
+		Jitter:         0.5,
+		Classify:       ClassifyError,
+	}
+}
+
+func WithRetryPolicy(p RetryPolicy) option {
+	return func(s *Service) {
+		s.retryPolicy = p
+	}
+}
+
+type permanentError struct {
+	error
+}
+
+// PermanentError marks err as not worth retrying.
+func PermanentError(err error) error {
+	return permanentError{err}
+}
+
+// ClassifyError treats missing and unreadable local files as permanent and
+// everything else - I/O, network and backend errors - as transient.
+func ClassifyError(err error) ErrorClass {
+	switch e := err.(type) {
+	case permanentError:
+		return Permanent
+	case *exec.Error:
+		return Permanent
+	case net.Error:
+		return Transient
+	default:
+		if e == io.ErrUnexpectedEOF {
+			return Transient
+		}
+		if os.IsNotExist(err) || os.IsPermission(err) {
+			return Permanent
+		}
+	}
+	return Transient
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt-1))
+	if max := float64(p.MaxBackoff); p.MaxBackoff > 0 && d > max {
+		d = max
+	}
+	d -= d * p.Jitter * rand.Float64()
+	return time.Duration(d)
+}
+
+// Do calls fn until it succeeds, returns a permanent error, the attempts are
+// exhausted or ctx is done. It returns the last error and the number of attempts made.
+func (p RetryPolicy) Do(ctx context.Context, logctx log.Interface, fn func(context.Context) error) (int, error) {
+	classify := p.Classify
+	if classify == nil {
+		classify = ClassifyError
+	}
+	attempt := 0
+	for {
+		attempt++
+		err := fn(ctx)
+		if err == nil {
+			return attempt, nil
+		}
+		if ctx.Err() != nil {
+			return attempt, ctx.Err()
+		}
+		if classify(err) == Permanent || attempt >= p.MaxAttempts {
+			return attempt, err
+		}
+		wait := p.backoff(attempt)
+		logctx.WithError(err).Warnf("attempt %d failed, retrying in %v", attempt, wait)
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return attempt, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package syncronizer
+
+import (
+	"context"
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+)
+
+var ctx context.Context = context.Background()
+
+func testPolicy() RetryPolicy {
+	p := DefaultRetryPolicy()
+	p.InitialBackoff = time.Millisecond
+	p.MaxBackoff = 2 * time.Millisecond
+	return p
+}
+
+func TestRetryTransient(t *testing.T) {
+	calls := 0
+	attempts, err := testPolicy().Do(ctx, log.Log, func(context.Context) error {
+		calls++
+		if calls < 3 {
+			return errors.New("connection reset")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("expected success after retrying, got: %v", err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got: %d", attempts)
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	p := testPolicy()
+	attempts, err := p.Do(ctx, log.Log, func(context.Context) error {
+		return errors.New("service unavailable")
+	})
+	if err == nil || attempts != p.MaxAttempts {
+		t.Errorf("expected to give up after %d attempts, got: %d (%v)", p.MaxAttempts, attempts, err)
+	}
+}
+
+func TestRetryPermanent(t *testing.T) {
+	attempts, err := testPolicy().Do(ctx, log.Log, func(context.Context) error {
+		_, err := os.Open("/does/not/exist")
+		return err
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("expected no retries for a permanent error, got %d attempts", attempts)
+	}
+}
+
+func TestClassifyPathErrors(t *testing.T) {
+	for errno, want := range map[syscall.Errno]ErrorClass{
+		syscall.ENOENT: Permanent,
+		syscall.EACCES: Permanent,
+		syscall.EIO:    Transient,
+		syscall.EAGAIN: Transient,
+	} {
+		err := &os.PathError{Op: "read", Path: "/p/a.jpg", Err: errno}
+		if got := ClassifyError(err); got != want {
+			t.Errorf("%v: expected class %d, got %d", errno, want, got)
+		}
+	}
+}
+
+func TestRetryCanceled(t *testing.T) {
+	c, cancel := context.WithCancel(ctx)
+	p := testPolicy()
+	p.InitialBackoff = time.Hour
+	p.MaxBackoff = time.Hour
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	_, err := p.Do(c, log.Log, func(context.Context) error {
+		return errors.New("timeout")
+	})
+	if err != context.Canceled {
+		t.Errorf("expected the retry loop to stop on cancellation, got: %v", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	p := DefaultRetryPolicy()
+	p.Jitter = 0
+	if d := p.backoff(1); d != p.InitialBackoff {
+		t.Errorf("expected first backoff to be %v, got: %v", p.InitialBackoff, d)
+	}
+	if d := p.backoff(3); d != 4*p.InitialBackoff {
+		t.Errorf("expected exponential backoff, got: %v", d)
+	}
+	if d := p.backoff(100); d != p.MaxBackoff {
+		t.Errorf("expected backoff capped at %v, got: %v", p.MaxBackoff, d)
+	}
+}
@@ -0,0 +1,130 @@
+package syncronizer
+
+import (
+	"context"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// RateSetter is implemented by the rate limiter the schedule is applied to,
+// e.g. storage.RateLimiter.
+type RateSetter interface {
+	SetRate(bytesPerSec int64)
+}
+
+// Window is a time of day range with its own upload rate. Start and End are
+// offsets from midnight, a window with End before Start spans midnight.
+type Window struct {
+	Start time.Duration
+	End   time.Duration
+	// Rate is in bytes per second, 0 means unlimited and a negative rate pauses
+	// the uploads.
+	Rate int64
+}
+
+// Schedule sets the upload rate depending on the local time of day. The first
+// window containing the time applies, outside of all windows DefaultRate does.
+type Schedule struct {
+	Windows     []Window
+	DefaultRate int64
+}
+
+func (w Window) contains(offset time.Duration) bool {
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// RateAt returns the rate at t and when it changes next.
+func (s Schedule) RateAt(t time.Time) (int64, time.Time) {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	rate := s.DefaultRate
+	for _, w := range s.Windows {
+		if w.contains(offset) {
+			rate = w.Rate
+			break
+		}
+	}
+	next := midnight.Add(48 * time.Hour)
+	for _, w := range s.Windows {
+		for _, b := range []time.Duration{w.Start, w.End} {
+			at := midnight.Add(b)
+			if !at.After(t) {
+				at = midnight.AddDate(0, 0, 1).Add(b)
+			}
+			if at.Before(next) {
+				next = at
+			}
+		}
+	}
+	return rate, next
+}
+
+// WithSchedule applies sched to l for as long as files are synced, l is
+// expected to throttle the writes of the remote storage. Uploads are not
+// started while the schedule pauses them.
+func WithSchedule(sched Schedule, l RateSetter) option {
+	return func(s *Service) {
+		s.schedule = &sched
+		s.rateSetter = l
+	}
+}
+
+// applySchedule keeps the rate up to date until ctx is done.
+func (s *Service) applySchedule(ctx context.Context, logctx log.Interface) {
+	if s.schedule == nil {
+		return
+	}
+	for {
+		rate, next := s.schedule.RateAt(s.now())
+		s.setRate(logctx, rate)
+		t := time.NewTimer(next.Sub(s.now()))
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (s *Service) setRate(logctx log.Interface, rate int64) {
+	s.rateMu.Lock()
+	defer s.rateMu.Unlock()
+	if s.rate != nil && *s.rate == rate {
+		return
+	}
+	s.rate = &rate
+	switch {
+	case rate < 0:
+		logctx.Info("outside of the upload windows, pausing uploads")
+	case rate == 0:
+		logctx.Info("upload rate unlimited")
+	default:
+		logctx.Infof("upload rate limited to %d bytes/s", rate)
+	}
+	s.rateSetter.SetRate(rate)
+	close(s.rateChanged)
+	s.rateChanged = make(chan struct{})
+}
+
+// waitForWindow blocks while the uploads are paused by the schedule.
+func (s *Service) waitForWindow(ctx context.Context) error {
+	for {
+		s.rateMu.Lock()
+		paused := s.rate != nil && *s.rate < 0
+		changed := s.rateChanged
+		s.rateMu.Unlock()
+		if !paused {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
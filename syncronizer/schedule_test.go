@@ -0,0 +1,74 @@
+package syncronizer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+)
+
+func TestScheduleRateAt(t *testing.T) {
+	sched := Schedule{
+		Windows: []Window{
+			{Start: 1 * time.Hour, End: 7 * time.Hour, Rate: 0},
+			{Start: 22 * time.Hour, End: 30 * time.Minute, Rate: 1000},
+		},
+		DefaultRate: -1,
+	}
+	day := time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		at   time.Duration
+		rate int64
+		next time.Duration
+	}{
+		{3 * time.Hour, 0, 7 * time.Hour},
+		{12 * time.Hour, -1, 22 * time.Hour},
+		{23 * time.Hour, 1000, 24*time.Hour + 30*time.Minute},
+		{10 * time.Minute, 1000, 30 * time.Minute},
+		{7 * time.Hour, -1, 22 * time.Hour},
+	}
+	for _, c := range cases {
+		rate, next := sched.RateAt(day.Add(c.at))
+		if rate != c.rate {
+			t.Errorf("at %v: expected rate %d, got: %d", c.at, c.rate, rate)
+		}
+		if want := day.Add(c.next); !next.Equal(want) {
+			t.Errorf("at %v: expected the next change at %v, got: %v", c.at, want, next)
+		}
+	}
+}
+
+type rateRecorder struct {
+	rates []int64
+}
+
+func (r *rateRecorder) SetRate(rate int64) {
+	r.rates = append(r.rates, rate)
+}
+
+func TestWaitForWindow(t *testing.T) {
+	rec := &rateRecorder{}
+	s := New(nil, nil, nil, nil, WithSchedule(Schedule{DefaultRate: -1}, rec))
+	s.setRate(log.Log, -1)
+	done := make(chan error)
+	go func() {
+		done <- s.waitForWindow(ctx)
+	}()
+	select {
+	case <-done:
+		t.Fatal("expected to wait while paused")
+	case <-time.After(20 * time.Millisecond):
+	}
+	s.setRate(log.Log, 500)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected to continue once the uploads are resumed")
+	}
+	if len(rec.rates) != 2 || rec.rates[1] != 500 {
+		t.Errorf("unexpected rates set: %v", rec.rates)
+	}
+}
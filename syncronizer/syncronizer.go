@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"io"
 	"path/filepath"
-	"runtime"
 	"sync"
 	"time"
 
@@ -23,24 +22,63 @@ type Service struct {
 	maxConcurrentUploads int
 	timeout              time.Duration
 	fileExts             []string
+	retryPolicy          RetryPolicy
+	persistInterval      time.Duration
+	failuresMu           sync.Mutex
+	failures             []Failure
+	observers            []Observer
+	progress             *progressTracker
+	schedule             *Schedule
+	rateSetter           RateSetter
+	rateMu               sync.Mutex
+	rate                 *int64
+	rateChanged          chan struct{}
+	now                  func() time.Time
+}
+
+// Failure describes a file which could not be synced, even after retrying.
+type Failure struct {
+	FilePath string
+	Attempts int
+	Err      error
 }
 
 type option func(*Service)
 
+// WithMaxConcurrentUploads sets how many files are uploaded at once, zero
+// keeps the default.
 func WithMaxConcurrentUploads(maxConcurrentUploads int) option {
 	return func(s *Service) {
-		s.maxConcurrentUploads = maxConcurrentUploads
+		if maxConcurrentUploads > 0 {
+			s.maxConcurrentUploads = maxConcurrentUploads
+		}
 	}
 }
+
+// WithTimeout sets the timeout for persisting the catalog, zero keeps the
+// default.
 func WithTimeout(t time.Duration) option {
 	return func(s *Service) {
-		s.timeout = t
+		if t > 0 {
+			s.timeout = t
+		}
 	}
 }
 
+// WithPersistInterval sets how often Watch persists the catalog.
+func WithPersistInterval(d time.Duration) option {
+	return func(s *Service) {
+		s.persistInterval = d
+	}
+}
+
+// WithFileExts sets the extensions of the files to sync, no extensions keep
+// the default.
 func WithFileExts(exts ...string) option {
 	return func(s *Service) {
-		s.fileExts = exts
+		if len(exts) > 0 {
+			s.fileExts = exts
+		}
 	}
 }
 
@@ -58,22 +96,100 @@ func New(remotestorage mirror.Storage,
 		maxConcurrentUploads: 10,
 		timeout:              1 * time.Minute,
 		fileExts:             []string{".jpg", ".jpeg", ".nef"},
+		retryPolicy:          DefaultRetryPolicy(),
+		persistInterval:      5 * time.Minute,
+		rateChanged:          make(chan struct{}),
+		now:                  time.Now,
 	}
 	for _, opt := range options {
 		opt(s)
 	}
+	s.progress = &progressTracker{observers: s.observers, now: time.Now}
 	return s
 }
 
-func (s *Service) Execute(ctx context.Context, logctx log.Interface, rootPath string) {
-	files := s.localstrg.FindFiles(rootPath, s.fileExts...)
-	logctx.Infof("found %d files to sync", len(files))
-	printMemUsage("after search files")
+// Execute syncs the files below the root paths and persists the catalog.
+// Files which could not be synced are reported in the result, the error is
+// only set if the sync as a whole failed or was cancelled.
+func (s *Service) Execute(ctx context.Context, logctx log.Interface, rootPaths ...string) (*Result, error) {
+	start := s.now()
+	s.progress.reset()
+	files := make([]mirror.FileInfo, 0)
+	for _, rootPath := range rootPaths {
+		s.progress.emit(Event{Type: ScanStarted, FilePath: rootPath})
+		found := s.localstrg.FindFiles(rootPath, s.fileExts...)
+		logctx.WithField("root", rootPath).Infof("found %d files to sync", len(found))
+		s.progress.emit(Event{Type: ScanDone, FilePath: rootPath, Files: len(found)})
+		files = append(files, found...)
+	}
+	s.syncFiles(ctx, logctx, files)
+	err := s.persist(logctx, true)
+	if err != nil {
+		logctx.WithError(err).Error("error persisting the catalog")
+		err = fmt.Errorf("error persisting the catalog: %v", err)
+	} else if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	res := s.result(start, s.logFailures(logctx))
+	s.progress.emit(Event{Type: SyncDone})
+	return res, err
+}
+
+// SyncPaths syncs the given files, or the files below the given directories,
+// without scanning anything else. The catalog is updated but not persisted.
+func (s *Service) SyncPaths(ctx context.Context, logctx log.Interface, paths []string) {
+	files := make([]mirror.FileInfo, 0)
+	for _, p := range paths {
+		files = append(files, s.localstrg.FindFiles(p, s.fileExts...)...)
+	}
+	if len(files) == 0 {
+		return
+	}
+	logctx.Infof("syncing %d changed files", len(files))
+	s.progress.reset()
+	s.progress.emit(Event{Type: ScanDone, Files: len(files)})
+	s.syncFiles(ctx, logctx, files)
+	s.logFailures(logctx)
+	s.progress.emit(Event{Type: SyncDone})
+}
+
+func (s *Service) syncFiles(ctx context.Context, logctx log.Interface, files []mirror.FileInfo) {
+	if s.schedule != nil {
+		rate, _ := s.schedule.RateAt(s.now())
+		s.setRate(logctx, rate)
+		scheduleCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go s.applySchedule(scheduleCtx, logctx)
+	}
 	unsyncedFilesByDir := s.getUnsyncedFiles(ctx, logctx, GroupByDir(files))
 	photosStream := s.extractMetadata(ctx, logctx, unsyncedFilesByDir)
 	syncedPhotosStream := s.syncRemoteStorage(ctx, logctx, photosStream)
+	s.addNewFiles(ctx, syncedPhotosStream)
+}
 
-	s.syncMetadataRepo(ctx, files, syncedPhotosStream)
+func (s *Service) addFailure(f Failure) {
+	s.failuresMu.Lock()
+	defer s.failuresMu.Unlock()
+	s.failures = append(s.failures, f)
+}
+
+// logFailures logs and returns the failures collected since the last call.
+func (s *Service) logFailures(logctx log.Interface) []Failure {
+	s.failuresMu.Lock()
+	failures := s.failures
+	s.failures = nil
+	s.failuresMu.Unlock()
+	if len(failures) == 0 {
+		return failures
+	}
+	for _, f := range failures {
+		logctx.WithFields(log.Fields{
+			"photo_path": f.FilePath,
+			"attempts":   f.Attempts,
+		}).WithError(f.Err).Error("file could not be synced")
+	}
+	logctx.Errorf("%d files could not be synced", len(failures))
+	return failures
 }
 
 func (s *Service) getUnsyncedFiles(ctx context.Context, logctx log.Interface, pathsGroupedByDir map[string][]mirror.FileInfo) <-chan []mirror.FileInfo {
@@ -95,6 +211,7 @@ func (s *Service) getUnsyncedFiles(ctx context.Context, logctx log.Interface, pa
 						if !exists {
 							dirFileInfoStream[i] = fi
 						}
+						s.progress.emit(Event{Type: FileHashed, FilePath: fi.FilePath(), New: !exists})
 					}(i, fi)
 				}
 			}
@@ -108,7 +225,6 @@ func (s *Service) getUnsyncedFiles(ctx context.Context, logctx log.Interface, pa
 				}
 			}
 			if send {
-				printMemUsage("getUnsyncedFiles")
 				fileInfoStream <- newFiles
 			}
 		}
@@ -129,10 +245,11 @@ func (s *Service) extractMetadata(ctx context.Context, logctx log.Interface, fil
 			default:
 				c, cancel := context.WithCancel(ctx)
 				md := s.metadataextr.Extract(c, logctx, paths)
+				s.reportUnextracted(ctx, paths, md)
 				for _, p := range md {
+					s.progress.emit(Event{Type: FileExtracted, FilePath: p.FilePath()})
 					metadataStream <- p
 				}
-				printMemUsage("extractMetadata")
 				cancel()
 			}
 		}
@@ -141,6 +258,25 @@ func (s *Service) extractMetadata(ctx context.Context, logctx log.Interface, fil
 	return metadataStream
 }
 
+// reportUnextracted records the files the extractor skipped as failures.
+func (s *Service) reportUnextracted(ctx context.Context, files []mirror.FileInfo, extracted []mirror.LocalPhoto) {
+	if ctx.Err() != nil || len(files) == len(extracted) {
+		return
+	}
+	ok := make(map[string]bool)
+	for _, p := range extracted {
+		ok[p.FilePath()] = true
+	}
+	for _, fi := range files {
+		if ok[fi.FilePath()] {
+			continue
+		}
+		err := fmt.Errorf("metadata could not be extracted")
+		s.addFailure(Failure{FilePath: fi.FilePath(), Err: err})
+		s.progress.emit(Event{Type: FileFailed, FilePath: fi.FilePath(), Err: err.Error()})
+	}
+}
+
 func (s *Service) syncRemoteStorage(ctx context.Context, logctx log.Interface, metadataStream <-chan mirror.LocalPhoto) <-chan mirror.LocalPhoto {
 	uploadedPhotosStream := make(chan mirror.LocalPhoto)
 	logctx = logctx.WithFields(log.Fields{
@@ -164,19 +300,32 @@ func (s *Service) syncRemoteStorage(ctx context.Context, logctx log.Interface, m
 				go func(m mirror.LocalPhoto) {
 					defer wg.Done()
 					defer func() { <-limiter }()
-					logctx = logctx.WithFields(log.Fields{
+					logctx := logctx.WithFields(log.Fields{
 						"photo_path": m.FilePath(),
 					})
 					c, cancel := context.WithCancel(ctx)
-					if err := s.uploadPhoto(c, logctx, m); err == nil {
-						c, cancel := context.WithCancel(ctx)
-						s.uploadThumb(c, logctx, m)
-						cancel()
-						uploadedPhotosStream <- m
-					} else {
-						logctx.Errorf("error uploading file: %v", err)
+					defer cancel()
+					if err := s.waitForWindow(c); err != nil {
+						return
+					}
+					attempts, err := s.retryPolicy.Do(c, logctx, s.reportRetries(m, func(ctx context.Context) error {
+						return s.uploadPhoto(ctx, logctx, m)
+					}))
+					if err == nil {
+						var n int
+						n, err = s.retryPolicy.Do(c, logctx, s.reportRetries(m, func(ctx context.Context) error {
+							return s.uploadThumb(ctx, logctx, m)
+						}))
+						attempts += n
 					}
-					cancel()
+					if err != nil {
+						logctx.WithError(err).Error("giving up on file")
+						s.addFailure(Failure{FilePath: m.FilePath(), Attempts: attempts, Err: err})
+						s.progress.emit(Event{Type: FileFailed, FilePath: m.FilePath(), Attempt: attempts, Err: err.Error()})
+						return
+					}
+					s.progress.emit(Event{Type: FileUploaded, FilePath: m.FilePath()})
+					uploadedPhotosStream <- m
 				}(metaData)
 			}
 		}
@@ -185,19 +334,41 @@ func (s *Service) syncRemoteStorage(ctx context.Context, logctx log.Interface, m
 	return uploadedPhotosStream
 }
 
+// reportRetries wraps fn to emit an UploadRetry event for every attempt after
+// the first one.
+func (s *Service) reportRetries(m mirror.LocalPhoto, fn func(context.Context) error) func(context.Context) error {
+	attempt := 0
+	var lastErr error
+	return func(ctx context.Context) error {
+		attempt++
+		if attempt > 1 {
+			s.progress.emit(Event{Type: UploadRetry, FilePath: m.FilePath(), Attempt: attempt, Err: lastErr.Error()})
+		}
+		lastErr = fn(ctx)
+		return lastErr
+	}
+}
+
 func (s *Service) uploadPhoto(ctx context.Context, logctx log.Interface, img mirror.LocalPhoto) error {
 	f, err := img.NewJpgReader()
 	if err != nil {
-		logctx.WithError(err).Errorf("error uploading file %s", img.FilePath)
+		logctx.WithError(err).Errorf("error reading file %s", img.FilePath())
 		return err
 	}
 	defer f.Close()
 
-	w := s.remotestrg.NewWriter(ctx, img.ID())
-	_, err = io.Copy(w, f)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var w io.WriteCloser
+	if rw, ok := s.remotestrg.(mirror.ResumableStorageWriter); ok {
+		w = rw.NewResumableWriter(ctx, img.ID())
+	} else {
+		w = s.remotestrg.NewWriter(ctx, img.ID())
+	}
+	_, err = io.Copy(w, &progressReader{r: f, path: img.FilePath(), tracker: s.progress})
 	if err != nil {
-		logctx.WithError(err).Errorf("error uploading file %s", img.FilePath)
-		fmt.Printf("err %v", err)
+		abort(w, cancel)
+		logctx.WithError(err).Errorf("error uploading file %s", img.FilePath())
 		return err
 	}
 	if err := w.Close(); err != nil {
@@ -208,22 +379,28 @@ func (s *Service) uploadPhoto(ctx context.Context, logctx log.Interface, img mir
 	return nil
 }
 
-func (s *Service) uploadThumb(ctx context.Context, logctx log.Interface, img mirror.LocalPhoto) {
+func (s *Service) uploadThumb(ctx context.Context, logctx log.Interface, img mirror.LocalPhoto) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	w := s.remotestrg.NewWriter(ctx, img.ThumbID())
 	_, err := io.Copy(w, bytes.NewReader(img.Thumbnail()))
 	if err != nil {
-		logctx.WithError(err).Errorf("error uploading thumb file %s", img.FilePath)
-		return
+		abort(w, cancel)
+		logctx.WithError(err).Errorf("error uploading thumb file %s", img.FilePath())
+		return err
 	}
 	if err := w.Close(); err != nil {
 		logctx.WithError(err).Error("error closing writer")
-		return
+		return err
 	}
+	return nil
 }
 
-func (s *Service) syncMetadataRepo(ctx context.Context, files []mirror.FileInfo, uploadedPhotosStream <-chan mirror.LocalPhoto) {
-	s.addNewFiles(ctx, uploadedPhotosStream)
-	s.metadataStore.Persist(ctx)
+// abort closes the writer of a failed upload. The context of the writer is
+// cancelled first, so that the partial upload is not completed.
+func abort(w io.Closer, cancel context.CancelFunc) {
+	cancel()
+	w.Close()
 }
 
 func (s *Service) addNewFiles(ctx context.Context, uploadedPhotosStream <-chan mirror.LocalPhoto) {
@@ -255,18 +432,3 @@ func GroupByDir(files []mirror.FileInfo) map[string][]mirror.FileInfo {
 	}
 	return filesGroupedByDir
 }
-
-func printMemUsage(where string) {
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
-	fmt.Println(where)
-	// For info on each, see: https://golang.org/pkg/runtime/#MemStats
-	fmt.Printf("Alloc = %v MiB", bToMb(m.Alloc))
-	fmt.Printf("\tTotalAlloc = %v MiB", bToMb(m.TotalAlloc))
-	fmt.Printf("\tSys = %v MiB", bToMb(m.Sys))
-	fmt.Printf("\tNumGC = %v\n", m.NumGC)
-}
-
-func bToMb(b uint64) uint64 {
-	return b / 1024 / 1024
-}
@@ -0,0 +1,184 @@
+package syncronizer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/marpio/mirror"
+)
+
+type fakeFile struct {
+	path string
+}
+
+func (f fakeFile) ID() string       { return "id_" + f.path }
+func (f fakeFile) FilePath() string { return f.path }
+
+type fakePhoto struct {
+	fakeFile
+}
+
+func (p fakePhoto) ThumbID() string          { return "thumb_" + p.ID() }
+func (p fakePhoto) Dir() string              { return "2018-01" }
+func (p fakePhoto) CreatedAt() time.Time     { return time.Time{} }
+func (p fakePhoto) SetCreatedAt(t time.Time) {}
+func (p fakePhoto) Thumbnail() []byte        { return []byte("thumb") }
+func (p fakePhoto) NewJpgReader() (io.ReadCloser, error) {
+	if strings.Contains(p.path, "broken") {
+		return ioutil.NopCloser(io.MultiReader(strings.NewReader(p.path), brokenReader{})), nil
+	}
+	return ioutil.NopCloser(strings.NewReader(p.path)), nil
+}
+
+type brokenReader struct{}
+
+func (brokenReader) Read(p []byte) (int, error) { return 0, errors.New("input/output error") }
+
+type fakeLocal struct {
+	files []string
+}
+
+func (l fakeLocal) NewReader(ctx context.Context, path string) (io.ReadCloser, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (l fakeLocal) FindFiles(rootPath string, fileExt ...string) []mirror.FileInfo {
+	res := make([]mirror.FileInfo, 0)
+	for _, f := range l.files {
+		res = append(res, fakeFile{f})
+	}
+	return res
+}
+
+// fakeExtractor skips files ending with .bad.
+type fakeExtractor struct{}
+
+func (fakeExtractor) Extract(ctx context.Context, logctx log.Interface, photos []mirror.FileInfo) []mirror.LocalPhoto {
+	res := make([]mirror.LocalPhoto, 0)
+	for _, p := range photos {
+		if !strings.HasSuffix(p.FilePath(), ".bad") {
+			res = append(res, fakePhoto{fakeFile{p.FilePath()}})
+		}
+	}
+	return res
+}
+
+type fakeCatalog struct {
+	mu        sync.Mutex
+	photos    map[string]mirror.RemotePhoto
+	persisted int
+}
+
+func (c *fakeCatalog) Add(item mirror.RemotePhoto) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.photos[item.ID()] = item
+	return nil
+}
+func (c *fakeCatalog) Delete(id string) error                        { return nil }
+func (c *fakeCatalog) Persist(ctx context.Context) error             { c.persisted++; return nil }
+func (c *fakeCatalog) GetAll() []mirror.RemotePhoto                  { return nil }
+func (c *fakeCatalog) GetDirs() ([]string, error)                    { return nil, nil }
+func (c *fakeCatalog) Reload(ctx context.Context) error              { return nil }
+func (c *fakeCatalog) GetByDir(string) ([]mirror.RemotePhoto, error) { return nil, nil }
+func (c *fakeCatalog) GetByDirAndId(dir, id string) (mirror.RemotePhoto, error) {
+	return nil, nil
+}
+func (c *fakeCatalog) Exists(id string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.photos[id]
+	return ok, nil
+}
+
+// fakeRemote fails all writes of paths containing "fail".
+type fakeRemote struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	aborted []string
+}
+
+type fakeWriter struct {
+	bytes.Buffer
+	ctx  context.Context
+	r    *fakeRemote
+	path string
+}
+
+func (w *fakeWriter) Close() error {
+	w.r.mu.Lock()
+	defer w.r.mu.Unlock()
+	if w.ctx.Err() != nil {
+		w.r.aborted = append(w.r.aborted, w.path)
+		return w.ctx.Err()
+	}
+	if strings.Contains(w.path, "fail") {
+		return PermanentError(errors.New("forbidden"))
+	}
+	w.r.objects[w.path] = w.Bytes()
+	return nil
+}
+
+func (r *fakeRemote) NewWriter(ctx context.Context, path string) io.WriteCloser {
+	return &fakeWriter{ctx: ctx, r: r, path: path}
+}
+func (r *fakeRemote) NewReader(ctx context.Context, path string) (io.ReadCloser, error) {
+	return nil, errors.New("not implemented")
+}
+func (r *fakeRemote) Delete(ctx context.Context, path string) error { return nil }
+func (r *fakeRemote) Exists(ctx context.Context, path string) bool  { return false }
+
+func TestExecuteResult(t *testing.T) {
+	catalog := &fakeCatalog{photos: map[string]mirror.RemotePhoto{
+		"id_/p/old.jpg": fakePhoto{fakeFile{"/p/old.jpg"}},
+	}}
+	remote := &fakeRemote{objects: make(map[string][]byte)}
+	local := fakeLocal{files: []string{"/p/old.jpg", "/p/a.jpg", "/p/b.jpg", "/p/fail.jpg", "/p/c.bad"}}
+	s := New(remote, catalog, local, fakeExtractor{})
+
+	res, err := s.Execute(ctx, log.Log, "/p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Scanned != 5 || res.Skipped != 1 || res.Uploaded != 2 || res.Failed != 2 {
+		t.Errorf("unexpected result: %+v", res)
+	}
+	if res.Bytes != int64(len("/p/a.jpg")+len("/p/b.jpg")+len("/p/fail.jpg")) {
+		t.Errorf("unexpected number of bytes: %d", res.Bytes)
+	}
+	failed := make(map[string]bool)
+	for _, f := range res.Failures {
+		failed[f.FilePath] = true
+	}
+	if !failed["/p/fail.jpg"] || !failed["/p/c.bad"] {
+		t.Errorf("unexpected failures: %v", res.Failures)
+	}
+	if _, ok := catalog.photos["id_/p/a.jpg"]; !ok {
+		t.Error("expected the uploaded photo to be added to the catalog")
+	}
+	if catalog.persisted != 1 {
+		t.Errorf("expected the catalog to be persisted once, got: %d", catalog.persisted)
+	}
+}
+
+func TestUploadAbortedOnReadError(t *testing.T) {
+	remote := &fakeRemote{objects: make(map[string][]byte)}
+	s := New(remote, &fakeCatalog{photos: map[string]mirror.RemotePhoto{}}, fakeLocal{}, fakeExtractor{})
+	if err := s.uploadPhoto(ctx, log.Log, fakePhoto{fakeFile{"/p/broken.jpg"}}); err == nil {
+		t.Fatal("expected the upload to fail")
+	}
+	if len(remote.aborted) != 1 || remote.aborted[0] != "id_/p/broken.jpg" {
+		t.Errorf("expected the writer to be closed without completing the upload, got %v", remote.aborted)
+	}
+	if _, ok := remote.objects["id_/p/broken.jpg"]; ok {
+		t.Error("expected the partial upload not to be stored")
+	}
+}
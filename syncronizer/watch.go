@@ -0,0 +1,47 @@
+package syncronizer
+
+import (
+	"context"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// Watch syncs the batches of changed files received from changes until ctx is
+// done or changes gets closed. The catalog is persisted periodically and once
+// more before Watch returns, so an interrupted watch loses no uploads.
+func (s *Service) Watch(ctx context.Context, logctx log.Interface, changes <-chan []string) error {
+	tick := time.NewTicker(s.persistInterval)
+	defer tick.Stop()
+	dirty := false
+	for {
+		select {
+		case <-ctx.Done():
+			return s.persist(logctx, dirty)
+		case paths, ok := <-changes:
+			if !ok {
+				return s.persist(logctx, dirty)
+			}
+			s.SyncPaths(ctx, logctx, paths)
+			dirty = true
+		case <-tick.C:
+			if err := s.persist(logctx, dirty); err != nil {
+				logctx.WithError(err).Error("error persisting the catalog")
+				continue
+			}
+			dirty = false
+		}
+	}
+}
+
+// persist saves the catalog with its own timeout, ctx of the caller might
+// already be cancelled when shutting down.
+func (s *Service) persist(logctx log.Interface, dirty bool) error {
+	if !dirty {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	logctx.Info("persisting the catalog")
+	return s.metadataStore.Persist(ctx)
+}
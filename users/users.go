@@ -0,0 +1,231 @@
+// Package users keeps the accounts of mirror-web in an encrypted object in
+// the bucket. Passwords are stored as bcrypt hashes.
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/marpio/mirror"
+	"github.com/marpio/mirror/storage"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ObjectName is the name of the users object in the bucket.
+const ObjectName = "mirror-users.json"
+
+const format = "mirror-users"
+
+// Roles of the users. Admins can in addition reload the catalog and see the
+// server's statistics.
+const (
+	RoleAdmin  = "admin"
+	RoleViewer = "viewer"
+)
+
+// MinPasswordLength is the length a password needs at least.
+const MinPasswordLength = 8
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9._@-]+$`)
+
+// User is an account. Generation is increased when the password changes, to
+// end the sessions started with the old one. Nonce is random for every
+// account, so that the sessions of a removed user do not work for a new user
+// of the same name.
+type User struct {
+	Name       string    `json:"name"`
+	Role       string    `json:"role"`
+	Hash       string    `json:"hash"`
+	Generation int       `json:"generation"`
+	Nonce      string    `json:"nonce,omitempty"`
+	Created    time.Time `json:"created"`
+}
+
+type usersFile struct {
+	Format string `json:"format"`
+	Users  []User `json:"users"`
+}
+
+// ValidRole reports whether role is one of the roles.
+func ValidRole(role string) bool {
+	return role == RoleAdmin || role == RoleViewer
+}
+
+// Store are the users read from the bucket. The password hashes are only
+// safe in an encrypted storage, like storage.RemoteStorage.
+type Store struct {
+	s     mirror.Storage
+	mu    sync.RWMutex
+	users map[string]User
+	// dummy is compared against for unknown users, so that they take as long
+	// as wrong passwords
+	dummy []byte
+}
+
+// Load reads the users in s. Without users object there are no users.
+func Load(ctx context.Context, s mirror.Storage) (*Store, error) {
+	dummy, err := bcrypt.GenerateFromPassword([]byte("mirror"), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	st := &Store{s: s, users: make(map[string]User), dummy: dummy}
+	if err := st.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// Reload reads the users again, to see the changes of mirror-cli user.
+func (st *Store) Reload(ctx context.Context) error {
+	f := usersFile{}
+	ok, err := storage.ReadJSON(ctx, st.s, ObjectName, &f)
+	if err != nil {
+		return fmt.Errorf("error reading the users: %v", err)
+	}
+	if ok && f.Format != format {
+		return fmt.Errorf("error parsing the users, is the key right?")
+	}
+	users := make(map[string]User)
+	for _, u := range f.Users {
+		users[u.Name] = u
+	}
+	st.mu.Lock()
+	st.users = users
+	st.mu.Unlock()
+	return nil
+}
+
+// Save writes the users to the bucket.
+func (st *Store) Save(ctx context.Context) error {
+	if err := storage.WriteJSON(ctx, st.s, ObjectName, usersFile{Format: format, Users: st.List()}); err != nil {
+		return fmt.Errorf("error writing the users: %v", err)
+	}
+	return nil
+}
+
+// List returns the users sorted by name.
+func (st *Store) List() []User {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	res := make([]User, 0, len(st.users))
+	for _, u := range st.users {
+		res = append(res, u)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name < res[j].Name })
+	return res
+}
+
+// Len returns the number of users.
+func (st *Store) Len() int {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return len(st.users)
+}
+
+// Get returns the user name.
+func (st *Store) Get(name string) (User, bool) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	u, ok := st.users[name]
+	return u, ok
+}
+
+func hash(password string) (string, error) {
+	if len(password) < MinPasswordLength {
+		return "", fmt.Errorf("the password needs at least %d characters", MinPasswordLength)
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+// Add creates the user name.
+func (st *Store) Add(name, password, role string) error {
+	if !validName.MatchString(name) {
+		return fmt.Errorf("invalid user name %q, use letters, digits and . _ @ -", name)
+	}
+	if !ValidRole(role) {
+		return fmt.Errorf("invalid role %q, expected %s or %s", role, RoleAdmin, RoleViewer)
+	}
+	h, err := hash(password)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.users[name]; ok {
+		return fmt.Errorf("the user %s already exists", name)
+	}
+	st.users[name] = User{Name: name, Role: role, Hash: h, Nonce: hex.EncodeToString(nonce), Created: time.Now().UTC()}
+	return nil
+}
+
+// SetPassword changes the password of name, which ends its sessions.
+func (st *Store) SetPassword(name, password string) error {
+	h, err := hash(password)
+	if err != nil {
+		return err
+	}
+	return st.update(name, func(u *User) {
+		u.Hash = h
+		u.Generation++
+	})
+}
+
+// SetRole changes the role of name.
+func (st *Store) SetRole(name, role string) error {
+	if !ValidRole(role) {
+		return fmt.Errorf("invalid role %q, expected %s or %s", role, RoleAdmin, RoleViewer)
+	}
+	return st.update(name, func(u *User) {
+		u.Role = role
+	})
+}
+
+func (st *Store) update(name string, f func(*User)) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	u, ok := st.users[name]
+	if !ok {
+		return fmt.Errorf("no user %s", name)
+	}
+	f(&u)
+	st.users[name] = u
+	return nil
+}
+
+// Remove deletes the user name, which ends its sessions.
+func (st *Store) Remove(name string) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if _, ok := st.users[name]; !ok {
+		return fmt.Errorf("no user %s", name)
+	}
+	delete(st.users, name)
+	return nil
+}
+
+// Authenticate returns the user name if password is its password.
+func (st *Store) Authenticate(name, password string) (User, bool) {
+	u, ok := st.Get(name)
+	h := st.dummy
+	if ok {
+		h = []byte(u.Hash)
+	}
+	if err := bcrypt.CompareHashAndPassword(h, []byte(password)); err != nil || !ok {
+		return User{}, false
+	}
+	return u, true
+}
@@ -0,0 +1,75 @@
+package users
+
+import (
+	"context"
+	"testing"
+
+	"github.com/marpio/mirror/crypto"
+	"github.com/marpio/mirror/storage"
+	"github.com/marpio/mirror/storage/remotebackend"
+	"github.com/spf13/afero"
+)
+
+const key = "b40b3de5e3ef0fc5c7c0b2a9d3d6c82f0c4a0fa7b9d7e2e3a8c1f1d0e9b8a7c6"
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+	backend := remotebackend.NewFileSystem(afero.NewMemMapFs())
+	rs := storage.NewRemote(backend, crypto.NewService(key))
+	st, err := Load(ctx, rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Len() != 0 {
+		t.Fatal("expected no users without users object")
+	}
+	if err := st.Add("anna", "short", RoleAdmin); err == nil {
+		t.Error("expected a short password to be refused")
+	}
+	if err := st.Add("anna", "correct horse", "owner"); err == nil {
+		t.Error("expected an unknown role to be refused")
+	}
+	if err := st.Add("anna", "correct horse", RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Add("anna", "correct horse", RoleAdmin); err == nil {
+		t.Error("expected an existing user to be refused")
+	}
+	st.Add("ben", "battery staple", RoleViewer)
+	if err := st.Save(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := Load(ctx, rs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, ok := other.Authenticate("anna", "correct horse"); !ok || u.Role != RoleAdmin {
+		t.Errorf("expected anna to log in as admin, got %+v, %v", u, ok)
+	}
+	if _, ok := other.Authenticate("anna", "wrong password"); ok {
+		t.Error("expected a wrong password to be refused")
+	}
+	if _, ok := other.Authenticate("carl", "correct horse"); ok {
+		t.Error("expected an unknown user to be refused")
+	}
+
+	other.SetPassword("ben", "another password")
+	if u, _ := other.Get("ben"); u.Generation != 1 {
+		t.Errorf("expected a new generation, got %d", u.Generation)
+	}
+	other.Remove("anna")
+	other.Save(ctx)
+	st.Reload(ctx)
+	if _, ok := st.Get("anna"); ok {
+		t.Error("expected anna to be removed")
+	}
+	if _, ok := st.Authenticate("ben", "another password"); !ok {
+		t.Error("expected the new password")
+	}
+
+	wrong, _ := Load(ctx, storage.NewRemote(backend, crypto.NewService("00"+key[2:])))
+	if wrong != nil {
+		t.Error("expected an error for another key")
+	}
+}
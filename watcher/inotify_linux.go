@@ -0,0 +1,130 @@
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_MOVED_TO
+
+// watch watches root and all directories below it with inotify. It sends the
+// paths of the files which got created or changed, and signals overflow when
+// events were lost because the kernel queue or events was full.
+func watch(root string) (<-chan string, <-chan struct{}, func() error, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, nil, nil, os.NewSyscallError("inotify_init1", err)
+	}
+	// a non-blocking fd wrapped in os.File uses the runtime poller, so Close
+	// interrupts a pending Read
+	f := os.NewFile(uintptr(fd), "inotify")
+	in := &inotify{fd: fd, f: f, root: root, dirs: make(map[int32]string), overflow: make(chan struct{}, 1)}
+	if err := in.addTree(root, nil); err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	events := make(chan string, 1024)
+	go in.read(events)
+	return events, in.overflow, f.Close, nil
+}
+
+type inotify struct {
+	fd       int
+	f        *os.File
+	root     string
+	mu       sync.Mutex
+	dirs     map[int32]string
+	overflow chan struct{}
+}
+
+// send passes p on without blocking the reading of the inotify queue, which
+// would overflow meanwhile.
+func (in *inotify) send(events chan<- string, p string) {
+	select {
+	case events <- p:
+	default:
+		in.overflowed()
+	}
+}
+
+func (in *inotify) overflowed() {
+	select {
+	case in.overflow <- struct{}{}:
+	default:
+	}
+}
+
+// addTree watches dir and its subdirectories. Files already present are sent
+// to events - they might have been created before the watch was in place.
+func (in *inotify) addTree(dir string, events chan<- string) error {
+	return filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !fi.IsDir() {
+			if events != nil {
+				in.send(events, p)
+			}
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(in.fd, p, watchMask)
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		in.mu.Lock()
+		in.dirs[int32(wd)] = p
+		in.mu.Unlock()
+		return nil
+	})
+}
+
+func (in *inotify) read(events chan<- string) {
+	defer close(events)
+	defer close(in.overflow)
+	var buf [syscall.SizeofInotifyEvent * 4096]byte
+	for {
+		n, err := in.f.Read(buf[:])
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + int(ev.Len)
+			offset = nameEnd
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				// directories created meanwhile might not be watched yet
+				in.addTree(in.root, nil)
+				in.overflowed()
+				continue
+			}
+			name := string(trimNull(buf[nameStart:nameEnd]))
+			in.mu.Lock()
+			dir, ok := in.dirs[ev.Wd]
+			in.mu.Unlock()
+			if !ok || name == "" {
+				continue
+			}
+			p := filepath.Join(dir, name)
+			if ev.Mask&syscall.IN_ISDIR != 0 {
+				if ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+					in.addTree(p, events)
+				}
+				continue
+			}
+			in.send(events, p)
+		}
+	}
+}
+
+func trimNull(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package watcher
+
+import "fmt"
+
+func watch(root string) (<-chan string, <-chan struct{}, func() error, error) {
+	return nil, nil, nil, fmt.Errorf("watching directories is only supported on linux")
+}
@@ -0,0 +1,174 @@
+package watcher
+
+import (
+	"context"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/apex/log"
+)
+
+// Watcher reports files below a directory which have been created or changed,
+// once they stopped changing for the quiet period - e.g. when a card import
+// finished copying them.
+type Watcher struct {
+	root        string
+	quietPeriod time.Duration
+	events      <-chan string
+	overflow    <-chan struct{}
+	close       func() error
+	now         func() time.Time
+	stat        func(string) (os.FileInfo, error)
+}
+
+type option func(*Watcher)
+
+func WithQuietPeriod(d time.Duration) option {
+	return func(w *Watcher) {
+		w.quietPeriod = d
+	}
+}
+
+// New starts watching root recursively. Events are collected from this point
+// on, even before Run is called.
+func New(root string, options ...option) (*Watcher, error) {
+	events, overflow, closeFn, err := watch(root)
+	if err != nil {
+		return nil, err
+	}
+	return newWatcher(root, events, overflow, closeFn, options...), nil
+}
+
+func newWatcher(root string, events <-chan string, overflow <-chan struct{}, closeFn func() error, options ...option) *Watcher {
+	w := &Watcher{
+		root:        root,
+		quietPeriod: 10 * time.Second,
+		events:      events,
+		overflow:    overflow,
+		close:       closeFn,
+		now:         time.Now,
+		stat:        os.Stat,
+	}
+	for _, opt := range options {
+		opt(w)
+	}
+	return w
+}
+
+type pending struct {
+	lastEvent time.Time
+	size      int64
+}
+
+func (w *Watcher) touch(files map[string]*pending, p string) {
+	if f, ok := files[p]; ok {
+		f.lastEvent = w.now()
+	} else {
+		files[p] = &pending{lastEvent: w.now(), size: -1}
+	}
+}
+
+// Run returns a stream of batches of settled files. The stream is closed when
+// ctx is done or the underlying notifications stop. The files settling while
+// the previous batch is not received yet are added to the next one. If events
+// were lost, the batch has the root instead, to be scanned again as a whole.
+func (w *Watcher) Run(ctx context.Context, logctx log.Interface) <-chan []string {
+	settled := make(chan []string)
+	go func() {
+		defer close(settled)
+		defer w.close()
+		files := make(map[string]*pending)
+		ready := make(map[string]bool)
+		var batch []string
+		tick := time.NewTicker(w.quietPeriod / 2)
+		defer tick.Stop()
+		overflow := w.overflow
+		for {
+			var out chan<- []string
+			if len(batch) > 0 {
+				out = settled
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case p, ok := <-w.events:
+				if !ok {
+					return
+				}
+				w.touch(files, p)
+			case _, ok := <-overflow:
+				if !ok {
+					overflow = nil
+					continue
+				}
+				if _, ok := files[w.root]; !ok {
+					logctx.WithField("dir", w.root).Warn("too many changes to follow, scanning the whole directory once they settled")
+				}
+				w.touch(files, w.root)
+			case <-tick.C:
+				for _, p := range w.collect(logctx, files) {
+					ready[p] = true
+				}
+				batch = w.batch(ready)
+			case out <- batch:
+				ready = make(map[string]bool)
+				batch = nil
+			}
+		}
+	}()
+	return settled
+}
+
+// batch returns the paths of ready sorted, or only the root if it is to be
+// scanned anyway.
+func (w *Watcher) batch(ready map[string]bool) []string {
+	if ready[w.root] {
+		return []string{w.root}
+	}
+	res := make([]string, 0, len(ready))
+	for p := range ready {
+		res = append(res, p)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// collect removes the files which did not change during the quiet period from
+// files and returns them.
+func (w *Watcher) collect(logctx log.Interface, files map[string]*pending) []string {
+	batch := make([]string, 0)
+	for p, f := range files {
+		if w.now().Sub(f.lastEvent) < w.quietPeriod {
+			continue
+		}
+		fi, err := w.stat(p)
+		if err != nil {
+			logctx.WithField("path", p).Debug("file disappeared before it settled")
+			delete(files, p)
+			continue
+		}
+		if fi.IsDir() {
+			// the root is pending after lost events, directories are not
+			// reported otherwise
+			if p == w.root {
+				batch = append(batch, p)
+			}
+			delete(files, p)
+			continue
+		}
+		// some copy tools preallocate or write without generating events, so the
+		// size has to stay the same until the next tick as well
+		if fi.Size() != f.size {
+			if f.size >= 0 {
+				f.lastEvent = w.now()
+			}
+			f.size = fi.Size()
+			continue
+		}
+		batch = append(batch, p)
+		delete(files, p)
+	}
+	sort.Strings(batch)
+	return batch
+}
@@ -0,0 +1,135 @@
+package watcher
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/apex/log"
+)
+
+type fileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (fi fileInfo) Size() int64 { return fi.size }
+func (fi fileInfo) IsDir() bool { return fi.size < 0 }
+
+func TestCollectWaitsForQuietPeriod(t *testing.T) {
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	sizes := map[string]int64{"/a.jpg": 10, "/b.jpg": 10}
+	w := newWatcher("/", nil, nil, nil, WithQuietPeriod(time.Second))
+	w.now = func() time.Time { return now }
+	w.stat = func(p string) (os.FileInfo, error) {
+		s, ok := sizes[p]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		return fileInfo{size: s}, nil
+	}
+	files := map[string]*pending{
+		"/a.jpg":    {lastEvent: now, size: -1},
+		"/b.jpg":    {lastEvent: now.Add(-500 * time.Millisecond), size: -1},
+		"/gone.jpg": {lastEvent: now.Add(-time.Hour), size: -1},
+	}
+	if b := w.collect(log.Log, files); len(b) != 0 {
+		t.Errorf("expected nothing to be settled yet, got: %v", b)
+	}
+	if _, ok := files["/gone.jpg"]; ok {
+		t.Error("expected deleted file to be dropped")
+	}
+
+	now = now.Add(time.Second)
+	if b := w.collect(log.Log, files); len(b) != 0 {
+		t.Errorf("expected the size to be checked once more, got: %v", b)
+	}
+	sizes["/b.jpg"] = 20
+	now = now.Add(500 * time.Millisecond)
+	b := w.collect(log.Log, files)
+	if len(b) != 1 || b[0] != "/a.jpg" {
+		t.Errorf("expected only the file with a stable size to be settled, got: %v", b)
+	}
+	now = now.Add(time.Second)
+	b = w.collect(log.Log, files)
+	if len(b) != 1 || b[0] != "/b.jpg" {
+		t.Errorf("expected the grown file to settle a quiet period later, got: %v", b)
+	}
+}
+
+func TestRunCoalescesWhileNotReceived(t *testing.T) {
+	events := make(chan string)
+	overflow := make(chan struct{}, 1)
+	w := newWatcher("/photos", events, overflow, func() error { return nil }, WithQuietPeriod(20*time.Millisecond))
+	w.stat = func(p string) (os.FileInfo, error) {
+		if p == "/photos" {
+			return fileInfo{size: -1}, nil
+		}
+		return fileInfo{size: 10}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	batches := w.Run(ctx, log.Log)
+
+	// nobody receives the batches during the initial sync, the events must
+	// still be taken
+	for i := 0; i < 3; i++ {
+		for _, p := range []string{"/photos/b.jpg", "/photos/a.jpg"} {
+			select {
+			case events <- p:
+			case <-ctx.Done():
+				t.Fatal("events blocked while the batches are not received")
+			}
+		}
+		time.Sleep(30 * time.Millisecond)
+	}
+	events <- "/photos/c.jpg"
+	time.Sleep(100 * time.Millisecond)
+	if b := <-batches; !reflect.DeepEqual(b, []string{"/photos/a.jpg", "/photos/b.jpg", "/photos/c.jpg"}) {
+		t.Errorf("expected the settled files in one batch, got %v", b)
+	}
+
+	overflow <- struct{}{}
+	events <- "/photos/d.jpg"
+	select {
+	case b := <-batches:
+		if !reflect.DeepEqual(b, []string{"/photos"}) {
+			t.Errorf("expected the root to be scanned again after lost events, got %v", b)
+		}
+	case <-ctx.Done():
+		t.Error("no rescan after lost events")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mirror-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w, err := New(dir, WithQuietPeriod(50*time.Millisecond))
+	if err != nil {
+		t.Skipf("watching not supported: %v", err)
+	}
+	c, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	batches := w.Run(c, log.Log)
+
+	sub := filepath.Join(dir, "import")
+	os.Mkdir(sub, 0700)
+	p := filepath.Join(sub, "photo.jpg")
+	ioutil.WriteFile(p, []byte("jpeg"), 0600)
+
+	select {
+	case b := <-batches:
+		if len(b) != 1 || b[0] != p {
+			t.Errorf("expected %s to be reported, got: %v", p, b)
+		}
+	case <-c.Done():
+		t.Error("file in a new directory not reported")
+	}
+}